@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// deletedUsername replaces a deleted player's name on the chat messages
+// they leave behind.
+const deletedUsername = "[deleted]"
+
+// DeleteAccountRequest confirms a deletion with the account's password.
+// Guests and accounts made through a sign-in provider have none and send
+// an empty body.
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// AccountExport is everything the server keeps about a player.
+type AccountExport struct {
+	Account *Account `json:"account"`
+	Profile *Profile `json:"profile"`
+	// Scores is keyed by "lifetime" and by season ID.
+	Scores      map[string]int   `json:"scores"`
+	Rating      float64          `json:"rating"`
+	Level       *Level           `json:"level"`
+	Stats       *PlayerStats     `json:"stats"`
+	Games       []GameRecord     `json:"games"`
+	ActiveGames []string         `json:"active_games"`
+	Friends     []string         `json:"friends"`
+	Incoming    []PendingFriend  `json:"incoming_friend_requests"`
+	Outgoing    []PendingFriend  `json:"outgoing_friend_requests"`
+	SavedCards  []string         `json:"saved_cards"`
+	Chat        []ChatMessage    `json:"chat"`
+	Bans        []*Ban           `json:"bans"`
+	Renames     []UsernameChange `json:"renames"`
+	Email       *EmailStatus     `json:"email"`
+	APIKeys     []*APIKey        `json:"api_keys"`
+	// OAuth is the player's ID at each linked sign-in provider.
+	OAuth        map[string]string     `json:"oauth"`
+	Achievements []UnlockedAchievement `json:"achievements"`
+	Coins        int                   `json:"coins"`
+	Inventory    []string              `json:"inventory"`
+	Devices      []*Device             `json:"devices"`
+	Push         map[string]bool       `json:"push_notifications"`
+	Inbox        []*Notification       `json:"notifications"`
+	ExportedAt   time.Time             `json:"exported_at"`
+}
+
+// chatMessagesBy collects a player's messages still held in room chats.
+func chatMessagesBy(ctx context.Context, username string) ([]ChatMessage, error) {
+	messages := []ChatMessage{}
+	err := scanBatches(ctx, rdb, chatKey("*"), func(keys []string) error {
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.StringSliceCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.LRange(ctx, key, 0, -1)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			for _, item := range cmd.Val() {
+				var msg ChatMessage
+				if json.Unmarshal([]byte(item), &msg) == nil && msg.Username == username {
+					messages = append(messages, msg)
+				}
+			}
+		}
+		return nil
+	})
+	return messages, err
+}
+
+// anonymizeChat takes a player's name off their messages in every room's
+// chat, leaving the conversation readable for everyone else. The WATCH
+// retries if a new message shifts the history while it is rewritten.
+func anonymizeChat(ctx context.Context, username string) error {
+	return scanKeys(ctx, chatKey("*"), func(key string) error {
+		return rdb.Watch(ctx, func(tx *redis.Tx) error {
+			raw, err := tx.LRange(ctx, key, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, item := range raw {
+					var msg ChatMessage
+					if json.Unmarshal([]byte(item), &msg) != nil || msg.Username != username {
+						continue
+					}
+					msg.Username = deletedUsername
+					data, err := json.Marshal(msg)
+					if err != nil {
+						return err
+					}
+					pipe.LSet(ctx, key, int64(i), data)
+				}
+				return nil
+			})
+			return err
+		}, key)
+	})
+}
+
+// removeFriendships drops a player from their friends' lists and withdraws
+// every friend request to or from them.
+func removeFriendships(ctx context.Context, username string) error {
+	friends, err := rdb.SMembers(ctx, friendsKey(username)).Result()
+	if err != nil {
+		return err
+	}
+	incoming, err := rdb.ZRange(ctx, friendRequestsKey(username), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	outgoing, err := rdb.ZRange(ctx, sentRequestsKey(username), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, friend := range friends {
+		pipe.SRem(ctx, friendsKey(friend), username)
+	}
+	for _, from := range incoming {
+		pipe.ZRem(ctx, sentRequestsKey(from), username)
+	}
+	for _, to := range outgoing {
+		pipe.ZRem(ctx, friendRequestsKey(to), username)
+	}
+	pipe.Del(ctx, friendsKey(username), friendRequestsKey(username), sentRequestsKey(username))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// removeFromLeaderboards takes a player off the lifetime board, every
+// season's board, the ratings and the XP ranking.
+func removeFromLeaderboards(ctx context.Context, username string) error {
+	seasons, err := seasonIDs(ctx)
+	if err != nil {
+		return err
+	}
+	boards := []string{leaderboardKey}
+	for _, id := range seasons {
+		boards = append(boards, seasonLeaderboardKey(id))
+	}
+	for _, board := range boards {
+		if err := leaderboards.RemovePlayer(ctx, board, username); err != nil {
+			return err
+		}
+	}
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, ratingsKey, username)
+	pipe.ZRem(ctx, xpKey, username)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// removeBans deletes a player's ban records along with their history.
+func removeBans(ctx context.Context, username string) error {
+	ids, err := rdb.LRange(ctx, banHistoryKey(username), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{banKey(username), banHistoryKey(username)}
+	for _, id := range ids {
+		keys = append(keys, banRecordKey(id))
+	}
+	return rdb.Del(ctx, keys...).Err()
+}
+
+// revokeRefreshTokens deletes a player's refresh tokens, so none outlive
+// the account and sign in whoever registers the name next.
+func revokeRefreshTokens(ctx context.Context, username string) error {
+	revoked := []string{}
+	err := scanValues(ctx, rdb, refreshKey("*"), func(key, owner string) error {
+		if owner == username {
+			revoked = append(revoked, key)
+		}
+		return nil
+	})
+	if err != nil || len(revoked) == 0 {
+		return err
+	}
+	return rdb.Del(ctx, revoked...).Err()
+}
+
+// revokeAccessTokens moves a player's token generation on, so the access
+// tokens already issued to them stop working before they expire.
+func revokeAccessTokens(ctx context.Context, username string) error {
+	return rdb.Incr(ctx, tokenGenerationKey(username)).Err()
+}
+
+// clearPlayerKeys drops a player's matchmaking ticket, saved cards,
+// presence, rename history, achievements, challenge progress and push
+// devices.
+func clearPlayerKeys(ctx context.Context, username string) error {
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, matchQueueKey, username)
+	pipe.Del(ctx,
+		matchTicketKey(username),
+		activeGamesKey(username),
+		playerCardsKey(ctx, username),
+		presenceConnectionsKey(username),
+		presenceStatusKey(username),
+		lastSeenKey(username),
+		renamesKey(username),
+		achievementsKey(username),
+		coinsKey(username),
+		inventoryKey(username),
+		dailyRewardKey(username),
+		challengeProgressKey(challengeDay(time.Now()), username),
+		devicesKey(username),
+		pushPrefsKey(username),
+		notificationsKey(username),
+		notificationIndexKey(username),
+		unreadNotificationsKey(username),
+		notificationPrefsKey(username),
+	)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// eraseAccount removes a player and everything stored about them. The
+// account itself goes last, so a deletion that fails part way can be
+// retried by the same player. Games they finished stay on record for the
+// other players, and reports they filed or received stay with moderators.
+func eraseAccount(ctx context.Context, username string) error {
+	hub.disconnectUser(ctx, username, websocket.CloseNormalClosure, "account deleted")
+	forfeitActiveGames(ctx, username)
+
+	if err := clearPlayerKeys(ctx, username); err != nil {
+		return err
+	}
+	if err := removeFriendships(ctx, username); err != nil {
+		return err
+	}
+	if err := removeFromLeaderboards(ctx, username); err != nil {
+		return err
+	}
+	checkTopTen(ctx)
+	if err := histories.DeleteHistory(ctx, username); err != nil {
+		return err
+	}
+	if err := anonymizeChat(ctx, username); err != nil {
+		return err
+	}
+	if err := removeBans(ctx, username); err != nil {
+		return err
+	}
+	if err := revokeRefreshTokens(ctx, username); err != nil {
+		return err
+	}
+	if err := revokeAccessTokens(ctx, username); err != nil {
+		return err
+	}
+	if err := revokeReconnectTokens(ctx, username); err != nil {
+		return err
+	}
+	if err := removeOAuthLinks(ctx, username); err != nil {
+		return err
+	}
+	if err := removeEmail(ctx, username); err != nil {
+		return err
+	}
+	if err := removeAPIKeys(ctx, username); err != nil {
+		return err
+	}
+	if err := users.DeleteUser(ctx, username); err != nil {
+		return err
+	}
+	releaseUsername(ctx, username)
+	return nil
+}
+
+// deleteAccount erases the caller's account for good. Registered accounts
+// must confirm with their password.
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	guest, err := users.IsGuest(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error deleting account")
+		return
+	}
+	noPassword, err := passwordless(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error deleting account")
+		return
+	}
+	if !guest && !noPassword {
+		var req DeleteAccountRequest
+		if err := decodeJSON(r, &req); err != nil {
+			respondPayload(w, r, err)
+			return
+		}
+		if req.Password == "" {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "Confirm with your password")
+			return
+		}
+		err := checkPassword(ctx, username, req.Password)
+		if err == errInvalidCredentials {
+			respondError(w, r, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error deleting account")
+			return
+		}
+	}
+
+	if err := eraseAccount(ctx, username); err != nil {
+		logFor(r).Error("deleting account", "username", username, "err", err)
+		respondInternal(w, r, err, "Error deleting account")
+		return
+	}
+	logFor(r).Info("account deleted", "username", username)
+	audit(ctx, username, AuditAccountDeleted, username, nil, nil)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// collectExport gathers everything stored about a player.
+func collectExport(ctx context.Context, username string) (*AccountExport, error) {
+	account, err := users.LoadAccount(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := users.Profile(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	export := &AccountExport{
+		Account:    account,
+		Profile:    profile,
+		Scores:     map[string]int{},
+		ExportedAt: time.Now().UTC(),
+	}
+
+	seasons, err := seasonIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	boards := map[string]string{"lifetime": leaderboardKey}
+	for _, id := range seasons {
+		boards[id] = seasonLeaderboardKey(id)
+	}
+	for name, board := range boards {
+		score, err := leaderboards.Score(ctx, board, username)
+		if err == errNotRanked {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		export.Scores[name] = score
+	}
+	if export.Rating, err = getRating(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Level, err = playerLevel(ctx, username); err != nil {
+		return nil, err
+	}
+
+	if export.Stats, err = histories.PlayerStats(ctx, username); err != nil {
+		return nil, err
+	}
+	_, total, err := histories.PlayerGames(ctx, username, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if export.Games, _, err = histories.PlayerGames(ctx, username, int(total), 0); err != nil {
+		return nil, err
+	}
+	if export.ActiveGames, err = rdb.ZRange(ctx, activeGamesKey(username), 0, -1).Result(); err != nil {
+		return nil, err
+	}
+
+	if export.Friends, err = rdb.SMembers(ctx, friendsKey(username)).Result(); err != nil {
+		return nil, err
+	}
+	if export.Incoming, err = pendingFriends(ctx, friendRequestsKey(username)); err != nil {
+		return nil, err
+	}
+	if export.Outgoing, err = pendingFriends(ctx, sentRequestsKey(username)); err != nil {
+		return nil, err
+	}
+
+	if export.SavedCards, err = rdb.LRange(ctx, playerCardsKey(ctx, username), 0, -1).Result(); err != nil {
+		return nil, err
+	}
+	if export.Chat, err = chatMessagesBy(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Bans, err = banHistory(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Renames, err = usernameChanges(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.OAuth, err = oauthLinks(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.APIKeys, err = listAPIKeysFor(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Email, err = loadEmail(ctx, username); err != nil && err != errNoEmail {
+		return nil, err
+	}
+	if export.Achievements, err = playerAchievements(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Coins, err = coinBalance(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Inventory, err = rdb.SMembers(ctx, inventoryKey(username)).Result(); err != nil {
+		return nil, err
+	}
+	if export.Devices, err = loadDevices(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Push, err = pushPrefs(ctx, username); err != nil {
+		return nil, err
+	}
+	if export.Inbox, err = loadNotifications(ctx, username); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// exportAccount hands the caller a copy of their data as a JSON download.
+func exportAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	export, err := collectExport(ctx, username)
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		logFor(r).Error("exporting account", "username", username, "err", err)
+		respondInternal(w, r, err, "Error exporting account")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+username+`-export.json"`)
+	json.NewEncoder(w).Encode(export)
+}
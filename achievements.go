@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Achievement is a milestone players unlock once.
+type Achievement struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// earned reports whether a player has met the goal as of a game they
+	// just finished. stats already include that game.
+	earned func(g *GameState, username string, stats *PlayerStats) bool
+}
+
+// UnlockedAchievement is an achievement as shown to a player, with when
+// they unlocked it if they have.
+type UnlockedAchievement struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	UnlockedAt  *time.Time `json:"unlocked_at,omitempty"`
+}
+
+var achievements = []Achievement{
+	{
+		ID:          "first_win",
+		Name:        "First Blood",
+		Description: "Win a game",
+		earned: func(g *GameState, username string, stats *PlayerStats) bool {
+			return g.Winner == username
+		},
+	},
+	{
+		ID:          "defuse_10",
+		Name:        "Bomb Squad",
+		Description: "Defuse 10 Exploding Kittens",
+		earned: func(g *GameState, username string, stats *PlayerStats) bool {
+			return stats.Defused >= 10
+		},
+	},
+	{
+		ID:          "no_defuse_win",
+		Name:        "Living Dangerously",
+		Description: "Win a game without drawing a Defuse",
+		earned: func(g *GameState, username string, stats *PlayerStats) bool {
+			return g.Winner == username && g.statsFor(username).DefusesDrawn == 0
+		},
+	},
+	{
+		ID:          "win_streak_5",
+		Name:        "On a Roll",
+		Description: "Win 5 games in a row",
+		earned: func(g *GameState, username string, stats *PlayerStats) bool {
+			return stats.CurrentStreak >= 5
+		},
+	},
+}
+
+// achievementsKey maps the IDs of a player's achievements to when they
+// were unlocked.
+func achievementsKey(username string) string {
+	return fmt.Sprintf("player:%s:achievements", username)
+}
+
+// unlockAchievement records an achievement and reports whether it is new.
+func unlockAchievement(ctx context.Context, username, id string, at time.Time) (bool, error) {
+	return rdb.HSetNX(ctx, achievementsKey(username), id, at.Unix()).Result()
+}
+
+// checkAchievements unlocks whatever a finished game earned its human
+// players and tells them over the websocket.
+func checkAchievements(ctx context.Context, g *GameState) {
+	now := time.Now().UTC()
+	for _, p := range append(append([]string{}, g.Players...), g.Abandoned...) {
+		if g.isBot(p) {
+			continue
+		}
+		stats, err := histories.PlayerStats(ctx, p)
+		if err != nil {
+			slog.Error("loading stats for achievements", "username", p, "err", err)
+			continue
+		}
+		for _, a := range achievements {
+			if !a.earned(g, p, stats) {
+				continue
+			}
+			unlocked, err := unlockAchievement(ctx, p, a.ID, now)
+			if err != nil {
+				slog.Error("unlocking achievement", "username", p, "achievement", a.ID, "err", err)
+				continue
+			}
+			if unlocked {
+				entry := UnlockedAchievement{ID: a.ID, Name: a.Name, Description: a.Description, UnlockedAt: &now}
+				hub.notifyUser(ctx, p, EventAchievement, entry.localized(defaultLocale))
+				notify(ctx, p, NotifyAchievement, map[string]string{"id": a.ID, "name": a.Name})
+			}
+		}
+	}
+}
+
+// localized is the achievement with its text in locale.
+func (a UnlockedAchievement) localized(locale string) UnlockedAchievement {
+	a.Name = translate(locale, "achievements."+a.ID+".name", a.Name)
+	a.Description = translate(locale, "achievements."+a.ID+".description", a.Description)
+	return a
+}
+
+// playerAchievements lists every achievement with when the player
+// unlocked it, locked ones included.
+func playerAchievements(ctx context.Context, username string) ([]UnlockedAchievement, error) {
+	unlocked, err := rdb.HGetAll(ctx, achievementsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]UnlockedAchievement, 0, len(achievements))
+	for _, a := range achievements {
+		entry := UnlockedAchievement{ID: a.ID, Name: a.Name, Description: a.Description}
+		if v, ok := unlocked[a.ID]; ok {
+			if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+				at := time.Unix(ts, 0).UTC()
+				entry.UnlockedAt = &at
+			}
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+func getPlayerAchievements(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	exists, err := users.UserExists(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading achievements")
+		return
+	}
+	if !exists {
+		respondError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+	list, err := playerAchievements(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading achievements")
+		return
+	}
+	locale := localeFor(r)
+	for i := range list {
+		list[i] = list[i].localized(locale)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", locale)
+	w.Header().Set("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// activeGamesKey indexes the games a player is seated in, scored by start
+// time.
+func activeGamesKey(username string) string {
+	return fmt.Sprintf("player:%s:games:active", username)
+}
+
+// trackActiveGame lists a new game under each of its human players, and
+// counts it as in play.
+func trackActiveGame(ctx context.Context, g *GameState) {
+	pipe := rdb.TxPipeline()
+	pipe.ZAdd(ctx, liveGamesKey, &redis.Z{Score: float64(g.StartedAt.Unix()), Member: g.ID})
+	for _, p := range g.Players {
+		if !g.isBot(p) {
+			pipe.ZAdd(ctx, activeGamesKey(p), &redis.Z{Score: float64(g.StartedAt.Unix()), Member: g.ID})
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("indexing active game", "game", g.ID, "err", err)
+	}
+}
+
+// untrackActiveGame drops a game from the given players' active lists.
+func untrackActiveGame(ctx context.Context, gameID string, players ...string) {
+	pipe := rdb.TxPipeline()
+	for _, p := range players {
+		pipe.ZRem(ctx, activeGamesKey(p), gameID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("unindexing active game", "game", gameID, "err", err)
+	}
+}
+
+// getActiveGames lists a player's games still in progress, newest first.
+func getActiveGames(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	ids, err := rdb.ZRevRange(ctx, activeGamesKey(username), 0, -1).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading games")
+		return
+	}
+
+	views := []*TurnView{}
+	for _, id := range ids {
+		g, err := loadGame(ctx, id)
+		if err != nil && err != errGameNotFound {
+			respondInternal(w, r, err, "Error loading games")
+			return
+		}
+		// Entries outlive games that were lost or finished elsewhere.
+		if err == errGameNotFound || g.Status == GameFinished || !g.hasPlayer(username) {
+			untrackActiveGame(ctx, id, username)
+			continue
+		}
+		views = append(views, g.turnView())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
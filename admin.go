@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	RolePlayer    = "player"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// roleRanks orders the roles; each can do everything the ones below it can.
+var roleRanks = map[string]int{
+	RolePlayer:    0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// adminTokenActor is who staff actions are put down to when a request used
+// ADMIN_TOKEN instead of a staff account.
+const adminTokenActor = "admin-token"
+
+const roleKey contextKey = "role"
+
+var (
+	errInsufficientRole = errors.New("your role does not allow this")
+	errBadRole          = errors.New("role must be player, moderator or admin")
+	errOwnRole          = errors.New("you cannot change your own role")
+	errOutranked        = errors.New("that player's role is at least as high as yours")
+)
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// ScoreRequest either sets a score outright or adjusts it by Delta.
+type ScoreRequest struct {
+	Score *int `json:"score"`
+	Delta *int `json:"delta"`
+}
+
+// AccountDetails is an account with the player's standing, for moderators.
+type AccountDetails struct {
+	Account
+	Score int          `json:"score"`
+	Stats *PlayerStats `json:"stats"`
+	Ban   *Ban         `json:"ban,omitempty"`
+}
+
+// adminSecret is ADMIN_TOKEN, which acts as an admin so the first staff
+// accounts can be set up. Empty turns it off.
+var adminSecret string
+
+// adminToken reports whether the request carries ADMIN_TOKEN.
+func adminToken(r *http.Request) bool {
+	given := r.Header.Get("X-Admin-Token")
+	return adminSecret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(adminSecret)) == 1
+}
+
+// requireRole only lets through signed-in accounts holding at least the
+// given role, or requests made with ADMIN_TOKEN.
+func requireRole(min string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if adminToken(r) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey, RoleAdmin)))
+				return
+			}
+			requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				role, err := users.Role(ctx, currentUser(r))
+				if err == errUserNotFound {
+					respondError(w, r, http.StatusForbidden, errInsufficientRole)
+					return
+				}
+				if err != nil {
+					respondInternal(w, r, err, "Error checking role")
+					return
+				}
+				if roleRanks[role] < roleRanks[min] {
+					respondError(w, r, http.StatusForbidden, errInsufficientRole)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey, role)))
+			})).ServeHTTP(w, r)
+		})
+	}
+}
+
+// currentRole returns the role requireRole granted the request.
+func currentRole(r *http.Request) string {
+	role, _ := r.Context().Value(roleKey).(string)
+	return role
+}
+
+// actorName is who performed a staff action.
+func actorName(r *http.Request) string {
+	if username := currentUser(r); username != "" {
+		return username
+	}
+	return adminTokenActor
+}
+
+// outranks reports whether the caller may act against username: staff can
+// only moderate accounts below their own role.
+func outranks(r *http.Request, username string) (bool, error) {
+	ctx := r.Context()
+	role, err := users.Role(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return roleRanks[currentRole(r)] > roleRanks[role], nil
+}
+
+func searchUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	accounts, total, err := users.SearchUsers(ctx, r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		respondInternal(w, r, err, "Error searching users")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	json.NewEncoder(w).Encode(accounts)
+}
+
+func getUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	account, err := users.LoadAccount(ctx, username)
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading user")
+		return
+	}
+	details := &AccountDetails{Account: *account}
+
+	details.Score, err = leaderboards.Score(ctx, leaderboardKey, username)
+	if err != nil && err != errNotRanked {
+		respondInternal(w, r, err, "Error loading user")
+		return
+	}
+	if details.Stats, err = histories.PlayerStats(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error loading user")
+		return
+	}
+	if details.Ban, err = loadBan(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error loading user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
+
+func setUserRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	var req RoleRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if _, ok := roleRanks[req.Role]; !ok {
+		respondError(w, r, http.StatusBadRequest, errBadRole)
+		return
+	}
+	if username == currentUser(r) {
+		respondError(w, r, http.StatusForbidden, errOwnRole)
+		return
+	}
+
+	previous, err := users.Role(ctx, username)
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error setting role")
+		return
+	}
+	if err := users.SetRole(ctx, username, req.Role); err != nil {
+		respondInternal(w, r, err, "Error setting role")
+		return
+	}
+	logFor(r).Info("role changed", "target", username, "role", req.Role)
+	audit(ctx, actorName(r), AuditRoleChanged, username,
+		map[string]string{"role": previous}, map[string]string{"role": req.Role})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"username": username, "role": req.Role})
+}
+
+// setUserScore sets or adjusts a player's score on the lifetime board, or
+// a season's with ?season=.
+func setUserScore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	var req ScoreRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if (req.Score == nil) == (req.Delta == nil) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "Send either score or delta")
+		return
+	}
+	board, err := leaderboardFor(r)
+	if err == errSeasonNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	exists, err := users.UserExists(ctx, username)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		respondError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+
+	before, err := leaderboards.Score(ctx, board, username)
+	if err != nil && err != errNotRanked {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	action := AuditScoreSet
+	if req.Delta != nil {
+		action = AuditScoreAdjusted
+		err = leaderboards.IncrementScore(ctx, username, *req.Delta, board)
+	} else {
+		err = leaderboards.SetScore(ctx, board, username, *req.Score)
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeScore(w, r, action, board, username, before)
+}
+
+// resetUserScore puts a player back to zero on the lifetime board, or a
+// season's with ?season=.
+func resetUserScore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	board, err := leaderboardFor(r)
+	if err == errSeasonNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	before, err := leaderboards.Score(ctx, board, username)
+	if err == errNotRanked {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := leaderboards.SetScore(ctx, board, username, 0); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeScore(w, r, AuditScoreReset, board, username, before)
+}
+
+// writeScore records a score change in the audit trail and responds with
+// the new score.
+func writeScore(w http.ResponseWriter, r *http.Request, action, board, username string, before int) {
+	ctx := r.Context()
+	score, err := leaderboards.Score(ctx, board, username)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	logFor(r).Info("score changed", "target", username, "board", board, "score", score)
+	audit(ctx, actorName(r), action, username,
+		map[string]interface{}{"board": board, "score": before},
+		map[string]interface{}{"board": board, "score": score})
+	if board == leaderboardKey {
+		checkTopTen(ctx)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"username": username, "score": score})
+}
+
+// getAnyGame shows a game in full, hands and deck included, for looking
+// into reports.
+func getAnyGame(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := loadGame(ctx, mux.Vars(r)["id"])
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading game")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPISpec describes the v1 API. It is written by hand: add a route to
+// it whenever one is added to registerV1, or checkAPISpec complains at
+// startup.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIVersion is the swagger-ui-dist release the docs page loads.
+const swaggerUIVersion = "5.17.14"
+
+var apiDocsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Exploding Kittens API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@{{.Version}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@{{.Version}}/swagger-ui-bundle.js"></script>
+<script nonce="{{.Nonce}}">
+SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`))
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(openAPISpec)
+}
+
+// serveAPIDocs serves Swagger UI for the spec. It loosens the default
+// Content-Security-Policy just enough for the UI's scripts and styles.
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	nonce := randomToken()
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf(
+		"default-src 'none'; script-src https://unpkg.com 'nonce-%s'; style-src https://unpkg.com; "+
+			"img-src 'self' data: https://unpkg.com; connect-src 'self'; frame-ancestors 'none'", nonce))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	apiDocsPage.Execute(w, map[string]string{"Version": swaggerUIVersion, "Nonce": nonce})
+}
+
+// checkAPISpec compares the routes registered under /api/v1 with the
+// operations in the spec, and returns one line per route missing from
+// either.
+func checkAPISpec(r *mux.Router) ([]string, error) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, fmt.Errorf("parsing openapi.json: %w", err)
+	}
+	documented := make(map[string]bool)
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	served := make(map[string]bool)
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, apiV1Prefix+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, m := range methods {
+			served[m+" "+strings.TrimPrefix(tmpl, apiV1Prefix)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for op := range served {
+		if !documented[op] {
+			problems = append(problems, op+" is served but not in openapi.json")
+		}
+	}
+	for op := range documented {
+		if !served[op] {
+			problems = append(problems, op+" is in openapi.json but not served")
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
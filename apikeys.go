@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Scopes an API key can be granted.
+const (
+	ScopeReadLeaderboard = "read:leaderboard"
+	ScopeReadStats       = "read:stats"
+)
+
+const (
+	apiKeyPrefix    = "ek_"
+	apiKeyHeader    = "X-API-Key"
+	maxAPIKeys      = 10
+	maxAPIKeyName   = 40
+	apiKeyShownFrom = len(apiKeyPrefix) + 8
+)
+
+var (
+	errInvalidAPIKey     = errors.New("invalid or revoked API key")
+	errInsufficientScope = errors.New("this API key's scopes do not allow this")
+	errAPIKeyNotFound    = errors.New("API key not found")
+	errTooManyAPIKeys    = errors.New("revoke an API key before creating another")
+	errGuestAPIKey       = errors.New("guests must upgrade their account before creating API keys")
+)
+
+// apiKeyLimit is every key's own bucket, kept apart from its owner's so a
+// busy bot cannot use up the player's budget, or the other way round.
+var apiKeyLimit = rateLimit{Name: "apikey", Rate: 1, Burst: 60}
+
+// routeScopes lists the routes an API key may call and the scope each
+// needs. Keys only read public data; everything else needs a signed-in
+// player.
+var routeScopes = map[string]string{
+	"/leaderboard":                     ScopeReadLeaderboard,
+	"/seasons":                         ScopeReadLeaderboard,
+	"/players/{username}/profile":      ScopeReadStats,
+	"/players/{username}/stats":        ScopeReadStats,
+	"/players/{username}/games":        ScopeReadStats,
+	"/players/{username}/achievements": ScopeReadStats,
+}
+
+var apiKeyScopes = map[string]bool{
+	ScopeReadLeaderboard: true,
+	ScopeReadStats:       true,
+}
+
+// APIKey is a key's record, without the secret, which is only shown when
+// the key is created or rotated.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Owner  string   `json:"-"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Prefix is the start of the key, so players can tell theirs apart.
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	hash       string
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// IssuedAPIKey carries a new secret back to its owner, once.
+type IssuedAPIKey struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+const apiKeyCtx contextKey = "api_key"
+
+// apiKeyRecordKey holds a key's details, by ID.
+func apiKeyRecordKey(id string) string {
+	return fmt.Sprintf("apikey:%s", id)
+}
+
+// apiKeySecretKey maps a key's hash to its ID. Like email tokens, keys are
+// stored only by hash.
+func apiKeySecretKey(hash string) string {
+	return fmt.Sprintf("apikey:secret:%s", hash)
+}
+
+// apiKeysKey is the set of a player's key IDs.
+func apiKeysKey(username string) string {
+	return fmt.Sprintf("player:%s:apikeys", username)
+}
+
+func validateScopes(scopes []string) *FieldError {
+	if len(scopes) == 0 {
+		return &FieldError{Field: "scopes", Code: "SCOPES_REQUIRED", Message: "Choose at least one scope"}
+	}
+	for _, s := range scopes {
+		if !apiKeyScopes[s] {
+			return &FieldError{Field: "scopes", Code: "UNKNOWN_SCOPE",
+				Message: fmt.Sprintf("Unknown scope %q, use %s or %s", s, ScopeReadLeaderboard, ScopeReadStats)}
+		}
+	}
+	return nil
+}
+
+func loadAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	fields, err := rdb.HGetAll(ctx, apiKeyRecordKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if fields["owner"] == "" {
+		return nil, errAPIKeyNotFound
+	}
+	key := &APIKey{
+		ID:     id,
+		Owner:  fields["owner"],
+		Name:   fields["name"],
+		Scopes: strings.Split(fields["scopes"], ","),
+		Prefix: fields["prefix"],
+		hash:   fields["hash"],
+	}
+	key.CreatedAt, _ = time.Parse(time.RFC3339, fields["created_at"])
+	if t, err := time.Parse(time.RFC3339, fields["rotated_at"]); err == nil {
+		key.RotatedAt = &t
+	}
+	if t, err := time.Parse(time.RFC3339, fields["last_used_at"]); err == nil {
+		key.LastUsedAt = &t
+	}
+	return key, nil
+}
+
+// ownAPIKey loads one of username's keys, treating anyone else's as
+// missing.
+func ownAPIKey(ctx context.Context, username, id string) (*APIKey, error) {
+	key, err := loadAPIKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if key.Owner != username {
+		return nil, errAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func listAPIKeysFor(ctx context.Context, username string) ([]*APIKey, error) {
+	ids, err := rdb.SMembers(ctx, apiKeysKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := []*APIKey{}
+	for _, id := range ids {
+		key, err := loadAPIKey(ctx, id)
+		if err == errAPIKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// issueAPIKeySecret makes a new secret for key and points it at the key,
+// retiring any old one.
+func issueAPIKeySecret(ctx context.Context, key *APIKey) (string, error) {
+	secret := apiKeyPrefix + randomToken()
+	hash := hashToken(secret)
+	pipe := rdb.TxPipeline()
+	if key.hash != "" {
+		pipe.Del(ctx, apiKeySecretKey(key.hash))
+	}
+	pipe.Set(ctx, apiKeySecretKey(hash), key.ID, 0)
+	pipe.HSet(ctx, apiKeyRecordKey(key.ID), "hash", hash, "prefix", secret[:apiKeyShownFrom])
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	key.hash = hash
+	key.Prefix = secret[:apiKeyShownFrom]
+	return secret, nil
+}
+
+func deleteAPIKey(ctx context.Context, key *APIKey) error {
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, apiKeySecretKey(key.hash), apiKeyRecordKey(key.ID))
+	pipe.SRem(ctx, apiKeysKey(key.Owner), key.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// removeAPIKeys revokes every key a deleted player made.
+func removeAPIKeys(ctx context.Context, username string) error {
+	keys, err := listAPIKeysFor(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := deleteAPIKey(ctx, key); err != nil {
+			return err
+		}
+	}
+	return rdb.Del(ctx, apiKeysKey(username)).Err()
+}
+
+// moveAPIKeys hands a renamed player's keys to their new name, so their
+// bots keep working.
+func moveAPIKeys(ctx context.Context, from, to string) error {
+	ids, err := rdb.SMembers(ctx, apiKeysKey(from)).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	for _, id := range ids {
+		pipe.HSet(ctx, apiKeyRecordKey(id), "owner", to)
+	}
+	pipe.Rename(ctx, apiKeysKey(from), apiKeysKey(to))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// authenticateAPIKey finds the key a secret belongs to and notes that it
+// was used.
+func authenticateAPIKey(ctx context.Context, secret string) (*APIKey, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, errInvalidAPIKey
+	}
+	id, err := rdb.Get(ctx, apiKeySecretKey(hashToken(secret))).Result()
+	if err == redis.Nil {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadAPIKey(ctx, id)
+	if err == errAPIKeyNotFound {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	rdb.HSet(ctx, apiKeyRecordKey(id), "last_used_at", time.Now().UTC().Format(time.RFC3339))
+	return key, nil
+}
+
+func (k *APIKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeys authenticates requests sending an X-API-Key header, and turns
+// them away from routes the key's scopes do not cover. Requests without
+// one pass through untouched.
+func apiKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		secret := r.Header.Get(apiKeyHeader)
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := authenticateAPIKey(ctx, secret)
+		if err == errInvalidAPIKey {
+			respondError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error checking API key")
+			return
+		}
+		if ban, err := loadBan(ctx, key.Owner); err != nil {
+			respondInternal(w, r, err, "Error checking account")
+			return
+		} else if ban != nil {
+			respondBanned(w, r, ban)
+			return
+		}
+		scope, ok := routeScopes[routeName(r)]
+		if !ok || !key.allows(scope) {
+			respondError(w, r, http.StatusForbidden, errInsufficientScope)
+			return
+		}
+
+		setRequestUser(r, key.Owner)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtx, key)))
+	})
+}
+
+// currentAPIKey returns the key apiKeys authenticated, if any.
+func currentAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyCtx).(*APIKey)
+	return key
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	keys, err := listAPIKeysFor(ctx, currentUser(r))
+	if err != nil {
+		respondInternal(w, r, err, "Error loading API keys")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// createAPIKey issues the caller a key with the scopes they ask for. The
+// key itself is in the response and nowhere else.
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	var req CreateAPIKeyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	var problems []*FieldError
+	if req.Name = strings.TrimSpace(req.Name); req.Name == "" || len(req.Name) > maxAPIKeyName {
+		problems = append(problems, &FieldError{Field: "name", Code: "NAME_INVALID",
+			Message: fmt.Sprintf("Name must be 1 to %d characters", maxAPIKeyName)})
+	}
+	if problem := validateScopes(req.Scopes); problem != nil {
+		problems = append(problems, problem)
+	}
+	if len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	guest, err := users.IsGuest(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error creating API key")
+		return
+	}
+	if guest {
+		respondError(w, r, http.StatusForbidden, errGuestAPIKey)
+		return
+	}
+	count, err := rdb.SCard(ctx, apiKeysKey(username)).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error creating API key")
+		return
+	}
+	if count >= maxAPIKeys {
+		respondError(w, r, http.StatusConflict, errTooManyAPIKeys)
+		return
+	}
+
+	key := &APIKey{
+		ID:        randomToken()[:16],
+		Owner:     username,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, apiKeyRecordKey(key.ID),
+		"owner", key.Owner,
+		"name", key.Name,
+		"scopes", strings.Join(key.Scopes, ","),
+		"created_at", key.CreatedAt.Format(time.RFC3339))
+	pipe.SAdd(ctx, apiKeysKey(username), key.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error creating API key")
+		return
+	}
+	secret, err := issueAPIKeySecret(ctx, key)
+	if err != nil {
+		respondInternal(w, r, err, "Error creating API key")
+		return
+	}
+	logFor(r).Info("API key created", "username", username, "key", key.ID, "scopes", key.Scopes)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(IssuedAPIKey{APIKey: key, Key: secret})
+}
+
+// rotateAPIKey replaces a key's secret, keeping its name and scopes. The
+// old secret stops working at once.
+func rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	key, err := ownAPIKey(ctx, username, mux.Vars(r)["id"])
+	if err == errAPIKeyNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error rotating API key")
+		return
+	}
+	secret, err := issueAPIKeySecret(ctx, key)
+	if err != nil {
+		respondInternal(w, r, err, "Error rotating API key")
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	key.RotatedAt = &now
+	if err := rdb.HSet(ctx, apiKeyRecordKey(key.ID), "rotated_at", now.Format(time.RFC3339)).Err(); err != nil {
+		logFor(r).Error("recording API key rotation", "key", key.ID, "err", err)
+	}
+	logFor(r).Info("API key rotated", "username", username, "key", key.ID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(IssuedAPIKey{APIKey: key, Key: secret})
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	key, err := ownAPIKey(ctx, username, mux.Vars(r)["id"])
+	if err == errAPIKeyNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error revoking API key")
+		return
+	}
+	if err := deleteAPIKey(ctx, key); err != nil {
+		respondInternal(w, r, err, "Error revoking API key")
+		return
+	}
+	logFor(r).Info("API key revoked", "username", username, "key", key.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
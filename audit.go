@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// auditLogKey is the audit trail, a stream that is only ever appended to.
+const auditLogKey = "audit:log"
+
+// systemActor is who the audit trail names for changes the server makes on
+// its own, such as paying out a win.
+const systemActor = "system"
+
+// auditScanBatch is how many entries a filtered audit query reads at a time.
+const auditScanBatch = 500
+
+const (
+	AuditRoleChanged     = "role.changed"
+	AuditScoreSet        = "score.set"
+	AuditScoreAdjusted   = "score.adjusted"
+	AuditScoreReset      = "score.reset"
+	AuditScoreAwarded    = "score.awarded"
+	AuditBanCreated      = "ban.created"
+	AuditBanLifted       = "ban.lifted"
+	AuditReportReviewed  = "report.reviewed"
+	AuditReportResolved  = "report.resolved"
+	AuditLogLevelChanged = "log_level.changed"
+	AuditAccountDeleted  = "account.deleted"
+	AuditAccountRenamed  = "account.renamed"
+	AuditPasswordReset   = "password.reset"
+	AuditJobsRetried     = "jobs.retried"
+	AuditMaintenanceSet  = "maintenance.changed"
+	AuditMOTDChanged     = "motd.changed"
+	AuditFlagChanged     = "flag.changed"
+)
+
+// AuditEntry is one change: who made it, to what, and the values before
+// and after.
+type AuditEntry struct {
+	ID     string          `json:"id"`
+	Actor  string          `json:"actor"`
+	Action string          `json:"action"`
+	Target string          `json:"target"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+// audit appends to the audit trail. Like replay events, failures are
+// logged rather than undoing the change being recorded.
+func audit(ctx context.Context, actor, action, target string, before, after interface{}) {
+	values := map[string]interface{}{
+		"actor":  actor,
+		"action": action,
+		"target": target,
+		"time":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for field, v := range map[string]interface{}{"before": before, "after": after} {
+		if v == nil {
+			continue
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			slog.Error("encoding audit entry", "action", action, "err", err)
+			return
+		}
+		values[field] = encoded
+	}
+	if err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: auditLogKey, Values: values}).Err(); err != nil {
+		slog.Error("recording audit entry", "action", action, "actor", actor, "target", target, "err", err)
+	}
+}
+
+func auditEntry(msg redis.XMessage) AuditEntry {
+	field := func(name string) string {
+		v, _ := msg.Values[name].(string)
+		return v
+	}
+	e := AuditEntry{
+		ID:     msg.ID,
+		Actor:  field("actor"),
+		Action: field("action"),
+		Target: field("target"),
+	}
+	if v := field("before"); v != "" {
+		e.Before = json.RawMessage(v)
+	}
+	if v := field("after"); v != "" {
+		e.After = json.RawMessage(v)
+	}
+	e.Time, _ = time.Parse(time.RFC3339Nano, field("time"))
+	return e
+}
+
+// streamBound turns an RFC 3339 time into a stream ID bound, or returns
+// def when the parameter is empty.
+func streamBound(v, def string) (string, bool) {
+	if v == "" {
+		return def, true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10), true
+}
+
+// getAuditLog lists audit entries newest first. ?actor=, ?action= and
+// ?target= filter them, ?since= and ?until= (RFC 3339) bound the time
+// range, and ?before= takes the ID of the last entry seen to fetch the
+// next page.
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	limit, _, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	start, ok := streamBound(q.Get("since"), "-")
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "since must be an RFC 3339 time")
+		return
+	}
+	end, ok := streamBound(q.Get("until"), "+")
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "until must be an RFC 3339 time")
+		return
+	}
+	if before := q.Get("before"); before != "" {
+		end = "(" + before
+	}
+
+	matches := func(e AuditEntry) bool {
+		return (q.Get("actor") == "" || e.Actor == q.Get("actor")) &&
+			(q.Get("action") == "" || e.Action == q.Get("action")) &&
+			(q.Get("target") == "" || e.Target == q.Get("target"))
+	}
+
+	entries := []AuditEntry{}
+	for len(entries) < limit {
+		batch, err := rdb.XRevRangeN(ctx, auditLogKey, end, start, auditScanBatch).Result()
+		if err != nil {
+			respondInternal(w, r, err, "Error loading audit log")
+			return
+		}
+		for _, msg := range batch {
+			if e := auditEntry(msg); matches(e) {
+				entries = append(entries, e)
+				if len(entries) == limit {
+					break
+				}
+			}
+		}
+		if len(batch) < auditScanBatch {
+			break
+		}
+		end = "(" + batch[len(batch)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	accessTokenTTL    = 15 * time.Minute
+	refreshTokenTTL   = 30 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+type contextKey string
+
+const usernameKey contextKey = "username"
+
+var jwtSecret []byte
+
+var (
+	errInvalidCredentials = errors.New("invalid username or password")
+	errInvalidToken       = errors.New("invalid or expired token")
+	errUsernameTaken      = errors.New("username is already taken")
+)
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Email is optional, and is sent a link to verify it.
+	Email string `json:"email,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func accountKey(username string) string {
+	return fmt.Sprintf("account:%s", username)
+}
+
+func refreshKey(token string) string {
+	return fmt.Sprintf("refresh:%s", token)
+}
+
+// tokenGenerationKey holds how many times a player's access tokens have
+// been revoked.
+func tokenGenerationKey(username string) string {
+	return fmt.Sprintf("player:%s:token_generation", username)
+}
+
+// accessClaims are what an access token carries. Generation is the
+// holder's token generation when it was issued, so revoking their tokens
+// cuts off the ones already handed out.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Generation int64 `json:"gen,omitempty"`
+}
+
+func tokenGeneration(ctx context.Context, username string) (int64, error) {
+	gen, err := rdb.Get(ctx, tokenGenerationKey(username)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return gen, err
+}
+
+// loadJWTSecret turns JWT_SECRET into the signing key. Development may
+// leave it unset, and then a random key is generated, which invalidates
+// every token on restart.
+func loadJWTSecret(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	slog.Warn("JWT_SECRET is not set, using a random signing key")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// issueTokens signs a short-lived access token and stores a fresh refresh
+// token for the user.
+func issueTokens(ctx context.Context, username string) (*TokenResponse, error) {
+	return issueTokensWithTTL(ctx, username, refreshTokenTTL)
+}
+
+func issueTokensWithTTL(ctx context.Context, username string, refreshTTL time.Duration) (*TokenResponse, error) {
+	gen, err := tokenGeneration(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
+		Generation: gen,
+	}).SignedString(jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := randomToken()
+	if err := rdb.Set(ctx, refreshKey(refresh), username, refreshTTL).Err(); err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func parseAccessToken(token string) (string, error) {
+	claims, err := parseAccessClaims(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+func parseAccessClaims(token string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// authenticate is parseAccessToken for requests that act as the holder: it
+// also refuses tokens issued before the holder's tokens were revoked.
+func authenticate(ctx context.Context, token string) (string, error) {
+	claims, err := parseAccessClaims(token)
+	if err != nil {
+		return "", err
+	}
+	gen, err := tokenGeneration(ctx, claims.Subject)
+	if err != nil {
+		return "", err
+	}
+	if claims.Generation < gen {
+		return "", errInvalidToken
+	}
+	return claims.Subject, nil
+}
+
+// createAccount stores a new account with a bcrypt hash of its password.
+// The name is claimed first so accounts never differ only in case.
+func createAccount(ctx context.Context, username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if err := claimUsername(ctx, username); err != nil {
+		return err
+	}
+	if err := users.CreateUser(ctx, username, string(hash)); err != nil {
+		releaseUsername(ctx, username)
+		return err
+	}
+	return nil
+}
+
+func checkPassword(ctx context.Context, username, password string) error {
+	hash, err := users.PasswordHash(ctx, username)
+	if err == errUserNotFound {
+		return errInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// requireAuth rejects requests without a valid access token and exposes the
+// token's username to the handler. Browsers cannot set headers on websocket
+// upgrades, so a token query parameter is accepted as well.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token := bearerToken(r)
+		if token == "" {
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Authorization required")
+			return
+		}
+
+		username, err := authenticate(ctx, token)
+		if err == errInvalidToken {
+			respondError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error checking account")
+			return
+		}
+		if ban, err := loadBan(ctx, username); err != nil {
+			respondInternal(w, r, err, "Error checking account")
+			return
+		} else if ban != nil {
+			respondBanned(w, r, ban)
+			return
+		}
+
+		setRequestUser(r, username)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), usernameKey, username)))
+	})
+}
+
+// bearerToken returns the access token sent with the request, if any.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// currentUser returns the username authenticated by requireAuth.
+func currentUser(r *http.Request) string {
+	username, _ := r.Context().Value(usernameKey).(string)
+	return username
+}
+
+// reservedUsername reports whether a name belongs to the server's own guest
+// or bot namespaces.
+func reservedUsername(username string) bool {
+	return strings.HasPrefix(username, guestPrefix) || strings.HasPrefix(username, botPrefix)
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RegisterRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	problems := validateCredentials(req.Username, req.Password)
+	emailProblems, err := newAccountEmail(ctx, req.Email)
+	if err == errEmailTaken {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error creating account")
+		return
+	}
+	if problems = append(problems, emailProblems...); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	err = createAccount(ctx, req.Username, req.Password)
+	if err == errUsernameTaken {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error creating account")
+		return
+	}
+	addToLeaderboard(ctx, req.Username)
+	if req.Email != "" {
+		if err := setEmail(ctx, req.Username, req.Email); err != nil {
+			logFor(r).Error("setting email", "username", req.Username, "err", err)
+		}
+	}
+
+	tokens, err := issueTokens(ctx, req.Username)
+	if err != nil {
+		respondInternal(w, r, err, "Error issuing tokens")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RefreshRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.RefreshToken == "" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "refresh_token is required")
+		return
+	}
+
+	// GETDEL makes each refresh token single-use.
+	username, err := rdb.GetDel(ctx, refreshKey(req.RefreshToken)).Result()
+	if err == redis.Nil {
+		respondError(w, r, http.StatusUnauthorized, errInvalidToken)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error refreshing token")
+		return
+	}
+	// Expired guests leave refresh tokens behind that must not resurrect them.
+	if exists, err := users.UserExists(ctx, username); err != nil || !exists {
+		respondError(w, r, http.StatusUnauthorized, errInvalidToken)
+		return
+	}
+	if ban, err := loadBan(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error refreshing token")
+		return
+	} else if ban != nil {
+		respondBanned(w, r, ban)
+		return
+	}
+
+	tokens, err := issueTokens(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error issuing tokens")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RefreshRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.RefreshToken == "" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "refresh_token is required")
+		return
+	}
+
+	if err := rdb.Del(ctx, refreshKey(req.RefreshToken)).Err(); err != nil {
+		respondInternal(w, r, err, "Error revoking token")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuthRefusesRevokedTokens(t *testing.T) {
+	ctx := context.Background()
+	testRedis(t)
+	saved := jwtSecret
+	jwtSecret = []byte("test secret")
+	t.Cleanup(func() { jwtSecret = saved })
+	handler := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(token string) int {
+		r := httptest.NewRequest("GET", "/api/v1/me", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	before, err := issueTokens(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status(before.AccessToken); got != http.StatusOK {
+		t.Fatalf("fresh token: status %d, want %d", got, http.StatusOK)
+	}
+	if err := revokeAccessTokens(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(before.AccessToken); got != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want %d", got, http.StatusUnauthorized)
+	}
+	after, err := issueTokens(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status(after.AccessToken); got != http.StatusOK {
+		t.Errorf("token issued after revoking: status %d, want %d", got, http.StatusOK)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var errSeatTaken = errors.New("seat is already played by a bot")
+
+type BackfillRequest struct {
+	Username   string `json:"username"`
+	Difficulty string `json:"difficulty"`
+}
+
+// replaceWithBot hands a player's seat, hand and any unfinished business
+// over to a new bot. The player is remembered as having abandoned the game.
+func (g *GameState) replaceWithBot(username, difficulty string) (string, error) {
+	if g.Status != GameActive {
+		return "", errGameOver
+	}
+	if !g.hasPlayer(username) {
+		return "", errNotInGame
+	}
+	if g.isEliminated(username) {
+		return "", errPlayerOut
+	}
+	if g.isBot(username) {
+		return "", errSeatTaken
+	}
+
+	var bot string
+	for name := range newBots(1, difficulty) {
+		bot = name
+	}
+	for i, p := range g.Players {
+		if p == username {
+			g.Players[i] = bot
+		}
+	}
+	g.Hands[bot] = g.Hands[username]
+	delete(g.Hands, username)
+	if g.Bots == nil {
+		g.Bots = map[string]string{}
+	}
+	g.Bots[bot] = difficulty
+	if g.Reinserting == username {
+		g.Reinserting = bot
+	}
+	if g.Altering == username {
+		g.Altering = bot
+	}
+	if f := g.Favor; f != nil {
+		if f.From == username {
+			f.From = bot
+		}
+		if f.To == username {
+			f.To = bot
+		}
+	}
+	if p := g.Pending; p != nil {
+		if p.Player == username {
+			p.Player = bot
+		}
+		if p.Target == username {
+			p.Target = bot
+		}
+	}
+	g.Abandoned = append(g.Abandoned, username)
+	g.logAction(LogEntry{Type: EventPlayerReplaced, Player: username, Target: bot})
+	return bot, nil
+}
+
+func (room *Room) replaceWithBot(username, bot, difficulty string) {
+	for i, p := range room.Players {
+		if p == username {
+			room.Players[i] = bot
+		}
+	}
+	if room.Bots == nil {
+		room.Bots = map[string]string{}
+	}
+	room.Bots[bot] = difficulty
+}
+
+// backfillSeat swaps a bot into a running room in place of username. The
+// room stays locked until both the game and the room have the bot.
+func backfillSeat(ctx context.Context, room *Room, username, difficulty string) (string, error) {
+	var (
+		bot string
+		g   *GameState
+	)
+	_, err := updateRoom(ctx, room.ID, func(room *Room) (err error) {
+		g, err = updateGame(ctx, room.GameID, "backfill", func(g *GameState) (err error) {
+			bot, err = g.replaceWithBot(username, difficulty)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		room.replaceWithBot(username, bot, difficulty)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	untrackActiveGame(ctx, g.ID, username)
+	recordEvent(ctx, g.ID, EventPlayerReplaced, map[string]interface{}{
+		"username": username,
+		"bot":      bot,
+	})
+	hub.broadcast(ctx, g.channel(), EventPlayerReplaced, map[string]interface{}{
+		"username":   username,
+		"bot":        bot,
+		"difficulty": difficulty,
+	})
+	// Hand the turn to the bot straight away if it was the absent player's.
+	publishTurn(ctx, g)
+	return bot, nil
+}
+
+// watchAbandon gives a disconnected player the grace period to come back
+// before backfilling their seat, if the room opted in.
+func watchAbandon(ctx context.Context, roomID, username string) {
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(reconnectGrace, func() {
+		if hub.connected(roomID, username) || connectionState(ctx, roomID, username) != ConnectionDisconnected {
+			return
+		}
+		room, err := loadRoom(ctx, roomID)
+		if err != nil || !room.Backfill || room.Status != RoomInProgress || !room.hasPlayer(username) {
+			return
+		}
+		bot, err := backfillSeat(ctx, room, username, BotMedium)
+		if err != nil {
+			if err != errPlayerOut && err != errGameOver && err != errSeatTaken {
+				slog.Error("backfilling seat", "username", username, "room", roomID, "err", err)
+			}
+			return
+		}
+		slog.Info("replaced disconnected player", "username", username, "bot", bot, "room", roomID)
+	})
+}
+
+// backfillRoom lets the room owner replace an absent player with a bot.
+func backfillRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req BackfillRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Difficulty == "" {
+		req.Difficulty = BotMedium
+	}
+	if !validDifficulty(req.Difficulty) {
+		respondError(w, r, http.StatusBadRequest, errBadDifficulty)
+		return
+	}
+
+	room, err := loadRoom(ctx, mux.Vars(r)["id"])
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+	if room.Owner != currentUser(r) {
+		respondError(w, r, http.StatusForbidden, errNotRoomOwner)
+		return
+	}
+	if room.Status != RoomInProgress {
+		writeError(w, r, http.StatusConflict, "NO_GAME_IN_PROGRESS", "Room has no game in progress")
+		return
+	}
+
+	bot, err := backfillSeat(ctx, room, req.Username, req.Difficulty)
+	if err == errNotInGame {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"username": req.Username,
+		"bot":      bot,
+	})
+}
+
+// leaveRoom abandons a running game, leaving a bot in the seat so the
+// others can play on.
+func leaveRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	room, err := loadRoom(ctx, mux.Vars(r)["id"])
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+	if room.Status != RoomInProgress {
+		writeError(w, r, http.StatusConflict, "NO_GAME_IN_PROGRESS", "Room has no game in progress")
+		return
+	}
+
+	bot, err := backfillSeat(ctx, room, username, BotMedium)
+	if err == errNotInGame {
+		respondError(w, r, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"bot":    bot,
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errAccountBanned = errors.New("account is banned")
+	errNotBanned     = errors.New("account is not banned")
+	errBadBanLength  = errors.New("duration must be a positive duration such as 72h, or left out for a permanent ban")
+)
+
+// BanRequest bans an account for Duration, or for good when it is empty.
+type BanRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Ban is why, by whom and until when an account was banned. Records are
+// kept after the ban ends so a player's history can be looked back on.
+type Ban struct {
+	ID        string     `json:"id"`
+	Username  string     `json:"username"`
+	Reason    string     `json:"reason"`
+	BannedBy  string     `json:"banned_by"`
+	BannedAt  time.Time  `json:"banned_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LiftedBy  string     `json:"lifted_by,omitempty"`
+	LiftedAt  *time.Time `json:"lifted_at,omitempty"`
+	// Forfeited lists the games the player was taken out of.
+	Forfeited []string `json:"forfeited,omitempty"`
+}
+
+// banKey holds the ID of an account's current ban. A temporary ban's key
+// expires with it.
+func banKey(username string) string {
+	return fmt.Sprintf("ban:%s", username)
+}
+
+func banRecordKey(id string) string {
+	return fmt.Sprintf("ban:record:%s", id)
+}
+
+// banHistoryKey lists every ban an account has had, oldest first.
+func banHistoryKey(username string) string {
+	return fmt.Sprintf("player:%s:bans", username)
+}
+
+func loadBanRecord(ctx context.Context, id string) (*Ban, error) {
+	data, err := rdb.Get(ctx, banRecordKey(id)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var ban Ban
+	if err := json.Unmarshal(data, &ban); err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+func saveBanRecord(ctx context.Context, ban *Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, banRecordKey(ban.ID), data, 0).Err()
+}
+
+// loadBan returns the account's ban in force, or nil if it is not banned.
+func loadBan(ctx context.Context, username string) (*Ban, error) {
+	id, err := rdb.Get(ctx, banKey(username)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ban, err := loadBanRecord(ctx, id)
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The key normally expires with the ban; this covers clock skew.
+	if ban.ExpiresAt != nil && !time.Now().Before(*ban.ExpiresAt) {
+		return nil, nil
+	}
+	return ban, nil
+}
+
+// respondBanned tells a banned player why and for how long.
+func respondBanned(w http.ResponseWriter, r *http.Request, ban *Ban) {
+	writeError(w, r, http.StatusForbidden, errorCodes[errAccountBanned], ban.message())
+}
+
+// message tells the player why they are banned and until when.
+func (ban *Ban) message() string {
+	if ban.ExpiresAt != nil {
+		return fmt.Sprintf("Account is banned until %s: %s", ban.ExpiresAt.Format(time.RFC3339), ban.Reason)
+	}
+	return "Account is banned: " + ban.Reason
+}
+
+// forfeitActiveGames takes a banned player out of every game they are
+// still playing.
+func forfeitActiveGames(ctx context.Context, username string) []string {
+	ids, err := rdb.ZRange(ctx, activeGamesKey(username), 0, -1).Result()
+	if err != nil {
+		slog.Error("loading active games", "username", username, "err", err)
+		return nil
+	}
+	forfeited := []string{}
+	for _, id := range ids {
+		g, err := updateGameAs(ctx, id, "ban", username, func(g *GameState) error {
+			if g.Status != GameActive || !g.hasPlayer(username) || g.isEliminated(username) {
+				return errNoChange
+			}
+			return g.forfeit(username)
+		})
+		if err == errNoChange || err == errGameNotFound {
+			untrackActiveGame(ctx, id, username)
+			continue
+		}
+		if err != nil {
+			slog.Error("forfeiting banned player", "game", id, "username", username, "err", err)
+			continue
+		}
+		publishForfeit(ctx, g, username)
+		forfeited = append(forfeited, id)
+	}
+	return forfeited
+}
+
+func banUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	var req BanRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "A reason is required")
+		return
+	}
+	var length time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			respondError(w, r, http.StatusBadRequest, errBadBanLength)
+			return
+		}
+		length = d
+	}
+	ok, err := outranks(r, username)
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error banning user")
+		return
+	}
+	if !ok {
+		respondError(w, r, http.StatusForbidden, errOutranked)
+		return
+	}
+
+	now := time.Now().UTC()
+	ban := &Ban{
+		ID:       newID(),
+		Username: username,
+		Reason:   req.Reason,
+		BannedBy: actorName(r),
+		BannedAt: now,
+	}
+	if length > 0 {
+		until := now.Add(length)
+		ban.ExpiresAt = &until
+	}
+	if err := saveBanRecord(ctx, ban); err != nil {
+		respondInternal(w, r, err, "Error banning user")
+		return
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, banKey(username), ban.ID, length)
+	pipe.RPush(ctx, banHistoryKey(username), ban.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error banning user")
+		return
+	}
+	logFor(r).Info("user banned", "target", username, "reason", req.Reason, "duration", req.Duration)
+	audit(ctx, ban.BannedBy, AuditBanCreated, username, nil, ban)
+
+	hub.disconnectUser(ctx, username, websocket.ClosePolicyViolation, "account banned")
+	if err := revokeReconnectTokens(ctx, username); err != nil {
+		logFor(r).Error("revoking reconnect tokens", "username", username, "err", err)
+	}
+	ban.Forfeited = forfeitActiveGames(ctx, username)
+	if len(ban.Forfeited) > 0 {
+		if err := saveBanRecord(ctx, ban); err != nil {
+			logFor(r).Error("recording forfeited games", "ban", ban.ID, "err", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ban)
+}
+
+func unbanUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	ban, err := loadBan(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error lifting ban")
+		return
+	}
+	if ban == nil {
+		respondError(w, r, http.StatusNotFound, errNotBanned)
+		return
+	}
+	before := *ban
+	now := time.Now().UTC()
+	ban.LiftedBy = actorName(r)
+	ban.LiftedAt = &now
+	if err := saveBanRecord(ctx, ban); err != nil {
+		respondInternal(w, r, err, "Error lifting ban")
+		return
+	}
+	if err := rdb.Del(ctx, banKey(username)).Err(); err != nil {
+		respondInternal(w, r, err, "Error lifting ban")
+		return
+	}
+	logFor(r).Info("ban lifted", "target", username, "ban", ban.ID)
+	audit(ctx, ban.LiftedBy, AuditBanLifted, username, before, ban)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ban)
+}
+
+// banHistory returns every ban an account has had, newest first.
+func banHistory(ctx context.Context, username string) ([]*Ban, error) {
+	ids, err := rdb.LRange(ctx, banHistoryKey(username), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	bans := []*Ban{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		ban, err := loadBanRecord(ctx, ids[i])
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func listBans(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	bans, err := banHistory(ctx, mux.Vars(r)["username"])
+	if err != nil {
+		respondInternal(w, r, err, "Error loading bans")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
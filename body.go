@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const defaultMaxBodyBytes = 64 << 10
+
+// maxBodyBytes caps every request body. Set with MAX_BODY_BYTES.
+var maxBodyBytes int64 = defaultMaxBodyBytes
+
+// jsonBodies rejects request bodies that are not JSON or are larger than
+// maxBodyBytes, before anything reads them. Requests without a body pass.
+func jsonBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > maxBodyBytes {
+			respondPayload(w, r, &http.MaxBytesError{Limit: maxBodyBytes})
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			writeError(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Send the request body as application/json")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// payloadError is a request body that could not be decoded, with a message
+// saying why that is safe to show the client.
+type payloadError struct {
+	message string
+	err     error
+}
+
+func (e *payloadError) Error() string { return e.message }
+
+func (e *payloadError) Unwrap() error { return e.err }
+
+// decodeJSON decodes the request body into v, which must be exactly one
+// JSON value with no fields v does not have. An empty body gives an error
+// wrapping io.EOF, for handlers where the body is optional.
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &payloadError{message: payloadMessage(err), err: err}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &payloadError{message: payloadMessage(err), err: err}
+		}
+		return &payloadError{message: "Request body must hold a single JSON value"}
+	}
+	return nil
+}
+
+func payloadMessage(err error) string {
+	var (
+		syntax    *json.SyntaxError
+		wrongType *json.UnmarshalTypeError
+		tooLarge  *http.MaxBytesError
+	)
+	switch {
+	case errors.Is(err, io.EOF):
+		return "Request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "Request body is cut short"
+	case errors.As(err, &syntax):
+		return fmt.Sprintf("Malformed JSON at byte %d", syntax.Offset)
+	case errors.As(err, &wrongType) && wrongType.Field != "":
+		return fmt.Sprintf("Field %q must be %s", wrongType.Field, jsonKind(wrongType.Type.Kind().String()))
+	case errors.As(err, &wrongType):
+		return fmt.Sprintf("Request body must be %s", jsonKind(wrongType.Type.Kind().String()))
+	case errors.As(err, &tooLarge):
+		return fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	return "Invalid request payload"
+}
+
+// jsonKind names a Go kind the way a JSON client thinks of it.
+func jsonKind(kind string) string {
+	switch {
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "true or false"
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "slice", kind == "array":
+		return "an array"
+	}
+	return "an object"
+}
+
+// respondPayload reports a body decodeJSON or jsonBodies refused.
+func respondPayload(w http.ResponseWriter, r *http.Request, err error) {
+	message := payloadMessage(err)
+	var invalid *payloadError
+	if errors.As(err, &invalid) {
+		message = invalid.message
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, message)
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, message)
+}
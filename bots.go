@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"time"
+)
+
+const (
+	BotEasy   = "easy"
+	BotMedium = "medium"
+	BotHard   = "hard"
+)
+
+const (
+	botPrefix    = "bot-"
+	minBots      = 1
+	maxBots      = 3
+	botThinkTime = 1500 * time.Millisecond
+	// botLockTTL bounds how long a crashed instance can hold a bot's turn.
+	botLockTTL = 30 * time.Second
+)
+
+var errBadDifficulty = errors.New("difficulty must be easy, medium or hard")
+
+func botLockKey(gameID string) string {
+	return fmt.Sprintf("game:%s:bot", gameID)
+}
+
+func validDifficulty(difficulty string) bool {
+	switch difficulty {
+	case BotEasy, BotMedium, BotHard:
+		return true
+	}
+	return false
+}
+
+// newBots names n bots of the given difficulty. Bot names live in a
+// reserved namespace so they can never collide with a real account.
+func newBots(n int, difficulty string) map[string]string {
+	bots := make(map[string]string, n)
+	for len(bots) < n {
+		bots[botPrefix+difficulty+"-"+randomToken()[:6]] = difficulty
+	}
+	return bots
+}
+
+func (g *GameState) isBot(username string) bool {
+	_, ok := g.Bots[username]
+	return ok
+}
+
+// botRemember records what a bot has seen of the top of the deck. Unknown
+// positions are left empty.
+func (g *GameState) botRemember(bot string, cards []string) {
+	if !g.isBot(bot) {
+		return
+	}
+	if g.BotMemory == nil {
+		g.BotMemory = map[string][]string{}
+	}
+	g.BotMemory[bot] = append([]string{}, cards...)
+}
+
+// botsSawDraw drops the top card from every bot's memory after a draw.
+func (g *GameState) botsSawDraw() {
+	for bot, known := range g.BotMemory {
+		if len(known) > 0 {
+			g.BotMemory[bot] = known[1:]
+		}
+	}
+}
+
+// botsForget wipes bot memories once the deck order has changed.
+func (g *GameState) botsForget() {
+	g.BotMemory = nil
+}
+
+// kittenOdds is the public chance that the top card is an Exploding
+// Kitten: everyone knows how many are left and how big the deck is.
+func (g *GameState) kittenOdds() float64 {
+	if len(g.Deck) == 0 {
+		return 0
+	}
+	kittens := 0
+	for _, c := range g.Deck {
+		if c == CardExploding {
+			kittens++
+		}
+	}
+	return float64(kittens) / float64(len(g.Deck))
+}
+
+// botMove is what a bot decided to do with its turn: play Card (at Target),
+// play Cards as a combo or, when both are empty, draw.
+type botMove struct {
+	Card   string
+	Cards  []string
+	Target string
+}
+
+// chooseMove picks a bot's action. Easy bots play at random, medium bots
+// dodge when the public odds look bad, and hard bots also use whatever
+// they have seen of the deck.
+func (g *GameState) chooseMove(bot string) botMove {
+	hand := g.Hands[bot]
+	has := func(card string) bool { return g.hasCard(bot, card) }
+	dodge := func() botMove {
+		for _, c := range []string{CardAttack, CardSkip} {
+			if has(c) {
+				return botMove{Card: c}
+			}
+		}
+		if has(CardTargetedAttack) {
+			return botMove{Card: CardTargetedAttack, Target: g.favorTarget(bot)}
+		}
+		return botMove{}
+	}
+	// Every bot can see a face-up Imploding Kitten on top of the deck.
+	if at := g.implodingAt(); at != nil && *at == 0 {
+		if move := dodge(); move.Card != "" {
+			return move
+		}
+		if has(CardShuffle) {
+			return botMove{Card: CardShuffle}
+		}
+	}
+
+	switch g.Bots[bot] {
+	case BotEasy:
+		if len(hand) > 0 && mrand.Intn(4) == 0 {
+			card := hand[mrand.Intn(len(hand))]
+			switch card {
+			case CardSkip, CardAttack, CardShuffle, CardSeeTheFuture, CardAlterTheFuture:
+				return botMove{Card: card}
+			case CardFavor, CardTargetedAttack:
+				return botMove{Card: card, Target: g.favorTarget(bot)}
+			}
+		}
+		return botMove{}
+
+	case BotMedium:
+		threshold := 0.3
+		if !has(CardDefuse) {
+			threshold = 0.15
+		}
+		if g.kittenOdds() >= threshold {
+			return dodge()
+		}
+		if len(hand) < 3 && has(CardFavor) {
+			return botMove{Card: CardFavor, Target: g.favorTarget(bot)}
+		}
+		if pair := g.comboCards(bot); len(hand) < 4 && pair != nil {
+			return botMove{Cards: pair, Target: g.favorTarget(bot)}
+		}
+		return botMove{}
+
+	default:
+		known := g.BotMemory[bot]
+		if len(known) > 0 && known[0] != "" {
+			if known[0] != CardExploding {
+				return botMove{}
+			}
+			if has(CardAlterTheFuture) {
+				return botMove{Card: CardAlterTheFuture}
+			}
+			if move := dodge(); move.Card != "" {
+				return move
+			}
+			if has(CardShuffle) {
+				return botMove{Card: CardShuffle}
+			}
+			return botMove{}
+		}
+		if g.kittenOdds() >= 0.15 && has(CardSeeTheFuture) {
+			return botMove{Card: CardSeeTheFuture}
+		}
+		if g.kittenOdds() >= 0.25 && !has(CardDefuse) {
+			return dodge()
+		}
+		if len(hand) < 4 && has(CardFavor) {
+			return botMove{Card: CardFavor, Target: g.favorTarget(bot)}
+		}
+		if pair := g.comboCards(bot); pair != nil {
+			return botMove{Cards: pair, Target: g.favorTarget(bot)}
+		}
+		return botMove{}
+	}
+}
+
+// favorTarget picks the surviving opponent holding the most cards.
+func (g *GameState) favorTarget(bot string) string {
+	target, most := "", -1
+	for _, p := range g.alivePlayers() {
+		if p != bot && len(g.Hands[p]) > most {
+			target, most = p, len(g.Hands[p])
+		}
+	}
+	return target
+}
+
+// reinsertPosition picks where a bot hides a defused kitten. Stronger bots
+// put it on top so the next player draws it.
+func (g *GameState) reinsertPosition(bot string) int {
+	switch g.Bots[bot] {
+	case BotEasy:
+		return mrand.Intn(len(g.Deck) + 1)
+	case BotMedium:
+		return mrand.Intn(len(g.Deck)/2 + 1)
+	default:
+		return 0
+	}
+}
+
+// scheduleBotTurn gives the bot whose turn it is a moment to "think" before
+// it acts. The lock keeps duplicate notifications from making it act twice.
+func scheduleBotTurn(ctx context.Context, g *GameState) {
+	bot := g.currentPlayer()
+	if !g.isBot(bot) {
+		return
+	}
+	ok, err := rdb.SetNX(ctx, botLockKey(g.ID), bot, botLockTTL).Result()
+	if err != nil || !ok {
+		return
+	}
+	gameID := g.ID
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(botThinkTime, func() {
+		runBotTurn(ctx, gameID)
+	})
+}
+
+// botAction is what a bot did on its turn, kept for notifying the table
+// once the move has been saved.
+type botAction struct {
+	bot      string
+	reinsert bool
+	position int
+	alter    bool
+	play     *PlayResult
+	draw     *DrawResult
+}
+
+// runBotTurn carries out one bot action through the same rules engine and
+// notifications as a human player's requests.
+func runBotTurn(ctx context.Context, gameID string) {
+	var act botAction
+	g, err := updateGame(ctx, gameID, "bot_turn", func(g *GameState) error {
+		act = botAction{bot: g.currentPlayer()}
+		bot := act.bot
+		if !g.isBot(bot) || g.Pending != nil || g.Favor != nil {
+			// A pending action or favor re-publishes the turn once it
+			// resolves.
+			return errNoChange
+		}
+
+		if g.Reinserting == bot {
+			act.reinsert = true
+			act.position = g.reinsertPosition(bot)
+			return g.reinsert(bot, act.position)
+		}
+		if g.Altering == bot {
+			act.alter = true
+			return g.alter(bot, g.botAlteration())
+		}
+
+		if move := g.chooseMove(bot); move.Card != "" || move.Cards != nil {
+			var (
+				result *PlayResult
+				err    error
+			)
+			if move.Cards != nil {
+				result, err = g.playCombo(bot, move.Cards, move.Target, "", time.Now())
+			} else {
+				result, err = g.play(bot, move.Card, move.Target, time.Now())
+			}
+			if err == nil {
+				act.play = result
+				return nil
+			}
+			// Fall back to drawing if the chosen card turned out unplayable.
+		}
+		result, err := g.draw(bot)
+		act.draw = result
+		return err
+	})
+	rdb.Del(ctx, botLockKey(gameID))
+	if err == errNoChange {
+		return
+	}
+	if err != nil {
+		slog.Error("playing bot turn", "bot", act.bot, "game", gameID, "err", err)
+		return
+	}
+
+	switch {
+	case act.reinsert:
+		publishReinsert(ctx, g, act.bot, act.position)
+	case act.alter:
+		publishAlter(ctx, g, act.bot)
+	case act.play != nil:
+		publishPlay(ctx, g, act.bot, act.play)
+	default:
+		if g.Status == GameFinished {
+			completeGame(ctx, g)
+		}
+		publishDraw(ctx, g, act.bot, act.draw)
+	}
+}
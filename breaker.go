@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis retries transient failures itself, up to REDIS_MAX_RETRIES times
+// (0 for none), waiting a jittered, doubling backoff between
+// REDIS_RETRY_BACKOFF and REDIS_MAX_RETRY_BACKOFF. All of it happens
+// within REDIS_TIMEOUT.
+const (
+	defaultRedisRetries    = 3
+	defaultRetryBackoff    = 8 * time.Millisecond
+	defaultMaxRetryBackoff = 512 * time.Millisecond
+
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 10 * time.Second
+)
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("redis is unavailable")
+
+// readCommands are the commands the breaker fails fast while it is open.
+// Writes are still tried: failing them here would only hide that Redis
+// is back.
+var readCommands = map[string]bool{
+	"get": true, "mget": true, "exists": true, "ttl": true, "pttl": true,
+	"hget": true, "hmget": true, "hgetall": true, "hexists": true, "hlen": true,
+	"lrange": true, "llen": true, "lindex": true,
+	"smembers": true, "sismember": true, "scard": true,
+	"zcard": true, "zcount": true, "zrange": true, "zrevrange": true,
+	"zrangebyscore": true, "zrevrangebyscore": true,
+	"zscore": true, "zrank": true, "zrevrank": true,
+	"xrange": true, "xrevrange": true, "xlen": true, "scan": true,
+}
+
+// circuitBreaker stops sending reads to Redis after threshold failures in
+// a row. Once cooldown has passed it lets one probe through: if that
+// succeeds the breaker closes, otherwise it opens for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	cooldown  time.Duration
+
+	// Counters for /admin/debug/vars.
+	opened   int64
+	rejected int64
+}
+
+var breaker = &circuitBreaker{
+	state:     BreakerClosed,
+	threshold: defaultBreakerThreshold,
+	cooldown:  defaultBreakerCooldown,
+}
+
+func init() {
+	expvar.Publish("redis_breaker", expvar.Func(func() interface{} { return breaker.stats() }))
+}
+
+// allow reports whether a read may go to Redis now.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.rejected++
+			return false
+		}
+		b.state = BreakerHalfOpen
+	}
+	// Half open: one probe at a time.
+	if b.probing {
+		b.rejected++
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a call that went to Redis.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		if b.state != BreakerClosed {
+			slog.Info("redis is back, closing the circuit breaker")
+		}
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.state == BreakerClosed && b.failures >= b.threshold {
+		if b.state == BreakerClosed {
+			slog.Warn("redis is failing, opening the circuit breaker", "failures", b.failures)
+		}
+		b.state, b.openedAt = BreakerOpen, time.Now()
+		b.opened++
+	}
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{
+		"state":    b.state,
+		"failures": b.failures,
+		"opened":   b.opened,
+		"rejected": b.rejected,
+	}
+}
+
+// redisFailed reports whether err means Redis could not be reached, as
+// opposed to an answer such as a missing key or a failed transaction.
+func redisFailed(err error) bool {
+	if err == nil || err == redis.Nil || err == redis.TxFailedErr || errors.Is(err, errCircuitOpen) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var reply redis.Error
+	return !errors.As(err, &reply)
+}
+
+// storageDown reports whether a request failed because Redis timed out,
+// could not be connected to, or the breaker turned it away.
+func storageDown(err error) bool {
+	var opErr *net.OpError
+	return redisTimedOut(err) || errors.As(err, &opErr) || errors.Is(err, errCircuitOpen)
+}
+
+// breakerHook runs Redis traffic through the circuit breaker.
+type breakerHook struct{}
+
+func (breakerHook) BeforeProcess(c context.Context, cmd redis.Cmder) (context.Context, error) {
+	if readCommands[cmd.Name()] && !breaker.allow() {
+		return c, errCircuitOpen
+	}
+	return c, nil
+}
+
+func (breakerHook) AfterProcess(c context.Context, cmd redis.Cmder) error {
+	if !errors.Is(cmd.Err(), errCircuitOpen) {
+		breaker.record(redisFailed(cmd.Err()))
+	}
+	return nil
+}
+
+func (breakerHook) BeforeProcessPipeline(c context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		if !readCommands[cmd.Name()] {
+			return c, nil
+		}
+	}
+	if !breaker.allow() {
+		return c, errCircuitOpen
+	}
+	return c, nil
+}
+
+func (breakerHook) AfterProcessPipeline(c context.Context, cmds []redis.Cmder) error {
+	failed := false
+	for _, cmd := range cmds {
+		if errors.Is(cmd.Err(), errCircuitOpen) {
+			return nil
+		}
+		if redisFailed(cmd.Err()) {
+			failed = true
+		}
+	}
+	breaker.record(failed)
+	return nil
+}
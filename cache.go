@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeaderboardCacheTTL = 5 * time.Second
+	// maxCachedPages bounds a page cache, since clients pick the pages.
+	maxCachedPages = 1000
+)
+
+// leaderboardCacheTTL is how long a leaderboard page is served from memory,
+// and how long clients may keep it, before it is read again. Set with
+// LEADERBOARD_CACHE_TTL.
+var leaderboardCacheTTL = defaultLeaderboardCacheTTL
+
+// cachedPage is an encoded response body kept for reuse.
+type cachedPage struct {
+	body    []byte
+	total   int64
+	etag    string
+	expires time.Time
+}
+
+func newCachedPage(body []byte, total int64, ttl time.Duration) *cachedPage {
+	h := sha256.New()
+	h.Write(body)
+	h.Write([]byte(strconv.FormatInt(total, 10)))
+	return &cachedPage{
+		body:    body,
+		total:   total,
+		etag:    strconv.Quote(hex.EncodeToString(h.Sum(nil)[:16])),
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// pageCache keeps encoded pages in process for a short while. Each
+// instance has its own, so instances may disagree for up to a TTL.
+type pageCache struct {
+	mu    sync.Mutex
+	pages map[string]*cachedPage
+}
+
+func newPageCache() *pageCache {
+	return &pageCache{pages: map[string]*cachedPage{}}
+}
+
+// get returns the page cached under key, unless it has expired.
+func (c *pageCache) get(key string) (*cachedPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pages[key]
+	if !ok || time.Now().After(p.expires) {
+		return nil, false
+	}
+	return p, true
+}
+
+// stale returns the page last cached under key, expired or not, for when
+// a fresh one cannot be read.
+func (c *pageCache) stale(key string) (*cachedPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pages[key]
+	return p, ok
+}
+
+// put caches a page, first clearing out expired pages when the cache is
+// full, and everything if that frees nothing.
+func (c *pageCache) put(key string, p *cachedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pages) >= maxCachedPages {
+		now := time.Now()
+		for k, old := range c.pages {
+			if now.After(old.expires) {
+				delete(c.pages, k)
+			}
+		}
+		if len(c.pages) >= maxCachedPages {
+			c.pages = map[string]*cachedPage{}
+		}
+	}
+	c.pages[key] = p
+}
+
+var leaderboardPages = newPageCache()
@@ -0,0 +1,191 @@
+package main
+
+import (
+	mrand "math/rand/v2"
+)
+
+const (
+	CardDefuse       = "defuse"
+	CardShuffle      = "shuffle"
+	CardExploding    = "exploding"
+	CardSkip         = "skip"
+	CardAttack       = "attack"
+	CardFavor        = "favor"
+	CardSeeTheFuture = "see_the_future"
+	CardNope         = "nope"
+)
+
+// Cat cards do nothing on their own and are played in combos.
+const (
+	CardTacoCat     = "tacocat"
+	CardCattermelon = "cattermelon"
+	CardPotatoCat   = "hairy_potato_cat"
+	CardBeardCat    = "beard_cat"
+	CardRainbowCat  = "rainbow_ralphing_cat"
+)
+
+var catCards = []string{
+	CardTacoCat, CardCattermelon, CardPotatoCat, CardBeardCat, CardRainbowCat, CardFeralCat,
+}
+
+func isCat(card string) bool {
+	for _, c := range catCards {
+		if c == card {
+			return true
+		}
+	}
+	return false
+}
+
+// cardTypes lists every card in the game.
+var cardTypes = []string{
+	CardDefuse, CardShuffle, CardExploding, CardSkip,
+	CardAttack, CardFavor, CardSeeTheFuture, CardNope,
+	CardTacoCat, CardCattermelon, CardPotatoCat, CardBeardCat, CardRainbowCat,
+	CardImploding, CardAlterTheFuture, CardTargetedAttack, CardFeralCat,
+}
+
+func knownCard(card string) bool {
+	for _, c := range cardTypes {
+		if c == card {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	handSize = 4
+	// totalDefuses is how many Defuses come in the box.
+	totalDefuses = 6
+)
+
+type cardCount struct {
+	card  string
+	count int
+}
+
+// deckComposition is the pool of cards dealt from before Exploding Kittens
+// are shuffled in, as used for a full table.
+var deckComposition = []cardCount{
+	{CardTacoCat, 4},
+	{CardCattermelon, 4},
+	{CardPotatoCat, 4},
+	{CardBeardCat, 4},
+	{CardRainbowCat, 4},
+	{CardSkip, 4},
+	{CardAttack, 4},
+	{CardFavor, 4},
+	{CardShuffle, 4},
+	{CardSeeTheFuture, 5},
+	{CardNope, 5},
+}
+
+// catsPerType is how many of each cat card a table of players deals from:
+// the full four from four players up, fewer for smaller games so they
+// don't drag on.
+func catsPerType(players int) int {
+	switch {
+	case players >= 4:
+		return 4
+	case players == 3:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// spareDefuses is how many Defuses go back into the deck once everyone has
+// theirs: two for small games, the rest of the box for bigger ones.
+func spareDefuses(players int) int {
+	if players <= 3 {
+		return 2
+	}
+	return totalDefuses - players
+}
+
+// pileComposition is what the pile for a table of players is built from
+// under these rules, before counts are adjusted.
+func (hr *HouseRules) pileComposition(players int) []cardCount {
+	pile := append([]cardCount{}, deckComposition...)
+	if hr.expansion(ExpansionImploding) {
+		pile = append(pile, implodingComposition...)
+	}
+	for i, cc := range pile {
+		if isCat(cc.card) && cc.card != CardFeralCat {
+			pile[i].count = catsPerType(players)
+		}
+	}
+	return pile
+}
+
+// composition counts every card dealt for a game, hands included.
+func composition(deck []string, hands map[string][]string) map[string]int {
+	counts := map[string]int{}
+	for _, c := range deck {
+		counts[c]++
+	}
+	for _, hand := range hands {
+		for _, c := range hand {
+			counts[c]++
+		}
+	}
+	return counts
+}
+
+func shuffleCards(cards []string, rng *mrand.Rand) {
+	rng.Shuffle(len(cards), func(i, j int) {
+		cards[i], cards[j] = cards[j], cards[i]
+	})
+}
+
+// dealGame builds a fresh deck sized for the game's players, deals each
+// their Defuses plus a starting hand, then shuffles one Exploding Kitten
+// fewer than there are players, and the spare Defuses, into what is left.
+// One kitten is swapped for the Imploding Kitten when the expansion is on.
+// The same rng state, house rules and modifiers always produce the same
+// deal.
+func dealGame(g *GameState, rng *mrand.Rand) ([]string, map[string][]string) {
+	players, modifiers := g.DealtTo, g.Modifiers
+	deck := []string{}
+	for _, cc := range g.Rules.pileComposition(len(players)) {
+		for i := 0; i < g.Rules.cardCount(cc.card, cc.count); i++ {
+			deck = append(deck, cc.card)
+		}
+	}
+	shuffleCards(deck, rng)
+
+	hands := make(map[string][]string, len(players))
+	for _, p := range players {
+		hand := []string{}
+		for i := 0; i < g.Rules.startingDefuses(); i++ {
+			hand = append(hand, CardDefuse)
+		}
+		hand = append(hand, deck[:handSize]...)
+		deck = deck[handSize:]
+		hands[p] = hand
+	}
+
+	kittens := len(players) - 1
+	if kittens < 1 {
+		kittens = 1
+	}
+	if g.Rules.expansion(ExpansionImploding) {
+		// The Imploding Kitten takes the place of one Exploding Kitten.
+		kittens--
+		deck = append(deck, CardImploding)
+	}
+	for i := 0; i < kittens; i++ {
+		deck = append(deck, CardExploding)
+	}
+	defuses := spareDefuses(len(players))
+	if hasModifier(modifiers, ModifierHolidayDeck) {
+		defuses += holidayDefuses
+	}
+	for i := 0; i < defuses; i++ {
+		deck = append(deck, CardDefuse)
+	}
+	shuffleCards(deck, rng)
+
+	return deck, hands
+}
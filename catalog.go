@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// What a card does, broadly, so clients can group and style them.
+const (
+	EffectKitten   = "kitten"
+	EffectDefuse   = "defuse"
+	EffectAction   = "action"
+	EffectReaction = "reaction"
+	EffectCat      = "cat"
+)
+
+const defaultCardArtURL = "/static/cards"
+
+// cardArtURL is where card artwork is served from, one PNG per card ID.
+// Set with CARD_ART_URL.
+var cardArtURL = defaultCardArtURL
+
+// Card describes a card for clients. ID is the string the API uses for
+// the card everywhere else.
+type Card struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Effect      string `json:"effect"`
+	Expansion   string `json:"expansion,omitempty"`
+	ArtworkURL  string `json:"artwork_url"`
+}
+
+// cardInfo holds the catalog entry for every card in cardTypes.
+var cardInfo = map[string]Card{
+	CardExploding:      {Name: "Exploding Kitten", Effect: EffectKitten, Description: "Draw this and you explode, unless you play a Defuse."},
+	CardDefuse:         {Name: "Defuse", Effect: EffectDefuse, Description: "Saves you from an Exploding Kitten, which you then put back anywhere in the deck."},
+	CardSkip:           {Name: "Skip", Effect: EffectAction, Description: "End your turn without drawing a card."},
+	CardAttack:         {Name: "Attack", Effect: EffectAction, Description: "End your turn without drawing. The next player takes two turns."},
+	CardFavor:          {Name: "Favor", Effect: EffectAction, Description: "Another player must give you a card of their choice."},
+	CardShuffle:        {Name: "Shuffle", Effect: EffectAction, Description: "Shuffle the deck."},
+	CardSeeTheFuture:   {Name: "See the Future", Effect: EffectAction, Description: "Privately look at the top three cards of the deck."},
+	CardNope:           {Name: "Nope", Effect: EffectReaction, Description: "Stop any action except a kitten or a Defuse. Can be played at any time."},
+	CardTacoCat:        {Name: "Tacocat", Effect: EffectCat, Description: "Play two or three matching cats to steal from another player."},
+	CardCattermelon:    {Name: "Cattermelon", Effect: EffectCat, Description: "Play two or three matching cats to steal from another player."},
+	CardPotatoCat:      {Name: "Hairy Potato Cat", Effect: EffectCat, Description: "Play two or three matching cats to steal from another player."},
+	CardBeardCat:       {Name: "Beard Cat", Effect: EffectCat, Description: "Play two or three matching cats to steal from another player."},
+	CardRainbowCat:     {Name: "Rainbow-Ralphing Cat", Effect: EffectCat, Description: "Play two or three matching cats to steal from another player."},
+	CardImploding:      {Name: "Imploding Kitten", Effect: EffectKitten, Expansion: ExpansionImploding, Description: "The first draw puts it back face up. The second is the end: it can't be defused."},
+	CardAlterTheFuture: {Name: "Alter the Future", Effect: EffectAction, Expansion: ExpansionImploding, Description: "Look at the top three cards of the deck and put them back in any order."},
+	CardTargetedAttack: {Name: "Targeted Attack", Effect: EffectAction, Expansion: ExpansionImploding, Description: "End your turn without drawing. A player of your choice takes two turns."},
+	CardFeralCat:       {Name: "Feral Cat", Effect: EffectCat, Expansion: ExpansionImploding, Description: "Counts as any cat in a pair or three of a kind."},
+}
+
+// cardCatalog lists every card in the game, named for locale.
+func cardCatalog(locale string) []Card {
+	cards := make([]Card, 0, len(cardTypes))
+	for _, id := range cardTypes {
+		c := cardInfo[id]
+		c.ID = id
+		c.Name = translate(locale, "cards."+id+".name", c.Name)
+		c.Description = translate(locale, "cards."+id+".description", c.Description)
+		c.ArtworkURL = cardArtURL + "/" + id + ".png"
+		cards = append(cards, c)
+	}
+	return cards
+}
+
+func listCards(w http.ResponseWriter, r *http.Request) {
+	locale := localeFor(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", locale)
+	w.Header().Set("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(cardCatalog(locale))
+}
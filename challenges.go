@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	challengesPerDay = 3
+	// challengeProgressTTL keeps a day's progress around a little past the
+	// day itself so late games still land.
+	challengeProgressTTL = 48 * time.Hour
+)
+
+// What a challenge counts.
+const (
+	ChallengeWinGames    = "win_games"
+	ChallengePlayGames   = "play_games"
+	ChallengeDefuse      = "defuse"
+	ChallengePlayCard    = "play_card"
+	ChallengeWinWithCard = "win_with_card"
+)
+
+// Challenge is one of the day's goals. Win-with-card challenges need
+// PerGame of Card played in a single winning game.
+type Challenge struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"`
+	Card        string `json:"card,omitempty"`
+	PerGame     int    `json:"per_game,omitempty"`
+	Target      int    `json:"target"`
+	Reward      int    `json:"reward"`
+}
+
+// ChallengeProgress is how far a player has got with a challenge today.
+type ChallengeProgress struct {
+	Challenge
+	Progress  int  `json:"progress"`
+	Completed bool `json:"completed"`
+}
+
+// challengePool is what each day's challenges are drawn from. The draw is
+// seeded by the date, so every instance agrees on the day's challenges.
+var challengePool = []Challenge{
+	{ID: "win_1", Description: "Win a game", Kind: ChallengeWinGames, Target: 1, Reward: 1},
+	{ID: "win_3", Description: "Win 3 games", Kind: ChallengeWinGames, Target: 3, Reward: 3},
+	{ID: "play_3", Description: "Play 3 games", Kind: ChallengePlayGames, Target: 3, Reward: 1},
+	{ID: "defuse_2", Description: "Defuse 2 Exploding Kittens", Kind: ChallengeDefuse, Target: 2, Reward: 2},
+	{ID: "skip_5", Description: "Play 5 Skips", Kind: ChallengePlayCard, Card: CardSkip, Target: 5, Reward: 1},
+	{ID: "attack_3", Description: "Play 3 Attacks", Kind: ChallengePlayCard, Card: CardAttack, Target: 3, Reward: 1},
+	{ID: "future_3", Description: "See the Future 3 times", Kind: ChallengePlayCard, Card: CardSeeTheFuture, Target: 3, Reward: 1},
+	{ID: "nope_2", Description: "Play 2 Nopes", Kind: ChallengePlayCard, Card: CardNope, Target: 2, Reward: 1},
+	{ID: "win_skips_3", Description: "Win a game using 3 Skips", Kind: ChallengeWinWithCard, Card: CardSkip, PerGame: 3, Target: 1, Reward: 3},
+	{ID: "win_attacks_2", Description: "Win a game using 2 Attacks", Kind: ChallengeWinWithCard, Card: CardAttack, PerGame: 2, Target: 1, Reward: 3},
+	{ID: "win_favors_2", Description: "Win a game using 2 Favors", Kind: ChallengeWinWithCard, Card: CardFavor, PerGame: 2, Target: 1, Reward: 3},
+	{ID: "win_shuffles_2", Description: "Win a game using 2 Shuffles", Kind: ChallengeWinWithCard, Card: CardShuffle, PerGame: 2, Target: 1, Reward: 3},
+}
+
+// challengeDay names the UTC day a time falls on.
+func challengeDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// dailyChallenges picks a day's challenges.
+func dailyChallenges(day string) []Challenge {
+	h := fnv.New64a()
+	h.Write([]byte(day))
+	rng := mrand.New(mrand.NewPCG(h.Sum64(), 0))
+
+	picked := make([]Challenge, 0, challengesPerDay)
+	for _, i := range rng.Perm(len(challengePool))[:challengesPerDay] {
+		picked = append(picked, challengePool[i])
+	}
+	return picked
+}
+
+// challengeProgressKey maps a day's challenge IDs to a player's progress,
+// with a done:<id> field once the reward is paid.
+func challengeProgressKey(day, username string) string {
+	return fmt.Sprintf("challenges:%s:player:%s", day, username)
+}
+
+// contribution is how much a finished game moves a player along a
+// challenge.
+func (c *Challenge) contribution(g *GameState, username string) int {
+	st := g.statsFor(username)
+	won := g.Winner == username
+	switch c.Kind {
+	case ChallengeWinGames:
+		if won {
+			return 1
+		}
+	case ChallengePlayGames:
+		return 1
+	case ChallengeDefuse:
+		return st.Defused
+	case ChallengePlayCard:
+		return st.CardsPlayed[c.Card]
+	case ChallengeWinWithCard:
+		if won && st.CardsPlayed[c.Card] >= c.PerGame {
+			return 1
+		}
+	}
+	return 0
+}
+
+// trackChallenges counts a finished game towards its human players' daily
+// challenges and pays out the ones it completes.
+func trackChallenges(ctx context.Context, g *GameState) {
+	day := challengeDay(time.Now())
+	challenges := dailyChallenges(day)
+	for _, p := range append(append([]string{}, g.Players...), g.Abandoned...) {
+		if g.isBot(p) {
+			continue
+		}
+		key := challengeProgressKey(day, p)
+		for _, c := range challenges {
+			n := c.contribution(g, p)
+			if n == 0 {
+				continue
+			}
+			progress, err := rdb.HIncrBy(ctx, key, c.ID, int64(n)).Result()
+			if err != nil {
+				slog.Error("tracking challenge", "username", p, "challenge", c.ID, "err", err)
+				continue
+			}
+			rdb.Expire(ctx, key, challengeProgressTTL)
+			if progress < int64(c.Target) {
+				continue
+			}
+			// done:<id> makes sure each challenge pays out once.
+			first, err := rdb.HSetNX(ctx, key, "done:"+c.ID, 1).Result()
+			if err != nil || !first {
+				continue
+			}
+			if err := awardScore(ctx, p, c.Reward, "challenge", day+"/"+c.ID); err != nil {
+				slog.Error("rewarding challenge", "username", p, "challenge", c.ID, "err", err)
+			}
+			if err := awardCoins(ctx, p, c.Reward*coinsPerChallengePoint); err != nil {
+				slog.Error("rewarding challenge", "username", p, "challenge", c.ID, "err", err)
+			}
+			hub.notifyUser(ctx, p, EventChallengeDone, ChallengeProgress{Challenge: c, Progress: c.Target, Completed: true})
+		}
+	}
+}
+
+func getTodaysChallenges(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	day := challengeDay(now)
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"date":       day,
+		"expires_at": tomorrow,
+		"challenges": dailyChallenges(day),
+	})
+}
+
+// getChallengeProgress shows the caller's progress on today's challenges.
+func getChallengeProgress(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	day := challengeDay(time.Now())
+
+	fields, err := rdb.HGetAll(ctx, challengeProgressKey(day, currentUser(r))).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading challenges")
+		return
+	}
+	progress := []ChallengeProgress{}
+	for _, c := range dailyChallenges(day) {
+		n, _ := strconv.Atoi(fields[c.ID])
+		if n > c.Target {
+			n = c.Target
+		}
+		progress = append(progress, ChallengeProgress{
+			Challenge: c,
+			Progress:  n,
+			Completed: fields["done:"+c.ID] != "",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"date":       day,
+		"challenges": progress,
+	})
+}
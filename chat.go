@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// chatHistorySize is how many recent messages a room keeps for players
+	// who join or reconnect late.
+	chatHistorySize = 50
+	maxChatLength   = 280
+)
+
+var (
+	errChatUnavailable = errors.New("chat is only available inside a room")
+	errChatDisabled    = errors.New("chat is turned off")
+	errChatReadOnly    = errors.New("spectators cannot chat")
+	errChatEmpty       = errors.New("message is empty")
+	errChatTooLong     = fmt.Errorf("message is longer than %d characters", maxChatLength)
+	errChatFlood       = errors.New("sending messages too quickly")
+)
+
+type ChatMessage struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Text     string    `json:"text"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+func chatKey(room string) string {
+	return fmt.Sprintf("room:%s:chat", room)
+}
+
+// chat posts a message to everyone in the client's room and keeps it in
+// the room's recent history.
+func (c *Client) chat(ctx context.Context, text string) error {
+	if c.room == lobbyRoom {
+		return errChatUnavailable
+	}
+	if c.spectator {
+		return errChatReadOnly
+	}
+	if !featureOn(FlagChat, c.username) {
+		return errChatDisabled
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errChatEmpty
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return errChatTooLong
+	}
+
+	allowed, _, err := chatLimit.take(ctx, "user:"+c.username)
+	if err != nil {
+		// As with requests, a Redis hiccup lets messages through.
+		slog.Error("checking rate limit", "bucket", chatLimit.Name, "err", err)
+	} else if !allowed {
+		return errChatFlood
+	}
+
+	msg := ChatMessage{
+		ID:       newID(),
+		Username: c.username,
+		Text:     censor(text),
+		SentAt:   time.Now().UTC(),
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := chatKey(c.room)
+	pipe := rdb.TxPipeline()
+	pipe.RPush(ctx, key, data)
+	pipe.LTrim(ctx, key, -chatHistorySize, -1)
+	pipe.Expire(ctx, key, idleGameTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	hub.broadcast(ctx, c.room, EventChatMessage, msg)
+	return nil
+}
+
+// getChatHistory returns a room's recent messages, oldest first. A private
+// room's chat is only shown to the people in it.
+func getChatHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	id := mux.Vars(r)["id"]
+
+	room, err := loadRoom(ctx, id)
+	if err != nil && err != errRoomNotFound {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+	if err == nil && room.Private && !room.hasPlayer(username) && !room.hasSpectator(username) {
+		respondError(w, r, http.StatusForbidden, errRoomPrivate)
+		return
+	}
+
+	raw, err := rdb.LRange(ctx, chatKey(id), 0, -1).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading chat")
+		return
+	}
+	messages := []ChatMessage{}
+	for _, item := range raw {
+		var msg ChatMessage
+		if json.Unmarshal([]byte(item), &msg) == nil {
+			messages = append(messages, msg)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Combos are sets of cards played together to steal from another player.
+// A pending combo carries its kind in place of a card.
+const (
+	// ComboPair takes a random card from the target.
+	ComboPair = "two_of_a_kind"
+	// ComboTriple takes the named card from the target, if they have it.
+	ComboTriple = "three_of_a_kind"
+	// ComboFive takes the named card from the discard pile.
+	ComboFive = "five_different"
+)
+
+var (
+	errBadCombo     = errors.New("cards do not make a combo")
+	errBadNamedCard = errors.New("name a card to ask for")
+	errNotDiscarded = errors.New("card is not in the discard pile")
+)
+
+type ComboRequest struct {
+	Cards  []string `json:"cards"`
+	Target string   `json:"target"`
+	Named  string   `json:"named"`
+}
+
+// comboKind works out which combo a set of cards makes. Pairs and triples
+// are matching cat cards, any of which may be a Feral Cat; five different
+// cards can be anything.
+func comboKind(cards []string) (string, bool) {
+	switch len(cards) {
+	case 2, 3:
+		match := ""
+		for _, c := range cards {
+			if !isCat(c) {
+				return "", false
+			}
+			if c == CardFeralCat {
+				continue
+			}
+			if match != "" && c != match {
+				return "", false
+			}
+			match = c
+		}
+		if len(cards) == 2 {
+			return ComboPair, true
+		}
+		return ComboTriple, true
+	case 5:
+		seen := map[string]bool{}
+		for _, c := range cards {
+			if seen[c] {
+				return "", false
+			}
+			seen[c] = true
+		}
+		return ComboFive, true
+	}
+	return "", false
+}
+
+// removeCards takes all of cards from a player's hand, or none of them if
+// the hand is missing any.
+func (g *GameState) removeCards(username string, cards []string) bool {
+	hand := append([]string{}, g.Hands[username]...)
+	for _, card := range cards {
+		found := false
+		for i, c := range hand {
+			if c == card {
+				hand = append(hand[:i], hand[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	g.Hands[username] = hand
+	return true
+}
+
+// discard puts played cards on the discard pile.
+func (g *GameState) discard(cards ...string) {
+	g.Discard = append(g.Discard, cards...)
+}
+
+func (g *GameState) inDiscard(card string) bool {
+	for _, c := range g.Discard {
+		if c == card {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GameState) takeFromDiscard(card string) bool {
+	for i, c := range g.Discard {
+		if c == card {
+			g.Discard = append(g.Discard[:i:i], g.Discard[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// playCombo plays a combo from the current player's hand. Like an action
+// card it can be noped, and applyAction carries it out once its window
+// closes.
+func (g *GameState) playCombo(username string, cards []string, target, named string, now time.Time) (*PlayResult, error) {
+	if err := g.requireTurn(username); err != nil {
+		return nil, err
+	}
+	if err := g.requireIdle(); err != nil {
+		return nil, err
+	}
+
+	kind, ok := comboKind(cards)
+	if !ok {
+		return nil, errBadCombo
+	}
+	switch kind {
+	case ComboPair:
+		named = ""
+	case ComboTriple:
+		if !knownCard(named) {
+			return nil, errBadNamedCard
+		}
+	case ComboFive:
+		target = ""
+		if !knownCard(named) {
+			return nil, errBadNamedCard
+		}
+		if !g.inDiscard(named) {
+			return nil, errNotDiscarded
+		}
+	}
+	if kind != ComboFive && (target == username || !g.hasPlayer(target) || g.isEliminated(target)) {
+		return nil, errInvalidTarget
+	}
+	if !g.removeCards(username, cards) {
+		return nil, errCardNotInHand
+	}
+	g.countPlay(username, kind)
+	g.discard(cards...)
+	g.logAction(LogEntry{Type: EventCardPlayed, Player: username, Card: kind, Cards: cards, Target: target, Named: named})
+
+	g.Pending = &PendingAction{
+		ID:       newID(),
+		Player:   username,
+		Card:     kind,
+		Cards:    append([]string{}, cards...),
+		Target:   target,
+		Named:    named,
+		Nopes:    []string{},
+		Deadline: now.Add(g.nopeWindow()),
+	}
+
+	return &PlayResult{
+		Card:   kind,
+		Cards:  g.Pending.Cards,
+		Target: target,
+		Named:  named,
+		Hand:   g.Hands[username],
+	}, nil
+}
+
+// applyCombo carries out a combo that survived its Nope window.
+func (g *GameState) applyCombo(p *PendingAction, res *Resolution) {
+	switch p.Card {
+	case ComboPair:
+		res.Received = g.takeRandomCard(p.Target, p.Player)
+	case ComboTriple:
+		if g.removeCard(p.Target, p.Named) {
+			g.Hands[p.Player] = append(g.Hands[p.Player], p.Named)
+			res.Received = p.Named
+		}
+	case ComboFive:
+		if g.takeFromDiscard(p.Named) {
+			g.Hands[p.Player] = append(g.Hands[p.Player], p.Named)
+			res.Received = p.Named
+		}
+	}
+}
+
+// comboCards finds a pair of cats a bot could play, Feral Cats included.
+func (g *GameState) comboCards(bot string) []string {
+	cats := map[string]int{}
+	for _, c := range g.Hands[bot] {
+		if isCat(c) {
+			cats[c]++
+		}
+	}
+	feral := cats[CardFeralCat]
+	for _, c := range catCards {
+		if c == CardFeralCat {
+			continue
+		}
+		if cats[c] >= 2 {
+			return []string{c, c}
+		}
+		if cats[c] == 1 && feral > 0 {
+			return []string{c, CardFeralCat}
+		}
+	}
+	if feral >= 2 {
+		return []string{CardFeralCat, CardFeralCat}
+	}
+	return nil
+}
+
+func playCombo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req ComboRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+
+	var (
+		settled *Resolution
+		result  *PlayResult
+	)
+	g, err := moveGame(w, r, func(g *GameState) (err error) {
+		now := time.Now()
+		settled = g.settle(now)
+		result, err = g.playCombo(username, req.Cards, req.Target, req.Named, now)
+		return err
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	result.State = g.turnView()
+	publishResolution(ctx, g, settled)
+	publishPlay(ctx, g, username, result)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
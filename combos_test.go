@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComboKind(t *testing.T) {
+	tests := []struct {
+		name  string
+		cards []string
+		kind  string
+		ok    bool
+	}{
+		{"pair", []string{CardTacoCat, CardTacoCat}, ComboPair, true},
+		{"pair with a feral cat", []string{CardTacoCat, CardFeralCat}, ComboPair, true},
+		{"mismatched pair", []string{CardTacoCat, CardBeardCat}, "", false},
+		{"pair of action cards", []string{CardSkip, CardSkip}, "", false},
+		{"triple", []string{CardBeardCat, CardFeralCat, CardBeardCat}, ComboTriple, true},
+		{"five different", []string{CardSkip, CardAttack, CardFavor, CardShuffle, CardTacoCat}, ComboFive, true},
+		{"five with a repeat", []string{CardSkip, CardSkip, CardFavor, CardShuffle, CardTacoCat}, "", false},
+		{"four cards", []string{CardTacoCat, CardTacoCat, CardTacoCat, CardTacoCat}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, ok := comboKind(tt.cards)
+			if kind != tt.kind || ok != tt.ok {
+				t.Errorf("got %q, %v, want %q, %v", kind, ok, tt.kind, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPlayCombo(t *testing.T) {
+	tests := []struct {
+		name     string
+		cards    []string
+		target   string
+		named    string
+		received string
+	}{
+		{"pair takes a random card", []string{CardTacoCat, CardTacoCat}, "bob", "", CardDefuse},
+		{"triple takes the named card", []string{CardBeardCat, CardBeardCat, CardFeralCat}, "bob", CardDefuse, CardDefuse},
+		{"triple misses a card not held", []string{CardBeardCat, CardBeardCat, CardFeralCat}, "bob", CardNope, ""},
+		{"five takes from the discard pile", []string{CardTacoCat, CardBeardCat, CardFeralCat, CardSkip, CardFavor}, "", CardAttack, CardAttack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame(nil, "alice", "bob")
+			g.Hands["alice"] = []string{CardTacoCat, CardTacoCat, CardBeardCat, CardBeardCat, CardFeralCat, CardSkip, CardFavor}
+			g.Hands["bob"] = []string{CardDefuse}
+			g.Discard = []string{CardAttack}
+			now := time.Now()
+			if _, err := g.playCombo("alice", tt.cards, tt.target, tt.named, now); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(g.Hands["alice"]); got != 7-len(tt.cards) {
+				t.Errorf("alice holds %d cards after playing, want %d", got, 7-len(tt.cards))
+			}
+			res := g.settle(now.Add(nopeWindow))
+			if res == nil {
+				t.Fatal("combo did not resolve")
+			}
+			if res.Received != tt.received {
+				t.Errorf("received %q, want %q", res.Received, tt.received)
+			}
+			if tt.received != "" && !g.hasCard("alice", tt.received) {
+				t.Errorf("alice does not hold %s", tt.received)
+			}
+			if g.currentPlayer() != "alice" {
+				t.Errorf("current player is %s, want alice", g.currentPlayer())
+			}
+		})
+	}
+}
+
+func TestPlayComboRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		cards  []string
+		target string
+		named  string
+		want   error
+	}{
+		{"out of turn", "bob", []string{CardTacoCat, CardTacoCat}, "alice", "", errNotYourTurn},
+		{"not a combo", "alice", []string{CardTacoCat, CardBeardCat}, "bob", "", errBadCombo},
+		{"cards not held", "alice", []string{CardBeardCat, CardBeardCat}, "bob", "", errCardNotInHand},
+		{"steal from yourself", "alice", []string{CardTacoCat, CardTacoCat}, "alice", "", errInvalidTarget},
+		{"triple without a name", "alice", []string{CardTacoCat, CardTacoCat, CardFeralCat}, "bob", "", errBadNamedCard},
+		{"five for a card not discarded", "alice", []string{CardTacoCat, CardFeralCat, CardSkip, CardFavor, CardNope}, "", CardDefuse, errNotDiscarded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardTacoCat, CardTacoCat, CardFeralCat, CardSkip, CardFavor, CardNope}, "alice", "bob")
+			if _, err := g.playCombo(tt.player, tt.cards, tt.target, tt.named, time.Now()); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
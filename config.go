@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Config is every setting the server reads at startup. Each comes from an
+// environment variable, or a .env file, and a command-line flag named
+// after it overrides it: -port for PORT, -redis-addrs for REDIS_ADDRS.
+type Config struct {
+	// Env is APP_ENV: production, the default, or development.
+	Env         string
+	Port        string
+	GRPCPort    string
+	Storage     string
+	DatabaseURL string
+	Redis       RedisConfig
+
+	JWTSecret  string
+	AdminToken string
+	CORS       CORSConfig
+	HTTPS      HTTPSConfig
+	HSTSMaxAge time.Duration
+	TrustProxy bool
+	ProxyHops  int
+	LogLevel   slog.Level
+	// LoginThrottle is how failed sign-ins are locked out.
+	LoginThrottle LoginThrottleConfig
+	OAuth         OAuthConfig
+	Mail          MailConfig
+	Push          PushConfig
+	Clients       ClientConfig
+	Telemetry     TelemetryConfig
+	// EmailLinkURL is the web client's address, for links in emails.
+	EmailLinkURL string
+	// MaxBodyBytes caps request bodies.
+	MaxBodyBytes int
+
+	ReconnectGrace      time.Duration
+	SavedGameTTL        time.Duration
+	JanitorInterval     time.Duration
+	IdleGameTTL         time.Duration
+	QueueTimeout        time.Duration
+	TurnTimeout         time.Duration
+	MaxTimeouts         int
+	FavorTimeout        time.Duration
+	LeaderboardCacheTTL time.Duration
+	MinRankedLevel      int
+	SeasonSchedule      string
+	JobWorkers          int
+
+	ProfanityFilter bool
+	ProfanityWords  []string
+	StreakBonuses   []StreakBonus
+	CardArtURL      string
+	DefaultLocale   string
+	LocalesDir      string
+}
+
+// RedisConfig is how to reach Redis; see newRedisClient.
+type RedisConfig struct {
+	Mode             string
+	Addrs            []string
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	TLS              bool
+	CACert           string
+	ClientCert       string
+	ClientKey        string
+
+	Timeout          time.Duration
+	MaxRetries       int
+	RetryBackoff     time.Duration
+	MaxRetryBackoff  time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// ConfigError lists every problem with the configuration, so they can all
+// be fixed in one go.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// LogValue logs the problems as a list.
+func (e ConfigError) LogValue() slog.Value {
+	return slog.AnyValue([]string(e))
+}
+
+// loadConfig reads the configuration from the environment and args, and
+// checks it.
+func loadConfig(args []string) (*Config, error) {
+	l, err := newConfigLoader(args)
+	if err != nil {
+		return nil, ConfigError{err.Error()}
+	}
+
+	cfg := &Config{
+		Env:         l.str("APP_ENV", EnvProduction),
+		Port:        l.str("PORT", "8080"),
+		GRPCPort:    l.str("GRPC_PORT", ""),
+		Storage:     l.str("STORAGE", "redis"),
+		DatabaseURL: l.str("DATABASE_URL", ""),
+		Redis: RedisConfig{
+			Mode:             l.str("REDIS_MODE", RedisStandalone),
+			Addrs:            l.list("REDIS_ADDRS"),
+			MasterName:       l.str("REDIS_MASTER_NAME", ""),
+			Username:         l.str("REDIS_USERNAME", ""),
+			Password:         l.str("PASSWORD", ""),
+			SentinelPassword: l.str("SENTINEL_PASSWORD", ""),
+			DB:               l.integer("REDIS_DB", 0, 0),
+			TLS:              l.boolean("REDIS_TLS", false),
+			CACert:           l.str("REDIS_CA_CERT", ""),
+			ClientCert:       l.str("REDIS_CLIENT_CERT", ""),
+			ClientKey:        l.str("REDIS_CLIENT_KEY", ""),
+			Timeout:          l.duration("REDIS_TIMEOUT", defaultRedisTimeout),
+			MaxRetries:       l.integer("REDIS_MAX_RETRIES", defaultRedisRetries, 0),
+			RetryBackoff:     l.duration("REDIS_RETRY_BACKOFF", defaultRetryBackoff),
+			MaxRetryBackoff:  l.duration("REDIS_MAX_RETRY_BACKOFF", defaultMaxRetryBackoff),
+			BreakerThreshold: l.integer("REDIS_BREAKER_THRESHOLD", defaultBreakerThreshold, 1),
+			BreakerCooldown:  l.duration("REDIS_BREAKER_COOLDOWN", defaultBreakerCooldown),
+		},
+
+		JWTSecret:  l.str("JWT_SECRET", ""),
+		AdminToken: l.str("ADMIN_TOKEN", ""),
+		CORS: CORSConfig{
+			Origins: l.list("ALLOWED_ORIGINS"),
+			Methods: l.list("CORS_ALLOWED_METHODS"),
+			Headers: l.list("CORS_ALLOWED_HEADERS"),
+			MaxAge:  l.duration("CORS_MAX_AGE", defaultCORSMaxAge),
+		},
+		HTTPS: HTTPSConfig{
+			CertFile: l.str("TLS_CERT_FILE", ""),
+			KeyFile:  l.str("TLS_KEY_FILE", ""),
+			Domains:  l.list("AUTOCERT_DOMAINS"),
+			CacheDir: l.str("AUTOCERT_CACHE_DIR", "autocert-cache"),
+			Email:    l.str("AUTOCERT_EMAIL", ""),
+			HTTPPort: l.str("HTTP_PORT", "80"),
+		},
+		HSTSMaxAge: l.duration("HSTS_MAX_AGE", defaultHSTSMaxAge),
+		TrustProxy: l.boolean("TRUST_PROXY", false),
+		ProxyHops:  l.integer("TRUSTED_PROXY_HOPS", 1, 1),
+		OAuth: OAuthConfig{
+			PublicURL:          strings.TrimSuffix(l.str("PUBLIC_URL", ""), "/"),
+			SuccessURL:         l.str("OAUTH_SUCCESS_URL", ""),
+			GoogleClientID:     l.str("GOOGLE_CLIENT_ID", ""),
+			GoogleClientSecret: l.str("GOOGLE_CLIENT_SECRET", ""),
+			GitHubClientID:     l.str("GITHUB_CLIENT_ID", ""),
+			GitHubClientSecret: l.str("GITHUB_CLIENT_SECRET", ""),
+		},
+		Mail: MailConfig{
+			Mailer:         l.str("MAILER", MailerLog),
+			From:           l.str("MAIL_FROM", ""),
+			SMTPHost:       l.str("SMTP_HOST", ""),
+			SMTPPort:       l.integer("SMTP_PORT", 587, 1),
+			SMTPUsername:   l.str("SMTP_USERNAME", ""),
+			SMTPPassword:   l.str("SMTP_PASSWORD", ""),
+			SendGridAPIKey: l.str("SENDGRID_API_KEY", ""),
+		},
+		Push: PushConfig{
+			FCMCredentials: l.str("FCM_CREDENTIALS", ""),
+			APNsKeyFile:    l.str("APNS_KEY_FILE", ""),
+			APNsKeyID:      l.str("APNS_KEY_ID", ""),
+			APNsTeamID:     l.str("APNS_TEAM_ID", ""),
+			APNsTopic:      l.str("APNS_TOPIC", ""),
+			APNsSandbox:    l.boolean("APNS_SANDBOX", false),
+		},
+		Clients: ClientConfig{
+			MinVersion:         l.str("MIN_CLIENT_VERSION", ""),
+			RecommendedVersion: l.str("RECOMMENDED_CLIENT_VERSION", ""),
+			UpdateURL:          l.str("CLIENT_UPDATE_URL", ""),
+		},
+		Telemetry: TelemetryConfig{
+			Sink:       l.str("TELEMETRY_SINK", TelemetryRedis),
+			URL:        l.str("TELEMETRY_URL", ""),
+			SampleRate: l.fraction("TELEMETRY_SAMPLE_RATE", 1),
+		},
+		EmailLinkURL: strings.TrimSuffix(l.str("EMAIL_LINK_URL", ""), "/"),
+		LoginThrottle: LoginThrottleConfig{
+			Window:           l.duration("LOGIN_FAILURE_WINDOW", loginThrottle.Window),
+			UserLimit:        l.integer("LOGIN_LOCKOUT_THRESHOLD", loginThrottle.UserLimit, 1),
+			IPLimit:          l.integer("LOGIN_IP_LOCKOUT_THRESHOLD", loginThrottle.IPLimit, 1),
+			Lockout:          l.duration("LOGIN_LOCKOUT", loginThrottle.Lockout),
+			MaxLockout:       l.duration("LOGIN_MAX_LOCKOUT", loginThrottle.MaxLockout),
+			CaptchaAfter:     l.integer("LOGIN_CAPTCHA_AFTER", loginThrottle.CaptchaAfter, 0),
+			CaptchaSecret:    l.str("CAPTCHA_SECRET", ""),
+			CaptchaVerifyURL: l.str("CAPTCHA_VERIFY_URL", defaultCaptchaVerifyURL),
+		},
+		MaxBodyBytes: l.integer("MAX_BODY_BYTES", defaultMaxBodyBytes, 1),
+
+		ReconnectGrace:      l.duration("RECONNECT_GRACE", defaultReconnectGrace),
+		SavedGameTTL:        l.duration("SAVED_GAME_TTL", defaultSavedGameTTL),
+		JanitorInterval:     l.duration("JANITOR_INTERVAL", defaultJanitorInterval),
+		IdleGameTTL:         l.duration("GAME_IDLE_TTL", defaultIdleGameTTL),
+		QueueTimeout:        l.duration("MATCHMAKING_TIMEOUT", defaultQueueTimeout),
+		TurnTimeout:         l.duration("TURN_TIMEOUT", defaultTurnTimeout),
+		MaxTimeouts:         l.integer("TURN_TIMEOUT_LIMIT", defaultMaxTimeouts, 1),
+		FavorTimeout:        l.duration("FAVOR_TIMEOUT", defaultFavorTimeout),
+		LeaderboardCacheTTL: l.duration("LEADERBOARD_CACHE_TTL", defaultLeaderboardCacheTTL),
+		MinRankedLevel:      l.integer("MIN_RANKED_LEVEL", defaultMinRankedLevel, 1),
+		SeasonSchedule:      l.str("SEASON_SCHEDULE", defaultSeasonSchedule),
+		JobWorkers:          l.integer("JOB_WORKERS", defaultJobWorkers, 1),
+
+		ProfanityFilter: l.boolean("PROFANITY_FILTER", true),
+		ProfanityWords:  l.list("PROFANITY_WORDS"),
+		CardArtURL:      strings.TrimSuffix(l.str("CARD_ART_URL", defaultCardArtURL), "/"),
+		DefaultLocale:   strings.ToLower(l.str("DEFAULT_LOCALE", "en")),
+		LocalesDir:      l.str("LOCALES_DIR", ""),
+	}
+	if len(cfg.Redis.Addrs) == 0 {
+		if addr := l.str("ADDRESS", ""); addr != "" {
+			cfg.Redis.Addrs = []string{addr}
+		}
+	}
+	if len(cfg.CORS.Origins) == 0 && cfg.Env == EnvDevelopment {
+		cfg.CORS.Origins = []string{"*"}
+	}
+	if len(cfg.CORS.Methods) == 0 {
+		cfg.CORS.Methods = defaultCORSMethods
+	}
+	if len(cfg.CORS.Headers) == 0 {
+		cfg.CORS.Headers = defaultCORSHeaders
+	}
+
+	if v := l.str("LOG_LEVEL", "info"); cfg.LogLevel.UnmarshalText([]byte(v)) != nil {
+		l.problem("LOG_LEVEL must be debug, info, warn or error, not %q", v)
+	}
+	if bonuses, err := parseStreakBonuses(l.str("STREAK_BONUSES", "")); err != nil {
+		l.problem("STREAK_BONUSES: %v", err)
+	} else {
+		cfg.StreakBonuses = bonuses
+	}
+
+	cfg.validate(l)
+	return cfg, l.err()
+}
+
+// validate checks settings against each other and that required ones are
+// there.
+func (cfg *Config) validate(l *configLoader) {
+	if cfg.Env != EnvProduction && cfg.Env != EnvDevelopment {
+		l.problem("APP_ENV must be production or development, not %q", cfg.Env)
+	}
+	if n, err := strconv.Atoi(cfg.Port); err != nil || n < 1 || n > 65535 {
+		l.problem("PORT must be a port number, not %q", cfg.Port)
+	}
+	if cfg.JWTSecret == "" && cfg.Env == EnvProduction {
+		l.problem("JWT_SECRET is required with APP_ENV=production")
+	}
+	if cfg.GRPCPort != "" {
+		if n, err := strconv.Atoi(cfg.GRPCPort); err != nil || n < 1 || n > 65535 {
+			l.problem("GRPC_PORT must be a port number, not %q", cfg.GRPCPort)
+		} else if cfg.GRPCPort == cfg.Port {
+			l.problem("GRPC_PORT must differ from PORT")
+		}
+	}
+
+	switch cfg.Storage {
+	case "redis", "memory":
+	case "postgres":
+		if cfg.DatabaseURL == "" {
+			l.problem("DATABASE_URL is required with STORAGE=postgres")
+		}
+	default:
+		l.problem("STORAGE must be redis, postgres or memory, not %q", cfg.Storage)
+	}
+
+	rc := cfg.Redis
+	if cfg.Storage != "memory" && len(rc.Addrs) == 0 {
+		l.problem("ADDRESS or REDIS_ADDRS is required unless STORAGE=memory")
+	}
+	switch rc.Mode {
+	case RedisStandalone:
+		if len(rc.Addrs) > 1 {
+			l.problem("REDIS_ADDRS lists more than one server; set REDIS_MODE=sentinel")
+		}
+	case RedisSentinel:
+		if rc.MasterName == "" {
+			l.problem("REDIS_MASTER_NAME is required with REDIS_MODE=sentinel")
+		}
+	case RedisCluster:
+		l.problem("REDIS_MODE=cluster is not supported")
+	default:
+		l.problem("REDIS_MODE must be standalone or sentinel, not %q", rc.Mode)
+	}
+	if (rc.ClientCert == "") != (rc.ClientKey == "") {
+		l.problem("REDIS_CLIENT_CERT and REDIS_CLIENT_KEY must be set together")
+	}
+	if !rc.TLS && (rc.CACert != "" || rc.ClientCert != "") {
+		l.problem("REDIS_CA_CERT and REDIS_CLIENT_CERT need REDIS_TLS=true")
+	}
+	if rc.RetryBackoff > rc.MaxRetryBackoff {
+		l.problem("REDIS_RETRY_BACKOFF must not exceed REDIS_MAX_RETRY_BACKOFF")
+	}
+
+	hc := cfg.HTTPS
+	if (hc.CertFile == "") != (hc.KeyFile == "") {
+		l.problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if hc.CertFile != "" && len(hc.Domains) > 0 {
+		l.problem("set either TLS_CERT_FILE or AUTOCERT_DOMAINS, not both")
+	}
+	if len(hc.Domains) > 0 {
+		if n, err := strconv.Atoi(hc.HTTPPort); err != nil || n < 1 || n > 65535 {
+			l.problem("HTTP_PORT must be a port number, not %q", hc.HTTPPort)
+		} else if hc.HTTPPort == cfg.Port {
+			l.problem("HTTP_PORT must differ from PORT with AUTOCERT_DOMAINS")
+		}
+	}
+
+	oc := cfg.OAuth
+	if (oc.GoogleClientID == "") != (oc.GoogleClientSecret == "") {
+		l.problem("GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET must be set together")
+	}
+	if (oc.GitHubClientID == "") != (oc.GitHubClientSecret == "") {
+		l.problem("GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET must be set together")
+	}
+	if oc.GoogleClientID != "" || oc.GitHubClientID != "" {
+		if u, err := url.Parse(oc.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problem("PUBLIC_URL must be this server's URL, such as https://api.example.com, to sign in with a provider")
+		}
+	}
+	if oc.SuccessURL != "" {
+		if u, err := url.Parse(oc.SuccessURL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problem("OAUTH_SUCCESS_URL must be a URL, not %q", oc.SuccessURL)
+		}
+	}
+
+	mc := cfg.Mail
+	switch mc.Mailer {
+	case MailerLog:
+	case MailerSMTP:
+		if mc.SMTPHost == "" {
+			l.problem("SMTP_HOST is required with MAILER=smtp")
+		}
+	case MailerSendGrid:
+		if mc.SendGridAPIKey == "" {
+			l.problem("SENDGRID_API_KEY is required with MAILER=sendgrid")
+		}
+	default:
+		l.problem("MAILER must be log, smtp or sendgrid, not %q", mc.Mailer)
+	}
+	if mc.Mailer != MailerLog {
+		if _, err := mail.ParseAddress(mc.From); err != nil {
+			l.problem("MAIL_FROM must be an email address to send mail from")
+		}
+	}
+	pc := cfg.Push
+	if pc.APNsKeyFile != "" && (pc.APNsKeyID == "" || pc.APNsTeamID == "" || pc.APNsTopic == "") {
+		l.problem("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC are required with APNS_KEY_FILE")
+	}
+	tc := cfg.Telemetry
+	switch tc.Sink {
+	case TelemetryRedis, TelemetryStdout, TelemetryOff:
+	case TelemetryHTTP:
+		if u, err := url.Parse(tc.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problem("TELEMETRY_URL must be a URL with TELEMETRY_SINK=http, not %q", tc.URL)
+		}
+	default:
+		l.problem("TELEMETRY_SINK must be redis, stdout, http or off, not %q", tc.Sink)
+	}
+	cc := cfg.Clients
+	minVersion, minOK := parseClientVersion(cc.MinVersion)
+	if cc.MinVersion != "" && !minOK {
+		l.problem("MIN_CLIENT_VERSION must be a version like 1.4.2, not %q", cc.MinVersion)
+	}
+	recommended, recommendedOK := parseClientVersion(cc.RecommendedVersion)
+	if cc.RecommendedVersion != "" && !recommendedOK {
+		l.problem("RECOMMENDED_CLIENT_VERSION must be a version like 1.4.2, not %q", cc.RecommendedVersion)
+	}
+	if minOK && recommendedOK && recommended.less(minVersion) {
+		l.problem("RECOMMENDED_CLIENT_VERSION must not be older than MIN_CLIENT_VERSION")
+	}
+	if cc.UpdateURL != "" {
+		if u, err := url.Parse(cc.UpdateURL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problem("CLIENT_UPDATE_URL must be a URL, not %q", cc.UpdateURL)
+		}
+	}
+	if cfg.EmailLinkURL != "" {
+		if u, err := url.Parse(cfg.EmailLinkURL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problem("EMAIL_LINK_URL must be a URL, not %q", cfg.EmailLinkURL)
+		}
+	}
+
+	lt := cfg.LoginThrottle
+	if lt.Lockout > lt.MaxLockout {
+		l.problem("LOGIN_LOCKOUT must not exceed LOGIN_MAX_LOCKOUT")
+	}
+	if lt.CaptchaSecret != "" {
+		if u, err := url.Parse(lt.CaptchaVerifyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.problem("CAPTCHA_VERIFY_URL must be a URL, not %q", lt.CaptchaVerifyURL)
+		}
+	}
+
+	for _, origin := range cfg.CORS.Origins {
+		if origin == "*" {
+			if cfg.Env != EnvDevelopment {
+				l.problem("ALLOWED_ORIGINS may only be * with APP_ENV=development")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			l.problem("ALLOWED_ORIGINS entry %q is not an origin such as https://example.com", origin)
+		}
+	}
+	if _, err := cron.ParseStandard(cfg.SeasonSchedule); err != nil {
+		l.problem("SEASON_SCHEDULE: %v", err)
+	}
+}
+
+// configLoader reads settings from flags, then the environment, noting
+// every problem it finds rather than stopping at the first.
+type configLoader struct {
+	flags    map[string]string
+	used     map[string]bool
+	problems ConfigError
+}
+
+// newConfigLoader takes flags of the form -name=value or -name value,
+// with one or two dashes.
+func newConfigLoader(args []string) (*configLoader, error) {
+	l := &configLoader{flags: map[string]string{}, used: map[string]bool{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := strings.TrimLeft(arg, "-")
+		if name == arg || name == "" {
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		name, value, ok := strings.Cut(name, "=")
+		if !ok {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		l.flags[name] = value
+	}
+	return l, nil
+}
+
+func (l *configLoader) problem(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+// lookup finds a setting by its environment variable name.
+func (l *configLoader) lookup(name string) string {
+	flag := strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	l.used[flag] = true
+	if v, ok := l.flags[flag]; ok {
+		return strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(os.Getenv(name))
+}
+
+func (l *configLoader) str(name, def string) string {
+	if v := l.lookup(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// list reads a comma-separated list, leaving out empty entries.
+func (l *configLoader) list(name string) []string {
+	items := []string{}
+	for _, item := range strings.Split(l.lookup(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *configLoader) boolean(name string, def bool) bool {
+	v := l.lookup(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.problem("%s must be true or false, not %q", name, v)
+	}
+	return b
+}
+
+// integer reads a whole number of at least min.
+func (l *configLoader) integer(name string, def, min int) int {
+	v := l.lookup(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		l.problem("%s must be a whole number of at least %d, not %q", name, min, v)
+		return def
+	}
+	return n
+}
+
+// fraction reads a number from 0 to 1.
+func (l *configLoader) fraction(name string, def float64) float64 {
+	v := l.lookup(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		l.problem("%s must be a number from 0 to 1, not %q", name, v)
+		return def
+	}
+	return f
+}
+
+// duration reads a positive duration such as "90s".
+func (l *configLoader) duration(name string, def time.Duration) time.Duration {
+	v := l.lookup(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		l.problem("%s must be a positive duration such as 30s, not %q", name, v)
+		return def
+	}
+	return d
+}
+
+// err reports the problems found, flags nobody asked for included.
+func (l *configLoader) err() error {
+	unknown := []string{}
+	for flag := range l.flags {
+		if !l.used[flag] {
+			unknown = append(unknown, flag)
+		}
+	}
+	sort.Strings(unknown)
+	for _, flag := range unknown {
+		l.problem("unknown flag -%s", flag)
+	}
+	if len(l.problems) == 0 {
+		return nil
+	}
+	return l.problems
+}
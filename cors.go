@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/cors"
+)
+
+// Deployment environments APP_ENV can name.
+const (
+	EnvProduction  = "production"
+	EnvDevelopment = "development"
+)
+
+const defaultCORSMaxAge = 10 * time.Minute
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{
+		"Content-Type", "Authorization", "X-Request-ID", "Idempotency-Key",
+		"If-Match", "If-None-Match", "traceparent", "tracestate", "X-Client-Version",
+	}
+)
+
+// corsExposedHeaders are the response headers browsers let clients read.
+var corsExposedHeaders = []string{
+	"X-Request-ID", "X-Total-Count", "X-Unread-Count", "ETag",
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After",
+	"Deprecation", "Sunset", "Link", "Idempotent-Replayed",
+}
+
+// CORSConfig is which browser origins may call the API and how. Origins
+// is ALLOWED_ORIGINS, and empty allows none but the server's own. "*"
+// allows any origin and is only accepted in development, where it is the
+// default.
+type CORSConfig struct {
+	Origins []string
+	Methods []string
+	Headers []string
+	MaxAge  time.Duration
+}
+
+func (c CORSConfig) anyOrigin() bool {
+	for _, o := range c.Origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// newCORS builds the CORS middleware. Requests carry credentials, and
+// browsers refuse a literal "*" for those, so any origin is allowed by
+// echoing it back instead. rs/cors reads no origins as any, so that case
+// gets a func refusing them all.
+func newCORS(c CORSConfig) *cors.Cors {
+	opts := cors.Options{
+		AllowedOrigins:   c.Origins,
+		AllowedMethods:   c.Methods,
+		AllowedHeaders:   c.Headers,
+		ExposedHeaders:   corsExposedHeaders,
+		MaxAge:           int(c.MaxAge.Seconds()),
+		AllowCredentials: true,
+	}
+	switch {
+	case c.anyOrigin():
+		opts.AllowedOrigins = nil
+		opts.AllowOriginFunc = func(string) bool { return true }
+	case len(c.Origins) == 0:
+		opts.AllowOriginFunc = func(string) bool { return false }
+	}
+	return cors.New(opts)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+var (
+	errReinsertPending = errors.New("waiting for a defused kitten to be reinserted")
+	errNothingToInsert = errors.New("you have no exploding kitten to reinsert")
+	errBadPosition     = errors.New("position is outside the deck")
+)
+
+type ReinsertRequest struct {
+	Position int `json:"position"`
+}
+
+// reinsert puts a defused Exploding Kitten, or a revealed Imploding Kitten,
+// back into the deck at the chosen depth (0 is the top) and finishes the
+// player's turn.
+func (g *GameState) reinsert(username string, position int) error {
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	if g.Reinserting != username {
+		return errNothingToInsert
+	}
+	if position < 0 || position > len(g.Deck) {
+		return errBadPosition
+	}
+
+	card := g.putBackKitten(position)
+	entry := LogEntry{Type: EventKittenReinserted, Player: username}
+	if card == CardImploding {
+		entry.Card = card
+	}
+	g.logAction(entry)
+	if g.isBot(username) {
+		known := make([]string, position+1)
+		known[position] = card
+		g.botRemember(username, known)
+	}
+
+	g.endTurn()
+	return nil
+}
+
+// putBackKitten returns the kitten being reinserted to the deck at
+// position and reports which kitten it was. An Imploding Kitten goes back
+// face up.
+func (g *GameState) putBackKitten(position int) string {
+	card := CardExploding
+	if g.ReinsertCard != "" {
+		card = g.ReinsertCard
+	}
+	deck := make([]string, 0, len(g.Deck)+1)
+	deck = append(deck, g.Deck[:position]...)
+	deck = append(deck, card)
+	deck = append(deck, g.Deck[position:]...)
+	g.Deck = deck
+	g.Reinserting = ""
+	g.ReinsertCard = ""
+	if card == CardImploding {
+		g.ImplodingFaceUp = true
+	}
+	g.botsForget()
+	return card
+}
+
+func publishReinsert(ctx context.Context, g *GameState, username string, position int) {
+	recordEvent(ctx, g.ID, EventKittenReinserted, map[string]interface{}{
+		"username": username,
+		"position": position,
+	})
+	// The chosen position stays private to the player who defused, unless
+	// it was the face-up Imploding Kitten that went back.
+	payload := map[string]interface{}{
+		"username":   username,
+		"cards_left": len(g.Deck),
+	}
+	if at := g.implodingAt(); at != nil && *at == position {
+		payload["card"] = CardImploding
+		payload["position"] = position
+	}
+	hub.broadcast(ctx, g.channel(), EventKittenReinserted, payload)
+	publishTurn(ctx, g)
+}
+
+func reinsertKitten(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req ReinsertRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+
+	g, err := moveGame(w, r, func(g *GameState) error {
+		return g.reinsert(username, req.Position)
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	publishReinsert(ctx, g, username, req.Position)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestDrawExplodingKitten(t *testing.T) {
+	tests := []struct {
+		name     string
+		hand     []string
+		players  []string
+		outcome  string
+		current  string
+		status   string
+		winner   string
+		reinsert bool
+	}{
+		{
+			name:     "defused",
+			hand:     []string{CardDefuse},
+			players:  []string{"alice", "bob", "carol"},
+			outcome:  OutcomeDefused,
+			current:  "alice",
+			status:   GameActive,
+			reinsert: true,
+		},
+		{
+			name:    "exploded",
+			hand:    []string{CardSkip},
+			players: []string{"alice", "bob", "carol"},
+			outcome: OutcomeExploded,
+			current: "bob",
+			status:  GameActive,
+		},
+		{
+			name:    "exploded with one player left",
+			hand:    []string{CardSkip},
+			players: []string{"alice", "bob"},
+			outcome: OutcomeExploded,
+			status:  GameFinished,
+			winner:  "bob",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame(tt.hand, tt.players...)
+			g.Deck = append([]string{CardExploding}, g.Deck...)
+			res := mustDraw(t, g, "alice")
+			if res.Outcome != tt.outcome {
+				t.Errorf("outcome %s, want %s", res.Outcome, tt.outcome)
+			}
+			if res.MustReinsert != tt.reinsert {
+				t.Errorf("must reinsert = %v, want %v", res.MustReinsert, tt.reinsert)
+			}
+			if g.hasCard("alice", CardDefuse) {
+				t.Error("alice kept her defuse")
+			}
+			if g.Status != tt.status || g.Winner != tt.winner {
+				t.Errorf("game is %s won by %q, want %s won by %q", g.Status, g.Winner, tt.status, tt.winner)
+			}
+			if tt.status == GameActive && g.currentPlayer() != tt.current {
+				t.Errorf("current player is %s, want %s", g.currentPlayer(), tt.current)
+			}
+		})
+	}
+}
+
+func TestReinsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		player   string
+		position int
+		want     error
+	}{
+		{"on top", "alice", 0, nil},
+		{"in the middle", "alice", 4, nil},
+		{"at the bottom", "alice", 10, nil},
+		{"above the deck", "alice", -1, errBadPosition},
+		{"below the deck", "alice", 11, errBadPosition},
+		{"someone else's kitten", "bob", 0, errNothingToInsert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardDefuse}, "alice", "bob")
+			g.Deck = append([]string{CardExploding}, g.Deck...)
+			mustDraw(t, g, "alice")
+			if _, err := g.draw("alice"); err != errReinsertPending {
+				t.Fatalf("drawing before reinserting: got %v, want %v", err, errReinsertPending)
+			}
+
+			err := g.reinsert(tt.player, tt.position)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if len(g.Deck) != 11 || g.Deck[tt.position] != CardExploding {
+				t.Errorf("kitten not at %d in %v", tt.position, g.Deck)
+			}
+			if g.Reinserting != "" || g.currentPlayer() != "bob" {
+				t.Errorf("turn did not pass to bob after reinserting")
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	emailVerifyTTL   = 24 * time.Hour
+	passwordResetTTL = time.Hour
+	maxEmailLength   = 254
+)
+
+var (
+	errEmailTaken    = errors.New("that email address is used by another account")
+	errNoEmail       = errors.New("no email address is set")
+	errEmailVerified = errors.New("email address is already verified")
+	errBadEmailToken = errors.New("verification link is invalid or has expired")
+	errBadResetToken = errors.New("reset link is invalid or has expired")
+	errGuestEmail    = errors.New("guests must upgrade their account before adding an email address")
+)
+
+// emailLinkURL is the web client's address, which links in emails point
+// at. Without it emails carry the bare token. Set with EMAIL_LINK_URL.
+var emailLinkURL string
+
+// EmailRequest sets the caller's email address, confirmed with their
+// password unless they have none.
+type EmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
+}
+
+type EmailTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// EmailStatus is a player's email address and whether they have proved
+// it is theirs.
+type EmailStatus struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// emailKey holds a player's address and whether it is verified.
+func emailKey(username string) string {
+	return fmt.Sprintf("player:%s:email", username)
+}
+
+// emailIndexKey maps an address, ignoring case, to the player it belongs
+// to, so no two accounts share one.
+func emailIndexKey(address string) string {
+	return fmt.Sprintf("email:%s", strings.ToLower(address))
+}
+
+// Tokens are stored by their hash, so a copy of Redis cannot be used to
+// verify addresses or reset passwords.
+func emailVerifyKey(token string) string {
+	return fmt.Sprintf("email:verify:%s", hashToken(token))
+}
+
+func passwordResetKey(token string) string {
+	return fmt.Sprintf("password:reset:%s", hashToken(token))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateEmail(address string) *FieldError {
+	invalid := func(code, msg string) *FieldError {
+		return &FieldError{Field: "email", Code: code, Message: msg}
+	}
+	if address == "" {
+		return invalid("EMAIL_REQUIRED", "Email is required")
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || len(address) > maxEmailLength {
+		return invalid("EMAIL_INVALID", "That is not an email address")
+	}
+	return nil
+}
+
+// newAccountEmail checks an address given when an account is made: that it
+// is well formed, if given at all, and not in use.
+func newAccountEmail(ctx context.Context, address string) ([]*FieldError, error) {
+	if address == "" {
+		return nil, nil
+	}
+	if problem := validateEmail(address); problem != nil {
+		return []*FieldError{problem}, nil
+	}
+	owner, err := emailOwner(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		return nil, errEmailTaken
+	}
+	return nil, nil
+}
+
+func loadEmail(ctx context.Context, username string) (*EmailStatus, error) {
+	fields, err := rdb.HGetAll(ctx, emailKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if fields["address"] == "" {
+		return nil, errNoEmail
+	}
+	return &EmailStatus{Email: fields["address"], Verified: fields["verified"] == "1"}, nil
+}
+
+// emailOwner is who uses an address, or "" if nobody does.
+func emailOwner(ctx context.Context, address string) (string, error) {
+	owner, err := rdb.Get(ctx, emailIndexKey(address)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+// setEmail gives a player a new, unverified address and mails it a link
+// to verify it. Their old address, if any, is freed.
+func setEmail(ctx context.Context, username, address string) error {
+	ok, err := rdb.SetNX(ctx, emailIndexKey(address), username, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		owner, err := emailOwner(ctx, address)
+		if err != nil {
+			return err
+		}
+		if owner != username {
+			return errEmailTaken
+		}
+	}
+
+	old, err := loadEmail(ctx, username)
+	if err != nil && err != errNoEmail {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	if old != nil && !strings.EqualFold(old.Email, address) {
+		pipe.Del(ctx, emailIndexKey(old.Email))
+	}
+	pipe.HSet(ctx, emailKey(username), "address", address, "verified", "0")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return sendVerification(ctx, username, address)
+}
+
+// sendVerification mails address a single-use link proving it belongs to
+// username.
+func sendVerification(ctx context.Context, username, address string) error {
+	token := randomToken()
+	pending, _ := json.Marshal(map[string]string{"username": username, "email": address})
+	if err := rdb.Set(ctx, emailVerifyKey(token), pending, emailVerifyTTL).Err(); err != nil {
+		return err
+	}
+	sendMail(ctx, address, "Confirm your email address", fmt.Sprintf(
+		"Hi %s,\n\nConfirm this is your email address for Exploding Kittens:\n\n%s\n\n"+
+			"This expires in 24 hours. If you didn't ask for it, you can ignore this email.\n",
+		username, emailLink("verify-email", token)))
+	return nil
+}
+
+func emailLink(page, token string) string {
+	if emailLinkURL == "" {
+		return "Your code is " + token
+	}
+	return emailLinkURL + "/" + page + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// removeEmail frees a deleted player's address.
+func removeEmail(ctx context.Context, username string) error {
+	current, err := loadEmail(ctx, username)
+	if err == errNoEmail {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rdb.Del(ctx, emailIndexKey(current.Email), emailKey(username)).Err()
+}
+
+// moveEmail points a renamed player's address at their new name.
+func moveEmail(ctx context.Context, from, to string) error {
+	current, err := loadEmail(ctx, from)
+	if err == errNoEmail {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Rename(ctx, emailKey(from), emailKey(to))
+	pipe.Set(ctx, emailIndexKey(current.Email), to, 0)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func getEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	status, err := loadEmail(ctx, currentUser(r))
+	if err == errNoEmail {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading email")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// changeEmail sets the caller's address and sends it a verification link.
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	var req EmailRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if problem := validateEmail(req.Email); problem != nil {
+		respondInvalid(w, r, []*FieldError{problem})
+		return
+	}
+
+	guest, err := users.IsGuest(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error changing email")
+		return
+	}
+	if guest {
+		respondError(w, r, http.StatusForbidden, errGuestEmail)
+		return
+	}
+	noPassword, err := passwordless(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error changing email")
+		return
+	}
+	if !noPassword {
+		err := checkPassword(ctx, username, req.Password)
+		if err == errInvalidCredentials {
+			respondError(w, r, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error changing email")
+			return
+		}
+	}
+
+	err = setEmail(ctx, username, req.Email)
+	if err == errEmailTaken {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error changing email")
+		return
+	}
+	logFor(r).Info("email changed", "username", username)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(EmailStatus{Email: req.Email})
+}
+
+// resendVerification mails the caller's address a fresh link.
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	status, err := loadEmail(ctx, username)
+	if err == errNoEmail {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error sending verification")
+		return
+	}
+	if status.Verified {
+		respondError(w, r, http.StatusConflict, errEmailVerified)
+		return
+	}
+	if err := sendVerification(ctx, username, status.Email); err != nil {
+		respondInternal(w, r, err, "Error sending verification")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
+
+// verifyEmail marks an address verified with the token mailed to it. The
+// token is spent either way, and does nothing if the player has changed
+// address since.
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req EmailTokenRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	raw, err := rdb.GetDel(ctx, emailVerifyKey(req.Token)).Result()
+	if err == redis.Nil || req.Token == "" {
+		respondError(w, r, http.StatusBadRequest, errBadEmailToken)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error verifying email")
+		return
+	}
+	var pending struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	json.Unmarshal([]byte(raw), &pending)
+	current, err := loadEmail(ctx, pending.Username)
+	if err == errNoEmail || (err == nil && current.Email != pending.Email) {
+		respondError(w, r, http.StatusBadRequest, errBadEmailToken)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error verifying email")
+		return
+	}
+	if err := rdb.HSet(ctx, emailKey(pending.Username), "verified", "1").Err(); err != nil {
+		respondInternal(w, r, err, "Error verifying email")
+		return
+	}
+	logFor(r).Info("email verified", "username", pending.Username)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(EmailStatus{Email: current.Email, Verified: true})
+}
+
+// forgotPassword mails a reset link to an account's verified address. It
+// answers the same whether or not there is such an account, so it cannot
+// be used to find out who has signed up.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ForgotPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if problem := validateEmail(req.Email); problem != nil {
+		respondInvalid(w, r, []*FieldError{problem})
+		return
+	}
+
+	if err := sendPasswordReset(ctx, req.Email); err != nil {
+		respondInternal(w, r, err, "Error sending password reset")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
+
+func sendPasswordReset(ctx context.Context, address string) error {
+	username, err := emailOwner(ctx, address)
+	if err != nil || username == "" {
+		return err
+	}
+	status, err := loadEmail(ctx, username)
+	if err == errNoEmail {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !status.Verified {
+		return nil
+	}
+	noPassword, err := passwordless(ctx, username)
+	if err != nil || noPassword {
+		return err
+	}
+
+	token := randomToken()
+	if err := rdb.Set(ctx, passwordResetKey(token), username, passwordResetTTL).Err(); err != nil {
+		return err
+	}
+	sendMail(ctx, status.Email, "Reset your password", fmt.Sprintf(
+		"Hi %s,\n\nSomeone asked to reset your Exploding Kittens password. To choose a new one:\n\n%s\n\n"+
+			"This can be used once and expires in an hour. If it wasn't you, you can ignore this email.\n",
+		username, emailLink("reset-password", token)))
+	return nil
+}
+
+// resetPassword sets a new password with a token from forgotPassword and
+// signs out every session, in case the old password was stolen.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ResetPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if problem := validatePassword(req.Password); problem != nil {
+		respondInvalid(w, r, []*FieldError{problem})
+		return
+	}
+	username, err := rdb.GetDel(ctx, passwordResetKey(req.Token)).Result()
+	if err == redis.Nil || req.Token == "" {
+		respondError(w, r, http.StatusBadRequest, errBadResetToken)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error resetting password")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondInternal(w, r, err, "Error resetting password")
+		return
+	}
+	err = users.SetPasswordHash(ctx, username, string(hash))
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusBadRequest, errBadResetToken)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error resetting password")
+		return
+	}
+	if err := revokeRefreshTokens(ctx, username); err != nil {
+		logFor(r).Error("ending sessions after password reset", "username", username, "err", err)
+	}
+	if err := revokeAccessTokens(ctx, username); err != nil {
+		logFor(r).Error("ending sessions after password reset", "username", username, "err", err)
+	}
+	clearLoginFailures(ctx, username)
+	logFor(r).Info("password reset", "username", username)
+	audit(ctx, username, AuditPasswordReset, username, nil, nil)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// Error codes clients can switch on. Codes for specific domain errors live
+// in errorCodes.
+const (
+	CodeBadRequest       = "BAD_REQUEST"
+	CodeInvalidPayload   = "INVALID_PAYLOAD"
+	CodePayloadTooLarge  = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMedia = "UNSUPPORTED_MEDIA_TYPE"
+	CodeInvalidUsername  = "INVALID_USERNAME"
+	CodeInvalidPassword  = "INVALID_PASSWORD"
+	CodeInvalidEmail     = "INVALID_EMAIL"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeNotFound         = "NOT_FOUND"
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodeConflict         = "CONFLICT"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeInternal         = "INTERNAL_ERROR"
+	CodeUnavailable      = "SERVICE_UNAVAILABLE"
+	CodeMaintenance      = "MAINTENANCE"
+	CodeUpgradeRequired  = "UPGRADE_REQUIRED"
+	// CodeStorageTimeout means Redis took too long, and CodeStorageDown
+	// that it has been failing; retry either after a moment.
+	CodeStorageTimeout = "STORAGE_TIMEOUT"
+	CodeStorageDown    = "STORAGE_UNAVAILABLE"
+)
+
+// errorCodes names the domain errors handlers report directly.
+var errorCodes = map[error]string{
+	errInvalidCredentials: "INVALID_CREDENTIALS",
+	errInvalidToken:       "INVALID_TOKEN",
+	errLoginLocked:        "LOGIN_LOCKED",
+	errCaptchaRequired:    "CAPTCHA_REQUIRED",
+	errCaptchaFailed:      "CAPTCHA_FAILED",
+	errUsernameTaken:      "USERNAME_TAKEN",
+	errNotGuest:           "NOT_A_GUEST",
+	errUserNotFound:       "PLAYER_NOT_FOUND",
+	errNotRanked:          "NOT_RANKED",
+	errBadPagination:      "INVALID_PAGINATION",
+	errSeasonNotFound:     "SEASON_NOT_FOUND",
+	errGameNotFound:       "GAME_NOT_FOUND",
+	errGameBusy:           "GAME_BUSY",
+	errStaleVersion:       "STALE_VERSION",
+	errBadVersion:         "INVALID_VERSION",
+	errGameOver:           "GAME_OVER",
+	errGameSuspended:      "GAME_SUSPENDED",
+	errNotSuspended:       "GAME_NOT_SUSPENDED",
+	errNotSolo:            "NOT_SINGLE_PLAYER",
+	errNotInGame:          "NOT_IN_GAME",
+	errDeckEmpty:          "DECK_EMPTY",
+	errNotYourTurn:        "NOT_YOUR_TURN",
+	errPlayerOut:          "PLAYER_ELIMINATED",
+	errCardNotInHand:      "CARD_NOT_IN_HAND",
+	errCardNotPlayable:    "CARD_NOT_PLAYABLE",
+	errInvalidTarget:      "INVALID_TARGET",
+	errNothingToNope:      "NOTHING_TO_NOPE",
+	errActionPending:      "ACTION_PENDING",
+	errNopeWindowClosed:   "NOPE_WINDOW_CLOSED",
+	errNopeOwnPlay:        "NOPE_OWN_PLAY",
+	errReinsertPending:    "REINSERT_PENDING",
+	errNothingToInsert:    "NOTHING_TO_REINSERT",
+	errBadPosition:        "INVALID_POSITION",
+	errAlterPending:       "ALTER_PENDING",
+	errNothingToAlter:     "NOTHING_TO_ALTER",
+	errBadAlteration:      "INVALID_ALTERATION",
+	errBadCombo:           "INVALID_COMBO",
+	errBadNamedCard:       "INVALID_NAMED_CARD",
+	errNotDiscarded:       "CARD_NOT_DISCARDED",
+	errFavorPending:       "FAVOR_PENDING",
+	errNoFavorOwed:        "NO_FAVOR_OWED",
+	errRoomNotFound:       "ROOM_NOT_FOUND",
+	errRoomFull:           "ROOM_FULL",
+	errRoomClosed:         "ROOM_CLOSED",
+	errRoomBusy:           "ROOM_BUSY",
+	errAlreadyInRoom:      "ALREADY_IN_ROOM",
+	errNotRoomOwner:       "NOT_ROOM_OWNER",
+	errNotEnough:          "NOT_ENOUGH_PLAYERS",
+	errSpectatorsFull:     "SPECTATORS_FULL",
+	errSeatTaken:          "SEAT_TAKEN",
+	errBadDifficulty:      "INVALID_DIFFICULTY",
+	errGameNotFinished:    "GAME_NOT_FINISHED",
+	errRematchDeclined:    "REMATCH_DECLINED",
+	errRoomPrivate:        "ROOM_PRIVATE",
+	errJoinCodeNotFound:   "JOIN_CODE_NOT_FOUND",
+	errFriendSelf:         "FRIEND_SELF",
+	errAlreadyFriends:     "ALREADY_FRIENDS",
+	errRequestPending:     "FRIEND_REQUEST_PENDING",
+	errNoFriendRequest:    "FRIEND_REQUEST_NOT_FOUND",
+	errNotFriends:         "NOT_FRIENDS",
+	errTooManyFriends:     "FRIEND_LIMIT_REACHED",
+	errChatUnavailable:    "CHAT_UNAVAILABLE",
+	errChatDisabled:       "CHAT_DISABLED",
+	errChatReadOnly:       "CHAT_READ_ONLY",
+	errChatEmpty:          "CHAT_EMPTY",
+	errChatTooLong:        "CHAT_TOO_LONG",
+	errChatFlood:          "CHAT_RATE_LIMITED",
+	errReactionNoRoom:     "REACTION_UNAVAILABLE",
+	errReactionReadOnly:   "REACTION_READ_ONLY",
+	errUnknownEmote:       "UNKNOWN_EMOTE",
+	errReactionFlood:      "REACTION_RATE_LIMITED",
+	errReportSelf:         "REPORT_SELF",
+	errBadReportReason:    "INVALID_REPORT_REASON",
+	errReportedNotInGame:  "REPORTED_NOT_IN_GAME",
+	errAlreadyReported:    "ALREADY_REPORTED",
+	errReportNotFound:     "REPORT_NOT_FOUND",
+	errReportResolved:     "REPORT_RESOLVED",
+	errBadResolution:      "INVALID_RESOLUTION",
+	errBadReportStatus:    "INVALID_REPORT_STATUS",
+	errInsufficientRole:   "INSUFFICIENT_ROLE",
+	errBadRole:            "INVALID_ROLE",
+	errOwnRole:            "OWN_ROLE",
+	errOutranked:          "OUTRANKED",
+	errAccountBanned:      "ACCOUNT_BANNED",
+	errNotBanned:          "NOT_BANNED",
+	errBadBanLength:       "INVALID_BAN_DURATION",
+	errSameUsername:       "SAME_USERNAME",
+	errGuestRename:        "GUEST_RENAME",
+	errRenameBusy:         "RENAME_WHILE_PLAYING",
+	errRenameCooldown:     "USERNAME_CHANGE_COOLDOWN",
+	errNotYourProfile:     "NOT_YOUR_PROFILE",
+	errLevelTooLow:        "LEVEL_TOO_LOW",
+	errItemNotFound:       "ITEM_NOT_FOUND",
+	errItemOwned:          "ITEM_OWNED",
+	errInsufficientCoins:  "INSUFFICIENT_COINS",
+	errAvatarNotOwned:     "AVATAR_NOT_OWNED",
+	errTournamentNotFound: "TOURNAMENT_NOT_FOUND",
+	errTournamentClosed:   "TOURNAMENT_CLOSED",
+	errTournamentFull:     "TOURNAMENT_FULL",
+	errAlreadyRegistered:  "ALREADY_REGISTERED",
+	errNotRegistered:      "NOT_REGISTERED",
+	errTournamentBusy:     "TOURNAMENT_BUSY",
+	errLiveEventNotFound:  "EVENT_NOT_FOUND",
+	errWebhookNotFound:    "WEBHOOK_NOT_FOUND",
+	errBadPlatform:        "BAD_PLATFORM",
+	errDeviceNotFound:     "DEVICE_NOT_FOUND",
+	errTooManyDevices:     "TOO_MANY_DEVICES",
+	errNoNotification:     "NOTIFICATION_NOT_FOUND",
+	errFlagNotFound:       "FLAG_NOT_FOUND",
+	errFeatureDisabled:    "FEATURE_DISABLED",
+	errNopeDisabled:       "NOPE_DISABLED",
+	errUnknownProvider:    "UNKNOWN_PROVIDER",
+	errOAuthState:         "OAUTH_STATE_INVALID",
+	errOAuthDenied:        "OAUTH_DENIED",
+	errIdentityLinked:     "IDENTITY_LINKED",
+	errProviderLinked:     "PROVIDER_LINKED",
+	errGuestLink:          "GUEST_LINK",
+	errNotLinked:          "PROVIDER_NOT_LINKED",
+	errLastSignIn:         "LAST_SIGN_IN",
+	errOAuthUnavailable:   "OAUTH_UNAVAILABLE",
+	errEmailTaken:         "EMAIL_TAKEN",
+	errNoEmail:            "NO_EMAIL",
+	errEmailVerified:      "EMAIL_ALREADY_VERIFIED",
+	errBadEmailToken:      "INVALID_EMAIL_TOKEN",
+	errBadResetToken:      "INVALID_RESET_TOKEN",
+	errGuestEmail:         "GUEST_EMAIL",
+	errInvalidAPIKey:      "INVALID_API_KEY",
+	errInsufficientScope:  "INSUFFICIENT_SCOPE",
+	errAPIKeyNotFound:     "API_KEY_NOT_FOUND",
+	errTooManyAPIKeys:     "TOO_MANY_API_KEYS",
+	errGuestAPIKey:        "GUEST_API_KEY",
+}
+
+// statusCodes is the fallback code for errors without one of their own.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMedia,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// ErrorResponse is the body of every error the API returns.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   []*FieldError `json:"details,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+// writeError sends the error envelope. An empty code falls back to the
+// generic code for the status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if code == "" {
+		code = statusCodes[status]
+		if code == "" {
+			code = CodeInternal
+		}
+	}
+	writeErrorBody(w, r, status, ErrorBody{Code: code, Message: message})
+}
+
+// writeErrorBody sends a prepared error, stamped with the request's ID.
+func writeErrorBody(w http.ResponseWriter, r *http.Request, status int, body ErrorBody) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		body.RequestID = info.id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: body})
+}
+
+// knownError reports whether err is one of the domain errors above rather
+// than an infrastructure failure.
+func knownError(err error) bool {
+	_, ok := errorCodes[err]
+	return ok
+}
+
+// respondError reports err with its code, in the caller's language where
+// there is a translation. Server errors are logged and answered with a
+// generic message so internals never reach the client, or a retryable 503
+// when Redis timed out or is down.
+func respondError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status >= http.StatusInternalServerError && storageDown(err) {
+		respondUnavailable(w, r, err)
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		logFor(r).Error("request failed", "path", r.URL.Path, "err", err)
+		writeError(w, r, status, CodeInternal, "Internal server error")
+		return
+	}
+	code := errorCodes[err]
+	if code == "" {
+		writeError(w, r, status, code, err.Error())
+		return
+	}
+	writeError(w, r, status, code, localize(r, "errors."+code, err.Error()))
+}
+
+// recoverPanics turns a panicking handler into a 500 instead of a dropped
+// connection, and logs the stack.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logFor(r).Error("handler panicked", "path", r.URL.Path, "panic", p, "stack", string(debug.Stack()))
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, CodeNotFound, "No such endpoint")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Every write to a game is also recorded as an event: the action that made
+// it and the change it made to the stored state. Folding a game's events
+// in version order rebuilds it as of any version, starting from the latest
+// snapshot at or before it. Each event is copied to a shared stream that
+// downstream processors read through consumer groups.
+
+const (
+	// snapshotEvery is how many versions pass between full snapshots.
+	snapshotEvery = 25
+	// changeFeedLength caps the shared stream; processors are expected to
+	// keep up with far fewer.
+	changeFeedLength = 100000
+	changeFeedKey    = "games:changes"
+
+	processorBatch     = 50
+	processorClaimIdle = time.Minute
+)
+
+const (
+	ActionStart = "start"
+	// ActionRecorded is published by the stats processor once a finished
+	// game is in every participant's history.
+	ActionRecorded = "recorded"
+)
+
+var errBrokenChangeLog = errors.New("game change log is incomplete")
+
+func gameChangesKey(gameID string) string {
+	return fmt.Sprintf("game:%s:changes", gameID)
+}
+
+func gameSnapshotsKey(gameID string) string {
+	return fmt.Sprintf("game:%s:snapshots", gameID)
+}
+
+// GameChange is one recorded write to a game.
+type GameChange struct {
+	ID      string    `json:"id"`
+	Version int64     `json:"version"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor,omitempty"`
+	Diff    stateDiff `json:"diff"`
+	Time    time.Time `json:"time"`
+}
+
+// stateDiff turns one JSON object into another. Each key maps to an
+// operation: "v" replaces the value, "d" deletes the key and "p" applies a
+// nested diff to an object. Unlike a JSON merge patch it keeps keys whose
+// value is null, so a folded game encodes exactly as the stored one.
+type stateDiff map[string]diffOp
+
+type diffOp struct {
+	Value  json.RawMessage `json:"v,omitempty"`
+	Delete bool            `json:"d,omitempty"`
+	Patch  stateDiff       `json:"p,omitempty"`
+}
+
+func diffState(before, after map[string]json.RawMessage) stateDiff {
+	diff := stateDiff{}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			diff[k] = diffOp{Delete: true}
+		}
+	}
+	for k, v := range after {
+		old, ok := before[k]
+		if ok && jsonEqual(old, v) {
+			continue
+		}
+		var oldObj, newObj map[string]json.RawMessage
+		if ok && json.Unmarshal(old, &oldObj) == nil && oldObj != nil &&
+			json.Unmarshal(v, &newObj) == nil && newObj != nil {
+			diff[k] = diffOp{Patch: diffState(oldObj, newObj)}
+			continue
+		}
+		diff[k] = diffOp{Value: v}
+	}
+	return diff
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func (d stateDiff) apply(doc map[string]json.RawMessage) error {
+	for k, op := range d {
+		switch {
+		case op.Delete:
+			delete(doc, k)
+		case op.Patch != nil:
+			var nested map[string]json.RawMessage
+			if err := json.Unmarshal(doc[k], &nested); err != nil || nested == nil {
+				return fmt.Errorf("patching %s: not an object", k)
+			}
+			if err := op.Patch.apply(nested); err != nil {
+				return err
+			}
+			data, err := json.Marshal(nested)
+			if err != nil {
+				return err
+			}
+			doc[k] = data
+		default:
+			doc[k] = op.Value
+		}
+	}
+	return nil
+}
+
+func stateDoc(data []byte) map[string]json.RawMessage {
+	doc := map[string]json.RawMessage{}
+	json.Unmarshal(data, &doc)
+	return doc
+}
+
+// recordChange appends a write to the game's change log and the shared
+// feed. before is the game as loaded, or nil for a new game. Failures are
+// logged; the write itself has already happened.
+func recordChange(ctx context.Context, action, actor string, before []byte, g *GameState) {
+	after, err := json.Marshal(g)
+	if err != nil {
+		slog.Error("encoding game change", "game", g.ID, "err", err)
+		return
+	}
+	var was GameState
+	if before != nil {
+		json.Unmarshal(before, &was)
+	}
+	diff, err := json.Marshal(diffState(stateDoc(before), stateDoc(after)))
+	if err != nil {
+		slog.Error("encoding game change", "game", g.ID, "err", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	version := strconv.FormatInt(g.Version, 10)
+	finished := g.Status == GameFinished && was.Status != GameFinished
+	pipe := rdb.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: gameChangesKey(g.ID),
+		Values: map[string]interface{}{
+			"version": version,
+			"action":  action,
+			"actor":   actor,
+			"diff":    diff,
+			"time":    now.Format(time.RFC3339Nano),
+		},
+	})
+	if g.Version%snapshotEvery == 0 {
+		pipe.HSet(ctx, gameSnapshotsKey(g.ID), version, after)
+	}
+	if ttl := g.ttl(); ttl > 0 {
+		pipe.Expire(ctx, gameChangesKey(g.ID), ttl)
+		pipe.Expire(ctx, gameSnapshotsKey(g.ID), ttl)
+	}
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: changeFeedKey,
+		MaxLen: changeFeedLength,
+		Approx: true,
+		Values: map[string]interface{}{
+			"game":     g.ID,
+			"version":  version,
+			"action":   action,
+			"actor":    actor,
+			"status":   g.Status,
+			"finished": strconv.FormatBool(finished),
+			"time":     now.Format(time.RFC3339Nano),
+		},
+	})
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("recording game change", "game", g.ID, "action", action, "err", err)
+	}
+}
+
+// gameChanges reads a game's change log in version order.
+func gameChanges(ctx context.Context, gameID string) ([]GameChange, error) {
+	entries, err := rdb.XRange(ctx, gameChangesKey(gameID), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]GameChange, 0, len(entries))
+	for _, entry := range entries {
+		c := GameChange{ID: entry.ID}
+		c.Action, _ = entry.Values["action"].(string)
+		c.Actor, _ = entry.Values["actor"].(string)
+		version, _ := entry.Values["version"].(string)
+		c.Version, _ = strconv.ParseInt(version, 10, 64)
+		stamp, _ := entry.Values["time"].(string)
+		c.Time, _ = time.Parse(time.RFC3339Nano, stamp)
+		diff, _ := entry.Values["diff"].(string)
+		if err := json.Unmarshal([]byte(diff), &c.Diff); err != nil {
+			return nil, fmt.Errorf("decoding change %s: %w", entry.ID, err)
+		}
+		changes = append(changes, c)
+	}
+	// Concurrent writers can append out of order; versions cannot.
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Version < changes[j].Version })
+	return changes, nil
+}
+
+// foldGame rebuilds a game from its events as of version, or as of its
+// latest event when version is 0.
+func foldGame(ctx context.Context, gameID string, version int64) (*GameState, error) {
+	snapshots, err := rdb.HGetAll(ctx, gameSnapshotsKey(gameID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var from int64
+	doc := map[string]json.RawMessage{}
+	for v, data := range snapshots {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= from || (version > 0 && n > version) {
+			continue
+		}
+		from, doc = n, stateDoc([]byte(data))
+	}
+
+	changes, err := gameChanges(ctx, gameID)
+	if err != nil {
+		return nil, err
+	}
+	at := from
+	for _, c := range changes {
+		if c.Version <= from {
+			continue
+		}
+		if version > 0 && c.Version > version {
+			break
+		}
+		if c.Version != at+1 {
+			return nil, errBrokenChangeLog
+		}
+		if err := c.Diff.apply(doc); err != nil {
+			return nil, fmt.Errorf("applying version %d: %w", c.Version, err)
+		}
+		at = c.Version
+	}
+	if at == 0 {
+		return nil, errGameNotFound
+	}
+	if version > 0 && at != version {
+		return nil, errGameNotFound
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var g GameState
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// getGameChanges shows moderators a game's change log and whether
+// folding it reproduces the stored game.
+func getGameChanges(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	changes, err := gameChanges(ctx, id)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading changes")
+		return
+	}
+	folded, err := foldGame(ctx, id, 0)
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	consistent := err == nil
+	if err != nil && err != errBrokenChangeLog {
+		respondInternal(w, r, err, "Error rebuilding game")
+		return
+	}
+	if consistent {
+		stored, err := loadGame(ctx, id)
+		if err != nil && err != errGameNotFound {
+			respondInternal(w, r, err, "Error loading game")
+			return
+		}
+		a, _ := json.Marshal(folded)
+		b, _ := json.Marshal(stored)
+		consistent = stored != nil && jsonEqual(a, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changes":    changes,
+		"consistent": consistent,
+	})
+}
+
+// eventProcessor handles the shared change feed for one consumer group.
+// Handlers must be safe to run twice for the same entry: an entry whose
+// consumer dies before acknowledging it is claimed by another.
+type eventProcessor struct {
+	group  string
+	handle func(ctx context.Context, entry redis.XMessage) error
+}
+
+var eventProcessors = []eventProcessor{
+	{group: "stats", handle: processStats},
+	{group: "achievements", handle: processAchievements},
+	{group: "replays", handle: processReplays},
+	{group: "webhooks", handle: processWebhooks},
+}
+
+// processStats records a finished game in its players' histories, pays
+// the winner and updates ratings, then announces it for processors that
+// read those. The payout waits for the history so it sees the new streak.
+func processStats(ctx context.Context, entry redis.XMessage) error {
+	g, ok, err := finishedGame(ctx, entry, "finished", "true")
+	if err != nil || !ok {
+		return err
+	}
+	finishedAt, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(entry.Values["time"]))
+	if err := recordGame(ctx, g, finishedAt); err != nil {
+		return err
+	}
+	if err := awardWin(ctx, g); err != nil {
+		return err
+	}
+	if err := updateRatings(ctx, g); err != nil {
+		return err
+	}
+	return rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: changeFeedKey,
+		MaxLen: changeFeedLength,
+		Approx: true,
+		Values: map[string]interface{}{
+			"game":   g.ID,
+			"action": ActionRecorded,
+			"status": g.Status,
+			"time":   time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}).Err()
+}
+
+// processAchievements waits for a game's stats, which several
+// achievements count, before checking what its players earned.
+func processAchievements(ctx context.Context, entry redis.XMessage) error {
+	g, ok, err := finishedGame(ctx, entry, "action", ActionRecorded)
+	if err != nil || !ok {
+		return err
+	}
+	checkAchievements(ctx, g)
+	return nil
+}
+
+// processReplays keeps a finished game's replay and change log for as long
+// as the game itself. Multiplayer games are kept until the janitor deletes
+// them along with their streams.
+func processReplays(ctx context.Context, entry redis.XMessage) error {
+	g, ok, err := finishedGame(ctx, entry, "finished", "true")
+	if err != nil || !ok || g.ttl() == 0 {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	for _, key := range []string{gameEventsKey(g.ID), gameChangesKey(g.ID), gameSnapshotsKey(g.ID)} {
+		pipe.Expire(ctx, key, g.ttl())
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// finishedGame loads the game an entry is about if field has value. Games
+// deleted since are skipped.
+func finishedGame(ctx context.Context, entry redis.XMessage, field, value string) (*GameState, bool, error) {
+	if v, _ := entry.Values[field].(string); v != value {
+		return nil, false, nil
+	}
+	id, _ := entry.Values["game"].(string)
+	g, err := loadGame(ctx, id)
+	if err == errGameNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return g, true, nil
+}
+
+// instanceName tells this process apart from the other instances sharing
+// Redis, in consumer groups and worker lists.
+func instanceName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID()[:8])
+}
+
+// startEventProcessors runs every processor until the returned func is
+// called. Each instance joins every group as its own consumer, so entries
+// are shared between instances.
+func startEventProcessors(ctx context.Context) func() {
+	consumer := instanceName()
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	for _, p := range eventProcessors {
+		err := rdb.XGroupCreateMkStream(ctx, changeFeedKey, p.group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			slog.Error("creating consumer group", "group", p.group, "err", err)
+		}
+	}
+	for _, p := range eventProcessors {
+		go func(p eventProcessor) {
+			defer func() { done <- struct{}{} }()
+			p.run(ctx, consumer, quit)
+		}(p)
+	}
+	return func() {
+		close(quit)
+		for range eventProcessors {
+			<-done
+		}
+	}
+}
+
+func (p eventProcessor) run(ctx context.Context, consumer string, quit <-chan struct{}) {
+	block := blockingReadTime()
+	lastClaim := time.Time{}
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		var entries []redis.XMessage
+		if time.Since(lastClaim) > processorClaimIdle {
+			// Take over what consumers that died left unacknowledged.
+			lastClaim = time.Now()
+			claimed, err := p.claim(ctx, consumer)
+			if err != nil {
+				slog.Error("claiming stale entries", "group", p.group, "err", err)
+			}
+			entries = claimed
+		}
+		if len(entries) == 0 {
+			streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    p.group,
+				Consumer: consumer,
+				Streams:  []string{changeFeedKey, ">"},
+				Count:    processorBatch,
+				Block:    block,
+			}).Result()
+			if err != nil && err != redis.Nil {
+				slog.Error("reading change feed", "group", p.group, "err", err)
+				select {
+				case <-quit:
+					return
+				case <-time.After(block):
+				}
+				continue
+			}
+			for _, s := range streams {
+				entries = append(entries, s.Messages...)
+			}
+		}
+
+		for _, entry := range entries {
+			if err := p.handle(ctx, entry); err != nil {
+				// Left pending, to be claimed again once idle.
+				slog.Error("processing game change", "group", p.group, "entry", entry.ID, "err", err)
+				continue
+			}
+			if err := rdb.XAck(ctx, changeFeedKey, p.group, entry.ID).Err(); err != nil {
+				slog.Error("acknowledging game change", "group", p.group, "entry", entry.ID, "err", err)
+			}
+		}
+	}
+}
+
+// claim takes over entries other consumers have held too long. It pairs
+// XPENDING with XCLAIM rather than using XAUTOCLAIM, whose reply changed
+// shape in Redis 7.
+func (p eventProcessor) claim(ctx context.Context, consumer string) ([]redis.XMessage, error) {
+	pending, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: changeFeedKey,
+		Group:  p.group,
+		Idle:   processorClaimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  processorBatch,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	ids := make([]string, len(pending))
+	for i, e := range pending {
+		ids[i] = e.ID
+	}
+	return rdb.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   changeFeedKey,
+		Group:    p.group,
+		Consumer: consumer,
+		MinIdle:  processorClaimIdle,
+		Messages: ids,
+	}).Result()
+}
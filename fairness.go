@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	mrand "math/rand/v2"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// shuffleAlgorithm tells verifiers how a seed turns into card order.
+const shuffleAlgorithm = "Go math/rand/v2 Shuffle over ChaCha8 keyed with HMAC-SHA256(seed, \"deal\"), " +
+	"then HMAC-SHA256(seed, \"<n>\") for the nth random choice during play"
+
+// Fairness is what a game reveals about its randomness. The seed stays
+// secret until the game is over; before that only its commitment is shown.
+type Fairness struct {
+	GameID     string              `json:"game_id"`
+	Commitment string              `json:"commitment"`
+	Revealed   bool                `json:"revealed"`
+	Seed       string              `json:"seed,omitempty"`
+	Algorithm  string              `json:"algorithm"`
+	DealtTo    []string            `json:"dealt_to,omitempty"`
+	Deck       []string            `json:"deck,omitempty"`
+	Hands      map[string][]string `json:"hands,omitempty"`
+}
+
+// newSeed draws a game's secret shuffle seed from crypto/rand.
+func newSeed() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// seedCommitment is published when a game starts so the seed revealed at
+// the end can be checked against it.
+func seedCommitment(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+// seededRand is the generator for one labelled use of a seed.
+func seededRand(seed, label string) *mrand.Rand {
+	mac := hmac.New(sha256.New, []byte(seed))
+	mac.Write([]byte(label))
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return mrand.New(mrand.NewChaCha8(key))
+}
+
+// rng returns a generator for the game's next random choice, such as a
+// Shuffle card or the card taken by a Favor. Each choice gets its own
+// stream so any of them can be recomputed from the seed later.
+func (g *GameState) rng() *mrand.Rand {
+	if g.Seed == "" {
+		// Games dealt before seeds existed get one on first use.
+		g.Seed = newSeed()
+		g.Commitment = seedCommitment(g.Seed)
+	}
+	g.SeedUses++
+	return seededRand(g.Seed, strconv.Itoa(g.SeedUses))
+}
+
+func getFairness(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := loadGame(ctx, mux.Vars(r)["id"])
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading game")
+		return
+	}
+
+	f := Fairness{
+		GameID:     g.ID,
+		Commitment: g.Commitment,
+		Algorithm:  shuffleAlgorithm,
+	}
+	if g.Status == GameFinished && g.Seed != "" {
+		f.Revealed = true
+		f.Seed = g.Seed
+		f.DealtTo = g.DealtTo
+		f.Deck, f.Hands = dealGame(g, seededRand(g.Seed, "deal"))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fanOutBuffer is how many published messages may queue for the hub
+// before go-redis starts dropping them.
+const fanOutBuffer = 1000
+
+const (
+	roomChannelPrefix = "events:room:"
+	userChannelPrefix = "events:user:"
+)
+
+// roomChannel carries a room's events to every instance with clients in
+// it.
+func roomChannel(room string) string {
+	return roomChannelPrefix + room
+}
+
+// userChannel carries a player's own events, and requests to disconnect
+// them, to every instance they are connected to.
+func userChannel(username string) string {
+	return userChannelPrefix + username
+}
+
+// fanOutMessage is what instances publish to each other. Event is encoded
+// exactly as clients receive it.
+type fanOutMessage struct {
+	// To limits a room event to one player's connections.
+	To         string          `json:"to,omitempty"`
+	Event      json.RawMessage `json:"event,omitempty"`
+	Disconnect *closeReason    `json:"disconnect,omitempty"`
+}
+
+type closeReason struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// startFanOut subscribes the hub to the channels of the rooms and players
+// connected to this instance, and delivers what other instances publish to
+// them. Until it runs, and whenever publishing fails, events only reach
+// this instance's clients. The returned func unsubscribes.
+func startFanOut(ctx context.Context) func() {
+	ps := rdb.Subscribe(ctx)
+	hub.mu.Lock()
+	hub.pubsub.Store(ps)
+	for room := range hub.rooms {
+		hub.subscribe(ctx, roomChannel(room))
+	}
+	for username := range hub.users {
+		hub.subscribe(ctx, userChannel(username))
+	}
+	hub.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range ps.Channel(redis.WithChannelSize(fanOutBuffer)) {
+			var m fanOutMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				slog.Error("decoding fan-out message", "channel", msg.Channel, "err", err)
+				continue
+			}
+			hub.dispatch(ctx, msg.Channel, m)
+		}
+	}()
+	return func() {
+		hub.pubsub.Store(nil)
+		if err := ps.Close(); err != nil {
+			slog.Error("closing fan-out subscription", "err", err)
+		}
+		<-done
+	}
+}
+
+// publish sends m to every instance subscribed to channel, this one
+// included. It is delivered here directly when there is no subscription
+// or Redis cannot take it.
+func (h *Hub) publish(ctx context.Context, channel string, m fanOutMessage) {
+	if h.pubsub.Load() != nil {
+		data, err := json.Marshal(m)
+		if err == nil {
+			err = rdb.Publish(ctx, channel, data).Err()
+		}
+		if err == nil {
+			return
+		}
+		slog.Error("publishing event", "channel", channel, "err", err)
+	}
+	h.dispatch(ctx, channel, m)
+}
+
+// dispatch delivers a message to this instance's clients.
+func (h *Hub) dispatch(ctx context.Context, channel string, m fanOutMessage) {
+	switch {
+	case strings.HasPrefix(channel, roomChannelPrefix):
+		h.deliverRoom(ctx, strings.TrimPrefix(channel, roomChannelPrefix), m.To, m.Event)
+	case strings.HasPrefix(channel, userChannelPrefix):
+		username := strings.TrimPrefix(channel, userChannelPrefix)
+		if m.Disconnect != nil {
+			h.disconnectLocal(username, m.Disconnect.Code, m.Disconnect.Reason)
+			return
+		}
+		h.deliverUser(username, m.Event)
+	}
+}
+
+// subscribe and unsubscribe follow the rooms and players connected here.
+// Callers hold h.mu.
+func (h *Hub) subscribe(ctx context.Context, channel string) {
+	if ps := h.pubsub.Load(); ps != nil {
+		if err := ps.Subscribe(ctx, channel); err != nil {
+			slog.Error("subscribing", "channel", channel, "err", err)
+		}
+	}
+}
+
+func (h *Hub) unsubscribe(ctx context.Context, channel string) {
+	if ps := h.pubsub.Load(); ps != nil {
+		if err := ps.Unsubscribe(ctx, channel); err != nil {
+			slog.Error("unsubscribing", "channel", channel, "err", err)
+		}
+	}
+}
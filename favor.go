@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const defaultFavorTimeout = 20 * time.Second
+
+// favorTimeout is how long the target of a Favor has to pick a card before
+// the server gives a random one for them. Set with FAVOR_TIMEOUT.
+var favorTimeout = defaultFavorTimeout
+
+var (
+	errFavorPending = errors.New("waiting for a favor to be given")
+	errNoFavorOwed  = errors.New("you do not owe a favor")
+)
+
+// FavorRequest is a card From owes To after a Favor resolved against them.
+// Play stops until it is given.
+type FavorRequest struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Deadline time.Time `json:"deadline"`
+}
+
+type GiveRequest struct {
+	Card string `json:"card"`
+}
+
+// askFavor leaves the target of a Favor owing a card, unless they have
+// none to give.
+func (g *GameState) askFavor(from, to string) {
+	if len(g.Hands[from]) == 0 {
+		return
+	}
+	g.Favor = &FavorRequest{From: from, To: to, Deadline: time.Now().UTC().Add(favorTimeout)}
+}
+
+// give hands the card a player picked to whoever asked them for a favor.
+func (g *GameState) give(username, card string) error {
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	if g.Favor == nil || g.Favor.From != username {
+		return errNoFavorOwed
+	}
+	if !g.removeCard(username, card) {
+		return errCardNotInHand
+	}
+	g.Hands[g.Favor.To] = append(g.Hands[g.Favor.To], card)
+	g.logAction(LogEntry{Type: EventFavorGiven, Player: username, Target: g.Favor.To})
+	g.Favor = nil
+	return nil
+}
+
+// botGift is the card a bot parts with for a favor: a cat if it can, a
+// Defuse only if it must.
+func (g *GameState) botGift(bot string) string {
+	hand := g.Hands[bot]
+	for _, c := range hand {
+		if isCat(c) {
+			return c
+		}
+	}
+	for _, c := range hand {
+		if c != CardDefuse {
+			return c
+		}
+	}
+	return hand[0]
+}
+
+// scheduleFavor gives the owed card for the player once their time is up,
+// or after a moment's thought when they are a bot.
+func scheduleFavor(ctx context.Context, g *GameState) {
+	f := g.Favor
+	if f == nil {
+		return
+	}
+	wait := time.Until(f.Deadline)
+	if g.isBot(f.From) {
+		wait = botThinkTime
+	}
+	gameID, deadline := g.ID, f.Deadline
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(wait, func() {
+		var (
+			from, to, card string
+		)
+		g, err := updateGame(ctx, gameID, "favor_timeout", func(g *GameState) error {
+			f := g.Favor
+			if f == nil || !f.Deadline.Equal(deadline) {
+				return errNoChange
+			}
+			from, to = f.From, f.To
+			if g.isBot(from) {
+				card = g.botGift(from)
+				return g.give(from, card)
+			}
+			if time.Now().Before(deadline) {
+				return errNoChange
+			}
+			card = g.takeRandomCard(from, to)
+			g.logAction(LogEntry{Type: EventFavorGiven, Player: from, Target: to})
+			g.Favor = nil
+			return nil
+		})
+		if err == errNoChange || err == errGameNotFound {
+			return
+		}
+		if err != nil {
+			slog.Error("giving favor", "game", gameID, "player", from, "err", err)
+			return
+		}
+		publishFavor(ctx, g, from, to, card)
+	})
+}
+
+// publishFavor tells the table a favor has been given. Only the two
+// players involved learn which card it was.
+func publishFavor(ctx context.Context, g *GameState, from, to, card string) {
+	recordEvent(ctx, g.ID, EventFavorGiven, map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"card": card,
+	})
+	hub.broadcast(ctx, g.channel(), EventFavorGiven, map[string]interface{}{
+		"from": from,
+		"to":   to,
+	})
+	hub.notify(ctx, g.channel(), to, EventFavorReceived, map[string]interface{}{
+		"card": card,
+		"from": from,
+	})
+	publishTurn(ctx, g)
+}
+
+func giveFavor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req GiveRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+
+	var to string
+	g, err := moveGame(w, r, func(g *GameState) error {
+		if g.Favor != nil {
+			to = g.Favor.To
+		}
+		return g.give(username, req.Card)
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	publishFavor(ctx, g, username, to, req.Card)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
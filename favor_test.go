@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGiveFavor(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		card   string
+		want   error
+	}{
+		{"chosen card", "bob", CardDefuse, nil},
+		{"card not held", "bob", CardAttack, errCardNotInHand},
+		{"no favor owed", "alice", CardSkip, errNoFavorOwed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardFavor, CardSkip, CardDefuse}, "alice", "bob")
+			mustPlay(t, g, "alice", CardFavor, "bob")
+			if _, err := g.draw("alice"); err != errFavorPending {
+				t.Fatalf("drawing before the favor was given: got %v, want %v", err, errFavorPending)
+			}
+
+			err := g.give(tt.player, tt.card)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if g.Favor != nil {
+				t.Error("favor still owed after it was given")
+			}
+			if !g.hasCard("alice", tt.card) || g.hasCard("bob", tt.card) {
+				t.Errorf("%s did not move from bob to alice", tt.card)
+			}
+		})
+	}
+}
+
+func TestFavorFromEmptyHand(t *testing.T) {
+	g := testGame([]string{CardFavor}, "alice", "bob")
+	g.Hands["bob"] = nil
+	mustPlay(t, g, "alice", CardFavor, "bob")
+	if g.Favor != nil {
+		t.Errorf("bob owes %+v with nothing to give", g.Favor)
+	}
+}
+
+func TestBotGift(t *testing.T) {
+	tests := []struct {
+		name string
+		hand []string
+		want string
+	}{
+		{"a cat first", []string{CardDefuse, CardSkip, CardTacoCat}, CardTacoCat},
+		{"anything but a defuse", []string{CardDefuse, CardSkip}, CardSkip},
+		{"a defuse if it must", []string{CardDefuse}, CardDefuse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame(tt.hand, "alice", "bot")
+			if got := g.botGift("bot"); got != tt.want {
+				t.Errorf("gave %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForfeitClearsFavor(t *testing.T) {
+	for _, player := range []string{"alice", "bob"} {
+		t.Run(player, func(t *testing.T) {
+			g := testGame([]string{CardFavor, CardSkip}, "alice", "bob", "carol")
+			g.Seed = "seed"
+			g.Favor = &FavorRequest{From: "bob", To: "alice", Deadline: time.Now().Add(favorTimeout)}
+			if err := g.forfeit(player); err != nil {
+				t.Fatal(err)
+			}
+			if g.Favor != nil {
+				t.Errorf("favor %+v outlived %s forfeiting", g.Favor, player)
+			}
+		})
+	}
+}
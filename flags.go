@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Features that can be switched off, or rolled out gradually, without a
+// redeploy.
+const (
+	// FlagExpansions lets rooms add expansion cards.
+	FlagExpansions = "expansions"
+	// FlagRanked lets players join matchmaking.
+	FlagRanked = "ranked"
+	// FlagChat lets players chat in rooms.
+	FlagChat = "chat"
+)
+
+var featureFlags = []string{FlagExpansions, FlagRanked, FlagChat}
+
+const (
+	// flagsKey maps flag names to their settings. Flags that aren't set
+	// are on for everyone.
+	flagsKey = "feature_flags"
+	// flagPoll is how soon every instance picks up a changed flag.
+	flagPoll = 5 * time.Second
+)
+
+var (
+	errFlagNotFound    = errors.New("feature flag not found")
+	errFeatureDisabled = errors.New("this feature is not available")
+)
+
+// appEnv is APP_ENV, which flags can be limited to.
+var appEnv = EnvProduction
+
+// FeatureFlag is who a feature is on for. Environments limits it to those
+// APP_ENVs, or every one when empty, and Percent to that share of players.
+type FeatureFlag struct {
+	Name         string     `json:"name"`
+	Enabled      bool       `json:"enabled"`
+	Environments []string   `json:"environments,omitempty"`
+	Percent      int        `json:"percent"`
+	UpdatedBy    string     `json:"updated_by,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+// defaultFlag is a flag nobody has set: on for everyone.
+func defaultFlag(name string) *FeatureFlag {
+	return &FeatureFlag{Name: name, Enabled: true, Percent: 100}
+}
+
+// on reports whether the flag is on for username here. A player is always
+// in or out of a partial rollout, and raising Percent only adds players.
+func (f *FeatureFlag) on(username string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Environments) > 0 {
+		here := false
+		for _, env := range f.Environments {
+			here = here || env == appEnv
+		}
+		if !here {
+			return false
+		}
+	}
+	if f.Percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + ":" + username))
+	return int(h.Sum32()%100) < f.Percent
+}
+
+// FeatureFlagRequest changes a flag. Percent defaults to 100.
+type FeatureFlagRequest struct {
+	Enabled      bool     `json:"enabled"`
+	Environments []string `json:"environments"`
+	Percent      *int     `json:"percent"`
+}
+
+// flagCache holds the flags so checking one costs no round trip. The flag
+// watcher keeps it fresh.
+var flagCache = struct {
+	sync.RWMutex
+	flags map[string]*FeatureFlag
+}{flags: map[string]*FeatureFlag{}}
+
+func knownFlag(name string) bool {
+	for _, f := range featureFlags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// featureOn reports whether a feature is on for username.
+func featureOn(name, username string) bool {
+	flagCache.RLock()
+	f, ok := flagCache.flags[name]
+	flagCache.RUnlock()
+	if !ok {
+		f = defaultFlag(name)
+	}
+	return f.on(username)
+}
+
+// loadFlags reads every known flag, set or not.
+func loadFlags(ctx context.Context) (map[string]*FeatureFlag, error) {
+	raw, err := rdb.HGetAll(ctx, flagsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	flags := map[string]*FeatureFlag{}
+	for _, name := range featureFlags {
+		flags[name] = defaultFlag(name)
+		data, ok := raw[name]
+		if !ok {
+			continue
+		}
+		var f FeatureFlag
+		if err := json.Unmarshal([]byte(data), &f); err != nil {
+			slog.Error("decoding feature flag", "flag", name, "err", err)
+			continue
+		}
+		flags[name] = &f
+	}
+	return flags, nil
+}
+
+func refreshFlags(ctx context.Context) error {
+	flags, err := loadFlags(ctx)
+	if err != nil {
+		return err
+	}
+	flagCache.Lock()
+	flagCache.flags = flags
+	flagCache.Unlock()
+	return nil
+}
+
+// startFlagWatcher keeps the cached flags current. The returned func stops
+// it.
+func startFlagWatcher(ctx context.Context) func() {
+	if err := refreshFlags(ctx); err != nil {
+		slog.Error("loading feature flags", "err", err)
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(flagPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := refreshFlags(ctx); err != nil {
+					slog.Error("loading feature flags", "err", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+func sortedFlags(flags map[string]*FeatureFlag) []*FeatureFlag {
+	list := make([]*FeatureFlag, 0, len(flags))
+	for _, f := range flags {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// getFeatures tells the caller which features are on for them, so clients
+// can hide the rest.
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	username := currentUser(r)
+	features := map[string]bool{}
+	for _, name := range featureFlags {
+		features[name] = featureOn(name, username)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(features)
+}
+
+func listFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	flags, err := loadFlags(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading feature flags")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sortedFlags(flags))
+}
+
+func validateFlag(req *FeatureFlagRequest) []*FieldError {
+	problems := []*FieldError{}
+	if req.Percent != nil && (*req.Percent < 0 || *req.Percent > 100) {
+		problems = append(problems, &FieldError{Field: "percent", Code: "PERCENT_OUT_OF_RANGE", Message: "Percent must be between 0 and 100"})
+	}
+	for _, env := range req.Environments {
+		if env != EnvProduction && env != EnvDevelopment {
+			problems = append(problems, &FieldError{Field: "environments", Code: "ENVIRONMENT_UNKNOWN",
+				Message: fmt.Sprintf("Environments must be %s or %s", EnvProduction, EnvDevelopment)})
+			break
+		}
+	}
+	return problems
+}
+
+// setFlag changes a flag. This instance uses it straight away; the rest
+// within flagPoll.
+func setFlag(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+	if !knownFlag(name) {
+		respondError(w, r, http.StatusNotFound, errFlagNotFound)
+		return
+	}
+	var req FeatureFlagRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if problems := validateFlag(&req); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+	flags, err := loadFlags(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading feature flags")
+		return
+	}
+
+	now := time.Now().UTC()
+	f := &FeatureFlag{
+		Name:         name,
+		Enabled:      req.Enabled,
+		Environments: req.Environments,
+		Percent:      100,
+		UpdatedBy:    actorName(r),
+		UpdatedAt:    &now,
+	}
+	if req.Percent != nil {
+		f.Percent = *req.Percent
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		respondInternal(w, r, err, "Error saving feature flag")
+		return
+	}
+	if err := rdb.HSet(ctx, flagsKey, name, data).Err(); err != nil {
+		respondInternal(w, r, err, "Error saving feature flag")
+		return
+	}
+	if err := refreshFlags(ctx); err != nil {
+		slog.Error("loading feature flags", "err", err)
+	}
+	logFor(r).Info("feature flag changed", "flag", name, "enabled", f.Enabled, "percent", f.Percent,
+		"environments", strings.Join(f.Environments, ","))
+	audit(ctx, actorName(r), AuditFlagChanged, name, flags[name], f)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// resetFlag puts a flag back to its default, on for everyone.
+func resetFlag(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+	if !knownFlag(name) {
+		respondError(w, r, http.StatusNotFound, errFlagNotFound)
+		return
+	}
+	flags, err := loadFlags(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading feature flags")
+		return
+	}
+	if err := rdb.HDel(ctx, flagsKey, name).Err(); err != nil {
+		respondInternal(w, r, err, "Error resetting feature flag")
+		return
+	}
+	if err := refreshFlags(ctx); err != nil {
+		slog.Error("loading feature flags", "err", err)
+	}
+	logFor(r).Info("feature flag reset", "flag", name)
+	audit(ctx, actorName(r), AuditFlagChanged, name, flags[name], defaultFlag(name))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// forfeit takes a player out of the game at their own request. A kitten
+// they were holding goes back into the deck at random and an action of
+// theirs still waiting on its Nope window is withdrawn, as are a future
+// they were still altering and a favor they owed or were owed. The turn
+// moves on if it was theirs, and the last player standing wins.
+func (g *GameState) forfeit(username string) error {
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	if !g.hasPlayer(username) {
+		return errNotInGame
+	}
+	if g.isEliminated(username) {
+		return errPlayerOut
+	}
+
+	if g.Reinserting == username {
+		g.putBackKitten(g.rng().IntN(len(g.Deck) + 1))
+	}
+	if g.Pending != nil && g.Pending.Player == username {
+		g.Pending = nil
+	}
+	if g.Altering == username {
+		g.Altering = ""
+	}
+	if f := g.Favor; f != nil && (f.From == username || f.To == username) {
+		g.Favor = nil
+	}
+	g.statsFor(username).Forfeited = true
+	g.logAction(LogEntry{Type: EventPlayerForfeited, Player: username})
+	g.eliminate(username)
+	return nil
+}
+
+// publishForfeit tells the table a player has left the game and either
+// hands on the turn or wraps the game up.
+func publishForfeit(ctx context.Context, g *GameState, username string) {
+	untrackActiveGame(ctx, g.ID, username)
+	recordEvent(ctx, g.ID, EventPlayerForfeited, map[string]interface{}{"username": username})
+	hub.broadcast(ctx, g.channel(), EventPlayerForfeited, map[string]interface{}{
+		"username": username,
+		"players":  g.alivePlayers(),
+	})
+	if g.Status != GameFinished {
+		publishTurn(ctx, g)
+		return
+	}
+	completeGame(ctx, g)
+	recordEvent(ctx, g.ID, EventGameOver, map[string]interface{}{"winner": g.Winner})
+	hub.broadcast(ctx, g.channel(), EventGameOver, map[string]interface{}{
+		"winner": g.Winner,
+	})
+}
+
+func forfeitGame(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	g, err := moveGame(w, r, func(g *GameState) error {
+		return g.forfeit(username)
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	publishForfeit(ctx, g, username)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForfeit(t *testing.T) {
+	tests := []struct {
+		name    string
+		player  string
+		setup   func(t *testing.T, g *GameState)
+		current string
+		winner  string
+		kitten  bool
+	}{
+		{name: "on their turn", player: "alice", current: "bob"},
+		{name: "off their turn", player: "bob", current: "alice"},
+		{
+			name:   "last but one",
+			player: "alice",
+			setup: func(t *testing.T, g *GameState) {
+				g.eliminate("carol")
+			},
+			winner: "bob",
+		},
+		{
+			name:   "holding a kitten",
+			player: "alice",
+			setup: func(t *testing.T, g *GameState) {
+				g.Deck = append([]string{CardExploding}, g.Deck...)
+				mustDraw(t, g, "alice")
+			},
+			current: "bob",
+			kitten:  true,
+		},
+		{
+			name:   "with an action pending",
+			player: "alice",
+			setup: func(t *testing.T, g *GameState) {
+				if _, err := g.play("alice", CardSkip, "", time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			current: "bob",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardSkip, CardDefuse}, "alice", "bob", "carol")
+			g.Seed = "seed"
+			if tt.setup != nil {
+				tt.setup(t, g)
+			}
+			deck := len(g.Deck)
+			if err := g.forfeit(tt.player); err != nil {
+				t.Fatal(err)
+			}
+			if !g.isEliminated(tt.player) || !g.statsFor(tt.player).Forfeited {
+				t.Errorf("%s is still in the game", tt.player)
+			}
+			if g.Reinserting != "" || g.Pending != nil {
+				t.Errorf("left behind reinserting %q and pending %+v", g.Reinserting, g.Pending)
+			}
+			if tt.kitten && (len(g.Deck) != deck+1 || countCards(g.Deck, CardExploding) != 1) {
+				t.Errorf("the kitten did not go back into %v", g.Deck)
+			}
+			if tt.winner != "" {
+				if g.Status != GameFinished || g.Winner != tt.winner {
+					t.Errorf("game is %s won by %q, want won by %q", g.Status, g.Winner, tt.winner)
+				}
+				return
+			}
+			if got := g.currentPlayer(); got != tt.current {
+				t.Errorf("current player is %s, want %s", got, tt.current)
+			}
+		})
+	}
+}
+
+func TestForfeitRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		setup  func(g *GameState)
+		want   error
+	}{
+		{name: "not in the game", player: "dave", want: errNotInGame},
+		{name: "already out", player: "carol", setup: func(g *GameState) { g.eliminate("carol") }, want: errPlayerOut},
+		{name: "game over", player: "alice", setup: func(g *GameState) { g.Status = GameFinished }, want: errGameOver},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame(nil, "alice", "bob", "carol")
+			if tt.setup != nil {
+				tt.setup(g)
+			}
+			if err := g.forfeit(tt.player); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func countCards(cards []string, card string) int {
+	n := 0
+	for _, c := range cards {
+		if c == card {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const maxFriends = 200
+
+var (
+	errFriendSelf      = errors.New("you cannot befriend yourself")
+	errAlreadyFriends  = errors.New("already friends with that player")
+	errRequestPending  = errors.New("friend request already sent")
+	errNoFriendRequest = errors.New("no friend request from that player")
+	errNotFriends      = errors.New("not friends with that player")
+	errTooManyFriends  = errors.New("friend list is full")
+)
+
+type FriendRequest struct {
+	Username string `json:"username"`
+}
+
+// Friend is an entry on a player's friend list.
+type Friend struct {
+	Username string     `json:"username"`
+	Online   bool       `json:"online"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// PendingFriend is a friend request waiting on an answer.
+type PendingFriend struct {
+	Username string    `json:"username"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+type FriendList struct {
+	Friends  []Friend        `json:"friends"`
+	Incoming []PendingFriend `json:"incoming"`
+	Outgoing []PendingFriend `json:"outgoing"`
+}
+
+func friendsKey(username string) string {
+	return fmt.Sprintf("player:%s:friends", username)
+}
+
+// friendRequestsKey holds the requests a player has received, scored by
+// when they were sent.
+func friendRequestsKey(username string) string {
+	return fmt.Sprintf("player:%s:friend_requests", username)
+}
+
+// sentRequestsKey holds the requests a player is still waiting on.
+func sentRequestsKey(username string) string {
+	return fmt.Sprintf("player:%s:friend_requests:sent", username)
+}
+
+func areFriends(ctx context.Context, a, b string) (bool, error) {
+	return rdb.SIsMember(ctx, friendsKey(a), b).Result()
+}
+
+// makeFriends links two players and clears any requests between them.
+func makeFriends(ctx context.Context, a, b string) error {
+	pipe := rdb.TxPipeline()
+	pipe.SAdd(ctx, friendsKey(a), b)
+	pipe.SAdd(ctx, friendsKey(b), a)
+	pipe.ZRem(ctx, friendRequestsKey(a), b)
+	pipe.ZRem(ctx, friendRequestsKey(b), a)
+	pipe.ZRem(ctx, sentRequestsKey(a), b)
+	pipe.ZRem(ctx, sentRequestsKey(b), a)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func pendingFriends(ctx context.Context, key string) ([]PendingFriend, error) {
+	entries, err := rdb.ZRevRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	pending := []PendingFriend{}
+	for _, z := range entries {
+		pending = append(pending, PendingFriend{
+			Username: z.Member.(string),
+			SentAt:   time.Unix(int64(z.Score), 0).UTC(),
+		})
+	}
+	return pending, nil
+}
+
+func listFriends(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	names, err := rdb.SMembers(ctx, friendsKey(username)).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading friends")
+		return
+	}
+	sort.Strings(names)
+	list := FriendList{Friends: []Friend{}}
+	for _, name := range names {
+		p, err := loadPresence(ctx, name)
+		if err != nil {
+			respondInternal(w, r, err, "Error loading friends")
+			return
+		}
+		list.Friends = append(list.Friends, Friend{
+			Username: name,
+			Online:   p.Status != PresenceOffline,
+			Status:   p.Status,
+			LastSeen: p.LastSeen,
+		})
+	}
+	if list.Incoming, err = pendingFriends(ctx, friendRequestsKey(username)); err != nil {
+		respondInternal(w, r, err, "Error loading friends")
+		return
+	}
+	if list.Outgoing, err = pendingFriends(ctx, sentRequestsKey(username)); err != nil {
+		respondInternal(w, r, err, "Error loading friends")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// sendFriendRequest asks another player to be friends. If they had already
+// asked the caller, the two simply become friends.
+func sendFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req FriendRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Username == "" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "username is required")
+		return
+	}
+	target := req.Username
+	if target == username {
+		respondError(w, r, http.StatusBadRequest, errFriendSelf)
+		return
+	}
+	exists, err := users.UserExists(ctx, target)
+	if err != nil {
+		respondInternal(w, r, err, "Error sending friend request")
+		return
+	}
+	if !exists {
+		respondError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+	friends, err := areFriends(ctx, username, target)
+	if err != nil {
+		respondInternal(w, r, err, "Error sending friend request")
+		return
+	}
+	if friends {
+		respondError(w, r, http.StatusConflict, errAlreadyFriends)
+		return
+	}
+	count, err := rdb.SCard(ctx, friendsKey(username)).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error sending friend request")
+		return
+	}
+	if count >= maxFriends {
+		respondError(w, r, http.StatusConflict, errTooManyFriends)
+		return
+	}
+
+	_, err = rdb.ZScore(ctx, friendRequestsKey(username), target).Result()
+	if err == nil {
+		if err := makeFriends(ctx, username, target); err != nil {
+			respondInternal(w, r, err, "Error accepting friend request")
+			return
+		}
+		hub.notifyUser(ctx, target, EventFriendAccepted, map[string]interface{}{"username": username})
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "accepted"})
+		return
+	}
+	if err != redis.Nil {
+		respondInternal(w, r, err, "Error sending friend request")
+		return
+	}
+
+	now := time.Now()
+	added, err := rdb.ZAddNX(ctx, friendRequestsKey(target), &redis.Z{Score: float64(now.Unix()), Member: username}).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error sending friend request")
+		return
+	}
+	if added == 0 {
+		respondError(w, r, http.StatusConflict, errRequestPending)
+		return
+	}
+	rdb.ZAdd(ctx, sentRequestsKey(username), &redis.Z{Score: float64(now.Unix()), Member: target})
+	hub.notifyUser(ctx, target, EventFriendRequest, map[string]interface{}{"username": username})
+	notify(ctx, target, NotifyFriendRequest, map[string]string{"username": username})
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "pending"})
+}
+
+func acceptFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	from := mux.Vars(r)["username"]
+
+	_, err := rdb.ZScore(ctx, friendRequestsKey(username), from).Result()
+	if err == redis.Nil {
+		respondError(w, r, http.StatusNotFound, errNoFriendRequest)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error accepting friend request")
+		return
+	}
+	count, err := rdb.SCard(ctx, friendsKey(username)).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error accepting friend request")
+		return
+	}
+	if count >= maxFriends {
+		respondError(w, r, http.StatusConflict, errTooManyFriends)
+		return
+	}
+	if err := makeFriends(ctx, username, from); err != nil {
+		respondInternal(w, r, err, "Error accepting friend request")
+		return
+	}
+	hub.notifyUser(ctx, from, EventFriendAccepted, map[string]interface{}{"username": username})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "accepted"})
+}
+
+// declineFriendRequest turns down a request. The sender is not told.
+func declineFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	from := mux.Vars(r)["username"]
+
+	pipe := rdb.TxPipeline()
+	removed := pipe.ZRem(ctx, friendRequestsKey(username), from)
+	pipe.ZRem(ctx, sentRequestsKey(from), username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error declining friend request")
+		return
+	}
+	if removed.Val() == 0 {
+		respondError(w, r, http.StatusNotFound, errNoFriendRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "declined"})
+}
+
+// cancelFriendRequest withdraws a request the caller sent.
+func cancelFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	to := mux.Vars(r)["username"]
+
+	pipe := rdb.TxPipeline()
+	removed := pipe.ZRem(ctx, sentRequestsKey(username), to)
+	pipe.ZRem(ctx, friendRequestsKey(to), username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error cancelling friend request")
+		return
+	}
+	if removed.Val() == 0 {
+		respondError(w, r, http.StatusNotFound, errNoFriendRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "cancelled"})
+}
+
+func removeFriend(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	friend := mux.Vars(r)["username"]
+
+	pipe := rdb.TxPipeline()
+	removed := pipe.SRem(ctx, friendsKey(username), friend)
+	pipe.SRem(ctx, friendsKey(friend), username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error removing friend")
+		return
+	}
+	if removed.Val() == 0 {
+		respondError(w, r, http.StatusNotFound, errNotFriends)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// getFriendsLeaderboard ranks the caller among their friends, on the
+// lifetime board or a season's with ?season=.
+func getFriendsLeaderboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	key, err := leaderboardFor(r)
+	if err == errSeasonNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	names, err := rdb.SMembers(ctx, friendsKey(username)).Result()
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	players := []Player{}
+	for _, name := range append(names, username) {
+		score, err := leaderboards.Score(ctx, key, name)
+		if err == errNotRanked {
+			continue
+		}
+		if err != nil {
+			respondError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		players = append(players, Player{Username: name, Score: score})
+	}
+	// Same order as the full leaderboard: highest score first, ties broken
+	// by name in reverse.
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].Score != players[j].Score {
+			return players[i].Score > players[j].Score
+		}
+		return players[i].Username > players[j].Username
+	})
+	for i := range players {
+		players[i].Rank = i + 1
+	}
+	if err := fillLevels(ctx, players); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := fillStreaks(ctx, players); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(players)
+}
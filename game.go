@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	GameActive    = "active"
+	GameSuspended = "suspended"
+	GameFinished  = "finished"
+	GameExpired   = "expired"
+)
+
+// Draw outcomes reported back to the client.
+const (
+	OutcomeSafe     = "safe"
+	OutcomeDefused  = "defused"
+	OutcomeExploded = "exploded"
+)
+
+var (
+	errGameNotFound = errors.New("game not found")
+	errGameOver     = errors.New("game is already over")
+	errNotInGame    = errors.New("player is not in this game")
+	errDeckEmpty    = errors.New("deck is empty")
+	errBadVersion   = errors.New("If-Match must be a game version")
+	// errNoChange aborts an updateGame without saving anything.
+	errNoChange = errors.New("game left unchanged")
+)
+
+type DrawResult struct {
+	Card         string   `json:"card"`
+	Outcome      string   `json:"outcome"`
+	CardsLeft    int      `json:"cards_left"`
+	HasDefuse    bool     `json:"has_defuse"`
+	MustReinsert bool     `json:"must_reinsert"`
+	Hand         []string `json:"hand"`
+	Status       string   `json:"status"`
+	Winner       string   `json:"winner,omitempty"`
+}
+
+func gameKey(id string) string {
+	return fmt.Sprintf("game:%s", id)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func newGame(roomID string, players []string, rules *HouseRules) *GameState {
+	seed := newSeed()
+	stats := make(map[string]*GameStats, len(players))
+	for _, p := range players {
+		stats[p] = &GameStats{}
+	}
+	g := &GameState{
+		ID:         newID(),
+		RoomID:     roomID,
+		Players:    players,
+		TurnsOwed:  1,
+		Status:     GameActive,
+		Stats:      stats,
+		Seed:       seed,
+		Commitment: seedCommitment(seed),
+		DealtTo:    append([]string{}, players...),
+		Rules:      rules,
+		Modifiers:  activeModifiers(),
+		StartedAt:  time.Now().UTC(),
+	}
+	g.Deck, g.Hands = dealGame(g, seededRand(seed, "deal"))
+	g.Composition = composition(g.Deck, g.Hands)
+	g.startTurnClock()
+	return g
+}
+
+func loadGame(ctx context.Context, id string) (*GameState, error) {
+	return games.LoadGame(ctx, id)
+}
+
+// saveGame stores a new game and records its start.
+func saveGame(ctx context.Context, g *GameState) error {
+	if err := games.SaveGame(ctx, g); err != nil {
+		return err
+	}
+	recordChange(ctx, ActionStart, "", nil, g)
+	return nil
+}
+
+// updateGame makes a change to a stored game atomically and records it
+// under action. See GameStore.UpdateGame.
+func updateGame(ctx context.Context, id, action string, change func(g *GameState) error) (*GameState, error) {
+	return updateGameAs(ctx, id, action, "", change)
+}
+
+// updateGameAs is updateGame for a change a player made.
+func updateGameAs(ctx context.Context, id, action, actor string, change func(g *GameState) error) (*GameState, error) {
+	var (
+		g      *GameState
+		before []byte
+	)
+	// The lock queues moves from every instance, so two can't act on the
+	// same turn; UpdateGame still guards against a lock that expired.
+	err := withLock(ctx, gameLockKey(id), errGameBusy, func() (err error) {
+		g, err = games.UpdateGame(ctx, id, func(g *GameState) error {
+			before, _ = json.Marshal(g)
+			return change(g)
+		})
+		return err
+	})
+	if err == nil {
+		recordChange(ctx, action, actor, before, g)
+	}
+	return g, err
+}
+
+func (g *GameState) hasPlayer(username string) bool {
+	for _, p := range g.Players {
+		if p == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GameState) hasCard(username, card string) bool {
+	for _, c := range g.Hands[username] {
+		if c == card {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GameState) removeCard(username, card string) bool {
+	hand := g.Hands[username]
+	for i, c := range hand {
+		if c == card {
+			g.Hands[username] = append(hand[:i:i], hand[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// draw pops the top card of the deck for the current player, applies its
+// effect and ends their turn.
+func (g *GameState) draw(username string) (*DrawResult, error) {
+	if err := g.requireTurn(username); err != nil {
+		return nil, err
+	}
+	if err := g.requireIdle(); err != nil {
+		return nil, err
+	}
+	if len(g.Deck) == 0 {
+		return nil, errDeckEmpty
+	}
+	card := g.Deck[0]
+	g.Deck = g.Deck[1:]
+	g.statsFor(username).CardsDrawn++
+	if card == CardDefuse {
+		g.statsFor(username).DefusesDrawn++
+	}
+	g.botsSawDraw()
+
+	outcome := OutcomeSafe
+	switch {
+	case card == CardExploding:
+		if g.removeCard(username, CardDefuse) {
+			g.Reinserting = username
+			g.discard(CardDefuse)
+			g.statsFor(username).Defused++
+			outcome = OutcomeDefused
+		} else {
+			g.eliminate(username)
+			outcome = OutcomeExploded
+		}
+	case card == CardImploding && g.ImplodingFaceUp:
+		// There is no defusing an Imploding Kitten once it is face up.
+		g.eliminate(username)
+		outcome = OutcomeImploded
+	case card == CardImploding:
+		g.Reinserting = username
+		g.ReinsertCard = CardImploding
+		outcome = OutcomeRevealed
+	default:
+		g.Hands[username] = append(g.Hands[username], card)
+	}
+	entry := LogEntry{Type: EventCardDrawn, Player: username, Outcome: outcome}
+	if isKitten(card) {
+		entry.Card = card
+	}
+	g.logAction(entry)
+
+	// A kitten to put back keeps the turn open until it has been put back.
+	if g.Reinserting == username {
+		return g.drawResult(username, card, outcome), nil
+	}
+	if g.Status == GameActive && len(g.Deck) == 0 {
+		g.Status = GameFinished
+		g.Winner = username
+	}
+	if g.Status == GameActive && outcome != OutcomeExploded && outcome != OutcomeImploded {
+		g.endTurn()
+	}
+
+	return g.drawResult(username, card, outcome), nil
+}
+
+func (g *GameState) drawResult(username, card, outcome string) *DrawResult {
+	return &DrawResult{
+		Card:         card,
+		Outcome:      outcome,
+		CardsLeft:    len(g.Deck),
+		HasDefuse:    g.hasCard(username, CardDefuse),
+		MustReinsert: g.Reinserting == username,
+		Hand:         g.Hands[username],
+		Status:       g.Status,
+		Winner:       g.Winner,
+	}
+}
+
+// completeGame runs the bookkeeping owed once a game reaches a terminal
+// state. History, ratings, the winner's payout and achievements are left to
+// the change feed's processors.
+func completeGame(ctx context.Context, g *GameState) {
+	finishRoom(ctx, g)
+	untrackActiveGame(ctx, g.ID, append(append([]string{}, g.Players...), g.Abandoned...)...)
+	advanceTournament(ctx, g)
+	awardXP(ctx, g)
+	trackChallenges(ctx, g)
+	countGameFinished(ctx, g, time.Now())
+}
+
+// publishDraw notifies the game's subscribers about a draw. Drawn cards go
+// into the player's hand, so only kittens are revealed.
+func publishDraw(ctx context.Context, g *GameState, username string, result *DrawResult) {
+	recordEvent(ctx, g.ID, EventCardDrawn, map[string]interface{}{
+		"username": username,
+		"card":     result.Card,
+		"outcome":  result.Outcome,
+	})
+	payload := map[string]interface{}{
+		"username":   username,
+		"cards_left": result.CardsLeft,
+	}
+	if isKitten(result.Card) {
+		payload["card"] = result.Card
+	}
+	hub.broadcast(ctx, g.channel(), EventCardDrawn, payload)
+	switch result.Outcome {
+	case OutcomeDefused, OutcomeExploded, OutcomeImploded:
+		hub.broadcast(ctx, g.channel(), EventExplosion, map[string]interface{}{
+			"username": username,
+			"card":     result.Card,
+			"defused":  result.Outcome == OutcomeDefused,
+		})
+	}
+	if g.Status == GameFinished {
+		recordEvent(ctx, g.ID, EventGameOver, map[string]interface{}{"winner": g.Winner})
+		hub.broadcast(ctx, g.channel(), EventGameOver, map[string]interface{}{
+			"winner": g.Winner,
+		})
+		return
+	}
+	publishTurn(ctx, g)
+}
+
+func createGame(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	g := newGame("", []string{username}, nil)
+	if err := saveGame(ctx, g); err != nil {
+		respondInternal(w, r, err, "Error creating game")
+		return
+	}
+	recordGameStart(ctx, g)
+	trackActiveGame(ctx, g)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         g.ID,
+		"cards_left": len(g.Deck),
+		"status":     g.Status,
+	})
+}
+
+// anyVersion accepts a move whatever the game's current version.
+const anyVersion = -1
+
+// expectedVersion reads the game version a client's move was based on from
+// If-Match. Clients that send none get anyVersion.
+func expectedVersion(r *http.Request) (int64, error) {
+	return parseVersion(r.Header.Get("If-Match"))
+}
+
+// parseVersion reads a version as If-Match carries it.
+func parseVersion(v string) (int64, error) {
+	v = strings.Trim(strings.TrimSpace(v), `"`)
+	if v == "" || v == "*" {
+		return anyVersion, nil
+	}
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || version < 0 {
+		return 0, errBadVersion
+	}
+	return version, nil
+}
+
+// checkVersion rejects a move based on an older version of the game.
+func (g *GameState) checkVersion(expected int64) error {
+	if expected != anyVersion && expected != g.Version {
+		return errStaleVersion
+	}
+	return nil
+}
+
+// etag is the game's version as an entity tag, to be sent back in If-Match.
+func (g *GameState) etag() string {
+	return strconv.Quote(strconv.FormatInt(g.Version, 10))
+}
+
+// moveGame applies a player's move to the game named in the request. The
+// move is refused if the client based it on an older version than the one
+// stored, and the response carries the new version in ETag.
+func moveGame(w http.ResponseWriter, r *http.Request, move func(g *GameState) error) (*GameState, error) {
+	ctx := r.Context()
+	expected, err := expectedVersion(r)
+	if err != nil {
+		return nil, err
+	}
+	g, err := applyMove(ctx, mux.Vars(r)["id"], path.Base(routeName(r)), currentUser(r), expected, move)
+	if err == nil {
+		w.Header().Set("ETag", g.etag())
+	}
+	return g, err
+}
+
+// applyMove is moveGame without the HTTP, for the gRPC API.
+func applyMove(ctx context.Context, id, action, username string, expected int64, move func(g *GameState) error) (*GameState, error) {
+	return updateGameAs(ctx, id, action, username, func(g *GameState) error {
+		if err := g.checkVersion(expected); err != nil {
+			return err
+		}
+		if g.Status == GameSuspended {
+			return errGameSuspended
+		}
+		if err := move(g); err != nil {
+			return err
+		}
+		g.resetTimeouts(username)
+		return nil
+	})
+}
+
+// respondGameError reports a failed move: rule violations are the
+// player's problem, anything else is the server's.
+func respondGameError(w http.ResponseWriter, r *http.Request, err error) {
+	respondError(w, r, gameErrorStatus(err), err)
+}
+
+func gameErrorStatus(err error) int {
+	switch {
+	case err == errGameNotFound:
+		return http.StatusNotFound
+	case err == errNotInGame:
+		return http.StatusForbidden
+	case err == errCardNotPlayable, err == errInvalidTarget, err == errBadPosition, err == errBadAlteration,
+		err == errBadCombo, err == errBadNamedCard, err == errBadVersion:
+		return http.StatusBadRequest
+	case knownError(err):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func drawCard(w http.ResponseWriter, r *http.Request) {
+	expected, err := expectedVersion(r)
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	g, result, err := drawFor(r.Context(), mux.Vars(r)["id"], currentUser(r), expected)
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", g.etag())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// drawFor draws a card for username and tells the table, for the REST and
+// gRPC APIs alike.
+func drawFor(ctx context.Context, id, username string, expected int64) (*GameState, *DrawResult, error) {
+	var (
+		g       *GameState
+		settled *Resolution
+		result  *DrawResult
+	)
+	err := traceStep(ctx, "draw", func(ctx context.Context) (err error) {
+		g, err = applyMove(ctx, id, "draw", username, expected, func(g *GameState) (err error) {
+			settled = g.settle(time.Now())
+			result, err = g.draw(username)
+			return err
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	traceStep(ctx, "publish draw", func(ctx context.Context) error {
+		if g.Status == GameFinished {
+			completeGame(ctx, g)
+		}
+		publishResolution(ctx, g, settled)
+		publishDraw(ctx, g, username, result)
+		return nil
+	})
+	return g, result, nil
+}
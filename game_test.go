@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testGames saves g to an in-memory game store for one test.
+func testGames(t *testing.T, g *GameState) {
+	t.Helper()
+	ctx := context.Background()
+	testRedis(t)
+	saved := games
+	games = newMemoryStore()
+	t.Cleanup(func() { games = saved })
+	if err := games.SaveGame(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gameRequest builds a request from username against g's routes.
+func gameRequest(g *GameState, username, method, body, ifMatch string) *http.Request {
+	r := httptest.NewRequest(method, "/api/v1/game/"+g.ID, strings.NewReader(body))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	r = mux.SetURLVars(r, map[string]string{"id": g.ID})
+	return r.WithContext(context.WithValue(r.Context(), usernameKey, username))
+}
+
+func TestPlayCardVersions(t *testing.T) {
+	g := testGame([]string{CardSeeTheFuture, CardShuffle}, "alice", "bob")
+	testGames(t, g)
+
+	w := httptest.NewRecorder()
+	playCard(w, gameRequest(g, "alice", "POST", `{"card":"`+CardSeeTheFuture+`"}`, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var res PlayResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if etag := (&GameState{Version: res.State.Version}).etag(); w.Header().Get("ETag") != etag {
+		t.Errorf("ETag %s, but the body is at version %s", w.Header().Get("ETag"), etag)
+	}
+
+	w = httptest.NewRecorder()
+	playCard(w, gameRequest(g, "alice", "POST", `{"card":"`+CardShuffle+`"}`, `"0"`))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "STALE_VERSION") {
+		t.Errorf("playing on version 0: status %d %s, want %d STALE_VERSION", w.Code, w.Body, http.StatusConflict)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// gameLogSize is how many of a game's most recent actions its public log
+// keeps.
+const gameLogSize = 100
+
+// LogEntry is one action in a game's public log. Type is the event the
+// action was announced as, and hidden cards are left out: draws only name
+// kittens, and a favor never names the card given.
+type LogEntry struct {
+	Type    string    `json:"type"`
+	Player  string    `json:"player,omitempty"`
+	Card    string    `json:"card,omitempty"`
+	Cards   []string  `json:"cards,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Named   string    `json:"named,omitempty"`
+	Outcome string    `json:"outcome,omitempty"`
+	Noped   bool      `json:"noped,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// StateView is a game as one player needs it to redraw the table: the turn
+// state, the discard pile and what has happened so far, their own hand,
+// and only how many cards everyone else holds.
+type StateView struct {
+	*TurnView
+	Discard   []string       `json:"discard"`
+	Log       []LogEntry     `json:"log"`
+	Hand      []string       `json:"hand,omitempty"`
+	HandSizes map[string]int `json:"hand_sizes"`
+}
+
+// logAction adds an entry to the game's public log, dropping the oldest
+// once it is full.
+func (g *GameState) logAction(e LogEntry) {
+	e.At = time.Now().UTC()
+	g.Log = append(g.Log, e)
+	if len(g.Log) > gameLogSize {
+		g.Log = append([]LogEntry{}, g.Log[len(g.Log)-gameLogSize:]...)
+	}
+}
+
+// stateView shows the game to username, who sees their hand only if they
+// are playing.
+func (g *GameState) stateView(username string) *StateView {
+	view := &StateView{
+		TurnView:  g.turnView(),
+		Discard:   g.Discard,
+		Log:       g.Log,
+		HandSizes: make(map[string]int, len(g.Players)),
+	}
+	for _, p := range g.Players {
+		view.HandSizes[p] = len(g.Hands[p])
+	}
+	if g.hasPlayer(username) {
+		view.Hand = g.Hands[username]
+	}
+	if view.Discard == nil {
+		view.Discard = []string{}
+	}
+	if view.Log == nil {
+		view.Log = []LogEntry{}
+	}
+	return view
+}
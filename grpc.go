@@ -0,0 +1,692 @@
+package main
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=hello --go-grpc_out=. --go-grpc_opt=module=hello proto/kittens/v1/kittens.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "hello/kittenspb"
+)
+
+// grpcErrorDomain names this API in the ErrorInfo on refused calls.
+const grpcErrorDomain = "kittens.v1"
+
+var errAlreadyJoined = errors.New("this stream has already joined a game")
+
+// grpcPublic are the methods callable without an access token.
+var grpcPublic = map[string]bool{
+	pb.Kittens_Login_FullMethodName:          true,
+	pb.Kittens_GetLeaderboard_FullMethodName: true,
+}
+
+// grpcReadOnly are the methods that keep working during maintenance.
+var grpcReadOnly = map[string]bool{
+	pb.Kittens_Login_FullMethodName:          true,
+	pb.Kittens_GetLeaderboard_FullMethodName: true,
+	pb.Kittens_GetGame_FullMethodName:        true,
+	pb.Kittens_StreamEvents_FullMethodName:   true,
+}
+
+// grpcRoutes names the REST route each unary method shares its rate limit
+// with, so a client gets the same budget over either API.
+var grpcRoutes = map[string]string{
+	pb.Kittens_Login_FullMethodName:          "/login",
+	pb.Kittens_GetLeaderboard_FullMethodName: "/leaderboard",
+	pb.Kittens_GetGame_FullMethodName:        "/game/{id}/state",
+	pb.Kittens_DrawCard_FullMethodName:       "/game/{id}/draw",
+	pb.Kittens_PlayCard_FullMethodName:       "/game/{id}/play",
+}
+
+// grpcCodes turns the REST API's statuses into gRPC's.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// startGRPC serves the gRPC API on port, over TLS when TLS_CERT_FILE is
+// set and in plaintext otherwise, for a proxy to terminate TLS. The
+// returned func drains it, cutting off whatever is still open after
+// shutdownTimeout.
+func startGRPC(port string, hc HTTPSConfig) func() {
+	var opts []grpc.ServerOption
+	if hc.CertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(hc.CertFile, hc.KeyFile)
+		if err != nil {
+			fatal("loading gRPC certificate", "err", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(grpcUnary),
+		grpc.ChainStreamInterceptor(grpcStream),
+	)
+	srv := grpc.NewServer(opts...)
+	pb.RegisterKittensServer(srv, kittensServer{})
+
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fatal("listening for gRPC", "port", port, "err", err)
+	}
+	slog.Info("gRPC server starting", "port", port)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			slog.Error("gRPC server stopped", "err", err)
+		}
+	}()
+	return func() {
+		drained := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(shutdownTimeout):
+			srv.Stop()
+		}
+	}
+}
+
+// grpcUnary authenticates and rate limits unary calls.
+func grpcUnary(c context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcClientVersion(c); err != nil {
+		return nil, err
+	}
+	c, err := grpcAuthenticate(c, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	limit, ok := routeLimits[grpcRoutes[info.FullMethod]]
+	if !ok {
+		limit = defaultLimit
+	}
+	if err := grpcTake(c, limit); err != nil {
+		return nil, err
+	}
+	if err := grpcMaintenance(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(c, req)
+}
+
+// grpcStream authenticates streams. Moves made over Play spend the same
+// rate limits as unary calls.
+func grpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcClientVersion(ss.Context()); err != nil {
+		return err
+	}
+	c, err := grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if err := grpcMaintenance(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, c: c})
+}
+
+// grpcMaintenance refuses methods that change games while maintenance is
+// on, as duringMaintenance does REST writes.
+func grpcMaintenance(method string) error {
+	m := currentMaintenance()
+	if m == nil || grpcReadOnly[method] {
+		return nil
+	}
+	if wait := m.retryAfter(); wait > 0 {
+		return grpcRetryable(codes.Unavailable, CodeMaintenance, m.message(defaultLocale), wait)
+	}
+	return grpcStatus(codes.Unavailable, CodeMaintenance, m.message(defaultLocale))
+}
+
+// authedStream carries the context grpcAuthenticate made to the handler.
+type authedStream struct {
+	grpc.ServerStream
+	c context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.c
+}
+
+// grpcAuthenticate checks the access token in the call's metadata, as
+// requireAuth does the Authorization header, and puts the username in the
+// context.
+func grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	token := grpcBearerToken(ctx)
+	if grpcPublic[method] && token == "" {
+		return ctx, nil
+	}
+	if token == "" {
+		return nil, grpcStatus(codes.Unauthenticated, CodeUnauthorized, "Authorization required")
+	}
+	username, err := authenticate(ctx, token)
+	if err == errInvalidToken {
+		return nil, grpcError(http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return nil, grpcInternal(err, "Error checking account")
+	}
+	ban, err := loadBan(ctx, username)
+	if err != nil {
+		return nil, grpcInternal(err, "Error checking account")
+	}
+	if ban != nil {
+		return nil, grpcStatus(codes.PermissionDenied, errorCodes[errAccountBanned], ban.message())
+	}
+	return context.WithValue(ctx, usernameKey, username), nil
+}
+
+func grpcBearerToken(c context.Context) string {
+	md, _ := metadata.FromIncomingContext(c)
+	for _, v := range md.Get("authorization") {
+		if strings.HasPrefix(v, "Bearer ") {
+			return strings.TrimPrefix(v, "Bearer ")
+		}
+	}
+	return ""
+}
+
+// grpcUser returns the username grpcAuthenticate found, if any.
+func grpcUser(c context.Context) string {
+	username, _ := c.Value(usernameKey).(string)
+	return username
+}
+
+// grpcPeerIP is the caller's address, believing x-forwarded-for only with
+// TRUST_PROXY, as clientIP does.
+func grpcPeerIP(c context.Context) string {
+	if trustProxy {
+		md, _ := metadata.FromIncomingContext(c)
+		if fwd := forwardedFor(md.Get("x-forwarded-for"), proxyHops); fwd != "" {
+			return fwd
+		}
+	}
+	p, ok := peer.FromContext(c)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcTake spends a token from the caller's bucket, by username once
+// signed in and by IP before.
+func grpcTake(ctx context.Context, limit rateLimit) error {
+	caller := "ip:" + grpcPeerIP(ctx)
+	if username := grpcUser(ctx); username != "" {
+		caller = "user:" + username
+	}
+	allowed, left, err := limit.take(ctx, caller)
+	if err != nil {
+		slog.Error("checking rate limit", "bucket", limit.Name, "err", err)
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+	wait := time.Duration((1 - left) / limit.Rate * float64(time.Second))
+	return grpcRetryable(codes.ResourceExhausted, CodeRateLimited, "Too many requests", wait)
+}
+
+// grpcStatus is a refusal carrying the REST API's error code.
+func grpcStatus(c codes.Code, code, message string) error {
+	st := status.New(c, message)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: code, Domain: grpcErrorDomain}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// grpcRetryable is a refusal that also says when to try again.
+func grpcRetryable(c codes.Code, code, message string, wait time.Duration) error {
+	st := status.New(c, message)
+	if detailed, err := st.WithDetails(
+		&errdetails.ErrorInfo{Reason: code, Domain: grpcErrorDomain},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)},
+	); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// grpcError is respondError for gRPC: err with its code, or a generic
+// internal error that is logged rather than shown.
+func grpcError(httpStatus int, err error) error {
+	if httpStatus >= http.StatusInternalServerError || !knownError(err) {
+		return grpcInternal(err, "Internal server error")
+	}
+	return grpcStatus(grpcCodes[httpStatus], errorCodes[err], err.Error())
+}
+
+// grpcInternal is respondInternal for gRPC.
+func grpcInternal(err error, message string) error {
+	if storageDown(err) {
+		slog.Warn("redis unavailable", "err", err)
+		code := CodeStorageDown
+		if redisTimedOut(err) {
+			code = CodeStorageTimeout
+		}
+		return grpcRetryable(codes.Unavailable, code, "The server is busy, try again shortly", redisRetryAfter)
+	}
+	slog.Error("gRPC call failed", "err", err)
+	return grpcStatus(codes.Internal, CodeInternal, message)
+}
+
+// kittensServer implements the gRPC API on top of the functions the REST
+// handlers use.
+type kittensServer struct {
+	pb.UnimplementedKittensServer
+}
+
+func (kittensServer) Login(ctx context.Context, in *pb.LoginRequest) (*pb.TokenResponse, error) {
+	tokens, wait, ban, err := signIn(ctx, grpcPeerIP(ctx), LoginRequest{
+		Username:     in.Username,
+		Password:     in.Password,
+		CaptchaToken: in.CaptchaToken,
+	})
+	switch {
+	case ban != nil:
+		return nil, grpcStatus(codes.PermissionDenied, errorCodes[errAccountBanned], ban.message())
+	case err == errInvalidCredentials:
+		return nil, grpcError(http.StatusUnauthorized, err)
+	case err == errLoginLocked:
+		return nil, grpcRetryable(codes.ResourceExhausted, errorCodes[err], err.Error(), wait)
+	case err == errCaptchaRequired, err == errCaptchaFailed:
+		return nil, grpcError(http.StatusUnauthorized, err)
+	case errors.Is(err, errCaptchaDown):
+		slog.Error("verifying CAPTCHA", "err", err)
+		return nil, grpcStatus(codes.Unavailable, CodeUnavailable, errCaptchaDown.Error())
+	case err != nil:
+		return nil, grpcInternal(err, "Error signing in")
+	}
+	return &pb.TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType:    tokens.TokenType,
+		ExpiresIn:    int32(tokens.ExpiresIn),
+	}, nil
+}
+
+func (kittensServer) GetLeaderboard(ctx context.Context, in *pb.LeaderboardRequest) (*pb.LeaderboardResponse, error) {
+	limit, offset := int(in.Limit), int(in.Offset)
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit < 0 || offset < 0 {
+		return nil, grpcError(http.StatusBadRequest, errBadPagination)
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	key, err := seasonLeaderboard(ctx, in.Season)
+	if err == errSeasonNotFound {
+		return nil, grpcError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return nil, grpcInternal(err, "Error loading leaderboard")
+	}
+	page, _, err := cachedLeaderboardPage(ctx, key, limit, offset)
+	if err != nil {
+		return nil, grpcInternal(err, "Error loading leaderboard")
+	}
+
+	var players []Player
+	if err := json.Unmarshal(page.body, &players); err != nil {
+		return nil, grpcInternal(err, "Error loading leaderboard")
+	}
+	resp := &pb.LeaderboardResponse{Total: page.total}
+	for _, p := range players {
+		resp.Players = append(resp.Players, &pb.Player{
+			Username: p.Username,
+			Score:    int32(p.Score),
+			Rank:     int32(p.Rank),
+			Level:    int32(p.Level),
+			Streak:   int32(p.Streak),
+		})
+	}
+	return resp, nil
+}
+
+func (kittensServer) GetGame(ctx context.Context, in *pb.GameRequest) (*pb.GameState, error) {
+	g, err := loadGame(ctx, in.GameId)
+	if err == errGameNotFound {
+		return nil, grpcError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return nil, grpcInternal(err, "Error loading game")
+	}
+	return gameStateMessage(g.stateView(grpcUser(ctx))), nil
+}
+
+func (kittensServer) DrawCard(c context.Context, in *pb.DrawCardRequest) (*pb.DrawResult, error) {
+	g, result, err := grpcDraw(c, in)
+	if err != nil {
+		return nil, grpcError(gameErrorStatus(err), err)
+	}
+	return drawResultMessage(g, result), nil
+}
+
+func (kittensServer) PlayCard(c context.Context, in *pb.PlayCardRequest) (*pb.PlayResult, error) {
+	g, result, err := grpcPlay(c, in)
+	if err != nil {
+		return nil, grpcError(gameErrorStatus(err), err)
+	}
+	return playResultMessage(g, result), nil
+}
+
+func grpcDraw(c context.Context, in *pb.DrawCardRequest) (*GameState, *DrawResult, error) {
+	expected, err := parseVersion(in.IfMatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	return drawFor(c, in.GameId, grpcUser(c), expected)
+}
+
+func grpcPlay(ctx context.Context, in *pb.PlayCardRequest) (*GameState, *PlayResult, error) {
+	expected, err := parseVersion(in.IfMatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	return playFor(ctx, in.GameId, grpcUser(ctx), expected, PlayRequest{Card: in.Card, Target: in.Target})
+}
+
+// StreamEvents subscribes to a game like a websocket does, and relays its
+// events until the caller hangs up or is disconnected.
+func (kittensServer) StreamEvents(in *pb.StreamEventsRequest, stream pb.Kittens_StreamEventsServer) error {
+	c, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
+
+	client, _, missed, err := joinGameStream(c, grpcUser(c), in.GameId, in.Since, cancel)
+	if err != nil {
+		return grpcError(gameErrorStatus(err), err)
+	}
+	defer leaveGameStream(context.WithoutCancel(c), client)
+
+	for _, data := range missed {
+		if err := relayEvent(data, stream.Send); err != nil {
+			return err
+		}
+	}
+	heartbeat := time.NewTicker(pingPeriod)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return streamEnded(c)
+		case data, ok := <-client.send:
+			if !ok {
+				return status.Error(codes.Unavailable, "event stream fell behind")
+			}
+			if err := relayEvent(data, stream.Send); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			touchPresence(c, client)
+		}
+	}
+}
+
+// Play serves a realtime client: a join subscribes the stream to a game,
+// after which draws and plays are answered on it between the game's
+// events. Refused actions are answered with an Error rather than ending
+// the stream.
+func (kittensServer) Play(stream pb.Kittens_PlayServer) error {
+	c, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
+	username := grpcUser(c)
+
+	actions := make(chan *pb.PlayAction)
+	received := make(chan error, 1)
+	go func() {
+		for {
+			action, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			select {
+			case actions <- action:
+			case <-c.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		client *Client
+		gameID string
+		events <-chan []byte
+	)
+	defer func() {
+		if client != nil {
+			// c is done by now; the cleanup must still run.
+			leaveGameStream(context.WithoutCancel(c), client)
+		}
+	}()
+	heartbeat := time.NewTicker(pingPeriod)
+	defer heartbeat.Stop()
+	send := func(u *pb.PlayUpdate) error { return stream.Send(u) }
+	sendEvent := func(ev *pb.GameEvent) error {
+		return send(&pb.PlayUpdate{Update: &pb.PlayUpdate_Event{Event: ev}})
+	}
+
+	for {
+		select {
+		case <-c.Done():
+			return streamEnded(c)
+		case err := <-received:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case data, ok := <-events:
+			if !ok {
+				return status.Error(codes.Unavailable, "event stream fell behind")
+			}
+			if err := relayEvent(data, sendEvent); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if client != nil {
+				touchPresence(c, client)
+			}
+		case action := <-actions:
+			var reply *pb.PlayUpdate
+			switch a := action.Action.(type) {
+			case *pb.PlayAction_Join:
+				if client != nil {
+					reply = playError(errAlreadyJoined)
+					break
+				}
+				joined, g, missed, err := joinGameStream(c, username, a.Join.GameId, a.Join.Since, cancel)
+				if err != nil {
+					reply = playError(err)
+					break
+				}
+				client, gameID, events = joined, g.ID, joined.send
+				reply = &pb.PlayUpdate{Update: &pb.PlayUpdate_Joined{Joined: gameStateMessage(g.stateView(username))}}
+				reply.Ref = action.Ref
+				if err := send(reply); err != nil {
+					return err
+				}
+				for _, data := range missed {
+					if err := relayEvent(data, sendEvent); err != nil {
+						return err
+					}
+				}
+				continue
+			case *pb.PlayAction_Draw:
+				if err := grpcTake(c, routeLimits["/game/{id}/draw"]); err != nil {
+					reply = playRefusal(err)
+					break
+				}
+				if a.Draw.GameId == "" {
+					a.Draw.GameId = gameID
+				}
+				g, result, err := grpcDraw(c, a.Draw)
+				if err != nil {
+					reply = playError(err)
+					break
+				}
+				reply = &pb.PlayUpdate{Update: &pb.PlayUpdate_Draw{Draw: drawResultMessage(g, result)}}
+			case *pb.PlayAction_Play:
+				if err := grpcTake(c, routeLimits["/game/{id}/play"]); err != nil {
+					reply = playRefusal(err)
+					break
+				}
+				if a.Play.GameId == "" {
+					a.Play.GameId = gameID
+				}
+				g, result, err := grpcPlay(c, a.Play)
+				if err != nil {
+					reply = playError(err)
+					break
+				}
+				reply = &pb.PlayUpdate{Update: &pb.PlayUpdate_Play{Play: playResultMessage(g, result)}}
+			default:
+				reply = &pb.PlayUpdate{Update: &pb.PlayUpdate_Error{Error: &pb.Error{
+					Code:    CodeBadRequest,
+					Message: "action must be join, draw or play",
+				}}}
+			}
+			reply.Ref = action.Ref
+			if err := send(reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamEnded is how a stream ends once its context is done: with the
+// reason it was disconnected, or quietly when the caller went away.
+func streamEnded(c context.Context) error {
+	cause := context.Cause(c)
+	if cause == nil || errors.Is(cause, context.Canceled) || errors.Is(cause, context.DeadlineExceeded) {
+		return c.Err()
+	}
+	return status.Error(codes.Unavailable, cause.Error())
+}
+
+func playError(err error) *pb.PlayUpdate {
+	return playRefusal(grpcError(gameErrorStatus(err), err))
+}
+
+// playRefusal puts a refusal from grpcError or grpcTake in an update.
+func playRefusal(err error) *pb.PlayUpdate {
+	st := status.Convert(err)
+	code := CodeInternal
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			code = info.Reason
+		}
+	}
+	return &pb.PlayUpdate{Update: &pb.PlayUpdate_Error{Error: &pb.Error{Code: code, Message: st.Message()}}}
+}
+
+// relayEvent converts an event the hub encoded for websockets and sends
+// it. Events that cannot be converted are logged and skipped.
+func relayEvent(data []byte, send func(*pb.GameEvent) error) error {
+	ev, err := eventMessage(data)
+	if err != nil {
+		slog.Error("converting event for gRPC", "err", err)
+		return nil
+	}
+	return send(ev)
+}
+
+func eventMessage(data []byte) (*pb.GameEvent, error) {
+	var ev struct {
+		Seq     int64           `json:"seq"`
+		Type    string          `json:"type"`
+		Room    string          `json:"room"`
+		Payload json.RawMessage `json:"payload"`
+		Time    time.Time       `json:"time"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, err
+	}
+	msg := &pb.GameEvent{Seq: ev.Seq, Type: ev.Type, Room: ev.Room, Time: timestamppb.New(ev.Time)}
+	if len(ev.Payload) > 0 && ev.Payload[0] == '{' {
+		msg.Payload = &structpb.Struct{}
+		if err := protojson.Unmarshal(ev.Payload, msg.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func gameStateMessage(v *StateView) *pb.GameState {
+	msg := &pb.GameState{
+		Id:            v.ID,
+		Version:       v.Version,
+		RoomId:        v.RoomID,
+		Status:        v.Status,
+		Players:       v.Players,
+		Eliminated:    v.Eliminated,
+		CurrentPlayer: v.CurrentPlayer,
+		TurnsOwed:     int32(v.TurnsOwed),
+		CardsLeft:     int32(v.CardsLeft),
+		Winner:        v.Winner,
+		Hand:          v.Hand,
+		HandSizes:     make(map[string]int32, len(v.HandSizes)),
+		Discard:       v.Discard,
+	}
+	for p, n := range v.HandSizes {
+		msg.HandSizes[p] = int32(n)
+	}
+	return msg
+}
+
+func drawResultMessage(g *GameState, r *DrawResult) *pb.DrawResult {
+	return &pb.DrawResult{
+		Card:         r.Card,
+		Outcome:      r.Outcome,
+		CardsLeft:    int32(r.CardsLeft),
+		HasDefuse:    r.HasDefuse,
+		MustReinsert: r.MustReinsert,
+		Hand:         r.Hand,
+		Status:       r.Status,
+		Winner:       r.Winner,
+		Version:      g.Version,
+	}
+}
+
+func playResultMessage(g *GameState, r *PlayResult) *pb.PlayResult {
+	return &pb.PlayResult{
+		Card:    r.Card,
+		Cards:   r.Cards,
+		Target:  r.Target,
+		Named:   r.Named,
+		Hand:    r.Hand,
+		Version: g.Version,
+	}
+}
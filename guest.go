@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	guestPrefix = "guest-"
+	guestTTL    = 7 * 24 * time.Hour
+)
+
+var errNotGuest = errors.New("account is not a guest account")
+
+// createGuest reserves a generated guest name whose account and score
+// expire unless the guest upgrades.
+func createGuest(ctx context.Context) (string, error) {
+	for {
+		username := guestPrefix + randomToken()[:8]
+		err := users.CreateGuest(ctx, username, guestTTL)
+		if err == errUsernameTaken {
+			continue
+		}
+		return username, err
+	}
+}
+
+// upgradeGuest turns a guest into a registered account under a new name,
+// carrying over their score, saved cards and game history.
+func upgradeGuest(ctx context.Context, guest, username, password string) error {
+	ok, err := users.IsGuest(ctx, guest)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotGuest
+	}
+	if err := createAccount(ctx, username, password); err != nil {
+		return err
+	}
+
+	score, err := leaderboards.Score(ctx, leaderboardKey, guest)
+	if err != nil && err != errNotRanked {
+		return err
+	}
+	if err := leaderboards.SetScore(ctx, leaderboardKey, username, score); err != nil {
+		return err
+	}
+	if err := leaderboards.RemovePlayer(ctx, leaderboardKey, guest); err != nil {
+		return err
+	}
+	if err := users.DeleteUser(ctx, guest); err != nil {
+		return err
+	}
+
+	if err := histories.MoveHistory(ctx, guest, username); err != nil {
+		return err
+	}
+
+	from, to := fmt.Sprintf("game:%s:cards", guest), fmt.Sprintf("game:%s:cards", username)
+	exists, err := rdb.Exists(ctx, from).Result()
+	if err != nil || exists == 0 {
+		return err
+	}
+	return rdb.Rename(ctx, from, to).Err()
+}
+
+func handleGuest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username, err := createGuest(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error creating guest")
+		return
+	}
+
+	tokens, err := issueTokensWithTTL(ctx, username, guestTTL)
+	if err != nil {
+		respondInternal(w, r, err, "Error issuing tokens")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username": username,
+		"tokens":   tokens,
+	})
+}
+
+func handleGuestUpgrade(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RegisterRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	problems := validateCredentials(req.Username, req.Password)
+	emailProblems, err := newAccountEmail(ctx, req.Email)
+	if err == errEmailTaken {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error upgrading guest")
+		return
+	}
+	if problems = append(problems, emailProblems...); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	err = upgradeGuest(ctx, currentUser(r), req.Username, req.Password)
+	if err == errNotGuest || err == errUsernameTaken {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error upgrading guest")
+		return
+	}
+	if req.Email != "" {
+		if err := setEmail(ctx, req.Username, req.Email); err != nil {
+			logFor(r).Error("setting email", "username", req.Username, "err", err)
+		}
+	}
+
+	tokens, err := issueTokens(ctx, req.Username)
+	if err != nil {
+		respondInternal(w, r, err, "Error issuing tokens")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
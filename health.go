@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds each dependency check so a hung dependency
+// fails the probe instead of stalling it.
+const readinessTimeout = 2 * time.Second
+
+// DependencyStatus reports one dependency's health in the readiness
+// payload.
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func checkDependency(check func() error) DependencyStatus {
+	start := time.Now()
+	err := check()
+	st := DependencyStatus{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		st.Status = "error"
+		st.Error = err.Error()
+	}
+	return st
+}
+
+// healthz answers as long as the process is up.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyz reports whether this instance can serve traffic: Redis answers,
+// the database (when configured) answers with every migration applied,
+// and the server is not shutting down.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	deps := map[string]DependencyStatus{
+		"redis": checkDependency(func() error {
+			c, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+			return rdb.Ping(c).Err()
+		}),
+	}
+	if pg, ok := users.(*PostgresStore); ok {
+		deps["postgres"] = checkDependency(func() error {
+			c, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+			if err := pg.db.PingContext(c); err != nil {
+				return err
+			}
+			return pg.checkMigrations(c)
+		})
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, dep := range deps {
+		if dep.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if hub.closing.Load() {
+		status, code = "shutting down", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        status,
+		"dependencies":  deps,
+		"redis_breaker": breaker.currentState(),
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GameStats tallies what one player did during a single game.
+type GameStats struct {
+	CardsDrawn int `json:"cards_drawn"`
+	// DefusesDrawn counts Defuse cards drawn from the deck, as opposed to
+	// the one dealt into every starting hand.
+	DefusesDrawn int `json:"defuses_drawn,omitempty"`
+	Defused      int `json:"defused"`
+	// CardsPlayed counts the action cards played, Nopes included, by type.
+	CardsPlayed map[string]int `json:"cards_played,omitempty"`
+	Forfeited   bool           `json:"forfeited,omitempty"`
+}
+
+// GameRecord is the permanent summary of a finished game.
+type GameRecord struct {
+	ID         string                `json:"id"`
+	RoomID     string                `json:"room_id,omitempty"`
+	Players    []string              `json:"players"`
+	Abandoned  []string              `json:"abandoned,omitempty"`
+	Winner     string                `json:"winner,omitempty"`
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+	Duration   int                   `json:"duration_seconds"`
+	Stats      map[string]*GameStats `json:"stats"`
+	// Composition is the deck the game was dealt from.
+	Composition map[string]int `json:"composition,omitempty"`
+}
+
+// PlayerStats is the lifetime aggregate served by the stats endpoint.
+type PlayerStats struct {
+	Username      string  `json:"username"`
+	GamesPlayed   int     `json:"games_played"`
+	Wins          int     `json:"wins"`
+	Losses        int     `json:"losses"`
+	WinRate       float64 `json:"win_rate"`
+	CardsDrawn    int     `json:"cards_drawn"`
+	Defused       int     `json:"defused"`
+	Forfeits      int     `json:"forfeits"`
+	CurrentStreak int     `json:"current_streak"`
+	LongestStreak int     `json:"longest_streak"`
+	// NextWinBonus is the streak multiplier the player's next win earns.
+	NextWinBonus int `json:"next_win_bonus,omitempty"`
+}
+
+func historyKey(gameID string) string {
+	return fmt.Sprintf("history:game:%s", gameID)
+}
+
+func playerHistoryKey(username string) string {
+	return fmt.Sprintf("history:player:%s", username)
+}
+
+func statsKey(username string) string {
+	return fmt.Sprintf("stats:%s", username)
+}
+
+func (g *GameState) statsFor(username string) *GameStats {
+	if g.Stats == nil {
+		g.Stats = map[string]*GameStats{}
+	}
+	st, ok := g.Stats[username]
+	if !ok {
+		st = &GameStats{}
+		g.Stats[username] = st
+	}
+	return st
+}
+
+// countPlay tallies an action card a player has played.
+func (g *GameState) countPlay(username, card string) {
+	st := g.statsFor(username)
+	if st.CardsPlayed == nil {
+		st.CardsPlayed = map[string]int{}
+	}
+	st.CardsPlayed[card]++
+}
+
+// recordGame archives a finished game and folds it into each participant's
+// lifetime stats. A game is only ever recorded once.
+func recordGame(ctx context.Context, g *GameState, finishedAt time.Time) error {
+	// Players who abandoned the game still take the loss.
+	participants := []string{}
+	for _, p := range append(append([]string{}, g.Players...), g.Abandoned...) {
+		if !g.isBot(p) {
+			g.statsFor(p)
+			participants = append(participants, p)
+		}
+	}
+
+	record := GameRecord{
+		ID:          g.ID,
+		RoomID:      g.RoomID,
+		Players:     g.Players,
+		Abandoned:   g.Abandoned,
+		Winner:      g.Winner,
+		StartedAt:   g.StartedAt,
+		FinishedAt:  finishedAt.UTC(),
+		Duration:    int(finishedAt.Sub(g.StartedAt).Seconds()),
+		Stats:       g.Stats,
+		Composition: g.Composition,
+	}
+	return histories.RecordGame(ctx, &record, participants)
+}
+
+func (st *PlayerStats) fillWinRate() {
+	if st.GamesPlayed > 0 {
+		st.WinRate = float64(st.Wins) / float64(st.GamesPlayed)
+	}
+}
+
+func getPlayerStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	st, err := histories.PlayerStats(ctx, mux.Vars(r)["username"])
+	if err != nil {
+		respondInternal(w, r, err, "Error loading stats")
+		return
+	}
+	st.NextWinBonus = streakMultiplier(st.CurrentStreak + 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func getPlayerGames(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	records, total, err := histories.PlayerGames(ctx, username, limit, offset)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading games")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	json.NewEncoder(w).Encode(records)
+}
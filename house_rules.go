@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Limits on house rules.
+const (
+	maxCardCount    = 20
+	minTurnTimer    = 10
+	maxTurnTimer    = 300
+	maxStartDefuses = 3
+)
+
+var errNopeDisabled = errors.New("nope is turned off in this game")
+
+// HouseRules are the options a room's creator picked. The zero value, or
+// no rules at all, plays the standard game.
+type HouseRules struct {
+	// Deck changes how many of a card are dealt from, by card type.
+	Deck map[string]int `json:"deck,omitempty"`
+	// TurnTimer is how many seconds a turn lasts in multiplayer games.
+	TurnTimer int `json:"turn_timer,omitempty"`
+	// Defuses is how many Defuses each player starts with.
+	Defuses *int `json:"defuses,omitempty"`
+	// Nope set to false takes Nope cards out of the game.
+	Nope *bool `json:"nope,omitempty"`
+	// Expansions adds the cards of each named expansion to the game.
+	Expansions []string `json:"expansions,omitempty"`
+}
+
+func (hr *HouseRules) cardCount(card string, standard int) int {
+	if card == CardNope && !hr.nopeEnabled() {
+		return 0
+	}
+	if hr != nil {
+		if n, ok := hr.Deck[card]; ok {
+			return n
+		}
+	}
+	return standard
+}
+
+func (hr *HouseRules) turnTimeout() time.Duration {
+	if hr == nil || hr.TurnTimer == 0 {
+		return turnTimeout
+	}
+	return time.Duration(hr.TurnTimer) * time.Second
+}
+
+func (hr *HouseRules) startingDefuses() int {
+	if hr == nil || hr.Defuses == nil {
+		return 1
+	}
+	return *hr.Defuses
+}
+
+func (hr *HouseRules) nopeEnabled() bool {
+	return hr == nil || hr.Nope == nil || *hr.Nope
+}
+
+// nopeWindow is how long the other players have to nope an action.
+func (g *GameState) nopeWindow() time.Duration {
+	if !g.Rules.nopeEnabled() {
+		return 0
+	}
+	return nopeWindow
+}
+
+// allowedFor reports whether username may use these rules: expansions are
+// behind FlagExpansions.
+func (hr *HouseRules) allowedFor(username string) bool {
+	return hr == nil || len(hr.Expansions) == 0 || featureOn(FlagExpansions, username)
+}
+
+// validateHouseRules checks a room's rules, including that the deck is big
+// enough to deal a full room their starting hands.
+func validateHouseRules(hr *HouseRules, capacity int) []*FieldError {
+	problems := []*FieldError{}
+	if hr == nil {
+		return problems
+	}
+	for _, e := range hr.Expansions {
+		if !knownExpansion(e) {
+			problems = append(problems, &FieldError{Field: "rules.expansions", Code: "EXPANSION_UNKNOWN",
+				Message: fmt.Sprintf("Expansions must be one of %s", strings.Join(expansions, ", "))})
+		}
+	}
+	pile := 0
+	for _, cc := range hr.pileComposition(capacity) {
+		pile += hr.cardCount(cc.card, cc.count)
+	}
+	for card, n := range hr.Deck {
+		dealt := false
+		for _, cc := range hr.pileComposition(capacity) {
+			dealt = dealt || cc.card == card
+		}
+		if !dealt {
+			problems = append(problems, &FieldError{Field: "rules.deck." + card, Code: "CARD_NOT_ADJUSTABLE",
+				Message: "Only the cards dealt from the pile can be adjusted"})
+		} else if n < 0 || n > maxCardCount {
+			problems = append(problems, &FieldError{Field: "rules.deck." + card, Code: "CARD_COUNT_OUT_OF_RANGE",
+				Message: fmt.Sprintf("Card counts must be between 0 and %d", maxCardCount)})
+		}
+	}
+	if pile < handSize*capacity {
+		problems = append(problems, &FieldError{Field: "rules.deck", Code: "DECK_TOO_SMALL",
+			Message: fmt.Sprintf("The deck needs at least %d cards to deal %d players", handSize*capacity, capacity)})
+	}
+	if hr.TurnTimer != 0 && (hr.TurnTimer < minTurnTimer || hr.TurnTimer > maxTurnTimer) {
+		problems = append(problems, &FieldError{Field: "rules.turn_timer", Code: "TURN_TIMER_OUT_OF_RANGE",
+			Message: fmt.Sprintf("Turn timer must be between %d and %d seconds", minTurnTimer, maxTurnTimer)})
+	}
+	if hr.Defuses != nil && (*hr.Defuses < 0 || *hr.Defuses > maxStartDefuses) {
+		problems = append(problems, &FieldError{Field: "rules.defuses", Code: "DEFUSES_OUT_OF_RANGE",
+			Message: fmt.Sprintf("Defuses must be between 0 and %d", maxStartDefuses)})
+	}
+	return problems
+}
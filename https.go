@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// hstsMaxAge is how long browsers are told to use only HTTPS. Set with
+// HSTS_MAX_AGE, where 0 sends no Strict-Transport-Security header.
+var hstsMaxAge = defaultHSTSMaxAge
+
+// HTTPSConfig is how the server terminates TLS itself, for deployments
+// with no proxy in front to do it. Either TLS_CERT_FILE and TLS_KEY_FILE
+// name a certificate, or AUTOCERT_DOMAINS lists the domains to get one for
+// from Let's Encrypt, cached in AUTOCERT_CACHE_DIR. Autocert also answers
+// on HTTP_PORT, for the ACME challenge and to redirect to HTTPS. With
+// neither, the server speaks plain HTTP.
+type HTTPSConfig struct {
+	CertFile string
+	KeyFile  string
+	Domains  []string
+	CacheDir string
+	Email    string
+	HTTPPort string
+}
+
+// secureHeaders sets the headers that keep browsers from sniffing, framing
+// or leaking API responses, and HSTS on requests that came over HTTPS.
+func secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		h.Set("Referrer-Policy", "no-referrer")
+		if hstsMaxAge > 0 && overHTTPS(r) {
+			h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(hstsMaxAge.Seconds()))+"; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// overHTTPS reports whether the client connected with TLS, to this server
+// or, with TRUST_PROXY, to the proxy in front of it.
+func overHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return trustProxy && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// listener returns what runs srv as hc says and, with autocert, a second
+// server for HTTP_PORT that answers ACME challenges and redirects the rest
+// to HTTPS.
+func listener(srv *http.Server, hc HTTPSConfig) (run func() error, redirect *http.Server) {
+	switch {
+	case hc.CertFile != "":
+		slog.Info("serving HTTPS", "cert", hc.CertFile)
+		return func() error { return srv.ListenAndServeTLS(hc.CertFile, hc.KeyFile) }, nil
+	case len(hc.Domains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hc.Domains...),
+			Cache:      autocert.DirCache(hc.CacheDir),
+			Email:      hc.Email,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		slog.Info("serving HTTPS with autocert", "domains", hc.Domains, "http_port", hc.HTTPPort)
+		redirect = &http.Server{
+			Addr:              ":" + hc.HTTPPort,
+			Handler:           m.HTTPHandler(nil),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		return func() error { return srv.ListenAndServeTLS("", "") }, redirect
+	default:
+		return srv.ListenAndServe, nil
+	}
+}
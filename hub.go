@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	EventPlayerJoined      = "player_joined"
+	EventGameStarted       = "game_started"
+	EventSpectatorJoined   = "spectator_joined"
+	EventCardDrawn         = "card_drawn"
+	EventCardPlayed        = "card_played"
+	EventTurnChanged       = "turn_changed"
+	EventExplosion         = "explosion"
+	EventGameOver          = "game_over"
+	EventNoped             = "nope_played"
+	EventActionResolved    = "action_resolved"
+	EventFutureSeen        = "future_seen"
+	EventFavorReceived     = "favor_received"
+	EventFavorRequested    = "favor_requested"
+	EventFavorGiven        = "favor_given"
+	EventKittenReinserted  = "kitten_reinserted"
+	EventFutureAltered     = "future_altered"
+	EventMatchFound        = "match_found"
+	EventPlayerReplaced    = "player_replaced"
+	EventConnectionChanged = "connection_changed"
+	EventSession           = "session"
+	EventPong              = "pong"
+	EventGameExpired       = "game_expired"
+	EventRoomExpired       = "room_expired"
+	EventQueueExpired      = "matchmaking_expired"
+	EventTurnTimer         = "turn_timer"
+	EventTurnTimeout       = "turn_timeout"
+	EventPlayerForfeited   = "player_forfeited"
+	EventRematchProposed   = "rematch_proposed"
+	EventRematchAccepted   = "rematch_accepted"
+	EventRematchDeclined   = "rematch_declined"
+	EventRematchStarted    = "rematch_started"
+	EventRoomInvite        = "room_invite"
+	EventFriendRequest     = "friend_request"
+	EventFriendAccepted    = "friend_accepted"
+	EventPresenceChanged   = "presence_changed"
+	EventChatMessage       = "chat_message"
+	EventChatRejected      = "chat_rejected"
+	EventReaction          = "reaction"
+	EventReactionRejected  = "reaction_rejected"
+	EventAchievement       = "achievement_unlocked"
+	EventChallengeDone     = "challenge_completed"
+	EventLevelUp           = "level_up"
+	EventTournamentMatch   = "tournament_match"
+	EventTournamentOver    = "tournament_over"
+	EventLiveEventStarted  = "live_event_started"
+	EventLiveEventEnded    = "live_event_ended"
+	EventNotification      = "notification"
+	EventMaintenance       = "maintenance_started"
+	EventMaintenanceOver   = "maintenance_ended"
+)
+
+// lobbyRoom is the channel clients join when they are not seated anywhere.
+const lobbyRoom = "lobby"
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 4096
+	sendBufferSize = 32
+)
+
+// Event is the envelope pushed to every client subscribed to a room. Seq
+// numbers a game room's events in order so resuming clients can catch up.
+type Event struct {
+	Seq     int64       `json:"seq,omitempty"`
+	Type    string      `json:"type"`
+	Room    string      `json:"room"`
+	Payload interface{} `json:"payload,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+type Client struct {
+	id       string
+	hub      *Hub
+	conn     *websocket.Conn
+	room     string
+	username string
+	send     chan []byte
+	// spectator connections are read-only and never receive events meant
+	// for a single player's eyes.
+	spectator bool
+	// cancel ends a gRPC stream's client, which has no websocket conn.
+	cancel context.CancelCauseFunc
+}
+
+// Hub tracks websocket clients grouped by room and fans events out to them.
+// Events go through Redis pub/sub once startFanOut has run, so a room's
+// players can be connected to different instances.
+type Hub struct {
+	mu    sync.RWMutex
+	rooms map[string]map[*Client]bool
+	// users counts each player's connections, to know which user channels
+	// this instance needs.
+	users  map[string]int
+	pubsub atomic.Pointer[redis.PubSub]
+	// closing is set during shutdown, when dropped connections are
+	// expected and must not count against the players.
+	closing atomic.Bool
+}
+
+var hub = newHub()
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+func newHub() *Hub {
+	return &Hub{
+		rooms: make(map[string]map[*Client]bool),
+		users: make(map[string]int),
+	}
+}
+
+func (h *Hub) register(ctx context.Context, c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients, ok := h.rooms[c.room]
+	if !ok {
+		clients = make(map[*Client]bool)
+		h.rooms[c.room] = clients
+		h.subscribe(ctx, roomChannel(c.room))
+	}
+	clients[c] = true
+	h.users[c.username]++
+	if h.users[c.username] == 1 {
+		h.subscribe(ctx, userChannel(c.username))
+	}
+}
+
+func (h *Hub) unregister(ctx context.Context, c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients, ok := h.rooms[c.room]
+	if !ok || !clients[c] {
+		return
+	}
+	delete(clients, c)
+	close(c.send)
+	if len(clients) == 0 {
+		delete(h.rooms, c.room)
+		h.unsubscribe(ctx, roomChannel(c.room))
+	}
+	h.users[c.username]--
+	if h.users[c.username] == 0 {
+		delete(h.users, c.username)
+		h.unsubscribe(ctx, userChannel(c.username))
+	}
+}
+
+// closeAll disconnects every client with the given close code so they know
+// to reconnect.
+func (h *Hub) closeAll(code int, reason string) {
+	h.closing.Store(true)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, clients := range h.rooms {
+		for c := range clients {
+			c.disconnect(code, reason)
+		}
+	}
+}
+
+// disconnectUser closes every connection a player has open, on every
+// instance.
+func (h *Hub) disconnectUser(ctx context.Context, username string, code int, reason string) {
+	h.publish(ctx, userChannel(username), fanOutMessage{Disconnect: &closeReason{Code: code, Reason: reason}})
+}
+
+// disconnectLocal closes a player's connections to this instance.
+func (h *Hub) disconnectLocal(username string, code int, reason string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, clients := range h.rooms {
+		for c := range clients {
+			if c.username == username {
+				c.disconnect(code, reason)
+			}
+		}
+	}
+}
+
+// disconnect closes a client's websocket with the given close code, or
+// ends its gRPC stream.
+func (c *Client) disconnect(code int, reason string) {
+	if c.conn == nil {
+		c.cancel(errors.New(reason))
+		return
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// connected reports whether the user has a live connection to the room.
+func (h *Hub) connected(room, username string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.rooms[room] {
+		if c.username == username && !c.spectator {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast sends an event to every client in the room, on every instance.
+func (h *Hub) broadcast(ctx context.Context, room, eventType string, payload interface{}) {
+	data, err := encodeEvent(ctx, &Event{
+		Type:    eventType,
+		Room:    room,
+		Payload: payload,
+		Time:    time.Now().UTC(),
+	}, "")
+	if err != nil {
+		slog.Error("encoding event", "type", eventType, "err", err)
+		return
+	}
+
+	h.publish(ctx, roomChannel(room), fanOutMessage{Event: data})
+}
+
+// deliverRoom sends an event to this instance's clients in a room, or only
+// to one player's when to is set. Clients whose send buffer is full are
+// assumed dead and dropped.
+func (h *Hub) deliverRoom(ctx context.Context, room, to string, data []byte) {
+	h.mu.RLock()
+	var stale []*Client
+	for c := range h.rooms[room] {
+		if to != "" && (c.username != to || c.spectator) {
+			continue
+		}
+		select {
+		case c.send <- data:
+		default:
+			if to == "" {
+				stale = append(stale, c)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range stale {
+		h.unregister(ctx, c)
+	}
+}
+
+// notify sends an event only to the given player's connections in a room,
+// for information the rest of the table must not see.
+func (h *Hub) notify(ctx context.Context, room, username, eventType string, payload interface{}) {
+	data, err := encodeEvent(ctx, &Event{
+		Type:    eventType,
+		Room:    room,
+		Payload: payload,
+		Time:    time.Now().UTC(),
+	}, username)
+	if err != nil {
+		slog.Error("encoding event", "type", eventType, "err", err)
+		return
+	}
+
+	h.publish(ctx, roomChannel(room), fanOutMessage{To: username, Event: data})
+}
+
+// notifyUser sends an event to every connection a player has open,
+// whichever room it is subscribed to.
+func (h *Hub) notifyUser(ctx context.Context, username, eventType string, payload interface{}) {
+	data, err := json.Marshal(Event{
+		Type:    eventType,
+		Payload: payload,
+		Time:    time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Error("encoding event", "type", eventType, "err", err)
+		return
+	}
+
+	h.publish(ctx, userChannel(username), fanOutMessage{Event: data})
+}
+
+// deliverUser sends an event to a player's clients on this instance.
+func (h *Hub) deliverUser(username string, data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, clients := range h.rooms {
+		for c := range clients {
+			if c.username != username {
+				continue
+			}
+			select {
+			case c.send <- data:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Client) readPump(ctx context.Context) {
+	defer func() {
+		c.hub.unregister(ctx, c)
+		c.conn.Close()
+		if c.hub.closing.Load() {
+			// Clients reconnect elsewhere; their presence lapses on its own
+			// if they do not.
+			return
+		}
+		dropPresence(ctx, c)
+		if !c.spectator && c.room != lobbyRoom {
+			playerDisconnected(ctx, c.room, c.username)
+		}
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		touchPresence(ctx, c)
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var msg struct {
+			Type  string `json:"type"`
+			Text  string `json:"text"`
+			Emote string `json:"emote"`
+		}
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Warn("websocket error", "username", c.username, "room", c.room, "err", err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		switch msg.Type {
+		case "ping":
+			c.reply(EventPong, nil)
+		case "chat":
+			if err := c.chat(ctx, msg.Text); err != nil {
+				c.replyError(EventChatRejected, err)
+			}
+		case "reaction":
+			if err := c.react(ctx, msg.Emote); err != nil {
+				c.replyError(EventReactionRejected, err)
+			}
+		}
+	}
+}
+
+// replyError tells this connection why its message was refused. Errors
+// without a code are logged and reported as internal.
+func (c *Client) replyError(eventType string, err error) {
+	code, ok := errorCodes[err]
+	if !ok {
+		slog.Error("handling websocket message", "type", eventType, "username", c.username, "room", c.room, "err", err)
+		code, err = CodeInternal, errors.New("message could not be sent")
+	}
+	c.reply(eventType, map[string]string{"code": code, "message": err.Error()})
+}
+
+// reply sends an event to this connection alone.
+func (c *Client) reply(eventType string, payload interface{}) {
+	data, err := json.Marshal(Event{Type: eventType, Room: c.room, Payload: payload, Time: time.Now().UTC()})
+	if err != nil {
+		slog.Error("encoding event", "type", eventType, "err", err)
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = lobbyRoom
+	}
+	username := currentUser(r)
+
+	spectator := r.URL.Query().Get("spectate") == "true"
+	if spectator {
+		rm, err := loadRoom(ctx, room)
+		if err != nil || !rm.hasSpectator(username) {
+			writeError(w, r, http.StatusForbidden, "NOT_SPECTATING", "Join the room as a spectator first")
+			return
+		}
+	} else if room != lobbyRoom {
+		// Only a private room's own players may listen in on it.
+		rm, err := loadRoom(ctx, room)
+		if err == nil && rm.Private && !rm.hasPlayer(username) {
+			respondError(w, r, http.StatusForbidden, errRoomPrivate)
+			return
+		}
+	}
+
+	connectClient(w, r, room, username, spectator, false, 0)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Translation bundles are flat JSON objects from keys such as
+// "cards.defuse.name" or "errors.NOT_YOUR_TURN" to text. The English text
+// lives in the code, so a missing key falls back to the default locale's
+// bundle and then to that.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLocale answers requests in no language we have. Set with
+// DEFAULT_LOCALE.
+var defaultLocale = "en"
+
+var bundles = map[string]map[string]string{}
+
+// loadLocales reads the bundles built into the binary, then any in dir
+// (LOCALES_DIR), which add locales or override keys of built-in ones.
+func loadLocales(dir string) error {
+	bundles = map[string]map[string]string{defaultLocale: {}}
+
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			return err
+		}
+		if err := addBundle(f.Name(), data); err != nil {
+			return err
+		}
+	}
+
+	if dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := addBundle(filepath.Base(path), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBundle merges a bundle file, named for its locale, into bundles.
+func addBundle(name string, data []byte) error {
+	var messages map[string]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return fmt.Errorf("locale %s: %w", name, err)
+	}
+	locale := strings.ToLower(strings.TrimSuffix(name, ".json"))
+	if bundles[locale] == nil {
+		bundles[locale] = map[string]string{}
+	}
+	for key, text := range messages {
+		bundles[locale][key] = text
+	}
+	return nil
+}
+
+// localeFor picks the best locale we have from the request's
+// Accept-Language, trying "pt" for "pt-BR" when there is no "pt-br".
+func localeFor(r *http.Request) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	choices := []choice{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag != "" && q > 0 {
+			choices = append(choices, choice{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		if _, ok := bundles[c.tag]; ok {
+			return c.tag
+		}
+		base, _, _ := strings.Cut(c.tag, "-")
+		if _, ok := bundles[base]; ok {
+			return base
+		}
+	}
+	return defaultLocale
+}
+
+// translate looks key up for locale, falling back to the default locale
+// and then to fallback, the English text.
+func translate(locale, key, fallback string) string {
+	if text, ok := bundles[locale][key]; ok {
+		return text
+	}
+	if text, ok := bundles[defaultLocale][key]; ok {
+		return text
+	}
+	return fallback
+}
+
+// localize translates key for the request's caller.
+func localize(r *http.Request, key, fallback string) string {
+	return translate(localeFor(r), key, fallback)
+}
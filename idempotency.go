@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyLockTTL frees a key whose first request died mid-flight.
+	idempotencyLockTTL = 30 * time.Second
+	maxIdempotencyKey  = 255
+)
+
+// idempotentResponse is what is kept for an Idempotency-Key: the request it
+// was first used with and, once that finished, the response to replay.
+type idempotentResponse struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+func idempotencyKey(caller, key string) string {
+	return fmt.Sprintf("idempotency:%s:%s", caller, key)
+}
+
+// responseCapture passes a response through while keeping a copy of it.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	c.status = code
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotent lets clients safely retry POST and DELETE requests by sending
+// an Idempotency-Key header. The first response for a key is stored and
+// replayed to any retry of the same request; reusing a key for a different
+// request is rejected. Server errors are not stored so they can be retried.
+func idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Idempotency-Key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondPayload(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		storeKey := idempotencyKey(rateLimitCaller(r), key)
+		pending, _ := json.Marshal(idempotentResponse{Fingerprint: fingerprint})
+		first, err := rdb.SetNX(ctx, storeKey, pending, idempotencyLockTTL).Result()
+		if err != nil {
+			logFor(r).Error("claiming idempotency key", "err", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !first {
+			replayIdempotent(w, r, storeKey, fingerprint)
+			return
+		}
+
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= http.StatusInternalServerError {
+			rdb.Del(ctx, storeKey)
+			return
+		}
+		saved, _ := json.Marshal(idempotentResponse{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      rec.status,
+			Header:      http.Header{"Content-Type": rec.Header().Values("Content-Type")},
+			Body:        rec.body.Bytes(),
+		})
+		if err := rdb.Set(ctx, storeKey, saved, idempotencyTTL).Err(); err != nil {
+			logFor(r).Error("saving idempotent response", "err", err)
+		}
+	})
+}
+
+// replayIdempotent answers a retry from the stored response.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, storeKey, fingerprint string) {
+	ctx := r.Context()
+	data, err := rdb.Get(ctx, storeKey).Bytes()
+	if err == redis.Nil {
+		// The first attempt failed and released the key between our calls.
+		writeError(w, r, http.StatusConflict, "REQUEST_IN_PROGRESS", "A request with this Idempotency-Key is still being processed")
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading idempotent response")
+		return
+	}
+
+	var saved idempotentResponse
+	if err := json.Unmarshal(data, &saved); err != nil {
+		respondInternal(w, r, err, "Error loading idempotent response")
+		return
+	}
+	if saved.Fingerprint != fingerprint {
+		writeError(w, r, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED", "Idempotency-Key was already used for a different request")
+		return
+	}
+	if !saved.Done {
+		writeError(w, r, http.StatusConflict, "REQUEST_IN_PROGRESS", "A request with this Idempotency-Key is still being processed")
+		return
+	}
+
+	for name, values := range saved.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(saved.Status)
+	w.Write(saved.Body)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    string
+		retry    string
+		body     string
+		status   int
+		calls    int
+		replayed bool
+	}{
+		{name: "retry replays", first: "/api/v1/rooms?size=4", retry: "/api/v1/rooms?size=4", status: http.StatusCreated, calls: 1, replayed: true},
+		{name: "other path rejected", first: "/api/v1/rooms", retry: "/api/v1/other", status: http.StatusUnprocessableEntity, calls: 1},
+		{name: "other query rejected", first: "/api/v1/rooms?size=4", retry: "/api/v1/rooms?size=5", status: http.StatusUnprocessableEntity, calls: 1},
+		{name: "other body rejected", first: "/api/v1/rooms", retry: "/api/v1/rooms", body: "{}", status: http.StatusUnprocessableEntity, calls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRedis(t)
+			calls := 0
+			h := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":"r1"}`))
+			}))
+			post := func(target, body string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("POST", target, strings.NewReader(body))
+				r.Header.Set("Idempotency-Key", "k1")
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				return w
+			}
+
+			post(tt.first, "")
+			w := post(tt.retry, tt.body)
+			if w.Code != tt.status {
+				t.Errorf("retry status %d, want %d", w.Code, tt.status)
+			}
+			if calls != tt.calls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.calls)
+			}
+			if got := w.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("replayed = %v, want %v", got, tt.replayed)
+			}
+			if tt.replayed && w.Body.String() != `{"id":"r1"}` {
+				t.Errorf("replayed body %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestIdempotentServerErrorsRetry(t *testing.T) {
+	testRedis(t)
+	calls := 0
+	h := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("DELETE", "/api/v1/rooms/r1", nil)
+		r.Header.Set("Idempotency-Key", "k1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+}
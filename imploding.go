@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// Cards from the Imploding Kittens expansion.
+const (
+	CardImploding      = "imploding"
+	CardAlterTheFuture = "alter_the_future"
+	CardTargetedAttack = "targeted_attack"
+	// CardFeralCat stands in for any cat card.
+	CardFeralCat = "feral_cat"
+)
+
+// ExpansionImploding adds the Imploding Kittens cards to a game.
+const ExpansionImploding = "imploding_kittens"
+
+var expansions = []string{ExpansionImploding}
+
+// implodingComposition is added to the pile when the expansion is on.
+var implodingComposition = []cardCount{
+	{CardAlterTheFuture, 4},
+	{CardTargetedAttack, 3},
+	{CardFeralCat, 4},
+}
+
+// Draw outcomes for the Imploding Kitten. Drawn face down it is put back
+// face up; drawn face up it can't be defused.
+const (
+	OutcomeRevealed = "revealed"
+	OutcomeImploded = "imploded"
+)
+
+var (
+	errAlterPending   = errors.New("waiting for the future to be altered")
+	errNothingToAlter = errors.New("you have no future to alter")
+	errBadAlteration  = errors.New("send the cards you saw in their new order")
+)
+
+type AlterRequest struct {
+	Cards []string `json:"cards"`
+}
+
+func knownExpansion(name string) bool {
+	for _, e := range expansions {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (hr *HouseRules) expansion(name string) bool {
+	return hr != nil && hasModifier(hr.Expansions, name)
+}
+
+// implodingAt is how far from the top the face-up Imploding Kitten is,
+// which every player can see.
+func (g *GameState) implodingAt() *int {
+	if !g.ImplodingFaceUp {
+		return nil
+	}
+	for i, c := range g.Deck {
+		if c == CardImploding {
+			return &i
+		}
+	}
+	return nil
+}
+
+// targetedAttack is an attack that sends the turns to a chosen player
+// rather than the next one.
+func (g *GameState) targetedAttack(target string) {
+	if g.isEliminated(target) {
+		g.attack()
+		return
+	}
+	owed := g.attackOwed()
+	for i, p := range g.Players {
+		if p == target {
+			g.Turn = i
+			g.TurnsOwed = owed
+			g.Attacked = true
+			g.startTurnClock()
+			return
+		}
+	}
+}
+
+// alter puts the cards a player saw with Alter the Future back on top of
+// the deck in the order they chose.
+func (g *GameState) alter(username string, cards []string) error {
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	if g.Altering != username {
+		return errNothingToAlter
+	}
+	n := futureSize
+	if n > len(g.Deck) {
+		n = len(g.Deck)
+	}
+	if len(cards) != n {
+		return errBadAlteration
+	}
+	seen := append([]string{}, g.Deck[:n]...)
+	chosen := append([]string{}, cards...)
+	sort.Strings(seen)
+	sort.Strings(chosen)
+	for i := range seen {
+		if seen[i] != chosen[i] {
+			return errBadAlteration
+		}
+	}
+
+	copy(g.Deck, cards)
+	g.Altering = ""
+	g.logAction(LogEntry{Type: EventFutureAltered, Player: username})
+	g.botsForget()
+	g.botRemember(username, cards)
+	return nil
+}
+
+// botAlteration has a bot push any kittens it saw as deep as it can.
+func (g *GameState) botAlteration() []string {
+	n := futureSize
+	if n > len(g.Deck) {
+		n = len(g.Deck)
+	}
+	order := append([]string{}, g.Deck[:n]...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return !isKitten(order[i]) && isKitten(order[j])
+	})
+	return order
+}
+
+func isKitten(card string) bool {
+	return card == CardExploding || card == CardImploding
+}
+
+func publishAlter(ctx context.Context, g *GameState, username string) {
+	recordEvent(ctx, g.ID, EventFutureAltered, map[string]interface{}{"username": username})
+	hub.broadcast(ctx, g.channel(), EventFutureAltered, map[string]interface{}{"username": username})
+	publishTurn(ctx, g)
+}
+
+func alterFuture(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req AlterRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+
+	g, err := moveGame(w, r, func(g *GameState) error {
+		return g.alter(username, req.Cards)
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	publishAlter(ctx, g, username)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
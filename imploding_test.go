@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDrawImplodingKitten(t *testing.T) {
+	tests := []struct {
+		name    string
+		faceUp  bool
+		outcome string
+		current string
+		status  string
+	}{
+		{
+			name:    "face down is revealed",
+			outcome: OutcomeRevealed,
+			current: "alice",
+			status:  GameActive,
+		},
+		{
+			name:    "face up implodes",
+			faceUp:  true,
+			outcome: OutcomeImploded,
+			current: "bob",
+			status:  GameActive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardDefuse}, "alice", "bob", "carol")
+			g.Deck = append([]string{CardImploding}, g.Deck...)
+			g.ImplodingFaceUp = tt.faceUp
+			res := mustDraw(t, g, "alice")
+			if res.Outcome != tt.outcome {
+				t.Errorf("outcome %s, want %s", res.Outcome, tt.outcome)
+			}
+			if tt.outcome == OutcomeRevealed && !g.hasCard("alice", CardDefuse) {
+				t.Error("alice spent her defuse on an Imploding Kitten")
+			}
+			if g.Status != tt.status || g.currentPlayer() != tt.current {
+				t.Errorf("game is %s with %s to move, want %s with %s", g.Status, g.currentPlayer(), tt.status, tt.current)
+			}
+		})
+	}
+}
+
+func TestReinsertImplodingKitten(t *testing.T) {
+	g := testGame([]string{CardSkip}, "alice", "bob")
+	g.Deck = append([]string{CardImploding}, g.Deck...)
+	mustDraw(t, g, "alice")
+	if err := g.reinsert("alice", 3); err != nil {
+		t.Fatal(err)
+	}
+	at := g.implodingAt()
+	if at == nil || *at != 3 {
+		t.Fatalf("imploding at %v, want face up at 3", at)
+	}
+	if g.currentPlayer() != "bob" {
+		t.Errorf("current player is %s, want bob", g.currentPlayer())
+	}
+}
+
+func TestTargetedAttack(t *testing.T) {
+	tests := []struct {
+		name   string
+		moves  func(t *testing.T, g *GameState)
+		player string
+		owed   int
+	}{
+		{
+			name: "targeted attack",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardTargetedAttack, "carol")
+			},
+			player: "carol",
+			owed:   2,
+		},
+		{
+			name: "attack back at once",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardTargetedAttack, "carol")
+				mustPlay(t, g, "carol", CardAttack, "")
+			},
+			player: "alice",
+			owed:   4,
+		},
+		{
+			name: "targeted attack back at once",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardAttack, "")
+				mustPlay(t, g, "bob", CardTargetedAttack, "alice")
+			},
+			player: "alice",
+			owed:   4,
+		},
+		{
+			name: "target eliminated before it resolves",
+			moves: func(t *testing.T, g *GameState) {
+				now := time.Now()
+				if _, err := g.play("alice", CardTargetedAttack, "carol", now); err != nil {
+					t.Fatal(err)
+				}
+				g.eliminate("carol")
+				g.settle(now.Add(nopeWindow))
+			},
+			player: "bob",
+			owed:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardAttack, CardTargetedAttack, CardTargetedAttack}, "alice", "bob", "carol")
+			tt.moves(t, g)
+			if got := g.currentPlayer(); got != tt.player {
+				t.Fatalf("current player is %s, want %s", got, tt.player)
+			}
+			if g.TurnsOwed != tt.owed {
+				t.Errorf("%s owes %d turns, want %d", tt.player, g.TurnsOwed, tt.owed)
+			}
+		})
+	}
+}
+
+func TestAlterTheFuture(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		cards  []string
+		want   error
+	}{
+		{"reordered", "alice", []string{CardImploding, CardFavor, CardExploding}, nil},
+		{"too few cards", "alice", []string{CardExploding, CardFavor}, errBadAlteration},
+		{"cards not seen", "alice", []string{CardSkip, CardFavor, CardExploding}, errBadAlteration},
+		{"someone else's future", "bob", []string{CardImploding, CardFavor, CardExploding}, errNothingToAlter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardAlterTheFuture}, "alice", "bob")
+			g.Deck = append([]string{CardExploding, CardFavor, CardImploding}, g.Deck...)
+			mustPlay(t, g, "alice", CardAlterTheFuture, "")
+			if _, err := g.draw("alice"); err != errAlterPending {
+				t.Fatalf("drawing before altering: got %v, want %v", err, errAlterPending)
+			}
+
+			err := g.alter(tt.player, tt.cards)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if got := g.Deck[:futureSize]; !reflect.DeepEqual(got, tt.cards) {
+				t.Errorf("top of the deck is %v, want %v", got, tt.cards)
+			}
+			if g.Altering != "" {
+				t.Error("still altering after the future was set")
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	janitorLockKey = "janitor:lock"
+
+	defaultJanitorInterval = time.Minute
+	defaultIdleGameTTL     = 24 * time.Hour
+	defaultQueueTimeout    = 15 * time.Minute
+)
+
+var (
+	// janitorInterval is how often the janitor sweeps. Set with
+	// JANITOR_INTERVAL.
+	janitorInterval = defaultJanitorInterval
+	// idleGameTTL is how long a lobby or multiplayer game may sit untouched
+	// before it is expired. Set with GAME_IDLE_TTL.
+	idleGameTTL = defaultIdleGameTTL
+	// queueTimeout is the longest a player may wait in matchmaking. Set
+	// with MATCHMAKING_TIMEOUT.
+	queueTimeout = defaultQueueTimeout
+)
+
+// runJanitor expires idle rooms and their games, drops stale matchmaking
+// tickets and starts tournaments that are due. Single-player games carry
+// their own key TTL and are left alone.
+func runJanitor(ctx context.Context) {
+	ok, err := rdb.SetNX(ctx, janitorLockKey, "1", janitorInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	defer rdb.Del(ctx, janitorLockKey)
+
+	now := time.Now()
+	expireIdleRooms(ctx, openRoomsKey, now)
+	expireIdleRooms(ctx, liveRoomsKey, now)
+	expireQueue(ctx, now)
+	startDueTournaments(ctx, now)
+}
+
+// expireIdleRooms sweeps one of the room indexes. A lobby's last activity is
+// its last save; a room in play is as fresh as its game.
+func expireIdleRooms(ctx context.Context, index string, now time.Time) {
+	ids, err := rdb.SMembers(ctx, index).Result()
+	if err != nil {
+		slog.Error("listing rooms", "index", index, "err", err)
+		return
+	}
+	cutoff := now.Add(-idleGameTTL)
+	for _, id := range ids {
+		room, err := loadRoom(ctx, id)
+		if err == errRoomNotFound {
+			rdb.SRem(ctx, index, id)
+			continue
+		}
+		if err != nil {
+			slog.Error("loading room", "room", id, "err", err)
+			continue
+		}
+
+		if room.GameID == "" {
+			if lastActive(room.UpdatedAt, room.CreatedAt).Before(cutoff) {
+				expireRoom(ctx, room, nil)
+			}
+			continue
+		}
+		g, err := expireGame(ctx, room.GameID, cutoff)
+		if err == errNoChange {
+			continue
+		}
+		if err != nil && err != errGameNotFound {
+			slog.Error("expiring game", "game", room.GameID, "err", err)
+			continue
+		}
+		expireRoom(ctx, room, g)
+	}
+}
+
+// expireGame marks a game expired if nobody has touched it since cutoff,
+// so a move racing the janitor either lands first or finds the game over.
+func expireGame(ctx context.Context, id string, cutoff time.Time) (*GameState, error) {
+	return updateGame(ctx, id, "expire", func(g *GameState) error {
+		if g.Status != GameActive || !lastActive(g.UpdatedAt, g.StartedAt).Before(cutoff) {
+			return errNoChange
+		}
+		g.Status = GameExpired
+		return nil
+	})
+}
+
+// expireRoom tells whoever is still listening, then deletes the room, its
+// game and everything keyed off them.
+func expireRoom(ctx context.Context, room *Room, g *GameState) {
+	if g != nil {
+		hub.broadcast(ctx, room.ID, EventGameExpired, map[string]interface{}{
+			"room_id":     room.ID,
+			"game_id":     g.ID,
+			"idle_since":  lastActive(g.UpdatedAt, g.StartedAt),
+			"idle_expiry": idleGameTTL.String(),
+		})
+		untrackActiveGame(ctx, g.ID, append(append([]string{}, g.Players...), g.Abandoned...)...)
+		countGameEnded(ctx, g.ID)
+	} else {
+		hub.broadcast(ctx, room.ID, EventRoomExpired, map[string]interface{}{
+			"room_id":     room.ID,
+			"idle_since":  lastActive(room.UpdatedAt, room.CreatedAt),
+			"idle_expiry": idleGameTTL.String(),
+		})
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, roomKey(room.ID), connectionsKey(room.ID), backlogKey(room.ID), backlogSeqKey(room.ID), chatKey(room.ID))
+	pipe.SRem(ctx, openRoomsKey, room.ID)
+	pipe.SRem(ctx, liveRoomsKey, room.ID)
+	if room.JoinCode != "" {
+		pipe.Del(ctx, joinCodeKey(room.JoinCode))
+	}
+	if room.GameID != "" {
+		id := room.GameID
+		pipe.Del(ctx, gameEventsKey(id), gameChangesKey(id), gameSnapshotsKey(id), gameCardsKey(id), botLockKey(id), turnPushKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("deleting expired room", "room", room.ID, "err", err)
+		return
+	}
+	if room.GameID != "" {
+		if err := games.DeleteGame(ctx, room.GameID); err != nil {
+			slog.Error("deleting expired game", "game", room.GameID, "err", err)
+			return
+		}
+	}
+	slog.Info("expired idle room", "room", room.ID, "game", room.GameID)
+}
+
+// expireQueue releases players who have waited past queueTimeout, and any
+// queue entry whose ticket has gone missing.
+func expireQueue(ctx context.Context, now time.Time) {
+	// Share the matchmaker's lock so a player is not released while being
+	// seated.
+	ok, err := rdb.SetNX(ctx, matchLockKey, "1", matchInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	defer rdb.Del(ctx, matchLockKey)
+
+	queued, err := rdb.ZRangeWithScores(ctx, matchQueueKey, 0, -1).Result()
+	if err != nil {
+		slog.Error("loading matchmaking queue", "err", err)
+		return
+	}
+	cutoff := now.Add(-queueTimeout).Unix()
+	for _, z := range queued {
+		name := z.Member.(string)
+		stale := int64(z.Score) < cutoff
+		if !stale {
+			n, err := rdb.Exists(ctx, matchTicketKey(name)).Result()
+			if err != nil {
+				continue
+			}
+			stale = n == 0
+		}
+		if !stale {
+			continue
+		}
+
+		pipe := rdb.TxPipeline()
+		pipe.ZRem(ctx, matchQueueKey, name)
+		pipe.Del(ctx, matchTicketKey(name))
+		if _, err := pipe.Exec(ctx); err != nil {
+			slog.Error("releasing matchmaking ticket", "username", name, "err", err)
+			continue
+		}
+		hub.notifyUser(ctx, name, EventQueueExpired, map[string]interface{}{
+			"waited": now.Sub(time.Unix(int64(z.Score), 0)).Round(time.Second).String(),
+		})
+	}
+}
+
+// lastActive is the later of a record's update and creation times, for
+// records saved before updates were stamped.
+func lastActive(updated, created time.Time) time.Time {
+	if updated.After(created) {
+		return updated
+	}
+	return created
+}
+
+// startJanitor queues a janitor sweep every janitorInterval, once across
+// instances. The returned func stops it.
+func startJanitor(ctx context.Context) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				key := "cleanup:" + now.Truncate(janitorInterval).Format(time.RFC3339)
+				if err := enqueueJobOnce(ctx, key, janitorInterval, JobCleanup, nil); err != nil {
+					slog.Error("queueing cleanup", "err", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Job types.
+const (
+	JobSendEmail      = "send_email"
+	JobSeasonRollover = "season_rollover"
+	JobCleanup        = "cleanup"
+	JobWebhook        = "webhook"
+	JobPush           = "push"
+	JobTelemetry      = "telemetry"
+)
+
+const (
+	jobQueueKey   = "jobs:queue"
+	jobDelayedKey = "jobs:delayed"
+	jobDeadKey    = "jobs:dead"
+	// jobWorkersKey scores each worker by when it was last heard from.
+	jobWorkersKey = "jobs:workers"
+
+	defaultJobWorkers = 4
+	maxJobAttempts    = 5
+	// jobRetryDelay is the wait before a failed job's first retry; it
+	// doubles with each attempt after.
+	jobRetryDelay = 10 * time.Second
+	// jobDeadLength caps how many failed jobs are kept for inspection.
+	jobDeadLength = 1000
+	// jobWorkerTimeout is how long a worker may go unheard before its
+	// unfinished jobs are handed to the others.
+	jobWorkerTimeout = time.Minute
+	jobTickInterval  = jobWorkerTimeout / 4
+)
+
+// jobWorkers is how many jobs each instance runs at once. Set with
+// JOB_WORKERS.
+var jobWorkers = defaultJobWorkers
+
+func jobProcessingKey(worker string) string {
+	return fmt.Sprintf("jobs:processing:%s", worker)
+}
+
+func jobOnceKey(key string) string {
+	return fmt.Sprintf("jobs:once:%s", key)
+}
+
+// Job is a task handed to the worker pool instead of being done while a
+// request or timer waits.
+type Job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error,omitempty"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+}
+
+// jobHandlers runs each job type. Handlers may run more than once for the
+// same job: after a failure, or when the instance running it dies.
+var jobHandlers = map[string]func(ctx context.Context, payload json.RawMessage) error{
+	JobSendEmail:      runSendEmail,
+	JobSeasonRollover: runSeasonRollover,
+	JobCleanup:        runCleanup,
+	JobWebhook:        runWebhook,
+	JobPush:           runPush,
+	JobTelemetry:      runTelemetry,
+}
+
+// enqueueJob queues a job for whichever worker is free first.
+func enqueueJob(ctx context.Context, typ string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job, err := json.Marshal(Job{
+		ID:         newID(),
+		Type:       typ,
+		Payload:    data,
+		EnqueuedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return rdb.LPush(ctx, jobQueueKey, job).Err()
+}
+
+// enqueueJobOnce queues a job unless one was already queued under key in
+// the last ttl, so timers firing on every instance queue it once.
+func enqueueJobOnce(ctx context.Context, key string, ttl time.Duration, typ string, payload interface{}) error {
+	first, err := rdb.SetNX(ctx, jobOnceKey(key), 1, ttl).Result()
+	if err != nil || !first {
+		return err
+	}
+	if err := enqueueJob(ctx, typ, payload); err != nil {
+		rdb.Del(ctx, jobOnceKey(key))
+		return err
+	}
+	return nil
+}
+
+// startJobWorkers runs n workers until the returned func is called, which
+// waits for jobs in progress to finish.
+func startJobWorkers(ctx context.Context, n int) func() {
+	instance := instanceName()
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	workers := make([]string, n)
+	for i := range workers {
+		workers[i] = fmt.Sprintf("%s-%d", instance, i)
+	}
+	heartbeat(ctx, workers)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(jobTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				heartbeat(ctx, workers)
+				promoteDelayedJobs(ctx)
+				recoverJobs(ctx)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			runJobWorker(ctx, worker, quit)
+		}(worker)
+	}
+
+	return func() {
+		close(quit)
+		wg.Wait()
+		members := make([]interface{}, len(workers))
+		for i, w := range workers {
+			members[i] = w
+		}
+		rdb.ZRem(ctx, jobWorkersKey, members...)
+	}
+}
+
+func heartbeat(ctx context.Context, workers []string) {
+	now := float64(time.Now().Unix())
+	members := make([]*redis.Z, len(workers))
+	for i, w := range workers {
+		members[i] = &redis.Z{Score: now, Member: w}
+	}
+	if err := rdb.ZAdd(ctx, jobWorkersKey, members...).Err(); err != nil {
+		slog.Error("registering job workers", "err", err)
+	}
+}
+
+// runJobWorker takes jobs until quit closes. A job moves to the worker's
+// own processing list while it runs, so it survives the instance dying.
+func runJobWorker(ctx context.Context, worker string, quit <-chan struct{}) {
+	block := blockingReadTime()
+	processing := jobProcessingKey(worker)
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		raw, err := rdb.BRPopLPush(ctx, jobQueueKey, processing, block).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			slog.Error("taking job", "worker", worker, "err", err)
+			select {
+			case <-quit:
+				return
+			case <-time.After(block):
+			}
+			continue
+		}
+		runJob(ctx, processing, raw)
+	}
+}
+
+// runJob runs one job taken onto the processing list, then drops it from
+// the list, scheduling a retry or giving up on it if it failed.
+func runJob(ctx context.Context, processing, raw string) {
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		slog.Error("decoding job", "err", err)
+		rdb.LRem(ctx, processing, 1, raw)
+		return
+	}
+	handle, ok := jobHandlers[job.Type]
+	err := fmt.Errorf("unknown job type %q", job.Type)
+	if ok {
+		started := time.Now()
+		if err = handle(ctx, job.Payload); err == nil {
+			slog.Debug("ran job", "job", job.ID, "type", job.Type, "took", time.Since(started))
+			rdb.LRem(ctx, processing, 1, raw)
+			return
+		}
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	data, _ := json.Marshal(job)
+	pipe := rdb.TxPipeline()
+	pipe.LRem(ctx, processing, 1, raw)
+	if ok && job.Attempts < maxJobAttempts {
+		retryAt := time.Now().Add(jobRetryDelay << (job.Attempts - 1))
+		pipe.ZAdd(ctx, jobDelayedKey, &redis.Z{Score: float64(retryAt.Unix()), Member: data})
+		slog.Warn("job failed, will retry", "job", job.ID, "type", job.Type, "attempts", job.Attempts, "err", err)
+	} else {
+		pipe.LPush(ctx, jobDeadKey, data)
+		pipe.LTrim(ctx, jobDeadKey, 0, jobDeadLength-1)
+		slog.Error("job failed, giving up", "job", job.ID, "type", job.Type, "attempts", job.Attempts, "err", err)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("rescheduling job", "job", job.ID, "err", err)
+	}
+}
+
+// promoteDelayedJobs queues retries that are due. Removing each from the
+// delayed set first means only one instance queues it.
+func promoteDelayedJobs(ctx context.Context) {
+	due, err := rdb.ZRangeByScore(ctx, jobDelayedKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		slog.Error("loading delayed jobs", "err", err)
+		return
+	}
+	for _, raw := range due {
+		if n, err := rdb.ZRem(ctx, jobDelayedKey, raw).Result(); err != nil || n == 0 {
+			continue
+		}
+		if err := rdb.LPush(ctx, jobQueueKey, raw).Err(); err != nil {
+			slog.Error("queueing delayed job", "err", err)
+		}
+	}
+}
+
+// recoverJobs requeues the jobs of workers that have stopped checking in.
+func recoverJobs(ctx context.Context) {
+	dead, err := rdb.ZRangeByScore(ctx, jobWorkersKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Add(-jobWorkerTimeout).Unix(), 10),
+	}).Result()
+	if err != nil {
+		slog.Error("loading job workers", "err", err)
+		return
+	}
+	for _, worker := range dead {
+		if n, err := rdb.ZRem(ctx, jobWorkersKey, worker).Result(); err != nil || n == 0 {
+			continue
+		}
+		requeued := 0
+		for {
+			err := rdb.RPopLPush(ctx, jobProcessingKey(worker), jobQueueKey).Err()
+			if err != nil {
+				if err != redis.Nil {
+					slog.Error("requeueing jobs", "worker", worker, "err", err)
+				}
+				break
+			}
+			requeued++
+		}
+		if requeued > 0 {
+			slog.Warn("requeued jobs of lost worker", "worker", worker, "jobs", requeued)
+		}
+	}
+}
+
+// EmailJob is a message for the mailer.
+type EmailJob struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+func runSendEmail(_ context.Context, payload json.RawMessage) error {
+	var m EmailJob
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+	return mailer.Send(m.To, m.Subject, m.Body)
+}
+
+// SeasonRolloverJob is when the rollover was due.
+type SeasonRolloverJob struct {
+	At time.Time `json:"at"`
+}
+
+func runSeasonRollover(ctx context.Context, payload json.RawMessage) error {
+	var job SeasonRolloverJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	return rolloverSeason(ctx, job.At)
+}
+
+func runCleanup(ctx context.Context, _ json.RawMessage) error {
+	runJanitor(ctx)
+	return nil
+}
+
+// JobStats is how the queue is doing.
+type JobStats struct {
+	Queued  int64 `json:"queued"`
+	Delayed int64 `json:"delayed"`
+	Workers int64 `json:"workers"`
+	Failed  int64 `json:"failed"`
+	// Recent lists the most recently failed jobs.
+	Recent []Job `json:"recent"`
+}
+
+func getJobStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pipe := rdb.Pipeline()
+	queued := pipe.LLen(ctx, jobQueueKey)
+	delayed := pipe.ZCard(ctx, jobDelayedKey)
+	workers := pipe.ZCard(ctx, jobWorkersKey)
+	failed := pipe.LLen(ctx, jobDeadKey)
+	recent := pipe.LRange(ctx, jobDeadKey, 0, defaultPageLimit-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error loading jobs")
+		return
+	}
+
+	stats := JobStats{
+		Queued:  queued.Val(),
+		Delayed: delayed.Val(),
+		Workers: workers.Val(),
+		Failed:  failed.Val(),
+		Recent:  []Job{},
+	}
+	for _, raw := range recent.Val() {
+		var job Job
+		if json.Unmarshal([]byte(raw), &job) == nil {
+			stats.Recent = append(stats.Recent, job)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// retryFailedJobs queues every job that ran out of attempts again, with
+// its attempts reset.
+func retryFailedJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	retried := 0
+	for {
+		raw, err := rdb.RPop(ctx, jobDeadKey).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error retrying jobs")
+			return
+		}
+		var job Job
+		if json.Unmarshal([]byte(raw), &job) != nil {
+			continue
+		}
+		job.Attempts = 0
+		data, _ := json.Marshal(job)
+		if err := rdb.LPush(ctx, jobQueueKey, data).Err(); err != nil {
+			rdb.RPush(ctx, jobDeadKey, raw)
+			respondInternal(w, r, err, "Error retrying jobs")
+			return
+		}
+		retried++
+	}
+	logFor(r).Info("retried failed jobs", "jobs", retried)
+	audit(ctx, actorName(r), AuditJobsRetried, "jobs", nil, map[string]int{"retried": retried})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"retried": retried})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	leaderboardKey         = "leaderboard"
+	leaderboardMigratedKey = "leaderboard:migrated"
+	aroundMeRadius         = 5
+	// scoredTTL is how long a game's scored marker outlives its payout,
+	// well past any redelivery of the finished game.
+	scoredTTL = 7 * 24 * time.Hour
+)
+
+// addToLeaderboard lists a player with a zero score without touching an
+// existing entry.
+func addToLeaderboard(ctx context.Context, username string) error {
+	return leaderboards.AddPlayer(ctx, leaderboardKey, username)
+}
+
+// incrementScore adds to a player's lifetime score and to the standings of
+// the season currently in progress.
+func incrementScore(ctx context.Context, username string, by int) error {
+	boards, err := scoreBoards(ctx)
+	if err != nil {
+		return err
+	}
+	return leaderboards.IncrementScore(ctx, username, by, boards...)
+}
+
+// scoreBoards lists the boards a payout counts on: the lifetime board and
+// the season in progress, if there is one.
+func scoreBoards(ctx context.Context) ([]string, error) {
+	season, err := currentSeason(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	boards := []string{leaderboardKey}
+	if season != "" {
+		boards = append(boards, seasonLeaderboardKey(season))
+	}
+	return boards, nil
+}
+
+func scoredKey(gameID string) string {
+	return fmt.Sprintf("game:%s:scored", gameID)
+}
+
+// awardWin credits the winner of a finished game with a point, multiplied
+// by their streak bonus and any double score event, and their coins. The
+// scored marker is set in the same step as the points, so each game pays out
+// at most once and a failure can't leave it marked but unpaid. processStats
+// runs it after recording the game, so the winner's streak already counts
+// this win.
+func awardWin(ctx context.Context, g *GameState) error {
+	if g.Status != GameFinished || g.Winner == "" || g.isBot(g.Winner) {
+		return nil
+	}
+	stats, err := histories.PlayerStats(ctx, g.Winner)
+	if err != nil {
+		return err
+	}
+	points := doubledBy(g.Modifiers, ModifierDoubleScore, streakMultiplier(stats.CurrentStreak))
+	boards, err := scoreBoards(ctx)
+	if err != nil {
+		return err
+	}
+	first, err := leaderboards.IncrementScoreOnce(ctx, scoredKey(g.ID), scoredTTL, g.Winner, points, boards...)
+	if err != nil || !first {
+		return err
+	}
+	if err := awardCoins(ctx, g.Winner, doubledBy(g.Modifiers, ModifierDoubleCoins, coinsPerWin)); err != nil {
+		return err
+	}
+	return auditScore(ctx, g.Winner, points, "game", g.ID)
+}
+
+// awardScore pays a player points the server owes them and puts the payout
+// in the audit trail, noting what it was for.
+func awardScore(ctx context.Context, username string, by int, reason, ref string) error {
+	if err := incrementScore(ctx, username, by); err != nil {
+		return err
+	}
+	return auditScore(ctx, username, by, reason, ref)
+}
+
+// auditScore puts a payout of by points already made in the audit trail.
+func auditScore(ctx context.Context, username string, by int, reason, ref string) error {
+	after, err := leaderboards.Score(ctx, leaderboardKey, username)
+	if err != nil {
+		return err
+	}
+	audit(ctx, systemActor, AuditScoreAwarded, username,
+		map[string]interface{}{"board": leaderboardKey, "score": after - by},
+		map[string]interface{}{"board": leaderboardKey, "score": after, reason: ref})
+	checkTopTen(ctx)
+	return nil
+}
+
+// migrateLeaderboard copies the legacy user:<name> string scores into the
+// leaderboard sorted set. It only runs once per Redis database.
+func migrateLeaderboard(ctx context.Context) error {
+	done, err := rdb.Exists(ctx, leaderboardMigratedKey).Result()
+	if err != nil || done > 0 {
+		return err
+	}
+
+	migrated := 0
+	err = scanValues(ctx, rdb, "user:*", func(key, value string) error {
+		score, err := strconv.Atoi(value)
+		if err != nil {
+			return nil
+		}
+		username := strings.TrimPrefix(key, "user:")
+		if err := leaderboards.SetScore(ctx, leaderboardKey, username, score); err != nil {
+			return err
+		}
+		migrated++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("migrated legacy scores to the leaderboard", "count", migrated)
+	return rdb.Set(ctx, leaderboardMigratedKey, migrated, 0).Err()
+}
+
+func getLeaderboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	key, err := leaderboardFor(r)
+	if err == errSeasonNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	page, stale, err := cachedLeaderboardPage(ctx, key, limit, offset)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(leaderboardCacheTTL.Seconds())))
+	w.Header().Set("ETag", page.etag)
+	w.Header().Set("X-Total-Count", strconv.FormatInt(page.total, 10))
+	if r.Header.Get("If-None-Match") == page.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(page.body)
+}
+
+// cachedLeaderboardPage is a page of a board, from the cache when it is
+// fresh, for the REST and gRPC APIs alike. While Redis is down an expired
+// page is better than none, and is reported as stale.
+func cachedLeaderboardPage(ctx context.Context, key string, limit, offset int) (page *cachedPage, stale bool, err error) {
+	cacheKey := fmt.Sprintf("%s:%d:%d", key, limit, offset)
+	if page, ok := leaderboardPages.get(cacheKey); ok {
+		return page, false, nil
+	}
+	page, err = leaderboardPage(ctx, key, limit, offset)
+	if err == nil {
+		leaderboardPages.put(cacheKey, page)
+		return page, false, nil
+	}
+	if old, ok := leaderboardPages.stale(cacheKey); ok && storageDown(err) {
+		return old, true, nil
+	}
+	return nil, false, err
+}
+
+// leaderboardPage reads and encodes a page of a board for the cache.
+func leaderboardPage(ctx context.Context, key string, limit, offset int) (*cachedPage, error) {
+	total, err := leaderboards.Count(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	players := []Player{}
+	if limit > 0 {
+		players, err = leaderboards.Range(ctx, key, int64(offset), int64(offset+limit-1))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := fillLevels(ctx, players); err != nil {
+		return nil, err
+	}
+	if err := fillStreaks(ctx, players); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(players)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedPage(append(body, '\n'), total, leaderboardCacheTTL), nil
+}
+
+// getLeaderboardAroundMe returns the caller's rank with the players just
+// above and below them.
+func getLeaderboardAroundMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	key, err := leaderboardFor(r)
+	if err == errSeasonNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rank, err := leaderboards.Rank(ctx, key, username)
+	if err == errNotRanked {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	start := rank - aroundMeRadius
+	if start < 0 {
+		start = 0
+	}
+	players, err := leaderboards.Range(ctx, key, start, rank+aroundMeRadius)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := fillLevels(ctx, players); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := fillStreaks(ctx, players); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var me Player
+	for _, p := range players {
+		if p.Username == username {
+			me = p
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rank":    me.Rank,
+		"score":   me.Score,
+		"players": players,
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Modifiers a live event can switch on. Games take the modifiers active
+// when they are dealt and keep them to the end.
+const (
+	ModifierDoubleScore = "double_score"
+	ModifierDoubleXP    = "double_xp"
+	ModifierDoubleCoins = "double_coins"
+	// ModifierHolidayDeck shuffles holidayDefuses extra Defuses into the
+	// deck.
+	ModifierHolidayDeck = "holiday_deck"
+)
+
+var modifiers = []string{ModifierDoubleScore, ModifierDoubleXP, ModifierDoubleCoins, ModifierHolidayDeck}
+
+const holidayDefuses = 2
+
+// liveEventsKey maps event IDs to the calendar's events.
+const liveEventsKey = "live_events"
+
+// liveEventPoll is how often each instance checks the calendar for events
+// starting or ending.
+const liveEventPoll = 30 * time.Second
+
+var errLiveEventNotFound = errors.New("event not found")
+
+// LiveEvent is a limited-time event on the calendar, such as a double
+// score weekend.
+type LiveEvent struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Modifier    string    `json:"modifier"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	CreatedBy   string    `json:"created_by"`
+}
+
+func (e *LiveEvent) activeAt(t time.Time) bool {
+	return !t.Before(e.StartsAt) && t.Before(e.EndsAt)
+}
+
+func knownModifier(m string) bool {
+	for _, known := range modifiers {
+		if known == m {
+			return true
+		}
+	}
+	return false
+}
+
+func hasModifier(list []string, m string) bool {
+	for _, have := range list {
+		if have == m {
+			return true
+		}
+	}
+	return false
+}
+
+// doubledBy doubles n when the modifier is on.
+func doubledBy(list []string, m string, n int) int {
+	if hasModifier(list, m) {
+		return 2 * n
+	}
+	return n
+}
+
+// activeEvents caches the calendar's current events so dealing a game
+// doesn't need a round trip. The event scheduler keeps it fresh.
+var activeEvents = struct {
+	sync.RWMutex
+	list []*LiveEvent
+}{}
+
+func currentLiveEvents() []*LiveEvent {
+	activeEvents.RLock()
+	defer activeEvents.RUnlock()
+	return activeEvents.list
+}
+
+// activeModifiers lists the modifiers of the events running now.
+func activeModifiers() []string {
+	list := []string{}
+	for _, e := range currentLiveEvents() {
+		if !hasModifier(list, e.Modifier) {
+			list = append(list, e.Modifier)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func loadLiveEvents(ctx context.Context) ([]*LiveEvent, error) {
+	raw, err := rdb.HGetAll(ctx, liveEventsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []*LiveEvent{}
+	for _, data := range raw {
+		var e LiveEvent
+		if json.Unmarshal([]byte(data), &e) == nil {
+			list = append(list, &e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartsAt.Before(list[j].StartsAt) })
+	return list, nil
+}
+
+// refreshLiveEvents reloads the running events and announces the ones that
+// started or ended since the last look to clients in the lobby. Every
+// instance does this for its own clients.
+func refreshLiveEvents(ctx context.Context, now time.Time) error {
+	all, err := loadLiveEvents(ctx)
+	if err != nil {
+		return err
+	}
+	active := []*LiveEvent{}
+	for _, e := range all {
+		if e.activeAt(now) {
+			active = append(active, e)
+		}
+	}
+
+	activeEvents.Lock()
+	before := activeEvents.list
+	activeEvents.list = active
+	activeEvents.Unlock()
+
+	was := map[string]bool{}
+	for _, e := range before {
+		was[e.ID] = true
+	}
+	for _, e := range active {
+		if !was[e.ID] {
+			hub.broadcast(ctx, lobbyRoom, EventLiveEventStarted, e)
+		}
+		delete(was, e.ID)
+	}
+	for _, e := range before {
+		if was[e.ID] {
+			hub.broadcast(ctx, lobbyRoom, EventLiveEventEnded, e)
+		}
+	}
+	return nil
+}
+
+// startEventScheduler keeps the active events current. The returned func
+// stops it.
+func startEventScheduler(ctx context.Context) func() {
+	if err := refreshLiveEvents(ctx, time.Now()); err != nil {
+		slog.Error("loading live events", "err", err)
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(liveEventPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := refreshLiveEvents(ctx, time.Now()); err != nil {
+					slog.Error("loading live events", "err", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+type CreateLiveEventRequest struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Modifier    string    `json:"modifier"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+}
+
+func validateLiveEvent(req *CreateLiveEventRequest) []*FieldError {
+	problems := []*FieldError{}
+	if req.Name == "" {
+		problems = append(problems, &FieldError{Field: "name", Code: "NAME_REQUIRED", Message: "Name is required"})
+	}
+	if !knownModifier(req.Modifier) {
+		problems = append(problems, &FieldError{Field: "modifier", Code: "MODIFIER_UNKNOWN",
+			Message: fmt.Sprintf("Modifier must be one of %s", strings.Join(modifiers, ", "))})
+	}
+	if !req.EndsAt.After(req.StartsAt) || !req.EndsAt.After(time.Now()) {
+		problems = append(problems, &FieldError{Field: "ends_at", Code: "ENDS_BEFORE_START", Message: "End time must be in the future and after the start"})
+	}
+	return problems
+}
+
+func createLiveEvent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req CreateLiveEventRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if problems := validateLiveEvent(&req); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	e := &LiveEvent{
+		ID:          newID(),
+		Name:        req.Name,
+		Description: req.Description,
+		Modifier:    req.Modifier,
+		StartsAt:    req.StartsAt.UTC(),
+		EndsAt:      req.EndsAt.UTC(),
+		CreatedBy:   actorName(r),
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		respondInternal(w, r, err, "Error creating event")
+		return
+	}
+	if err := rdb.HSet(ctx, liveEventsKey, e.ID, data).Err(); err != nil {
+		respondInternal(w, r, err, "Error creating event")
+		return
+	}
+	logFor(r).Info("live event scheduled", "event", e.ID, "modifier", e.Modifier, "starts_at", e.StartsAt, "ends_at", e.EndsAt)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+// listLiveEvents shows the whole calendar, past events included.
+func listLiveEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	list, err := loadLiveEvents(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func deleteLiveEvent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	removed, err := rdb.HDel(ctx, liveEventsKey, id).Result()
+	if err != nil && err != redis.Nil {
+		respondInternal(w, r, err, "Error deleting event")
+		return
+	}
+	if removed == 0 {
+		respondError(w, r, http.StatusNotFound, errLiveEventNotFound)
+		return
+	}
+	logFor(r).Info("live event deleted", "event", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getActiveEvents lists the events running now, for banners. It reads the
+// calendar rather than the cache so a new event shows up straight away.
+func getActiveEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	all, err := loadLiveEvents(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading events")
+		return
+	}
+	now := time.Now()
+	active := []*LiveEvent{}
+	for _, e := range all {
+		if e.activeAt(now) {
+			active = append(active, e)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	errLoginLocked     = errors.New("too many failed sign-ins, try again later")
+	errCaptchaRequired = errors.New("complete the CAPTCHA to sign in")
+	errCaptchaFailed   = errors.New("CAPTCHA verification failed")
+	// errCaptchaDown wraps failures to reach the CAPTCHA provider.
+	errCaptchaDown = errors.New("CAPTCHA verification is unavailable, try again shortly")
+)
+
+const defaultCaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+
+// LoginThrottleConfig is how failed sign-ins are throttled. Failures are
+// counted per username and per IP over Window. Once either count reaches
+// its limit, every further failure locks that username or IP out, for
+// Lockout at first and twice as long each time after, up to MaxLockout.
+// With CaptchaSecret set, sign-ins after CaptchaAfter failures also need a
+// CAPTCHA token, checked against CaptchaVerifyURL; reCAPTCHA, hCaptcha and
+// Turnstile all answer the same siteverify request.
+type LoginThrottleConfig struct {
+	Window           time.Duration
+	UserLimit        int
+	IPLimit          int
+	Lockout          time.Duration
+	MaxLockout       time.Duration
+	CaptchaAfter     int
+	CaptchaSecret    string
+	CaptchaVerifyURL string
+}
+
+var loginThrottle = LoginThrottleConfig{
+	Window:           15 * time.Minute,
+	UserLimit:        5,
+	IPLimit:          20,
+	Lockout:          30 * time.Second,
+	MaxLockout:       time.Hour,
+	CaptchaAfter:     3,
+	CaptchaVerifyURL: defaultCaptchaVerifyURL,
+}
+
+// loginEvents counts throttling decisions for monitoring, under
+// "login_throttle" at /admin/debug/vars.
+var loginEvents = expvar.NewMap("login_throttle")
+
+// loginScope is who failures are counted against: a username or an IP.
+type loginScope struct {
+	kind  string
+	id    string
+	limit int
+}
+
+func loginScopes(ip, username string) []loginScope {
+	return []loginScope{
+		{kind: "user", id: strings.ToLower(username), limit: loginThrottle.UserLimit},
+		{kind: "ip", id: ip, limit: loginThrottle.IPLimit},
+	}
+}
+
+func loginFailuresKey(s loginScope) string {
+	return fmt.Sprintf("login:failures:%s:%s", s.kind, s.id)
+}
+
+func loginLockKey(s loginScope) string {
+	return fmt.Sprintf("login:lock:%s:%s", s.kind, s.id)
+}
+
+// checkLoginAllowed refuses a sign-in while its username or IP is locked
+// out, or without a valid CAPTCHA token once there have been enough
+// failures. The wait before retrying comes back with errLoginLocked. When
+// Redis cannot be reached sign-ins go ahead, as with rate limits.
+func checkLoginAllowed(ctx context.Context, ip, username, captchaToken string) (time.Duration, error) {
+	scopes := loginScopes(ip, username)
+	pipe := rdb.Pipeline()
+	locks := make([]*redis.DurationCmd, len(scopes))
+	failures := make([]*redis.StringCmd, len(scopes))
+	for i, s := range scopes {
+		locks[i] = pipe.PTTL(ctx, loginLockKey(s))
+		failures[i] = pipe.Get(ctx, loginFailuresKey(s))
+	}
+	if _, err := pipe.Exec(ctx); redisFailed(err) {
+		slog.Error("checking login lockout", "err", err)
+		return 0, nil
+	}
+
+	var wait time.Duration
+	most := 0
+	for i := range scopes {
+		if ttl := locks[i].Val(); ttl > wait {
+			wait = ttl
+		}
+		if n, _ := failures[i].Int(); n > most {
+			most = n
+		}
+	}
+	if wait > 0 {
+		loginEvents.Add("refused_locked", 1)
+		return wait, errLoginLocked
+	}
+
+	if loginThrottle.CaptchaSecret == "" || most < loginThrottle.CaptchaAfter {
+		return 0, nil
+	}
+	if captchaToken == "" {
+		loginEvents.Add("captcha_required", 1)
+		return 0, errCaptchaRequired
+	}
+	ok, err := verifyCaptcha(captchaToken, ip)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errCaptchaDown, err)
+	}
+	if !ok {
+		loginEvents.Add("captcha_failed", 1)
+		return 0, errCaptchaFailed
+	}
+	return 0, nil
+}
+
+// recordLoginFailure counts a failed sign-in against its username and IP,
+// locking out whichever has reached its limit.
+func recordLoginFailure(ctx context.Context, ip, username string) {
+	loginEvents.Add("failures", 1)
+	scopes := loginScopes(ip, username)
+	pipe := rdb.TxPipeline()
+	counts := make([]*redis.IntCmd, len(scopes))
+	for i, s := range scopes {
+		counts[i] = pipe.Incr(ctx, loginFailuresKey(s))
+		pipe.Expire(ctx, loginFailuresKey(s), loginThrottle.Window)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("recording login failure", "err", err)
+		return
+	}
+
+	for i, s := range scopes {
+		n := int(counts[i].Val())
+		if n < s.limit {
+			continue
+		}
+		lockout := lockoutFor(n - s.limit)
+		if err := rdb.Set(ctx, loginLockKey(s), n, lockout).Err(); err != nil {
+			slog.Error("locking out login", "scope", s.kind, "err", err)
+			continue
+		}
+		loginEvents.Add("lockouts_"+s.kind, 1)
+		slog.Warn("login locked out", "scope", s.kind, "id", s.id, "failures", n, "lockout", lockout)
+	}
+}
+
+// lockoutFor is how long the nth failure past the limit locks out for.
+func lockoutFor(n int) time.Duration {
+	lockout := loginThrottle.Lockout
+	for i := 0; i < n && lockout < loginThrottle.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > loginThrottle.MaxLockout {
+		lockout = loginThrottle.MaxLockout
+	}
+	return lockout
+}
+
+// clearLoginFailures forgets a username's failures once it signs in. The
+// IP's are kept, so one good password does not reset an IP trying many
+// accounts.
+func clearLoginFailures(ctx context.Context, username string) {
+	s := loginScope{kind: "user", id: strings.ToLower(username)}
+	if err := rdb.Del(ctx, loginFailuresKey(s), loginLockKey(s)).Err(); err != nil {
+		slog.Error("clearing login failures", "username", username, "err", err)
+	}
+}
+
+var captchaClient = &http.Client{Timeout: 5 * time.Second}
+
+// verifyCaptcha asks the CAPTCHA provider whether token is a solved
+// challenge.
+func verifyCaptcha(token, remoteIP string) (bool, error) {
+	resp, err := captchaClient.PostForm(loginThrottle.CaptchaVerifyURL, url.Values{
+		"secret":   {loginThrottle.CaptchaSecret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return false, fmt.Errorf("verifying CAPTCHA: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("verifying CAPTCHA: provider answered %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("verifying CAPTCHA: %w", err)
+	}
+	return result.Success, nil
+}
+
+// loginRefused reports whether err is checkLoginAllowed turning a sign-in
+// away.
+func loginRefused(err error) bool {
+	return err == errLoginLocked || err == errCaptchaRequired || err == errCaptchaFailed || errors.Is(err, errCaptchaDown)
+}
+
+// respondLoginRefused reports a sign-in checkLoginAllowed turned away.
+func respondLoginRefused(w http.ResponseWriter, r *http.Request, wait time.Duration, err error) {
+	switch err {
+	case errLoginLocked:
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		respondError(w, r, http.StatusTooManyRequests, err)
+	case errCaptchaRequired, errCaptchaFailed:
+		respondError(w, r, http.StatusUnauthorized, err)
+	default:
+		logFor(r).Error("verifying CAPTCHA", "err", err)
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, errCaptchaDown.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// lockTTL bounds how long a crashed instance can hold a lock. Anything
+	// done under one must finish well within it.
+	lockTTL = 5 * time.Second
+	// lockWait is how long a caller queues for a held lock before giving
+	// up with a busy error.
+	lockWait = 2 * time.Second
+	// lockRetry is the longest pause between attempts to take a lock.
+	lockRetry = 50 * time.Millisecond
+)
+
+func roomLockKey(roomID string) string {
+	return fmt.Sprintf("room:%s:lock", roomID)
+}
+
+func gameLockKey(gameID string) string {
+	return fmt.Sprintf("game:%s:lock", gameID)
+}
+
+// releaseLock deletes a lock only if it still holds our token, so a holder
+// whose lock expired can't release the next one's.
+var releaseLock = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// acquireLock takes the lock at key for every instance, waiting up to
+// lockWait for whoever holds it. It reports false if the lock stayed held.
+// The returned func releases it.
+func acquireLock(ctx context.Context, key string) (func(), bool, error) {
+	token := randomToken()
+	deadline := time.Now().Add(lockWait)
+	pause := 5 * time.Millisecond
+	for {
+		ok, err := rdb.SetNX(ctx, key, token, lockTTL).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			// Release even if the caller's request was cancelled meanwhile.
+			release := context.WithoutCancel(ctx)
+			return func() {
+				if err := releaseLock.Run(release, rdb, []string{key}, token).Err(); err != nil {
+					slog.Error("releasing lock", "key", key, "err", err)
+				}
+			}, true, nil
+		}
+		if time.Now().Add(pause).After(deadline) {
+			return nil, false, nil
+		}
+		time.Sleep(pause)
+		if pause *= 2; pause > lockRetry {
+			pause = lockRetry
+		}
+	}
+}
+
+// withLock runs fn holding the lock at key, or returns busy if it can't be
+// had in time.
+func withLock(ctx context.Context, key string, busy error, fn func() error) error {
+	release, ok, err := acquireLock(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return busy
+	}
+	defer release()
+	return fn()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestInfoKey contextKey = "request"
+
+// logLevel can be changed while the server runs; see setLogLevel.
+var logLevel = new(slog.LevelVar)
+
+// requestInfo collects the fields logged for a request. Handlers further
+// down the chain fill in what they learn, such as who the caller is.
+type requestInfo struct {
+	id       string
+	username string
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// initLogging installs a JSON logger as the default. LOG_LEVEL sets the
+// level once the configuration is loaded.
+func initLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// statusRecorder remembers the status code written by a handler. It still
+// supports hijacking and flushing so websocket upgrades and event streams
+// pass through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests tags every request with an ID, echoed in X-Request-ID, and
+// logs one line per request once it completes.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if info.id == "" {
+			info.id = newID()
+		}
+		w.Header().Set("X-Request-ID", info.id)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"request_id", info.id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"username", info.username,
+			"status", rec.status,
+			"latency_ms", time.Since(start).Milliseconds(),
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			attrs = append(attrs, "trace_id", sc.TraceID().String())
+		}
+		slog.Log(r.Context(), level, "request", attrs...)
+	})
+}
+
+// setRequestUser attaches the authenticated caller to the request's log
+// line.
+func setRequestUser(r *http.Request, username string) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		info.username = username
+	}
+}
+
+// logFor returns a logger carrying the request's ID and caller.
+func logFor(r *http.Request) *slog.Logger {
+	info, ok := r.Context().Value(requestInfoKey).(*requestInfo)
+	if !ok {
+		return slog.Default()
+	}
+	return slog.With("request_id", info.id, "username", info.username)
+}
+
+// setLogLevel changes the log level at runtime.
+func setLogLevel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req LogLevelRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(req.Level))); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Level must be debug, info, warn or error")
+		return
+	}
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	logFor(r).Info("log level changed", "level", level.String())
+	audit(ctx, actorName(r), AuditLogLevelChanged, "log_level",
+		map[string]string{"level": previous.String()}, map[string]string{"level": level.String()})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"level": level.String()})
+}
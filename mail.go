@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mail backends MAILER can name.
+const (
+	MailerLog      = "log"
+	MailerSMTP     = "smtp"
+	MailerSendGrid = "sendgrid"
+)
+
+const sendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+// Mailer delivers plain-text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// MailConfig is how email goes out. MAILER=log, the default, only logs
+// messages, for development. smtp sends through SMTP_HOST, signing in as
+// SMTP_USERNAME when set, and sendgrid through SendGrid's API with
+// SENDGRID_API_KEY. Either way mail is from MAIL_FROM.
+type MailConfig struct {
+	Mailer         string
+	From           string
+	SMTPHost       string
+	SMTPPort       int
+	SMTPUsername   string
+	SMTPPassword   string
+	SendGridAPIKey string
+}
+
+var mailer Mailer = logMailer{}
+
+func newMailer(c MailConfig) Mailer {
+	switch c.Mailer {
+	case MailerSMTP:
+		return &smtpMailer{
+			addr: net.JoinHostPort(c.SMTPHost, fmt.Sprint(c.SMTPPort)),
+			host: c.SMTPHost,
+			from: c.From,
+			user: c.SMTPUsername,
+			pass: c.SMTPPassword,
+		}
+	case MailerSendGrid:
+		return &sendGridMailer{from: c.From, key: c.SendGridAPIKey, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return logMailer{}
+	}
+}
+
+// sendMail hands a message to the job queue, so a slow mail server neither
+// holds up the request nor shows how long delivery took, and a failed send
+// is retried. If the queue can't take it, it is sent in the background.
+func sendMail(ctx context.Context, to, subject, body string) {
+	err := enqueueJob(ctx, JobSendEmail, EmailJob{To: to, Subject: subject, Body: body})
+	if err == nil {
+		return
+	}
+	slog.Error("queueing email", "subject", subject, "err", err)
+	go func() {
+		if err := mailer.Send(to, subject, body); err != nil {
+			slog.Error("sending email", "subject", subject, "err", err)
+		}
+	}()
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	slog.Info("email not sent, MAILER=log", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+type smtpMailer struct {
+	addr, host, from, user, pass string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.user != "" {
+		auth = smtp.PlainAuth("", m.user, m.pass, m.host)
+	}
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg))
+}
+
+type sendGridMailer struct {
+	from, key string
+	client    *http.Client
+}
+
+func (m *sendGridMailer) Send(to, subject, body string) error {
+	type address struct {
+		Email string `json:"email"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"personalizations": []map[string][]address{{"to": {{Email: to}}}},
+		"from":             address{Email: m.from},
+		"subject":          subject,
+		"content":          []content{{Type: "text/plain", Value: body}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sendGridURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sendgrid answered %s: %s", resp.Status, detail)
+	}
+	return nil
+}
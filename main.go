@@ -4,28 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	"github.com/rs/cors"
 )
 
-var (
-	ctx = context.Background()
-	rdb *redis.Client
-)
+var rdb redis.UniversalClient
 
 type Player struct {
 	Username string `json:"username"`
 	Score    int    `json:"score"`
+	Rank     int    `json:"rank,omitempty"`
+	Level    int    `json:"level,omitempty"`
+	Streak   int    `json:"streak,omitempty"`
 }
 
 type LoginRequest struct {
 	Username string `json:"username"`
+	Password string `json:"password"`
+	// CaptchaToken is needed after repeated failures; see checkLoginAllowed.
+	CaptchaToken string `json:"captcha_token,omitempty"`
 }
 
 type CardDraw struct {
@@ -33,92 +36,252 @@ type CardDraw struct {
 }
 
 type GameState struct {
-	Deck      []string `json:"deck"`
-	HasDefuse bool     `json:"has_defuse"`
+	ID          string                `json:"id"`
+	Version     int64                 `json:"version"`
+	RoomID      string                `json:"room_id,omitempty"`
+	Players     []string              `json:"players"`
+	Eliminated  []string              `json:"eliminated,omitempty"`
+	Abandoned   []string              `json:"abandoned,omitempty"`
+	Hands       map[string][]string   `json:"hands"`
+	Deck        []string              `json:"deck"`
+	Turn        int                   `json:"turn"`
+	TurnsOwed   int                   `json:"turns_owed"`
+	Pending     *PendingAction        `json:"pending,omitempty"`
+	Reinserting string                `json:"reinserting,omitempty"`
+	Status      string                `json:"status"`
+	Winner      string                `json:"winner,omitempty"`
+	Stats       map[string]*GameStats `json:"stats"`
+	Bots        map[string]string     `json:"bots,omitempty"`
+	BotMemory   map[string][]string   `json:"bot_memory,omitempty"`
+	StartedAt   time.Time             `json:"started_at"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+	// TurnDeadline is when the current player's turn times out; Timeouts
+	// counts each player's turns timed out in a row.
+	TurnDeadline time.Time      `json:"turn_deadline"`
+	Timeouts     map[string]int `json:"timeouts,omitempty"`
+	// Seed drives every shuffle and random pick; it is only revealed once
+	// the game is over.
+	Seed       string   `json:"seed,omitempty"`
+	Commitment string   `json:"commitment,omitempty"`
+	SeedUses   int      `json:"seed_uses,omitempty"`
+	DealtTo    []string `json:"dealt_to,omitempty"`
+	// Attacked is set while the current player's turns come from an
+	// Attack, so attacking back passes on every turn they still owe.
+	Attacked bool `json:"attacked,omitempty"`
+	// Rules are the room's house rules, and Modifiers the live event
+	// modifiers the game was dealt under.
+	Rules     *HouseRules `json:"rules,omitempty"`
+	Modifiers []string    `json:"modifiers,omitempty"`
+	// ReinsertCard is the kitten Reinserting must put back, an Exploding
+	// Kitten when empty. Altering is the player rearranging the top of the
+	// deck after Alter the Future.
+	ReinsertCard    string `json:"reinsert_card,omitempty"`
+	Altering        string `json:"altering,omitempty"`
+	ImplodingFaceUp bool   `json:"imploding_face_up,omitempty"`
+	// Discard is every card played so far, oldest first.
+	Discard []string `json:"discard,omitempty"`
+	// Favor is a card still owed after a Favor resolved.
+	Favor *FavorRequest `json:"favor,omitempty"`
+	// Log is the public record of the game's latest actions.
+	Log []LogEntry `json:"log,omitempty"`
+	// Composition counts each card the game was dealt with.
+	Composition map[string]int `json:"composition,omitempty"`
 }
 
-func init() {
-	_ = godotenv.Load()
-
-	redis_address := os.Getenv("ADDRESS")
-	redis_pass := os.Getenv("PASSWORD")
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     redis_address,
-		Password: redis_pass,
-		DB:       0,
-	})
+// setup connects the stores and applies the configuration.
+func setup(ctx context.Context, cfg *Config) {
+	logLevel.Set(cfg.LogLevel)
+
+	rdb = newRedisClient(cfg.Redis)
+	configureStores(ctx, cfg)
+	redisTimeout = cfg.Redis.Timeout
+	breaker.threshold = cfg.Redis.BreakerThreshold
+	breaker.cooldown = cfg.Redis.BreakerCooldown
+	rdb.AddHook(redisDeadlines{})
+	rdb.AddHook(breakerHook{})
+
+	jwtSecret = loadJWTSecret(cfg.JWTSecret)
+	adminSecret = cfg.AdminToken
+	trustProxy = cfg.TrustProxy
+	proxyHops = cfg.ProxyHops
+	loginThrottle = cfg.LoginThrottle
+	configureOAuth(cfg.OAuth)
+	mailer = newMailer(cfg.Mail)
+	if err := configurePush(cfg.Push); err != nil {
+		fatal("configuring push notifications", "err", err)
+	}
+	emailLinkURL = cfg.EmailLinkURL
+	hstsMaxAge = cfg.HSTSMaxAge
+	maxBodyBytes = int64(cfg.MaxBodyBytes)
+	reconnectGrace = cfg.ReconnectGrace
+	savedGameTTL = cfg.SavedGameTTL
+	janitorInterval = cfg.JanitorInterval
+	jobWorkers = cfg.JobWorkers
+	idleGameTTL = cfg.IdleGameTTL
+	queueTimeout = cfg.QueueTimeout
+	turnTimeout = cfg.TurnTimeout
+	maxTimeouts = cfg.MaxTimeouts
+	favorTimeout = cfg.FavorTimeout
+	leaderboardCacheTTL = cfg.LeaderboardCacheTTL
+	minRankedLevel = cfg.MinRankedLevel
+	configureProfanity(cfg.ProfanityFilter, cfg.ProfanityWords)
+	streakBonuses = cfg.StreakBonuses
+	cardArtURL = cfg.CardArtURL
+	defaultLocale = cfg.DefaultLocale
+	appEnv = cfg.Env
+	configureClients(cfg.Clients)
+	configureTelemetry(cfg.Telemetry)
+	if err := loadLocales(cfg.LocalesDir); err != nil {
+		fatal("loading translations", "err", err)
+	}
 }
 
 func main() {
-	r := mux.NewRouter()
+	_ = godotenv.Load()
+	initLogging()
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("invalid configuration", "problems", err)
+	}
+	// ctx is for work that belongs to no request: startup and the
+	// background workers. Handlers use their request's context.
+	ctx := context.Background()
+	setup(ctx, cfg)
 
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
-		AllowCredentials: true,
-	})
+	flushSpans := initTracing(ctx)
 
-	r.HandleFunc("/api/login", handleLogin).Methods("POST")
-	r.HandleFunc("/api/score", updateScore).Methods("POST")
-	r.HandleFunc("/api/leaderboard", getLeaderboard).Methods("GET")
-	r.HandleFunc("/api/saveCardDraw", saveCardDraw).Methods("POST")
-	r.HandleFunc("/api/deleteSavedCards", deleteSavedCards).Methods("DELETE")
-	r.HandleFunc("/api/fetchSavedCards", fetchSavedCards).Methods("GET")
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	r.Use(nameSpans, apiKeys, checkClientVersion, duringMaintenance, limitRequests, jsonBodies, idempotent)
+
+	c := newCORS(cfg.CORS)
+
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+	r.HandleFunc("/readyz", readyz).Methods("GET")
+	r.HandleFunc("/ws/resume", resumeWs)
+	r.Handle("/ws", requireAuth(http.HandlerFunc(serveWs)))
+	mountAPI(r)
+	if problems, err := checkAPISpec(r); err != nil {
+		slog.Error("checking API spec", "err", err)
+	} else {
+		for _, p := range problems {
+			slog.Warn("API spec out of date", "problem", p)
+		}
+	}
 
-	handler := c.Handler(r)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if err := migrateLeaderboard(ctx); err != nil {
+		slog.Error("migrating leaderboard", "err", err)
+	}
+	if err := ensureSeason(ctx); err != nil {
+		slog.Error("opening season", "err", err)
+	}
+	seasons := startSeasonScheduler(ctx, cfg.SeasonSchedule)
+	stopFanOut := startFanOut(ctx)
+	stopMatchmaker := startMatchmaker(ctx)
+	stopJanitor := startJanitor(ctx)
+	stopEvents := startEventScheduler(ctx)
+	stopMaintenance := startMaintenanceWatcher(ctx)
+	stopFlags := startFlagWatcher(ctx)
+	stopProcessors := startEventProcessors(ctx)
+	stopJobs := startJobWorkers(ctx, jobWorkers)
+	resumeGames(ctx)
+
+	stopGRPC := func() {}
+	if cfg.GRPCPort != "" {
+		stopGRPC = startGRPC(cfg.GRPCPort, cfg.HTTPS)
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	handler := traceRequests(logRequests(recoverPanics(secureHeaders(c.Handler(r)))))
+
+	slog.Info("server starting", "port", cfg.Port)
+	serve(":"+cfg.Port, handler, cfg.HTTPS,
+		stopGRPC,
+		stopMatchmaker,
+		stopJanitor,
+		stopEvents,
+		stopMaintenance,
+		stopFlags,
+		stopProcessors,
+		stopJobs,
+		stopFanOut,
+		func() { <-seasons.Stop().Done() },
+		closeStores,
+		flushSpans,
+	)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
 		return
 	}
 
-	_, err := rdb.Get(ctx, "user:"+req.Username).Result()
-	if err == redis.Nil {
-		err = rdb.Set(ctx, "user:"+req.Username, 0, 0).Err()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	tokens, wait, ban, err := signIn(ctx, clientIP(r), req)
+	switch {
+	case ban != nil:
+		respondBanned(w, r, ban)
+		return
+	case err == errInvalidCredentials:
+		respondError(w, r, http.StatusUnauthorized, err)
+		return
+	case loginRefused(err):
+		respondLoginRefused(w, r, wait, err)
+		return
+	case err != nil:
+		respondInternal(w, r, err, "Error signing in")
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	json.NewEncoder(w).Encode(tokens)
 }
 
-func updateScore(w http.ResponseWriter, r *http.Request) {
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// signIn checks a player's password and issues them tokens, for the REST
+// and gRPC APIs alike. A sign-in refused by checkLoginAllowed comes back
+// with the wait before retrying, and a banned player's with their ban.
+func signIn(ctx context.Context, ip string, req LoginRequest) (tokens *TokenResponse, wait time.Duration, ban *Ban, err error) {
+	if wait, err := checkLoginAllowed(ctx, ip, req.Username, req.CaptchaToken); err != nil {
+		return nil, wait, nil, err
 	}
-
-	err := rdb.Incr(ctx, "user:"+req.Username).Err()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := checkPassword(ctx, req.Username, req.Password); err != nil {
+		if err == errInvalidCredentials {
+			recordLoginFailure(ctx, ip, req.Username)
+		}
+		return nil, 0, nil, err
 	}
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
-		return
+	clearLoginFailures(ctx, req.Username)
+	if ban, err := loadBan(ctx, req.Username); err != nil {
+		return nil, 0, nil, err
+	} else if ban != nil {
+		return nil, 0, ban, errAccountBanned
 	}
 
-	cardKey := fmt.Sprintf("game:%s:cards", username)
+	if err := addToLeaderboard(ctx, req.Username); err != nil {
+		return nil, 0, nil, err
+	}
+	tokens, err = issueTokens(ctx, req.Username)
+	return tokens, 0, nil, err
+}
 
+// updateScore is kept for old clients, which post here after a win. Scores
+// are now awarded by the server when a game ends, so all this does is clear
+// the client's saved draws.
+func updateScore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Deprecation", "true")
+	logFor(r).Info("ignored client score post")
+
+	cardKey, err := savedCardsKey(r)
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
 	er := rdb.Del(ctx, cardKey).Err()
 	if er != nil {
-		http.Error(w, "Error deleting saved cards", http.StatusInternalServerError)
+		respondInternal(w, r, er, "Error deleting saved cards")
 		return
 	}
 
@@ -126,76 +289,82 @@ func updateScore(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
-func getLeaderboard(w http.ResponseWriter, r *http.Request) {
-	keys, err := rdb.Keys(ctx, "user:*").Result()
+func gameCardsKey(gameID string) string {
+	return fmt.Sprintf("game:%s:cards", gameID)
+}
+
+// playerCardsKey holds the draws of clients that predate game IDs. They
+// used to live at game:<username>:cards, which shares a namespace with real
+// games, and are moved over on first use.
+func playerCardsKey(ctx context.Context, username string) string {
+	key := fmt.Sprintf("player:%s:cards", username)
+	rdb.RenameNX(ctx, gameCardsKey(username), key)
+	return key
+}
+
+// savedCardsKey is where a request's saved draws live: with the game named
+// by ?game=, which the caller must be playing, or for old clients that send
+// none, with the player.
+func savedCardsKey(r *http.Request) (string, error) {
+	ctx := r.Context()
+	username := currentUser(r)
+	gameID := r.URL.Query().Get("game")
+	if gameID == "" {
+		return playerCardsKey(ctx, username), nil
+	}
+	g, err := loadGame(ctx, gameID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
 	}
-
-	var players []Player
-	for _, key := range keys {
-		username := key[5:]
-		score, err := rdb.Get(ctx, key).Int()
-		if err != nil {
-			continue
-		}
-		players = append(players, Player{
-			Username: username,
-			Score:    score,
-		})
+	if !g.hasPlayer(username) {
+		return "", errNotInGame
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(players)
+	return gameCardsKey(gameID), nil
 }
 
 func saveCardDraw(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
+	ctx := r.Context()
+	var draw CardDraw
+	if err := decodeJSON(r, &draw); err != nil {
+		respondPayload(w, r, err)
 		return
 	}
 
-	var draw CardDraw
-	if err := json.NewDecoder(r.Body).Decode(&draw); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	cardKey, err := savedCardsKey(r)
+	if err != nil {
+		respondGameError(w, r, err)
 		return
 	}
-
-	cardKey := fmt.Sprintf("game:%s:cards", username)
-	err := rdb.LPush(ctx, cardKey, draw.Card).Err()
+	err = rdb.LPush(ctx, cardKey, draw.Card).Err()
 	if err != nil {
-		http.Error(w, "Error saving card draw", http.StatusInternalServerError)
+		respondInternal(w, r, err, "Error saving card draw")
 		return
 	}
-	printSavedCards(cardKey)
+	printSavedCards(ctx, cardKey)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Card draw saved successfully"})
 }
 
-func printSavedCards(cardKey string) {
+func printSavedCards(ctx context.Context, cardKey string) {
 	cards, err := rdb.LRange(ctx, cardKey, 0, -1).Result()
 	if err != nil {
-		fmt.Printf("Error retrieving saved cards: %v\n", err)
+		slog.Error("retrieving saved cards", "key", cardKey, "err", err)
 		return
 	}
 
-	fmt.Printf("Current cards for key %s: %v\n", cardKey, cards)
+	slog.Debug("saved cards", "key", cardKey, "cards", cards)
 }
 
 func deleteSavedCards(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
+	ctx := r.Context()
+	cardKey, err := savedCardsKey(r)
+	if err != nil {
+		respondGameError(w, r, err)
 		return
 	}
-
-	cardKey := fmt.Sprintf("game:%s:cards", username)
-
-	err := rdb.Del(ctx, cardKey).Err()
+	err = rdb.Del(ctx, cardKey).Err()
 	if err != nil {
-		http.Error(w, "Error deleting saved cards", http.StatusInternalServerError)
+		respondInternal(w, r, err, "Error deleting saved cards")
 		return
 	}
 
@@ -204,17 +373,15 @@ func deleteSavedCards(w http.ResponseWriter, r *http.Request) {
 }
 
 func fetchSavedCards(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
+	ctx := r.Context()
+	cardKey, err := savedCardsKey(r)
+	if err != nil {
+		respondGameError(w, r, err)
 		return
 	}
-
-	cardKey := fmt.Sprintf("game:%s:cards", username)
-
 	cards, err := rdb.LRange(ctx, cardKey, 0, -1).Result()
 	if err != nil {
-		http.Error(w, "Error fetching saved cards", http.StatusInternalServerError)
+		respondInternal(w, r, err, "Error fetching saved cards")
 		return
 	}
 
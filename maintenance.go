@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	maintenanceKey = "maintenance"
+	motdKey        = "motd"
+	// maintenancePoll is how soon every instance notices maintenance
+	// starting or ending.
+	maintenancePoll = 5 * time.Second
+)
+
+// maintenanceOpen are the write routes that keep working during
+// maintenance: signing in, so admins can end it, and telemetry, which
+// changes nothing.
+var maintenanceOpen = map[string]bool{
+	"/login":         true,
+	"/token/refresh": true,
+	"/logout":        true,
+	"/telemetry":     true,
+}
+
+// Maintenance is a planned outage. While it lasts, reads keep working but
+// nothing can be played or changed.
+type Maintenance struct {
+	Message   string     `json:"message"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	StartedBy string     `json:"started_by"`
+	StartedAt time.Time  `json:"started_at"`
+}
+
+// retryAfter is how long clients should wait before trying again, or zero
+// when the end isn't known.
+func (m *Maintenance) retryAfter() time.Duration {
+	if m.EndsAt == nil {
+		return 0
+	}
+	return time.Until(*m.EndsAt).Round(time.Second)
+}
+
+// MOTD is the announcement clients show at launch. Translations holds the
+// message in other languages, keyed by locale.
+type MOTD struct {
+	Message      string            `json:"message"`
+	Translations map[string]string `json:"translations,omitempty"`
+	UpdatedBy    string            `json:"updated_by"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// MaintenanceRequest starts maintenance. EndsAt is only a hint for
+// clients; maintenance lasts until an admin ends it.
+type MaintenanceRequest struct {
+	Message string     `json:"message"`
+	EndsAt  *time.Time `json:"ends_at"`
+}
+
+type MOTDRequest struct {
+	Message      string            `json:"message"`
+	Translations map[string]string `json:"translations"`
+}
+
+// maintenanceState caches whether maintenance is on, so checking it costs
+// no round trip. The maintenance watcher keeps it fresh.
+var maintenanceState = struct {
+	sync.RWMutex
+	current *Maintenance
+}{}
+
+func currentMaintenance() *Maintenance {
+	maintenanceState.RLock()
+	defer maintenanceState.RUnlock()
+	return maintenanceState.current
+}
+
+func setMaintenance(m *Maintenance) {
+	maintenanceState.Lock()
+	maintenanceState.current = m
+	maintenanceState.Unlock()
+}
+
+func loadMaintenance(ctx context.Context) (*Maintenance, error) {
+	data, err := rdb.Get(ctx, maintenanceKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Maintenance
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func refreshMaintenance(ctx context.Context) error {
+	m, err := loadMaintenance(ctx)
+	if err != nil {
+		return err
+	}
+	setMaintenance(m)
+	return nil
+}
+
+// startMaintenanceWatcher keeps the cached maintenance state current. The
+// returned func stops it.
+func startMaintenanceWatcher(ctx context.Context) func() {
+	if err := refreshMaintenance(ctx); err != nil {
+		slog.Error("loading maintenance", "err", err)
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(maintenancePoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := refreshMaintenance(ctx); err != nil {
+					slog.Error("loading maintenance", "err", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// message is what players are told, in their language unless the admin
+// wrote their own.
+func (m *Maintenance) message(locale string) string {
+	if m.Message != "" {
+		return m.Message
+	}
+	return translate(locale, "maintenance.message", "The game is down for maintenance. Please try again soon.")
+}
+
+// duringMaintenance refuses writes while maintenance is on. Reads, signing
+// in and the admin API keep working.
+func duringMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := currentMaintenance()
+		if m == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := routeName(r)
+		if maintenanceOpen[name] || name == "/admin" || strings.HasPrefix(name, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		respondMaintenance(w, r, m)
+	})
+}
+
+func respondMaintenance(w http.ResponseWriter, r *http.Request, m *Maintenance) {
+	if wait := m.retryAfter(); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)))
+	}
+	writeError(w, r, http.StatusServiceUnavailable, CodeMaintenance, m.message(localeFor(r)))
+}
+
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	m, err := loadMaintenance(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading maintenance")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"enabled": m != nil, "maintenance": m})
+}
+
+// startMaintenance turns maintenance on, or updates its message. This
+// instance stops taking writes straight away; the rest within
+// maintenancePoll.
+func startMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req MaintenanceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.EndsAt != nil && !req.EndsAt.After(time.Now()) {
+		respondInvalid(w, r, []*FieldError{{Field: "ends_at", Code: "ENDS_IN_PAST", Message: "End time must be in the future"}})
+		return
+	}
+	previous, err := loadMaintenance(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading maintenance")
+		return
+	}
+
+	var before interface{}
+	m := &Maintenance{
+		Message:   strings.TrimSpace(req.Message),
+		StartedBy: actorName(r),
+		StartedAt: time.Now().UTC(),
+	}
+	if previous != nil {
+		before = previous
+		m.StartedBy, m.StartedAt = previous.StartedBy, previous.StartedAt
+	}
+	if req.EndsAt != nil {
+		at := req.EndsAt.UTC()
+		m.EndsAt = &at
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		respondInternal(w, r, err, "Error starting maintenance")
+		return
+	}
+	if err := rdb.Set(ctx, maintenanceKey, data, 0).Err(); err != nil {
+		respondInternal(w, r, err, "Error starting maintenance")
+		return
+	}
+	setMaintenance(m)
+	logFor(r).Warn("maintenance started", "ends_at", m.EndsAt)
+	audit(ctx, actorName(r), AuditMaintenanceSet, maintenanceKey, before, m)
+	hub.broadcast(ctx, lobbyRoom, EventMaintenance, m)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "maintenance": m})
+}
+
+func endMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	previous, err := loadMaintenance(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading maintenance")
+		return
+	}
+	if err := rdb.Del(ctx, maintenanceKey).Err(); err != nil {
+		respondInternal(w, r, err, "Error ending maintenance")
+		return
+	}
+	setMaintenance(nil)
+	if previous != nil {
+		logFor(r).Warn("maintenance ended")
+		audit(ctx, actorName(r), AuditMaintenanceSet, maintenanceKey, previous, nil)
+		hub.broadcast(ctx, lobbyRoom, EventMaintenanceOver, map[string]interface{}{})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func loadMOTD(ctx context.Context) (*MOTD, error) {
+	data, err := rdb.Get(ctx, motdKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m MOTD
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// getMOTD is what clients check at launch: the message of the day, in the
+// caller's language when there is a translation, and any maintenance.
+// Both are null when there is nothing to show.
+func getMOTD(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	motd, err := loadMOTD(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading message of the day")
+		return
+	}
+	m, err := loadMaintenance(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading maintenance")
+		return
+	}
+
+	var message interface{}
+	if motd != nil {
+		text := motd.Message
+		if translated, ok := motd.Translations[localeFor(r)]; ok {
+			text = translated
+		}
+		message = map[string]interface{}{"message": text, "updated_at": motd.UpdatedAt}
+	}
+	var outage interface{}
+	if m != nil {
+		outage = map[string]interface{}{"message": m.message(localeFor(r)), "ends_at": m.EndsAt}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"motd": message, "maintenance": outage})
+}
+
+func setMOTD(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req MOTDRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		respondInvalid(w, r, []*FieldError{{Field: "message", Code: "MESSAGE_REQUIRED", Message: "Message is required"}})
+		return
+	}
+	previous, err := loadMOTD(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading message of the day")
+		return
+	}
+	var before interface{}
+	if previous != nil {
+		before = previous
+	}
+
+	motd := &MOTD{
+		Message:      req.Message,
+		Translations: req.Translations,
+		UpdatedBy:    actorName(r),
+		UpdatedAt:    time.Now().UTC(),
+	}
+	data, err := json.Marshal(motd)
+	if err != nil {
+		respondInternal(w, r, err, "Error saving message of the day")
+		return
+	}
+	if err := rdb.Set(ctx, motdKey, data, 0).Err(); err != nil {
+		respondInternal(w, r, err, "Error saving message of the day")
+		return
+	}
+	audit(ctx, actorName(r), AuditMOTDChanged, motdKey, before, motd)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(motd)
+}
+
+func clearMOTD(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	previous, err := loadMOTD(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading message of the day")
+		return
+	}
+	if err := rdb.Del(ctx, motdKey).Err(); err != nil {
+		respondInternal(w, r, err, "Error clearing message of the day")
+		return
+	}
+	if previous != nil {
+		audit(ctx, actorName(r), AuditMOTDChanged, motdKey, previous, nil)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
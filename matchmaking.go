@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	matchQueueKey = "matchmaking:queue"
+	matchLockKey  = "matchmaking:lock"
+
+	matchInterval = 2 * time.Second
+	// Players are first matched within baseRatingBand of each other; the
+	// band widens the longer the oldest player in a group has waited.
+	baseRatingBand  = 100
+	bandWidenPer    = 10 * time.Second
+	bandWidenAmount = 50
+)
+
+type MatchmakingRequest struct {
+	Size int `json:"size"`
+}
+
+type queuedPlayer struct {
+	Username string
+	Size     int
+	Rating   float64
+	JoinedAt time.Time
+}
+
+func matchTicketKey(username string) string {
+	return fmt.Sprintf("matchmaking:player:%s", username)
+}
+
+func joinMatchmaking(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req MatchmakingRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Size == 0 {
+		req.Size = minRoomCapacity
+	}
+	if req.Size < minRoomCapacity || req.Size > maxRoomCapacity {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Size must be between %d and %d", minRoomCapacity, maxRoomCapacity))
+		return
+	}
+
+	if !featureOn(FlagRanked, username) {
+		respondError(w, r, http.StatusForbidden, errFeatureDisabled)
+		return
+	}
+	level, err := playerLevel(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error joining matchmaking")
+		return
+	}
+	if level.Level < minRankedLevel {
+		respondError(w, r, http.StatusForbidden, errLevelTooLow)
+		return
+	}
+
+	rating, err := getRating(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error joining matchmaking")
+		return
+	}
+
+	now := time.Now()
+	added, err := rdb.ZAddNX(ctx, matchQueueKey, &redis.Z{Score: float64(now.Unix()), Member: username}).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error joining matchmaking")
+		return
+	}
+	if added == 0 {
+		writeError(w, r, http.StatusConflict, "ALREADY_QUEUED", "Already in the matchmaking queue")
+		return
+	}
+	rdb.HSet(ctx, matchTicketKey(username), "size", req.Size, "rating", rating, "joined_at", now.Unix())
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "queued",
+		"size":   req.Size,
+	})
+}
+
+func leaveMatchmaking(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	pipe := rdb.TxPipeline()
+	removed := pipe.ZRem(ctx, matchQueueKey, username)
+	pipe.Del(ctx, matchTicketKey(username))
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error leaving matchmaking")
+		return
+	}
+	if removed.Val() == 0 {
+		writeError(w, r, http.StatusNotFound, "NOT_QUEUED", "Not in the matchmaking queue")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+func loadQueue(ctx context.Context) ([]queuedPlayer, error) {
+	names, err := rdb.ZRange(ctx, matchQueueKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	queue := []queuedPlayer{}
+	for _, name := range names {
+		fields, err := rdb.HGetAll(ctx, matchTicketKey(name)).Result()
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(fields["size"])
+		rating, _ := strconv.ParseFloat(fields["rating"], 64)
+		joined, _ := strconv.ParseInt(fields["joined_at"], 10, 64)
+		if size == 0 {
+			size = minRoomCapacity
+		}
+		queue = append(queue, queuedPlayer{
+			Username: name,
+			Size:     size,
+			Rating:   rating,
+			JoinedAt: time.Unix(joined, 0),
+		})
+	}
+	return queue, nil
+}
+
+// formMatches groups queued players wanting the same table size into
+// games, pairing players whose ratings fall within a band that widens with
+// waiting time.
+func formMatches(queue []queuedPlayer, now time.Time) [][]queuedPlayer {
+	bySize := map[int][]queuedPlayer{}
+	for _, p := range queue {
+		bySize[p.Size] = append(bySize[p.Size], p)
+	}
+
+	var matches [][]queuedPlayer
+	for size, players := range bySize {
+		sort.Slice(players, func(i, j int) bool { return players[i].Rating < players[j].Rating })
+		for i := 0; i+size <= len(players); {
+			group := players[i : i+size]
+			oldest := group[0].JoinedAt
+			for _, p := range group {
+				if p.JoinedAt.Before(oldest) {
+					oldest = p.JoinedAt
+				}
+			}
+			band := baseRatingBand + bandWidenAmount*float64(now.Sub(oldest)/bandWidenPer)
+			if group[size-1].Rating-group[0].Rating <= band {
+				matches = append(matches, group)
+				i += size
+			} else {
+				i++
+			}
+		}
+	}
+	return matches
+}
+
+// openMatchRoom saves a room for players the server has paired up and
+// starts its game, leaving the caller to tell them.
+func openMatchRoom(ctx context.Context, room *Room) (*Room, *GameState, error) {
+	room.Owner = room.Players[0]
+	room.Capacity = len(room.Players)
+	room.Status = RoomWaiting
+	room.CreatedAt = time.Now().UTC()
+	g, err := room.start(room.Owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := saveGame(ctx, g); err != nil {
+		return nil, nil, err
+	}
+	if err := saveRoom(ctx, room); err != nil {
+		return nil, nil, err
+	}
+	recordGameStart(ctx, g)
+	trackActiveGame(ctx, g)
+	return room, g, nil
+}
+
+// startMatch takes the players out of the queue and seats them in a fresh
+// room with its game already started.
+func startMatch(ctx context.Context, group []queuedPlayer) error {
+	players := make([]string, len(group))
+	for i, p := range group {
+		players[i] = p.Username
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, p := range players {
+		pipe.ZRem(ctx, matchQueueKey, p)
+		pipe.Del(ctx, matchTicketKey(p))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	countMatched(ctx, group, time.Now())
+
+	room, g, err := openMatchRoom(ctx, &Room{ID: newID(), Players: players})
+	if err != nil {
+		return err
+	}
+
+	levels := map[string]int{}
+	for _, p := range players {
+		if level, err := playerLevel(ctx, p); err == nil {
+			levels[p] = level.Level
+		}
+	}
+	for _, p := range players {
+		hub.notifyUser(ctx, p, EventMatchFound, map[string]interface{}{
+			"room_id": room.ID,
+			"game_id": g.ID,
+			"players": players,
+			"levels":  levels,
+		})
+	}
+	publishTurn(ctx, g)
+	return nil
+}
+
+func runMatchmaker(ctx context.Context) {
+	// Only one instance matches at a time; the lock expires on its own if
+	// that instance dies mid-tick.
+	ok, err := rdb.SetNX(ctx, matchLockKey, "1", matchInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	defer rdb.Del(ctx, matchLockKey)
+
+	queue, err := loadQueue(ctx)
+	if err != nil {
+		slog.Error("loading matchmaking queue", "err", err)
+		return
+	}
+	for _, group := range formMatches(queue, time.Now()) {
+		if err := startMatch(ctx, group); err != nil {
+			slog.Error("starting match", "err", err)
+		}
+	}
+}
+
+// startMatchmaker runs the matcher in the background. The returned func
+// stops it, waiting for a tick in progress to finish.
+func startMatchmaker(ctx context.Context) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(matchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runMatchmaker(ctx)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
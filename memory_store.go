@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memAccount struct {
+	passwordHash string
+	guest        bool
+	role         string
+	profile      Profile
+	createdAt    time.Time
+	expiresAt    time.Time
+}
+
+func (a *memAccount) live(now time.Time) bool {
+	return a.expiresAt.IsZero() || now.Before(a.expiresAt)
+}
+
+func (a *memAccount) summary(username string) *Account {
+	role := a.role
+	if role == "" {
+		role = RolePlayer
+	}
+	return &Account{Username: username, Role: role, Guest: a.guest, CreatedAt: a.createdAt}
+}
+
+type memGame struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+func (g *memGame) live(now time.Time) bool {
+	return g.expiresAt.IsZero() || now.Before(g.expiresAt)
+}
+
+type memGameRef struct {
+	id         string
+	finishedAt time.Time
+}
+
+// MemoryStore keeps everything in process memory for local development.
+// Nothing survives a restart. Games and records are stored encoded so
+// callers never share state with the store.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	accounts     map[string]*memAccount
+	games        map[string]*memGame
+	records      map[string][]byte
+	playerGames  map[string][]memGameRef
+	stats        map[string]*PlayerStats
+	leaderboards map[string]map[string]int
+	markers      map[string]time.Time
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:     map[string]*memAccount{},
+		games:        map[string]*memGame{},
+		records:      map[string][]byte{},
+		playerGames:  map[string][]memGameRef{},
+		stats:        map[string]*PlayerStats{},
+		leaderboards: map[string]map[string]int{},
+		markers:      map[string]time.Time{},
+	}
+}
+
+func (s *MemoryStore) createAccount(username string, account *memAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.accounts[username]; ok && existing.live(time.Now()) {
+		return errUsernameTaken
+	}
+	account.createdAt = time.Now().UTC()
+	s.accounts[username] = account
+	return nil
+}
+
+func (s *MemoryStore) account(username string) *memAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[username]
+	if !ok || !a.live(time.Now()) {
+		return nil
+	}
+	return a
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, username, passwordHash string) error {
+	return s.createAccount(username, &memAccount{passwordHash: passwordHash})
+}
+
+func (s *MemoryStore) CreateGuest(ctx context.Context, username string, ttl time.Duration) error {
+	return s.createAccount(username, &memAccount{guest: true, expiresAt: time.Now().Add(ttl)})
+}
+
+func (s *MemoryStore) PasswordHash(ctx context.Context, username string) (string, error) {
+	a := s.account(username)
+	if a == nil || a.passwordHash == "" {
+		return "", errUserNotFound
+	}
+	return a.passwordHash, nil
+}
+
+func (s *MemoryStore) SetPasswordHash(ctx context.Context, username, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[username]
+	if !ok || !a.live(time.Now()) || a.passwordHash == "" {
+		return errUserNotFound
+	}
+	a.passwordHash = passwordHash
+	return nil
+}
+
+func (s *MemoryStore) UserExists(ctx context.Context, username string) (bool, error) {
+	return s.account(username) != nil, nil
+}
+
+func (s *MemoryStore) IsGuest(ctx context.Context, username string) (bool, error) {
+	a := s.account(username)
+	return a != nil && a.guest, nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.accounts, username)
+	return nil
+}
+
+func (s *MemoryStore) RenameUser(ctx context.Context, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	a, ok := s.accounts[from]
+	if !ok || !a.live(now) {
+		return errUserNotFound
+	}
+	if existing, ok := s.accounts[to]; ok && existing.live(now) {
+		return errUsernameTaken
+	}
+	s.accounts[to] = a
+	delete(s.accounts, from)
+	return nil
+}
+
+func (s *MemoryStore) Role(ctx context.Context, username string) (string, error) {
+	a := s.account(username)
+	if a == nil {
+		return "", errUserNotFound
+	}
+	if a.role == "" {
+		return RolePlayer, nil
+	}
+	return a.role, nil
+}
+
+func (s *MemoryStore) SetRole(ctx context.Context, username, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[username]
+	if !ok || !a.live(time.Now()) {
+		return errUserNotFound
+	}
+	a.role = role
+	return nil
+}
+
+func (s *MemoryStore) Profile(ctx context.Context, username string) (*Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[username]
+	if !ok || !a.live(time.Now()) {
+		return nil, errUserNotFound
+	}
+	p := a.profile
+	return &p, nil
+}
+
+func (s *MemoryStore) SetProfile(ctx context.Context, username string, p *Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[username]
+	if !ok || !a.live(time.Now()) {
+		return errUserNotFound
+	}
+	a.profile = *p
+	return nil
+}
+
+func (s *MemoryStore) LoadAccount(ctx context.Context, username string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[username]
+	if !ok || !a.live(time.Now()) {
+		return nil, errUserNotFound
+	}
+	return a.summary(username), nil
+}
+
+func (s *MemoryStore) SearchUsers(ctx context.Context, prefix string, limit, offset int) ([]Account, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	prefix = strings.ToLower(prefix)
+	matches := []Account{}
+	for name, a := range s.accounts {
+		if !a.live(now) || !strings.HasPrefix(strings.ToLower(name), prefix) {
+			continue
+		}
+		matches = append(matches, *a.summary(name))
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Username < matches[j].Username })
+
+	total := int64(len(matches))
+	if offset >= len(matches) {
+		return []Account{}, total, nil
+	}
+	matches = matches[offset:]
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, total, nil
+}
+
+// storedGame returns a game's encoding, or nil if it is missing or has
+// expired. Callers hold the lock.
+func (s *MemoryStore) storedGame(id string) []byte {
+	game, ok := s.games[id]
+	if !ok || !game.live(time.Now()) {
+		return nil
+	}
+	return game.data
+}
+
+// putGame stores an encoded game, expiring it after the game's TTL.
+// Callers hold the lock.
+func (s *MemoryStore) putGame(g *GameState) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	game := &memGame{data: data}
+	if ttl := g.ttl(); ttl > 0 {
+		game.expiresAt = time.Now().Add(ttl)
+	}
+	s.games[g.ID] = game
+	return nil
+}
+
+func (s *MemoryStore) LoadGame(ctx context.Context, id string) (*GameState, error) {
+	s.mu.RLock()
+	data := s.storedGame(id)
+	s.mu.RUnlock()
+	if data == nil {
+		return nil, errGameNotFound
+	}
+
+	var g GameState
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *MemoryStore) SaveGame(ctx context.Context, g *GameState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := checkStoredVersion(s.storedGame(g.ID), g.Version); err != nil {
+		return err
+	}
+
+	next := *g
+	next.Version++
+	next.UpdatedAt = time.Now().UTC()
+	if err := s.putGame(&next); err != nil {
+		return err
+	}
+	g.Version, g.UpdatedAt = next.Version, next.UpdatedAt
+	return nil
+}
+
+func (s *MemoryStore) UpdateGame(ctx context.Context, id string, change func(g *GameState) error) (*GameState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.storedGame(id)
+	if data == nil {
+		return nil, errGameNotFound
+	}
+
+	var g GameState
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	if err := change(&g); err != nil {
+		return nil, err
+	}
+	g.Version++
+	g.UpdatedAt = time.Now().UTC()
+	if err := s.putGame(&g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *MemoryStore) DeleteGame(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.games, id)
+	return nil
+}
+
+func (s *MemoryStore) RecordGame(ctx context.Context, record *GameRecord, participants []string) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[record.ID]; ok {
+		return nil
+	}
+	s.records[record.ID] = data
+
+	for _, p := range participants {
+		s.playerGames[p] = append(s.playerGames[p], memGameRef{id: record.ID, finishedAt: record.FinishedAt})
+		st, ok := s.stats[p]
+		if !ok {
+			st = &PlayerStats{Username: p}
+			s.stats[p] = st
+		}
+		st.GamesPlayed++
+		st.CardsDrawn += record.Stats[p].CardsDrawn
+		st.Defused += record.Stats[p].Defused
+		if record.Stats[p].Forfeited {
+			st.Forfeits++
+		}
+		if p == record.Winner {
+			st.Wins++
+			st.CurrentStreak++
+			if st.CurrentStreak > st.LongestStreak {
+				st.LongestStreak = st.CurrentStreak
+			}
+		} else {
+			st.Losses++
+			st.CurrentStreak = 0
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) PlayerStats(ctx context.Context, username string) (*PlayerStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := &PlayerStats{Username: username}
+	if existing, ok := s.stats[username]; ok {
+		*st = *existing
+		st.Username = username
+	}
+	st.fillWinRate()
+	return st, nil
+}
+
+func (s *MemoryStore) CurrentStreaks(ctx context.Context, usernames []string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	streaks := make(map[string]int, len(usernames))
+	for _, username := range usernames {
+		if st, ok := s.stats[username]; ok {
+			streaks[username] = st.CurrentStreak
+		}
+	}
+	return streaks, nil
+}
+
+func (s *MemoryStore) PlayerGames(ctx context.Context, username string, limit, offset int) ([]GameRecord, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refs := append([]memGameRef{}, s.playerGames[username]...)
+	sort.Slice(refs, func(i, j int) bool { return refs[i].finishedAt.After(refs[j].finishedAt) })
+
+	records := []GameRecord{}
+	for i := offset; i < len(refs) && i < offset+limit; i++ {
+		var record GameRecord
+		if json.Unmarshal(s.records[refs[i].id], &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, int64(len(refs)), nil
+}
+
+func (s *MemoryStore) MoveHistory(ctx context.Context, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if refs, ok := s.playerGames[from]; ok {
+		s.playerGames[to] = refs
+		delete(s.playerGames, from)
+	}
+	if st, ok := s.stats[from]; ok {
+		st.Username = to
+		s.stats[to] = st
+		delete(s.stats, from)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteHistory(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.playerGames, username)
+	delete(s.stats, username)
+	return nil
+}
+
+func (s *MemoryStore) board(name string) map[string]int {
+	b, ok := s.leaderboards[name]
+	if !ok {
+		b = map[string]int{}
+		s.leaderboards[name] = b
+	}
+	return b
+}
+
+func (s *MemoryStore) AddPlayer(ctx context.Context, board, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.board(board)
+	if _, ok := b[username]; !ok {
+		b[username] = 0
+	}
+	return nil
+}
+
+func (s *MemoryStore) IncrementScore(ctx context.Context, username string, by int, boards ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, board := range boards {
+		s.board(board)[username] += by
+	}
+	return nil
+}
+
+func (s *MemoryStore) IncrementScoreOnce(ctx context.Context, marker string, keep time.Duration, username string, by int, boards ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if expires, ok := s.markers[marker]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.markers[marker] = now.Add(keep)
+	for _, board := range boards {
+		s.board(board)[username] += by
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) SetScore(ctx context.Context, board, username string, score int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.board(board)[username] = score
+	return nil
+}
+
+func (s *MemoryStore) Score(ctx context.Context, board, username string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	score, ok := s.leaderboards[board][username]
+	if !ok {
+		return 0, errNotRanked
+	}
+	return score, nil
+}
+
+func (s *MemoryStore) RemovePlayer(ctx context.Context, board, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leaderboards[board], username)
+	return nil
+}
+
+func (s *MemoryStore) Count(ctx context.Context, board string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.leaderboards[board])), nil
+}
+
+// ranked orders a board like a Redis sorted set read in reverse: highest
+// score first, ties broken by name in reverse.
+func (s *MemoryStore) ranked(board string) []Player {
+	players := []Player{}
+	for name, score := range s.leaderboards[board] {
+		players = append(players, Player{Username: name, Score: score})
+	}
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].Score != players[j].Score {
+			return players[i].Score > players[j].Score
+		}
+		return players[i].Username > players[j].Username
+	})
+	return players
+}
+
+func (s *MemoryStore) Range(ctx context.Context, board string, start, stop int64) ([]Player, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ranked := s.ranked(board)
+	players := []Player{}
+	for i := start; i <= stop && i < int64(len(ranked)); i++ {
+		p := ranked[i]
+		p.Rank = int(i) + 1
+		players = append(players, p)
+	}
+	return players, nil
+}
+
+func (s *MemoryStore) Rank(ctx context.Context, board, username string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, p := range s.ranked(board) {
+		if p.Username == username {
+			return int64(i), nil
+		}
+	}
+	return 0, errNotRanked
+}
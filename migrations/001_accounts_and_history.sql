@@ -0,0 +1,37 @@
+CREATE TABLE accounts (
+    username      TEXT PRIMARY KEY,
+    password_hash TEXT,
+    guest         BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- Guest accounts lapse unless they are upgraded.
+    expires_at    TIMESTAMPTZ
+);
+
+CREATE TABLE games (
+    id          TEXT PRIMARY KEY,
+    room_id     TEXT,
+    winner      TEXT,
+    started_at  TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    record      JSONB NOT NULL
+);
+
+CREATE TABLE game_players (
+    game_id     TEXT NOT NULL REFERENCES games (id) ON DELETE CASCADE,
+    username    TEXT NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (game_id, username)
+);
+
+CREATE INDEX game_players_by_player ON game_players (username, finished_at DESC);
+
+CREATE TABLE player_stats (
+    username       TEXT PRIMARY KEY,
+    games_played   INTEGER NOT NULL DEFAULT 0,
+    wins           INTEGER NOT NULL DEFAULT 0,
+    losses         INTEGER NOT NULL DEFAULT 0,
+    cards_drawn    INTEGER NOT NULL DEFAULT 0,
+    defused        INTEGER NOT NULL DEFAULT 0,
+    current_streak INTEGER NOT NULL DEFAULT 0,
+    longest_streak INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1 @@
+ALTER TABLE player_stats ADD COLUMN forfeits INTEGER NOT NULL DEFAULT 0;
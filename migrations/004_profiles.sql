@@ -0,0 +1,4 @@
+ALTER TABLE accounts
+    ADD COLUMN avatar        TEXT NOT NULL DEFAULT '',
+    ADD COLUMN bio           TEXT NOT NULL DEFAULT '',
+    ADD COLUMN favorite_card TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const nopeWindow = 5 * time.Second
+
+var (
+	errActionPending    = errors.New("waiting for the nope window to close")
+	errNopeWindowClosed = errors.New("there is no open action to nope")
+	errNopeOwnPlay      = errors.New("you cannot nope your own play")
+)
+
+// PendingAction is an action card waiting out its Nope window. Every Nope
+// in the chain flips whether the action will happen.
+type PendingAction struct {
+	ID       string    `json:"id"`
+	Player   string    `json:"player"`
+	Card     string    `json:"card"`
+	Cards    []string  `json:"cards,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Named    string    `json:"named,omitempty"`
+	Nopes    []string  `json:"nopes"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// Resolution describes how a pending action ended. Future and Received are
+// private to the acting player and are never broadcast.
+type Resolution struct {
+	Player   string   `json:"player"`
+	Card     string   `json:"card"`
+	Target   string   `json:"target,omitempty"`
+	Named    string   `json:"named,omitempty"`
+	Noped    bool     `json:"noped"`
+	Nopes    []string `json:"nopes"`
+	Future   []string `json:"-"`
+	Received string   `json:"-"`
+}
+
+// nope adds a Nope to the open action's chain and reopens the window so
+// the other players can answer it.
+func (g *GameState) nope(username string, now time.Time) error {
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	if !g.hasPlayer(username) {
+		return errNotInGame
+	}
+	if g.isEliminated(username) {
+		return errPlayerOut
+	}
+	if !g.Rules.nopeEnabled() {
+		return errNopeDisabled
+	}
+
+	p := g.Pending
+	if p == nil || !now.Before(p.Deadline) {
+		return errNopeWindowClosed
+	}
+	last := p.Player
+	if len(p.Nopes) > 0 {
+		last = p.Nopes[len(p.Nopes)-1]
+	}
+	if last == username {
+		return errNopeOwnPlay
+	}
+	if !g.removeCard(username, CardNope) {
+		return errCardNotInHand
+	}
+	g.countPlay(username, CardNope)
+	g.discard(CardNope)
+	g.logAction(LogEntry{Type: EventNoped, Player: username})
+
+	p.Nopes = append(p.Nopes, username)
+	p.Deadline = now.Add(nopeWindow)
+	return nil
+}
+
+// settle resolves the pending action once its window has closed. It returns
+// nil while the window is still open or when nothing is pending.
+func (g *GameState) settle(now time.Time) *Resolution {
+	p := g.Pending
+	if p == nil || now.Before(p.Deadline) {
+		return nil
+	}
+	g.Pending = nil
+
+	res := &Resolution{
+		Player: p.Player,
+		Card:   p.Card,
+		Target: p.Target,
+		Named:  p.Named,
+		Noped:  len(p.Nopes)%2 == 1,
+		Nopes:  p.Nopes,
+	}
+	g.logAction(LogEntry{Type: EventActionResolved, Player: p.Player, Card: p.Card, Target: p.Target, Noped: res.Noped})
+	if !res.Noped && g.Status == GameActive {
+		g.applyAction(p, res)
+	}
+	return res
+}
+
+func publishResolution(ctx context.Context, g *GameState, res *Resolution) {
+	if res == nil {
+		return
+	}
+	recordEvent(ctx, g.ID, EventActionResolved, map[string]interface{}{
+		"resolution": res,
+		"future":     res.Future,
+		"received":   res.Received,
+	})
+	hub.broadcast(ctx, g.channel(), EventActionResolved, res)
+	if len(res.Future) > 0 {
+		hub.notify(ctx, g.channel(), res.Player, EventFutureSeen, map[string]interface{}{
+			"cards": res.Future,
+		})
+	}
+	if res.Received != "" {
+		hub.notify(ctx, g.channel(), res.Player, EventFavorReceived, map[string]interface{}{
+			"card": res.Received,
+			"from": res.Target,
+		})
+	}
+	if res.Card == CardFavor && g.Favor != nil {
+		hub.broadcast(ctx, g.channel(), EventFavorRequested, g.Favor)
+		scheduleFavor(ctx, g)
+	}
+	publishTurn(ctx, g)
+}
+
+// scheduleResolution closes a Nope window when its deadline passes. Each
+// Nope pushes the deadline back, in which case the timer re-arms itself.
+func scheduleResolution(ctx context.Context, gameID, pendingID string, at time.Time) {
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(time.Until(at), func() {
+		var (
+			res   *Resolution
+			rearm time.Time
+		)
+		g, err := updateGame(ctx, gameID, "resolve", func(g *GameState) error {
+			rearm = time.Time{}
+			if g.Pending == nil || g.Pending.ID != pendingID {
+				return errNoChange
+			}
+			if time.Now().Before(g.Pending.Deadline) {
+				rearm = g.Pending.Deadline
+				return errNoChange
+			}
+			res = g.settle(time.Now())
+			return nil
+		})
+		if err == errNoChange {
+			if !rearm.IsZero() {
+				scheduleResolution(ctx, gameID, pendingID, rearm)
+			}
+			return
+		}
+		if err != nil {
+			slog.Error("resolving nope window", "game", gameID, "err", err)
+			return
+		}
+		publishResolution(ctx, g, res)
+	})
+}
+
+func playNope(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	g, err := moveGame(w, r, func(g *GameState) error {
+		return g.nope(username, time.Now())
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	recordEvent(ctx, g.ID, EventNoped, map[string]interface{}{"username": username})
+	hub.broadcast(ctx, g.channel(), EventNoped, map[string]interface{}{
+		"username": username,
+		"nopes":    len(g.Pending.Nopes),
+		"deadline": g.Pending.Deadline,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
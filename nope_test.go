@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNopeChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		nopes  []string
+		noped  bool
+		nextUp string
+	}{
+		{name: "unanswered", nopes: nil, noped: false, nextUp: "bob"},
+		{name: "noped", nopes: []string{"bob"}, noped: true, nextUp: "alice"},
+		{name: "nope noped", nopes: []string{"bob", "carol"}, noped: false, nextUp: "bob"},
+		{name: "noped three times", nopes: []string{"bob", "carol", "bob"}, noped: true, nextUp: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardSkip, CardNope, CardNope}, "alice", "bob", "carol")
+			now := time.Now()
+			if _, err := g.play("alice", CardSkip, "", now); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.nopes {
+				now = now.Add(time.Second)
+				if err := g.nope(p, now); err != nil {
+					t.Fatalf("%s noping: %v", p, err)
+				}
+			}
+			if res := g.settle(now.Add(nopeWindow - time.Millisecond)); res != nil {
+				t.Fatal("settled before the last nope's window closed")
+			}
+			res := g.settle(now.Add(nopeWindow))
+			if res == nil {
+				t.Fatal("did not settle once the window closed")
+			}
+			if res.Noped != tt.noped {
+				t.Errorf("noped = %v, want %v", res.Noped, tt.noped)
+			}
+			if got := g.currentPlayer(); got != tt.nextUp {
+				t.Errorf("current player is %s, want %s", got, tt.nextUp)
+			}
+		})
+	}
+}
+
+func TestNopeRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		after  time.Duration
+		want   error
+	}{
+		{"own play", "alice", time.Second, errNopeOwnPlay},
+		{"window closed", "bob", nopeWindow, errNopeWindowClosed},
+		{"not in the game", "dave", time.Second, errNotInGame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardSkip, CardNope}, "alice", "bob")
+			now := time.Now()
+			if _, err := g.play("alice", CardSkip, "", now); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.nope(tt.player, now.Add(tt.after)); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlayWaitsForPendingAction(t *testing.T) {
+	g := testGame([]string{CardSeeTheFuture, CardShuffle}, "alice", "bob")
+	now := time.Now()
+	if _, err := g.play("alice", CardSeeTheFuture, "", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.play("alice", CardShuffle, "", now); err != errActionPending {
+		t.Errorf("got %v, want %v", err, errActionPending)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Notification categories, each of which a player can opt out of.
+const (
+	NotifyFriendRequest = "friend_request"
+	NotifyAchievement   = "achievement"
+	NotifyTurn          = "turn_reminder"
+)
+
+var notificationCategories = []string{NotifyFriendRequest, NotifyAchievement, NotifyTurn}
+
+// maxNotifications is how many notifications each inbox keeps; older
+// ones are dropped.
+const maxNotifications = 200
+
+var errNoNotification = errors.New("notification not found")
+
+// notificationText is each category's English title and body. {name} is
+// replaced with Data["name"].
+var notificationText = map[string][2]string{
+	NotifyFriendRequest: {"Friend request", "{username} wants to be your friend."},
+	NotifyAchievement:   {"Achievement unlocked", "You earned {name}."},
+	NotifyTurn:          {"Your turn", "It's your turn to play."},
+}
+
+func notificationsKey(username string) string {
+	return fmt.Sprintf("player:%s:notifications", username)
+}
+
+// notificationIndexKey orders a player's notifications by when they were
+// sent.
+func notificationIndexKey(username string) string {
+	return fmt.Sprintf("player:%s:notifications:index", username)
+}
+
+func unreadNotificationsKey(username string) string {
+	return fmt.Sprintf("player:%s:notifications:unread", username)
+}
+
+func notificationPrefsKey(username string) string {
+	return fmt.Sprintf("player:%s:notifications:prefs", username)
+}
+
+// Notification is an inbox entry. Title and Body are filled in, in the
+// reader's language, when it is read.
+type Notification struct {
+	ID        string            `json:"id"`
+	Category  string            `json:"category"`
+	Title     string            `json:"title,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+	Read      bool              `json:"read"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// rendered is the notification with its text in locale.
+func (n Notification) rendered(locale string) *Notification {
+	replace := []string{}
+	for k, v := range n.Data {
+		if n.Category == NotifyAchievement && k == "name" {
+			v = translate(locale, "achievements."+n.Data["id"]+".name", v)
+		}
+		replace = append(replace, "{"+k+"}", v)
+	}
+	r := strings.NewReplacer(replace...)
+	text := notificationText[n.Category]
+	n.Title = r.Replace(translate(locale, "notifications."+n.Category+".title", text[0]))
+	n.Body = r.Replace(translate(locale, "notifications."+n.Category+".body", text[1]))
+	return &n
+}
+
+// notificationPrefs is which categories reach a player's inbox. Every
+// category is on until turned off.
+func notificationPrefs(ctx context.Context, username string) (map[string]bool, error) {
+	stored, err := rdb.HGetAll(ctx, notificationPrefsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	prefs := map[string]bool{}
+	for _, c := range notificationCategories {
+		prefs[c] = stored[c] != "0"
+	}
+	return prefs, nil
+}
+
+// notify puts a notification in a player's inbox, unless they opted out of
+// its category, and shows it to them live if they are connected.
+func notify(ctx context.Context, username, category string, data map[string]string) {
+	prefs, err := notificationPrefs(ctx, username)
+	if err != nil || !prefs[category] {
+		return
+	}
+	n := &Notification{ID: newID(), Category: category, Data: data, CreatedAt: time.Now().UTC()}
+	stored, err := json.Marshal(n)
+	if err != nil {
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, notificationsKey(username), n.ID, stored)
+	pipe.ZAdd(ctx, notificationIndexKey(username), &redis.Z{Score: float64(n.CreatedAt.UnixMilli()), Member: n.ID})
+	pipe.SAdd(ctx, unreadNotificationsKey(username), n.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("storing notification", "username", username, "category", category, "err", err)
+		return
+	}
+	trimInbox(ctx, username)
+	hub.notifyUser(ctx, username, EventNotification, n.rendered(defaultLocale))
+}
+
+// trimInbox drops the oldest notifications past maxNotifications.
+func trimInbox(ctx context.Context, username string) {
+	old, err := rdb.ZRange(ctx, notificationIndexKey(username), 0, -maxNotifications-1).Result()
+	if err != nil || len(old) == 0 {
+		return
+	}
+	ids := make([]interface{}, len(old))
+	for i, id := range old {
+		ids[i] = id
+	}
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, notificationIndexKey(username), ids...)
+	pipe.HDel(ctx, notificationsKey(username), old...)
+	pipe.SRem(ctx, unreadNotificationsKey(username), ids...)
+	pipe.Exec(ctx)
+}
+
+// loadNotifications reads a player's inbox, newest first.
+func loadNotifications(ctx context.Context, username string) ([]*Notification, error) {
+	ids, err := rdb.ZRevRange(ctx, notificationIndexKey(username), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return []*Notification{}, err
+	}
+	pipe := rdb.Pipeline()
+	items := pipe.HMGet(ctx, notificationsKey(username), ids...)
+	unread := pipe.SMembers(ctx, unreadNotificationsKey(username))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	isUnread := map[string]bool{}
+	for _, id := range unread.Val() {
+		isUnread[id] = true
+	}
+	list := []*Notification{}
+	for _, v := range items.Val() {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var n Notification
+		if json.Unmarshal([]byte(data), &n) == nil {
+			n.Read = !isUnread[n.ID]
+			list = append(list, &n)
+		}
+	}
+	return list, nil
+}
+
+// getNotifications pages through the caller's inbox, or only the unread
+// notifications with ?unread=true. X-Unread-Count has the unread total.
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	all, err := loadNotifications(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading notifications")
+		return
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	matching := []*Notification{}
+	unread := 0
+	for _, n := range all {
+		if !n.Read {
+			unread++
+		}
+		if !unreadOnly || !n.Read {
+			matching = append(matching, n)
+		}
+	}
+	page := []*Notification{}
+	locale := localeFor(r)
+	for i := offset; i < len(matching) && i < offset+limit; i++ {
+		page = append(page, matching[i].rendered(locale))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(matching)))
+	w.Header().Set("X-Unread-Count", strconv.Itoa(unread))
+	json.NewEncoder(w).Encode(page)
+}
+
+func markNotificationRead(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	id := mux.Vars(r)["id"]
+	exists, err := rdb.HExists(ctx, notificationsKey(username), id).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error updating notification")
+		return
+	}
+	if !exists {
+		respondError(w, r, http.StatusNotFound, errNoNotification)
+		return
+	}
+	if err := rdb.SRem(ctx, unreadNotificationsKey(username), id).Err(); err != nil {
+		respondInternal(w, r, err, "Error updating notification")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func markAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := rdb.Del(ctx, unreadNotificationsKey(currentUser(r))).Err(); err != nil {
+		respondInternal(w, r, err, "Error updating notifications")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefs, err := notificationPrefs(ctx, currentUser(r))
+	if err != nil {
+		respondInternal(w, r, err, "Error loading notification settings")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// setNotificationPrefs opts in or out of categories. Categories left out
+// of the request are unchanged.
+func setNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req map[string]bool
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	values := []interface{}{}
+	for category, on := range req {
+		if _, ok := notificationText[category]; !ok {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidPayload,
+				fmt.Sprintf("Notification categories are %s", strings.Join(notificationCategories, ", ")))
+			return
+		}
+		flag := "0"
+		if on {
+			flag = "1"
+		}
+		values = append(values, category, flag)
+	}
+	if len(values) > 0 {
+		if err := rdb.HSet(ctx, notificationPrefsKey(username), values...).Err(); err != nil {
+			respondInternal(w, r, err, "Error saving notification settings")
+			return
+		}
+	}
+	prefs, err := notificationPrefs(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading notification settings")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
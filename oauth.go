@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// oauthStateTTL is how long a player has to finish signing in with a
+// provider once they have started.
+const oauthStateTTL = 10 * time.Minute
+
+// passwordlessKey holds the accounts made by signing in with a provider,
+// which have no password to confirm changes with.
+const passwordlessKey = "accounts:passwordless"
+
+// oauthStateCookie ties a sign-in to the browser that started it, so
+// nobody can send a player a callback link that signs them in as someone
+// else.
+const oauthStateCookie = "oauth_state"
+
+var (
+	errUnknownProvider  = errors.New("sign-in provider is not available")
+	errOAuthState       = errors.New("sign-in expired or was not started here, try again")
+	errOAuthDenied      = errors.New("sign-in was cancelled at the provider")
+	errIdentityLinked   = errors.New("that sign-in is already linked to another account")
+	errProviderLinked   = errors.New("a sign-in from that provider is already linked")
+	errGuestLink        = errors.New("guests must upgrade their account before linking a sign-in")
+	errNotLinked        = errors.New("no sign-in from that provider is linked")
+	errLastSignIn       = errors.New("that is the account's only way to sign in")
+	errOAuthUnavailable = errors.New("sign-in provider could not be reached")
+)
+
+// OAuthConfig enables signing in with Google and GitHub. A provider is
+// offered once its client ID and secret are set. PublicURL is where
+// players reach this server, so providers can send them back to
+// PublicURL/api/v1/auth/{provider}/callback, which must be registered with
+// the provider. With SuccessURL set, the callback redirects there with the
+// tokens in the fragment instead of answering with JSON.
+type OAuthConfig struct {
+	PublicURL          string
+	SuccessURL         string
+	GoogleClientID     string
+	GoogleClientSecret string
+	GitHubClientID     string
+	GitHubClientSecret string
+}
+
+var oauthConfig OAuthConfig
+
+// oauthProvider is an OAuth2 authorization server and how to read who
+// signed in from its user endpoint.
+type oauthProvider struct {
+	AuthURL  string
+	TokenURL string
+	UserURL  string
+	Scopes   []string
+	clientID string
+	secret   string
+	identity func(body []byte) (oauthIdentity, error)
+}
+
+// oauthIdentity is who a provider says signed in. Subject is the
+// provider's stable ID for them; Name is only a suggestion for a username.
+type oauthIdentity struct {
+	Subject string
+	Name    string
+}
+
+var oauthProviders = map[string]*oauthProvider{
+	"google": {
+		AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL: "https://oauth2.googleapis.com/token",
+		UserURL:  "https://openidconnect.googleapis.com/v1/userinfo",
+		Scopes:   []string{"openid", "email", "profile"},
+		identity: func(body []byte) (oauthIdentity, error) {
+			var u struct {
+				Sub       string `json:"sub"`
+				Email     string `json:"email"`
+				GivenName string `json:"given_name"`
+			}
+			if err := json.Unmarshal(body, &u); err != nil {
+				return oauthIdentity{}, err
+			}
+			name := u.GivenName
+			if name == "" {
+				name, _, _ = strings.Cut(u.Email, "@")
+			}
+			return oauthIdentity{Subject: u.Sub, Name: name}, nil
+		},
+	},
+	"github": {
+		AuthURL:  "https://github.com/login/oauth/authorize",
+		TokenURL: "https://github.com/login/oauth/access_token",
+		UserURL:  "https://api.github.com/user",
+		Scopes:   []string{"read:user"},
+		identity: func(body []byte) (oauthIdentity, error) {
+			var u struct {
+				ID    int64  `json:"id"`
+				Login string `json:"login"`
+			}
+			if err := json.Unmarshal(body, &u); err != nil {
+				return oauthIdentity{}, err
+			}
+			if u.ID == 0 {
+				return oauthIdentity{}, nil
+			}
+			return oauthIdentity{Subject: strconv.FormatInt(u.ID, 10), Name: u.Login}, nil
+		},
+	},
+}
+
+// configureOAuth hands each provider its client credentials.
+func configureOAuth(c OAuthConfig) {
+	oauthConfig = c
+	oauthProviders["google"].clientID, oauthProviders["google"].secret = c.GoogleClientID, c.GoogleClientSecret
+	oauthProviders["github"].clientID, oauthProviders["github"].secret = c.GitHubClientID, c.GitHubClientSecret
+}
+
+// providerFor is the provider a request names, if it is configured.
+func providerFor(r *http.Request) (string, *oauthProvider, error) {
+	name := mux.Vars(r)["provider"]
+	p, ok := oauthProviders[name]
+	if !ok || p.clientID == "" || oauthConfig.PublicURL == "" {
+		return "", nil, errUnknownProvider
+	}
+	return name, p, nil
+}
+
+func oauthCallbackURL(provider string) string {
+	return oauthConfig.PublicURL + apiV1Prefix + "/auth/" + provider + "/callback"
+}
+
+// oauthState is what is remembered between sending a player to the
+// provider and their coming back: the PKCE verifier, and who they are
+// linking the sign-in to, if anyone.
+type oauthState struct {
+	Provider string `json:"provider"`
+	Verifier string `json:"verifier"`
+	Link     string `json:"link,omitempty"`
+}
+
+func oauthStateKey(state string) string {
+	return fmt.Sprintf("oauth:state:%s", state)
+}
+
+// oauthIdentityKey maps a provider's ID for someone to their username.
+func oauthIdentityKey(provider, subject string) string {
+	return fmt.Sprintf("oauth:%s:%s", provider, subject)
+}
+
+// oauthLinksKey is the hash of a player's linked provider IDs, by provider.
+func oauthLinksKey(username string) string {
+	return fmt.Sprintf("player:%s:oauth", username)
+}
+
+// startOAuth sends the player to the provider to sign in. A caller who is
+// already signed in, with a bearer token or ?token=, links the provider to
+// their account instead.
+func startOAuth(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	provider, p, err := providerFor(r)
+	if err != nil {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+
+	st := oauthState{Provider: provider, Verifier: randomToken()}
+	if token := bearerToken(r); token != "" {
+		username, err := authenticate(ctx, token)
+		if err == errInvalidToken {
+			respondError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error starting sign-in")
+			return
+		}
+		guest, err := users.IsGuest(ctx, username)
+		if err != nil {
+			respondInternal(w, r, err, "Error starting sign-in")
+			return
+		}
+		if guest {
+			respondError(w, r, http.StatusForbidden, errGuestLink)
+			return
+		}
+		st.Link = username
+	}
+
+	state := randomToken()
+	encoded, _ := json.Marshal(st)
+	if err := rdb.Set(ctx, oauthStateKey(state), encoded, oauthStateTTL).Err(); err != nil {
+		respondInternal(w, r, err, "Error starting sign-in")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     legacyPrefix,
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   overHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {oauthCallbackURL(provider)},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, p.AuthURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// oauthCallback finishes a sign-in the provider sent the player back
+// from. A known identity signs in to its account, an unknown one gets a
+// new account named after it, and a link started by startOAuth is saved.
+func oauthCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	provider, p, err := providerFor(r)
+	if err != nil {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	q := r.URL.Query()
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || cookie.Value != q.Get("state") {
+		respondError(w, r, http.StatusBadRequest, errOAuthState)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: legacyPrefix, MaxAge: -1})
+	raw, err := rdb.GetDel(ctx, oauthStateKey(q.Get("state"))).Result()
+	if err == redis.Nil {
+		respondError(w, r, http.StatusBadRequest, errOAuthState)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error finishing sign-in")
+		return
+	}
+	var st oauthState
+	if json.Unmarshal([]byte(raw), &st) != nil || st.Provider != provider {
+		respondError(w, r, http.StatusBadRequest, errOAuthState)
+		return
+	}
+	if q.Get("error") != "" || q.Get("code") == "" {
+		respondError(w, r, http.StatusUnauthorized, errOAuthDenied)
+		return
+	}
+
+	id, err := p.fetchIdentity(provider, q.Get("code"), st.Verifier)
+	if err != nil {
+		logFor(r).Error("fetching OAuth identity", "provider", provider, "err", err)
+		respondError(w, r, http.StatusBadGateway, errOAuthUnavailable)
+		return
+	}
+
+	if st.Link != "" {
+		err := linkIdentity(ctx, st.Link, provider, id.Subject)
+		switch err {
+		case nil:
+		case errIdentityLinked, errProviderLinked:
+			respondError(w, r, http.StatusConflict, err)
+			return
+		default:
+			respondInternal(w, r, err, "Error linking sign-in")
+			return
+		}
+		logFor(r).Info("sign-in linked", "username", st.Link, "provider", provider)
+		if oauthConfig.SuccessURL != "" {
+			http.Redirect(w, r, oauthConfig.SuccessURL+"#"+url.Values{"linked": {provider}}.Encode(), http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "linked", "provider": provider})
+		return
+	}
+
+	username, err := rdb.Get(ctx, oauthIdentityKey(provider, id.Subject)).Result()
+	created := false
+	if err == redis.Nil {
+		username, err = createOAuthAccount(ctx, provider, id)
+		created = true
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error finishing sign-in")
+		return
+	}
+	if ban, err := loadBan(ctx, username); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	} else if ban != nil {
+		respondBanned(w, r, ban)
+		return
+	}
+	if err := addToLeaderboard(ctx, username); err != nil {
+		respondError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	tokens, err := issueTokens(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error issuing tokens")
+		return
+	}
+	logFor(r).Info("signed in with provider", "username", username, "provider", provider, "created", created)
+
+	if oauthConfig.SuccessURL != "" {
+		fragment := url.Values{
+			"access_token":  {tokens.AccessToken},
+			"refresh_token": {tokens.RefreshToken},
+			"token_type":    {tokens.TokenType},
+			"expires_in":    {strconv.Itoa(tokens.ExpiresIn)},
+			"username":      {username},
+		}
+		http.Redirect(w, r, oauthConfig.SuccessURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchIdentity trades the code the provider sent back for an access token
+// and asks the provider who it belongs to.
+func (p *oauthProvider) fetchIdentity(provider, code, verifier string) (oauthIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oauthCallbackURL(provider)},
+		"client_id":     {p.clientID},
+		"client_secret": {p.secret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := oauthDo(req, &token); err != nil {
+		return oauthIdentity{}, fmt.Errorf("exchanging code: %w", err)
+	}
+	if token.AccessToken == "" {
+		return oauthIdentity{}, fmt.Errorf("exchanging code: %s", token.Error)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, p.UserURL, nil)
+	if err != nil {
+		return oauthIdentity{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	var body json.RawMessage
+	if err := oauthDo(req, &body); err != nil {
+		return oauthIdentity{}, fmt.Errorf("fetching user: %w", err)
+	}
+	id, err := p.identity(body)
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("reading user: %w", err)
+	}
+	if id.Subject == "" {
+		return oauthIdentity{}, errors.New("reading user: no ID")
+	}
+	return id, nil
+}
+
+func oauthDo(req *http.Request, v interface{}) error {
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("provider answered %s", resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// linkIdentity records that username signs in as subject at provider. An
+// account links at most one identity per provider.
+func linkIdentity(ctx context.Context, username, provider, subject string) error {
+	key := oauthIdentityKey(provider, subject)
+	owner, err := rdb.Get(ctx, key).Result()
+	if err == nil && owner == username {
+		return nil
+	}
+	if err == nil {
+		return errIdentityLinked
+	}
+	if err != redis.Nil {
+		return err
+	}
+	linked, err := rdb.HExists(ctx, oauthLinksKey(username), provider).Result()
+	if err != nil {
+		return err
+	}
+	if linked {
+		return errProviderLinked
+	}
+	ok, err := rdb.SetNX(ctx, key, username, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errIdentityLinked
+	}
+	return rdb.HSet(ctx, oauthLinksKey(username), provider, subject).Err()
+}
+
+var oauthNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// createOAuthAccount makes an account for someone signing in with a
+// provider for the first time, named after them where that name is free
+// and allowed. It gets a random password nobody knows, so it can only be
+// signed in to through the provider.
+func createOAuthAccount(ctx context.Context, provider string, id oauthIdentity) (string, error) {
+	base := oauthNameChars.ReplaceAllString(id.Name, "")
+	if len(base) > maxUsernameLength-5 {
+		base = base[:maxUsernameLength-5]
+	}
+	if len(base) < minUsernameLength || validateUsername(base) != nil {
+		base = "player"
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		username := base
+		if attempt > 0 || base == "player" {
+			username = fmt.Sprintf("%s%04d", base, mrand.IntN(10000))
+		}
+		if validateUsername(username) != nil {
+			continue
+		}
+		err := createAccount(ctx, username, randomToken())
+		if err == errUsernameTaken {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := linkIdentity(ctx, username, provider, id.Subject); err != nil {
+			return "", err
+		}
+		return username, rdb.SAdd(ctx, passwordlessKey, username).Err()
+	}
+	return "", errors.New("no free username for new account")
+}
+
+// passwordless reports whether an account was made through a provider and
+// so has no password to confirm changes with.
+func passwordless(ctx context.Context, username string) (bool, error) {
+	return rdb.SIsMember(ctx, passwordlessKey, username).Result()
+}
+
+// oauthLinks returns a player's linked provider IDs, by provider.
+func oauthLinks(ctx context.Context, username string) (map[string]string, error) {
+	return rdb.HGetAll(ctx, oauthLinksKey(username)).Result()
+}
+
+// unlinkOAuth removes one of the caller's linked sign-ins. A passwordless
+// account keeps its last one, or it could never be signed in to again.
+func unlinkOAuth(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	provider := mux.Vars(r)["provider"]
+
+	links, err := oauthLinks(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error unlinking sign-in")
+		return
+	}
+	subject, ok := links[provider]
+	if !ok {
+		respondError(w, r, http.StatusNotFound, errNotLinked)
+		return
+	}
+	noPassword, err := passwordless(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error unlinking sign-in")
+		return
+	}
+	if noPassword && len(links) == 1 {
+		respondError(w, r, http.StatusConflict, errLastSignIn)
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, oauthIdentityKey(provider, subject))
+	pipe.HDel(ctx, oauthLinksKey(username), provider)
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error unlinking sign-in")
+		return
+	}
+	logFor(r).Info("sign-in unlinked", "username", username, "provider", provider)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// listOAuthLinks answers which providers the caller can sign in with.
+func listOAuthLinks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	links, err := oauthLinks(ctx, currentUser(r))
+	if err != nil {
+		respondInternal(w, r, err, "Error loading linked sign-ins")
+		return
+	}
+	providers := []string{}
+	for provider := range links {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{"providers": providers})
+}
+
+// moveOAuthLinks points a renamed player's linked sign-ins at their new
+// name.
+func moveOAuthLinks(ctx context.Context, from, to string) error {
+	links, err := oauthLinks(ctx, from)
+	if err != nil {
+		return err
+	}
+	noPassword, err := passwordless(ctx, from)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	for provider, subject := range links {
+		pipe.Set(ctx, oauthIdentityKey(provider, subject), to, 0)
+	}
+	if len(links) > 0 {
+		pipe.Rename(ctx, oauthLinksKey(from), oauthLinksKey(to))
+	}
+	if noPassword {
+		pipe.SRem(ctx, passwordlessKey, from)
+		pipe.SAdd(ctx, passwordlessKey, to)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// removeOAuthLinks forgets a deleted player's linked sign-ins.
+func removeOAuthLinks(ctx context.Context, username string) error {
+	links, err := oauthLinks(ctx, username)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	for provider, subject := range links {
+		pipe.Del(ctx, oauthIdentityKey(provider, subject))
+	}
+	pipe.Del(ctx, oauthLinksKey(username))
+	pipe.SRem(ctx, passwordlessKey, username)
+	_, err = pipe.Exec(ctx)
+	return err
+}
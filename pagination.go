@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+var errBadPagination = errors.New("limit and offset must be non-negative integers")
+
+// parsePagination reads limit/offset query parameters, applying the default
+// page size and capping the limit.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return 0, 0, errBadPagination
+		}
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errBadPagination
+		}
+	}
+	return limit, offset, nil
+}
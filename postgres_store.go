@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID serialises migrations when several instances start at
+// once.
+const migrationLockID = 4242
+
+// PostgresStore keeps accounts and game history in Postgres so they survive
+// Redis eviction. Live game state and leaderboards stay in Redis.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func openPostgres(ctx context.Context, url string) (*PostgresStore, error) {
+	if url == "" {
+		return nil, errors.New("DATABASE_URL is not set")
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+	s := &PostgresStore{db: db}
+	if err := s.migrate(ctx); err != nil {
+		return nil, fmt.Errorf("migrating: %w", err)
+	}
+	return s, nil
+}
+
+// migrate applies every embedded migration that has not run yet, in file
+// name order, each in its own transaction.
+func (s *PostgresStore) migrate(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(name, ".sql")
+		var applied bool
+		err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		body, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return err
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("applied migration", "version", version)
+	}
+	return nil
+}
+
+var errPendingMigrations = errors.New("database migrations are pending")
+
+// checkMigrations fails if any embedded migration has not been applied.
+func (s *PostgresStore) checkMigrations(c context.Context) error {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	var applied int
+	if err := s.db.QueryRowContext(c, `SELECT count(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	if applied < len(entries) {
+		return errPendingMigrations
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// liveAccount matches accounts that have not lapsed.
+const liveAccount = `(expires_at IS NULL OR expires_at > now())`
+
+func (s *PostgresStore) insertAccount(ctx context.Context, username string, passwordHash sql.NullString, guest bool, expiresAt sql.NullTime) error {
+	// A lapsed guest no longer holds its name.
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM accounts WHERE username = $1 AND NOT `+liveAccount, username); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO accounts (username, password_hash, guest, expires_at) VALUES ($1, $2, $3, $4)`,
+		username, passwordHash, guest, expiresAt)
+	if isUniqueViolation(err) {
+		return errUsernameTaken
+	}
+	return err
+}
+
+func (s *PostgresStore) CreateUser(ctx context.Context, username, passwordHash string) error {
+	return s.insertAccount(ctx, username, sql.NullString{String: passwordHash, Valid: true}, false, sql.NullTime{})
+}
+
+func (s *PostgresStore) CreateGuest(ctx context.Context, username string, ttl time.Duration) error {
+	return s.insertAccount(ctx, username, sql.NullString{}, true, sql.NullTime{Time: time.Now().Add(ttl), Valid: true})
+}
+
+func (s *PostgresStore) PasswordHash(ctx context.Context, username string) (string, error) {
+	var hash sql.NullString
+	err := s.db.QueryRowContext(ctx,
+		`SELECT password_hash FROM accounts WHERE username = $1 AND `+liveAccount, username).Scan(&hash)
+	if err == sql.ErrNoRows || (err == nil && !hash.Valid) {
+		return "", errUserNotFound
+	}
+	return hash.String, err
+}
+
+func (s *PostgresStore) SetPasswordHash(ctx context.Context, username, passwordHash string) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE accounts SET password_hash = $2 WHERE username = $1 AND password_hash IS NOT NULL AND `+liveAccount,
+		username, passwordHash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) UserExists(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM accounts WHERE username = $1 AND `+liveAccount+`)`, username).Scan(&exists)
+	return exists, err
+}
+
+func (s *PostgresStore) IsGuest(ctx context.Context, username string) (bool, error) {
+	var guest bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT guest FROM accounts WHERE username = $1 AND `+liveAccount, username).Scan(&guest)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return guest, err
+}
+
+func (s *PostgresStore) DeleteUser(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM accounts WHERE username = $1`, username)
+	return err
+}
+
+func (s *PostgresStore) RenameUser(ctx context.Context, from, to string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM accounts WHERE username = $1 AND NOT `+liveAccount, to); err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE accounts SET username = $2 WHERE username = $1 AND `+liveAccount, from, to)
+	if isUniqueViolation(err) {
+		return errUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) Role(ctx context.Context, username string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT role FROM accounts WHERE username = $1 AND `+liveAccount, username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", errUserNotFound
+	}
+	return role, err
+}
+
+func (s *PostgresStore) SetRole(ctx context.Context, username, role string) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE accounts SET role = $2 WHERE username = $1 AND `+liveAccount, username, role)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) LoadAccount(ctx context.Context, username string) (*Account, error) {
+	a := &Account{Username: username}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT role, guest, created_at FROM accounts WHERE username = $1 AND `+liveAccount, username).
+		Scan(&a.Role, &a.Guest, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *PostgresStore) Profile(ctx context.Context, username string) (*Profile, error) {
+	p := &Profile{}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT avatar, bio, favorite_card FROM accounts WHERE username = $1 AND `+liveAccount, username).
+		Scan(&p.Avatar, &p.Bio, &p.FavoriteCard)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *PostgresStore) SetProfile(ctx context.Context, username string, p *Profile) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE accounts SET avatar = $2, bio = $3, favorite_card = $4 WHERE username = $1 AND `+liveAccount,
+		username, p.Avatar, p.Bio, p.FavoriteCard)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// likeEscaper keeps a search prefix's own % and _ from acting as wildcards.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *PostgresStore) SearchUsers(ctx context.Context, prefix string, limit, offset int) ([]Account, int64, error) {
+	pattern := likeEscaper.Replace(strings.ToLower(prefix)) + "%"
+
+	var total int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM accounts WHERE lower(username) LIKE $1 AND `+liveAccount, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT username, role, guest, created_at FROM accounts
+		 WHERE lower(username) LIKE $1 AND `+liveAccount+`
+		 ORDER BY username LIMIT $2 OFFSET $3`, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		var a Account
+		if err := rows.Scan(&a.Username, &a.Role, &a.Guest, &a.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, total, rows.Err()
+}
+
+func (s *PostgresStore) RecordGame(ctx context.Context, record *GameRecord, participants []string) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO games (id, room_id, winner, started_at, finished_at, record)
+		 VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`,
+		record.ID, record.RoomID, record.Winner, record.StartedAt, record.FinishedAt, data)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	for _, p := range participants {
+		st := record.Stats[p]
+		win, forfeit := 0, 0
+		if p == record.Winner {
+			win = 1
+		}
+		if st.Forfeited {
+			forfeit = 1
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO game_players (game_id, username, finished_at) VALUES ($1, $2, $3)`,
+			record.ID, p, record.FinishedAt); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO player_stats AS s (username, games_played, wins, losses, cards_drawn, defused, forfeits, current_streak, longest_streak)
+			VALUES ($1, 1, $2, 1 - $2, $3, $4, $5, $2, $2)
+			ON CONFLICT (username) DO UPDATE SET
+				games_played   = s.games_played + 1,
+				wins           = s.wins + $2,
+				losses         = s.losses + 1 - $2,
+				cards_drawn    = s.cards_drawn + $3,
+				defused        = s.defused + $4,
+				forfeits       = s.forfeits + $5,
+				current_streak = CASE WHEN $2 = 1 THEN s.current_streak + 1 ELSE 0 END,
+				longest_streak = GREATEST(s.longest_streak, CASE WHEN $2 = 1 THEN s.current_streak + 1 ELSE 0 END)`,
+			p, win, st.CardsDrawn, st.Defused, forfeit)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) PlayerStats(ctx context.Context, username string) (*PlayerStats, error) {
+	st := &PlayerStats{Username: username}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT games_played, wins, losses, cards_drawn, defused, forfeits, current_streak, longest_streak
+		FROM player_stats WHERE username = $1`, username).Scan(
+		&st.GamesPlayed, &st.Wins, &st.Losses, &st.CardsDrawn, &st.Defused, &st.Forfeits, &st.CurrentStreak, &st.LongestStreak)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	st.fillWinRate()
+	return st, nil
+}
+
+func (s *PostgresStore) CurrentStreaks(ctx context.Context, usernames []string) (map[string]int, error) {
+	streaks := make(map[string]int, len(usernames))
+	if len(usernames) == 0 {
+		return streaks, nil
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT username, current_streak FROM player_stats WHERE username = ANY($1)`, usernames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			username string
+			streak   int
+		)
+		if err := rows.Scan(&username, &streak); err != nil {
+			return nil, err
+		}
+		streaks[username] = streak
+	}
+	return streaks, rows.Err()
+}
+
+func (s *PostgresStore) PlayerGames(ctx context.Context, username string, limit, offset int) ([]GameRecord, int64, error) {
+	var total int64
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM game_players WHERE username = $1`, username).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := []GameRecord{}
+	if limit <= 0 {
+		return records, total, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT g.record FROM game_players p JOIN games g ON g.id = p.game_id
+		WHERE p.username = $1 ORDER BY p.finished_at DESC LIMIT $2 OFFSET $3`,
+		username, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+		var record GameRecord
+		if json.Unmarshal(data, &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, total, rows.Err()
+}
+
+func (s *PostgresStore) MoveHistory(ctx context.Context, from, to string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE game_players SET username = $2 WHERE username = $1`, from, to); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE player_stats SET username = $2 WHERE username = $1`, from, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) DeleteHistory(ctx context.Context, username string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM game_players WHERE username = $1`, username); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM player_stats WHERE username = $1`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
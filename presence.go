@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceInGame  = "in_game"
+	PresenceOffline = "offline"
+)
+
+// presenceTTL is how long a connection counts as live without a heartbeat.
+// Pongs arrive every pingPeriod, so a live connection never gets close.
+const presenceTTL = 2 * pongWait
+
+// Presence is whether a player is around and, if not, when they last were.
+type Presence struct {
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// presenceConnectionsKey holds a player's live connections on every
+// instance, scored by when each expires unless it sends a heartbeat.
+func presenceConnectionsKey(username string) string {
+	return fmt.Sprintf("presence:%s:connections", username)
+}
+
+// presenceStatusKey is the last status announced for a player, so only
+// real changes are published.
+func presenceStatusKey(username string) string {
+	return fmt.Sprintf("presence:%s:status", username)
+}
+
+func lastSeenKey(username string) string {
+	return fmt.Sprintf("player:%s:last_seen", username)
+}
+
+// presenceTag names a connection in the presence set. Seated players are
+// tagged with their room so they show as in a game.
+func (c *Client) presenceTag() string {
+	if !c.spectator && c.room != lobbyRoom {
+		return "game:" + c.room + ":" + c.id
+	}
+	return "lobby:" + c.id
+}
+
+// touchPresence records a heartbeat from a live connection.
+func touchPresence(ctx context.Context, c *Client) {
+	now := time.Now()
+	key := presenceConnectionsKey(c.username)
+	pipe := rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now.Add(presenceTTL).Unix()), Member: c.presenceTag()})
+	pipe.Expire(ctx, key, presenceTTL)
+	pipe.Set(ctx, lastSeenKey(c.username), now.Unix(), 0)
+	markOnline(ctx, pipe, c.username, now)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("recording presence", "username", c.username, "err", err)
+		return
+	}
+	announcePresence(ctx, c.username)
+}
+
+// dropPresence forgets a closed connection.
+func dropPresence(ctx context.Context, c *Client) {
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, presenceConnectionsKey(c.username), c.presenceTag())
+	pipe.Set(ctx, lastSeenKey(c.username), time.Now().Unix(), 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("recording presence", "username", c.username, "err", err)
+		return
+	}
+	markOffline(ctx, c.username)
+	announcePresence(ctx, c.username)
+}
+
+// seatConnected reports whether a player has a live seated connection to
+// room on any instance.
+func seatConnected(ctx context.Context, room, username string) (bool, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	tags, err := rdb.ZRangeByScore(ctx, presenceConnectionsKey(username), &redis.ZRangeBy{Min: now, Max: "+inf"}).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "game:"+room+":") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func loadPresence(ctx context.Context, username string) (*Presence, error) {
+	key := presenceConnectionsKey(username)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	pipe := rdb.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+now)
+	tags := pipe.ZRange(ctx, key, 0, -1)
+	seen := pipe.Get(ctx, lastSeenKey(username))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	p := &Presence{Status: PresenceOffline}
+	for _, tag := range tags.Val() {
+		p.Status = PresenceOnline
+		if strings.HasPrefix(tag, "game:") {
+			p.Status = PresenceInGame
+			break
+		}
+	}
+	if unix, err := seen.Int64(); err == nil {
+		at := time.Unix(unix, 0).UTC()
+		p.LastSeen = &at
+	}
+	return p, nil
+}
+
+// announcePresence publishes a player's status to the lobby and to their
+// friends whenever it changes.
+func announcePresence(ctx context.Context, username string) {
+	p, err := loadPresence(ctx, username)
+	if err != nil {
+		slog.Error("loading presence", "username", username, "err", err)
+		return
+	}
+	previous, err := rdb.GetSet(ctx, presenceStatusKey(username), p.Status).Result()
+	if err != nil && err != redis.Nil {
+		slog.Error("recording presence", "username", username, "err", err)
+		return
+	}
+	if previous == p.Status || (previous == "" && p.Status == PresenceOffline) {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"username":  username,
+		"status":    p.Status,
+		"last_seen": p.LastSeen,
+	}
+	hub.broadcast(ctx, lobbyRoom, EventPresenceChanged, payload)
+	friends, err := rdb.SMembers(ctx, friendsKey(username)).Result()
+	if err != nil {
+		slog.Error("loading friends", "username", username, "err", err)
+		return
+	}
+	for _, f := range friends {
+		hub.notifyUser(ctx, f, EventPresenceChanged, payload)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// joinCodeAlphabet leaves out letters and digits that are easily
+	// confused when a code is read out loud.
+	joinCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	joinCodeLength   = 6
+	joinCodeAttempts = 5
+)
+
+var (
+	errRoomPrivate      = errors.New("room is private, join it with its code")
+	errJoinCodeNotFound = errors.New("no open room has that join code")
+)
+
+type InviteRequest struct {
+	Username string `json:"username"`
+}
+
+func joinCodeKey(code string) string {
+	return fmt.Sprintf("room:code:%s", code)
+}
+
+func newJoinCode() string {
+	b := make([]byte, joinCodeLength)
+	max := big.NewInt(int64(len(joinCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = joinCodeAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+// assignJoinCode reserves an unused code for a private room.
+func assignJoinCode(ctx context.Context, room *Room) error {
+	for i := 0; i < joinCodeAttempts; i++ {
+		code := newJoinCode()
+		ok, err := rdb.SetNX(ctx, joinCodeKey(code), room.ID, 0).Result()
+		if err != nil {
+			return err
+		}
+		if ok {
+			room.JoinCode = code
+			return nil
+		}
+	}
+	return errors.New("no free join code")
+}
+
+// releaseJoinCode frees a room's code once nobody can join it any more.
+func releaseJoinCode(ctx context.Context, room *Room) {
+	if room.JoinCode != "" {
+		rdb.Del(ctx, joinCodeKey(room.JoinCode))
+	}
+}
+
+func joinRoomByCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := strings.ToUpper(mux.Vars(r)["code"])
+
+	id, err := rdb.Get(ctx, joinCodeKey(code)).Result()
+	if err == redis.Nil {
+		respondError(w, r, http.StatusNotFound, errJoinCodeNotFound)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+	room, err := loadRoom(ctx, id)
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, errJoinCodeNotFound)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+
+	enterRoom(w, r, room)
+}
+
+// inviteToRoom sends another player a room's details, including its join
+// code when it is private. Only players seated in the room can invite.
+func inviteToRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req InviteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Username == "" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "username is required")
+		return
+	}
+
+	room, err := loadRoom(ctx, mux.Vars(r)["id"])
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+	if !room.hasPlayer(username) {
+		respondError(w, r, http.StatusForbidden, errNotInGame)
+		return
+	}
+	if room.Status == RoomFinished {
+		respondError(w, r, http.StatusConflict, errRoomClosed)
+		return
+	}
+
+	exists, err := users.UserExists(ctx, req.Username)
+	if err != nil {
+		respondInternal(w, r, err, "Error sending invite")
+		return
+	}
+	if !exists {
+		respondError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+
+	hub.notifyUser(ctx, req.Username, EventRoomInvite, map[string]interface{}{
+		"room_id":   room.ID,
+		"from":      username,
+		"join_code": room.JoinCode,
+		"status":    room.Status,
+		"players":   room.Players,
+		"capacity":  room.Capacity,
+	})
+	notifyDevices(ctx, req.Username, PushInvite, map[string]string{"from": username}, map[string]string{"room_id": room.ID})
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "invited"})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultProfanity is the built-in word list. PROFANITY_WORDS adds to it.
+var defaultProfanity = []string{
+	"asshole", "bastard", "bitch", "bollocks", "cunt", "dickhead", "fag",
+	"fuck", "motherfucker", "nigger", "nigga", "piss", "retard", "shit",
+	"slut", "twat", "wanker", "whore",
+}
+
+var (
+	profanityFilter = true
+	profanity       = defaultProfanity
+)
+
+// leetspeak undoes the usual letter swaps before matching.
+var leetspeak = strings.NewReplacer(
+	"0", "o", "1", "i", "!", "i", "3", "e", "4", "a", "@", "a",
+	"5", "s", "$", "s", "7", "t", "+", "t", "8", "b",
+)
+
+// chatWord matches the runs of a message that are checked on their own,
+// leetspeak symbols included.
+var chatWord = regexp.MustCompile(`[\p{L}\p{N}@$!+]+`)
+
+// configureProfanity applies PROFANITY_FILTER, which turns the filter off
+// when false, and PROFANITY_WORDS, a comma-separated list of extra words.
+func configureProfanity(filter bool, words []string) {
+	profanityFilter = filter
+	profanity = append([]string{}, defaultProfanity...)
+	for _, word := range words {
+		if word = normalizeWord(word); word != "" {
+			profanity = append(profanity, word)
+		}
+	}
+}
+
+// normalizeWord lowercases s, undoes leetspeak and drops everything but
+// letters, so spacing tricks like "F.u_C-k" still match.
+func normalizeWord(s string) string {
+	s = leetspeak.Replace(strings.ToLower(s))
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// profane reports whether s contains a listed word anywhere.
+func profane(s string) bool {
+	if !profanityFilter {
+		return false
+	}
+	s = normalizeWord(s)
+	for _, word := range profanity {
+		if strings.Contains(s, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// profaneWord reports whether a single word starts or ends with a listed
+// word. Unlike profane it lets through words that merely contain one, such
+// as place names, since chat is read in context.
+func profaneWord(s string) bool {
+	s = normalizeWord(s)
+	for _, word := range profanity {
+		if strings.HasPrefix(s, word) || strings.HasSuffix(s, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// censor masks the profane words of a chat message, leaving the rest of
+// the message as sent.
+func censor(text string) string {
+	if !profanityFilter {
+		return text
+	}
+	return chatWord.ReplaceAllStringFunc(text, func(word string) string {
+		if !profaneWord(word) {
+			return word
+		}
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+}
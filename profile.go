@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxBioLength = 160
+
+// defaultAvatar is shown for players who have not picked one.
+const defaultAvatar = "tabby"
+
+var errNotYourProfile = errors.New("you can only edit your own profile")
+
+// avatars are the pictures players can choose from. Like emotes, clients
+// draw them from the ID.
+var avatars = []string{
+	"tabby", "calico", "tuxedo", "siamese", "ginger", "sphynx",
+	"persian", "bengal", "void", "taco_cat", "zombie_kitten", "bomb",
+}
+
+// knownAvatar reports whether id is a free avatar or one sold in the shop.
+func knownAvatar(id string) bool {
+	for _, a := range avatars {
+		if a == id {
+			return true
+		}
+	}
+	return shopAvatar(id)
+}
+
+// ProfileUpdate changes the fields that are sent and leaves the rest.
+// Sending an empty string clears a field.
+type ProfileUpdate struct {
+	Avatar       *string `json:"avatar"`
+	Bio          *string `json:"bio"`
+	FavoriteCard *string `json:"favorite_card"`
+}
+
+// PlayerProfile is a player's public page.
+type PlayerProfile struct {
+	Username string `json:"username"`
+	Profile
+	Score    int          `json:"score"`
+	Rating   int          `json:"rating"`
+	Level    *Level       `json:"level"`
+	Presence *Presence    `json:"presence"`
+	Stats    *PlayerStats `json:"stats"`
+}
+
+// validateProfile checks a profile about to be saved.
+func validateProfile(p *Profile) []*FieldError {
+	problems := []*FieldError{}
+	if p.Avatar != "" && !knownAvatar(p.Avatar) {
+		problems = append(problems, &FieldError{Field: "avatar", Code: "AVATAR_UNKNOWN", Message: "No such avatar"})
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBioLength {
+		problems = append(problems, &FieldError{Field: "bio", Code: "BIO_TOO_LONG",
+			Message: fmt.Sprintf("Bio must be at most %d characters", maxBioLength)})
+	}
+	if p.FavoriteCard != "" && !knownCard(p.FavoriteCard) {
+		problems = append(problems, &FieldError{Field: "favorite_card", Code: "FAVORITE_CARD_UNKNOWN", Message: "No such card"})
+	}
+	return problems
+}
+
+func getPlayerProfile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+
+	profile, err := users.Profile(ctx, username)
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading profile")
+		return
+	}
+	if profile.Avatar == "" {
+		profile.Avatar = defaultAvatar
+	}
+	page := &PlayerProfile{Username: username, Profile: *profile}
+
+	page.Score, err = leaderboards.Score(ctx, leaderboardKey, username)
+	if err != nil && err != errNotRanked {
+		respondInternal(w, r, err, "Error loading profile")
+		return
+	}
+	rating, err := getRating(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading profile")
+		return
+	}
+	page.Rating = int(rating)
+	if page.Level, err = playerLevel(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error loading profile")
+		return
+	}
+	if page.Presence, err = loadPresence(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error loading profile")
+		return
+	}
+	if page.Stats, err = histories.PlayerStats(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error loading profile")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// updatePlayerProfile edits the caller's own profile. Bios are censored
+// like chat rather than rejected.
+func updatePlayerProfile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := mux.Vars(r)["username"]
+	if username != currentUser(r) {
+		respondError(w, r, http.StatusForbidden, errNotYourProfile)
+		return
+	}
+
+	var req ProfileUpdate
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+
+	profile, err := users.Profile(ctx, username)
+	if err == errUserNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error updating profile")
+		return
+	}
+	if req.Avatar != nil && *req.Avatar != profile.Avatar && shopAvatar(*req.Avatar) {
+		owned, err := ownsCosmetic(ctx, username, *req.Avatar)
+		if err != nil {
+			respondInternal(w, r, err, "Error updating profile")
+			return
+		}
+		if !owned {
+			respondError(w, r, http.StatusForbidden, errAvatarNotOwned)
+			return
+		}
+	}
+	if req.Avatar != nil {
+		profile.Avatar = *req.Avatar
+	}
+	if req.Bio != nil {
+		profile.Bio = strings.TrimSpace(*req.Bio)
+	}
+	if req.FavoriteCard != nil {
+		profile.FavoriteCard = *req.FavoriteCard
+	}
+	if problems := validateProfile(profile); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+	profile.Bio = censor(profile.Bio)
+
+	if err := users.SetProfile(ctx, username, profile); err != nil {
+		respondInternal(w, r, err, "Error updating profile")
+		return
+	}
+	if profile.Avatar == "" {
+		profile.Avatar = defaultAvatar
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func listAvatars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(avatars)
+}
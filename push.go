@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Device platforms: Android devices are reached through FCM, iOS devices
+// through APNs.
+const (
+	PlatformAndroid = "android"
+	PlatformIOS     = "ios"
+)
+
+// Kinds of push notification, each of which a player can turn off.
+const (
+	PushTurn       = "turn"
+	PushInvite     = "invite"
+	PushTournament = "tournament"
+)
+
+var pushKinds = []string{PushTurn, PushInvite, PushTournament}
+
+const (
+	maxDevices = 10
+
+	fcmScope     = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmSendURL   = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	apnsURL      = "https://api.push.apple.com/3/device/"
+	apnsDevURL   = "https://api.sandbox.push.apple.com/3/device/"
+	pushTimeout  = 10 * time.Second
+	apnsTokenTTL = 50 * time.Minute
+)
+
+var (
+	errBadPlatform    = errors.New("platform must be android or ios")
+	errDeviceNotFound = errors.New("device not found")
+	errTooManyDevices = errors.New("too many devices registered")
+	// errDeviceGone means the provider no longer knows the device, which
+	// is then forgotten.
+	errDeviceGone = errors.New("device token is no longer valid")
+)
+
+// PushConfig is how push notifications reach devices. FCM_CREDENTIALS is
+// a Firebase service account JSON file. APNs signs in with the .p8 key in
+// APNS_KEY_FILE, its APNS_KEY_ID and the APNS_TEAM_ID, sending for the app
+// APNS_TOPIC, to the sandbox with APNS_SANDBOX. A platform left
+// unconfigured has its notifications logged instead.
+type PushConfig struct {
+	FCMCredentials string
+	APNsKeyFile    string
+	APNsKeyID      string
+	APNsTeamID     string
+	APNsTopic      string
+	APNsSandbox    bool
+}
+
+// Pusher delivers a notification to one device.
+type Pusher interface {
+	Push(token string, n PushNotification) error
+}
+
+// PushNotification is what a device shows, plus data for the app.
+type PushNotification struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+var pushers = map[string]Pusher{
+	PlatformAndroid: logPusher{},
+	PlatformIOS:     logPusher{},
+}
+
+var pushClient = &http.Client{Timeout: pushTimeout}
+
+func devicesKey(username string) string {
+	return fmt.Sprintf("player:%s:devices", username)
+}
+
+func pushPrefsKey(username string) string {
+	return fmt.Sprintf("player:%s:push", username)
+}
+
+// configurePush sets up the providers that have credentials.
+func configurePush(c PushConfig) error {
+	if c.FCMCredentials != "" {
+		p, err := newFCMPusher(c.FCMCredentials)
+		if err != nil {
+			return fmt.Errorf("FCM_CREDENTIALS: %w", err)
+		}
+		pushers[PlatformAndroid] = p
+	}
+	if c.APNsKeyFile != "" {
+		p, err := newAPNsPusher(c)
+		if err != nil {
+			return fmt.Errorf("APNS_KEY_FILE: %w", err)
+		}
+		pushers[PlatformIOS] = p
+	}
+	return nil
+}
+
+type logPusher struct{}
+
+func (logPusher) Push(token string, n PushNotification) error {
+	slog.Info("push not sent, no credentials for the platform", "title", n.Title, "body", n.Body)
+	return nil
+}
+
+// fcmPusher sends through the FCM HTTP v1 API, trading a token signed with
+// the service account's key for an hour-long access token.
+type fcmPusher struct {
+	project  string
+	email    string
+	tokenURL string
+	key      *rsa.PrivateKey
+
+	mu      sync.Mutex
+	access  string
+	expires time.Time
+}
+
+func newFCMPusher(file string) (*fcmPusher, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(creds.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if creds.ProjectID == "" || creds.ClientEmail == "" || creds.TokenURI == "" {
+		return nil, errors.New("not a service account file")
+	}
+	return &fcmPusher{project: creds.ProjectID, email: creds.ClientEmail, tokenURL: creds.TokenURI, key: key}, nil
+}
+
+func (p *fcmPusher) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.access != "" && time.Now().Before(p.expires) {
+		return p.access, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   p.email,
+		"scope": fcmScope,
+		"aud":   p.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+	resp, err := pushClient.PostForm(p.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("FCM sign-in answered %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	p.access = token.AccessToken
+	// Renew a minute early so a token never expires in flight.
+	p.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return p.access, nil
+}
+
+func (p *fcmPusher) Push(token string, n PushNotification) error {
+	access, err := p.accessToken()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": n.Title, "body": n.Body},
+			"data":         n.Data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(fcmSendURL, p.project), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+access)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return errDeviceGone
+	default:
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if strings.Contains(string(detail), "UNREGISTERED") {
+			return errDeviceGone
+		}
+		return fmt.Errorf("FCM answered %s: %s", resp.Status, detail)
+	}
+}
+
+// apnsPusher sends through APNs with token-based authentication.
+type apnsPusher struct {
+	keyID, teamID, topic, url string
+	key                       *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	signed time.Time
+}
+
+func newAPNsPusher(c PushConfig) (*apnsPusher, error) {
+	data, err := os.ReadFile(c.APNsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &apnsPusher{keyID: c.APNsKeyID, teamID: c.APNsTeamID, topic: c.APNsTopic, url: apnsURL, key: key}
+	if c.APNsSandbox {
+		p.url = apnsDevURL
+	}
+	return p, nil
+}
+
+// providerToken is the signed token APNs wants on every request. APNs
+// rejects tokens older than an hour and throttles ones renewed too often.
+func (p *apnsPusher) providerToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Since(p.signed) < apnsTokenTTL {
+		return p.token, nil
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": p.teamID,
+		"iat": time.Now().Unix(),
+	})
+	t.Header["kid"] = p.keyID
+	signed, err := t.SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+	p.token, p.signed = signed, time.Now()
+	return p.token, nil
+}
+
+func (p *apnsPusher) Push(token string, n PushNotification) error {
+	auth, err := p.providerToken()
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": n.Title, "body": n.Body},
+			"sound": "default",
+		},
+	}
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+auth)
+	req.Header.Set("apns-topic", p.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 512)).Decode(&reason)
+	if resp.StatusCode == http.StatusGone || reason.Reason == "BadDeviceToken" || reason.Reason == "Unregistered" {
+		return errDeviceGone
+	}
+	return fmt.Errorf("APNs answered %s: %s", resp.Status, reason.Reason)
+}
+
+// Device is a phone a player gets push notifications on. Locale is the
+// language the app asked for when registering it.
+type Device struct {
+	Token     string    `json:"token"`
+	Platform  string    `json:"platform"`
+	Locale    string    `json:"locale"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RegisterDeviceRequest registers a device for push notifications.
+type RegisterDeviceRequest struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+func loadDevices(ctx context.Context, username string) ([]*Device, error) {
+	raw, err := rdb.HGetAll(ctx, devicesKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []*Device{}
+	for _, data := range raw {
+		var d Device
+		if json.Unmarshal([]byte(data), &d) == nil {
+			list = append(list, &d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// pushPrefs is which kinds of notification a player gets. Every kind is on
+// until turned off.
+func pushPrefs(ctx context.Context, username string) (map[string]bool, error) {
+	stored, err := rdb.HGetAll(ctx, pushPrefsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	prefs := map[string]bool{}
+	for _, kind := range pushKinds {
+		prefs[kind] = stored[kind] != "0"
+	}
+	return prefs, nil
+}
+
+// PushJob is one notification for all of a player's devices. The text is
+// translated for each device when it is sent.
+type PushJob struct {
+	Username string            `json:"username"`
+	Kind     string            `json:"kind"`
+	Args     map[string]string `json:"args,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// pushText is each kind's English title and body. {name} is replaced with
+// Args["name"].
+var pushText = map[string][2]string{
+	PushTurn:       {"Your turn", "It's your turn to play."},
+	PushInvite:     {"Game invite", "{from} invited you to a game."},
+	PushTournament: {"Tournament match", "Your round {round} match is starting."},
+}
+
+// notifyDevices queues a push to a player's devices if they want that kind
+// of notification and have a device to get it on.
+func notifyDevices(ctx context.Context, username, kind string, args, data map[string]string) {
+	n, err := rdb.HLen(ctx, devicesKey(username)).Result()
+	if err != nil || n == 0 {
+		return
+	}
+	prefs, err := pushPrefs(ctx, username)
+	if err != nil || !prefs[kind] {
+		return
+	}
+	if err := enqueueJob(ctx, JobPush, PushJob{Username: username, Kind: kind, Args: args, Data: data}); err != nil {
+		slog.Error("queueing push", "username", username, "kind", kind, "err", err)
+	}
+}
+
+func runPush(ctx context.Context, payload json.RawMessage) error {
+	var job PushJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	devices, err := loadDevices(ctx, job.Username)
+	if err != nil {
+		return err
+	}
+	replace := []string{}
+	for k, v := range job.Args {
+		replace = append(replace, "{"+k+"}", v)
+	}
+	r := strings.NewReplacer(replace...)
+	data := map[string]string{"kind": job.Kind}
+	for k, v := range job.Data {
+		data[k] = v
+	}
+
+	var failed error
+	for _, d := range devices {
+		text := pushText[job.Kind]
+		n := PushNotification{
+			Title: r.Replace(translate(d.Locale, "push."+job.Kind+".title", text[0])),
+			Body:  r.Replace(translate(d.Locale, "push."+job.Kind+".body", text[1])),
+			Data:  data,
+		}
+		pusher, ok := pushers[d.Platform]
+		if !ok {
+			continue
+		}
+		err := pusher.Push(d.Token, n)
+		if err == errDeviceGone {
+			rdb.HDel(ctx, devicesKey(job.Username), d.Token)
+			continue
+		}
+		if err != nil {
+			slog.Warn("sending push", "username", job.Username, "platform", d.Platform, "err", err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// remindTurn tells the player whose turn it now is, by push and in their
+// inbox, unless they are connected and can see it, or were already
+// reminded of this turn.
+func remindTurn(ctx context.Context, g *GameState) {
+	player := g.currentPlayer()
+	if g.isBot(player) || connectionState(ctx, g.channel(), player) == ConnectionConnected {
+		return
+	}
+	key := turnPushKey(g.ID)
+	previous, err := rdb.GetSet(ctx, key, player).Result()
+	if err != nil && err != redis.Nil {
+		return
+	}
+	rdb.Expire(ctx, key, idleGameTTL)
+	if previous == player {
+		return
+	}
+	data := map[string]string{"game_id": g.ID, "room_id": g.RoomID}
+	notify(ctx, player, NotifyTurn, data)
+	notifyDevices(ctx, player, PushTurn, nil, data)
+}
+
+// turnPushKey remembers who was last pushed about a game's turn, so a turn
+// announced twice is pushed once.
+func turnPushKey(gameID string) string {
+	return fmt.Sprintf("game:%s:pushed", gameID)
+}
+
+func listDevices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	list, err := loadDevices(ctx, currentUser(r))
+	if err != nil {
+		respondInternal(w, r, err, "Error loading devices")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// registerDevice adds a device, or refreshes its locale if it is known.
+func registerDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req RegisterDeviceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" || len(req.Token) > 4096 {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "token is required")
+		return
+	}
+	if _, ok := pushers[req.Platform]; !ok {
+		respondError(w, r, http.StatusBadRequest, errBadPlatform)
+		return
+	}
+
+	key := devicesKey(username)
+	known, err := rdb.HExists(ctx, key, req.Token).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error registering device")
+		return
+	}
+	if !known {
+		n, err := rdb.HLen(ctx, key).Result()
+		if err != nil {
+			respondInternal(w, r, err, "Error registering device")
+			return
+		}
+		if n >= maxDevices {
+			respondError(w, r, http.StatusConflict, errTooManyDevices)
+			return
+		}
+	}
+	d := &Device{
+		Token:     req.Token,
+		Platform:  req.Platform,
+		Locale:    localeFor(r),
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		respondInternal(w, r, err, "Error registering device")
+		return
+	}
+	if err := rdb.HSet(ctx, key, d.Token, data).Err(); err != nil {
+		respondInternal(w, r, err, "Error registering device")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+func removeDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	removed, err := rdb.HDel(ctx, devicesKey(currentUser(r)), mux.Vars(r)["token"]).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error removing device")
+		return
+	}
+	if removed == 0 {
+		respondError(w, r, http.StatusNotFound, errDeviceNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getPushPrefs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefs, err := pushPrefs(ctx, currentUser(r))
+	if err != nil {
+		respondInternal(w, r, err, "Error loading notification settings")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// setPushPrefs turns kinds of notification on or off. Kinds left out of
+// the request are unchanged.
+func setPushPrefs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req map[string]bool
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	values := []interface{}{}
+	for kind, on := range req {
+		if _, ok := pushText[kind]; !ok {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidPayload,
+				fmt.Sprintf("Notification kinds are %s", strings.Join(pushKinds, ", ")))
+			return
+		}
+		flag := "0"
+		if on {
+			flag = "1"
+		}
+		values = append(values, kind, flag)
+	}
+	if len(values) > 0 {
+		if err := rdb.HSet(ctx, pushPrefsKey(username), values...).Err(); err != nil {
+			respondInternal(w, r, err, "Error saving notification settings")
+			return
+		}
+	}
+	prefs, err := pushPrefs(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading notification settings")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rateLimit is a token bucket: Burst requests at once, refilled at Rate
+// requests per second. Routes sharing a Name share a bucket.
+type rateLimit struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+var (
+	authLimit    = rateLimit{Name: "auth", Rate: 5.0 / 60, Burst: 5}
+	actionLimit  = rateLimit{Name: "action", Rate: 5, Burst: 10}
+	readLimit    = rateLimit{Name: "read", Rate: 20, Burst: 40}
+	defaultLimit = rateLimit{Name: "default", Rate: 2, Burst: 20}
+	// chatLimit throttles chat messages sent over the websocket.
+	chatLimit = rateLimit{Name: "chat", Rate: 1, Burst: 5}
+	// reactionLimit throttles emotes, which are cheaper to spam than chat.
+	reactionLimit = rateLimit{Name: "reaction", Rate: 0.5, Burst: 3}
+)
+
+// routeLimits picks the bucket for each route, named as in routeName.
+// Routes not listed use defaultLimit.
+var routeLimits = map[string]rateLimit{
+	"/login":                        authLimit,
+	"/register":                     authLimit,
+	"/guest":                        authLimit,
+	"/auth/{provider}/start":        authLimit,
+	"/auth/{provider}/callback":     authLimit,
+	"/email/verify":                 authLimit,
+	"/password/forgot":              authLimit,
+	"/password/reset":               authLimit,
+	"/account/email/verify":         authLimit,
+	"/token/refresh":                authLimit,
+	"/guest/upgrade":                authLimit,
+	"/account":                      authLimit,
+	"/account/export":               authLimit,
+	"/account/username":             authLimit,
+	"/account/oauth/{provider}":     authLimit,
+	"/account/email":                authLimit,
+	"/account/api-keys":             authLimit,
+	"/account/api-keys/{id}":        authLimit,
+	"/account/api-keys/{id}/rotate": authLimit,
+	"/game/{id}/draw":               actionLimit,
+	"/game/{id}/play":               actionLimit,
+	"/game/{id}/nope":               actionLimit,
+	"/game/{id}/reinsert":           actionLimit,
+	"/game/{id}/alter":              actionLimit,
+	"/game/{id}/combo":              actionLimit,
+	"/game/{id}/give":               actionLimit,
+	"/game/{id}/forfeit":            actionLimit,
+	"/game/{id}/rematch":            actionLimit,
+	"/rooms/join-by-code/{code}":    actionLimit,
+	"/rooms/{id}/invite":            actionLimit,
+	"/reports":                      actionLimit,
+	"/saveCardDraw":                 actionLimit,
+	"/shop/{id}/purchase":           actionLimit,
+	"/tournaments/{id}/register":    actionLimit,
+	"/game/{id}/state":              readLimit,
+	"/fetchSavedCards":              readLimit,
+	"/leaderboard":                  readLimit,
+	"/leaderboard/me":               readLimit,
+	"/leaderboard/friends":          readLimit,
+	"/friends":                      readLimit,
+	"/rooms":                        readLimit,
+	"/rooms/{id}/connections":       readLimit,
+	"/rooms/{id}/chat":              readLimit,
+	"/cards":                        readLimit,
+	"/emotes":                       readLimit,
+	"/avatars":                      readLimit,
+	"/shop":                         readLimit,
+	"/inventory":                    readLimit,
+	"/tournaments":                  readLimit,
+	"/tournaments/{id}":             readLimit,
+	"/events/active":                readLimit,
+}
+
+// unlimitedRoutes are polled by orchestrators and must never be throttled.
+var unlimitedRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// tokenBucket refills and takes one token atomically so every instance
+// shares the same budget. It returns whether the request may proceed and
+// the tokens left afterwards.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+func rateLimitKey(bucket, caller string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", bucket, caller)
+}
+
+// take spends one token from the caller's bucket.
+func (l rateLimit) take(ctx context.Context, caller string) (bool, float64, error) {
+	now := time.Now().UnixMilli()
+	res, err := tokenBucket.Run(ctx, rdb, []string{rateLimitKey(l.Name, caller)}, l.Rate, l.Burst, now).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	allowed, _ := res[0].(int64)
+	left, _ := strconv.ParseFloat(fmt.Sprint(res[1]), 64)
+	return allowed == 1, left, nil
+}
+
+var (
+	// trustProxy is TRUST_PROXY: whether the server sits behind a proxy
+	// that sets X-Forwarded-For.
+	trustProxy bool
+	// proxyHops is TRUSTED_PROXY_HOPS: how many proxies in front of the
+	// server append to X-Forwarded-For.
+	proxyHops = 1
+)
+
+// forwardedFor picks the caller's address out of X-Forwarded-For. Each
+// proxy appends the address it saw, so only the last hops entries are
+// ours; anything before them came from the client and may be forged.
+func forwardedFor(headers []string, hops int) string {
+	entries := []string{}
+	for _, h := range headers {
+		for _, e := range strings.Split(h, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	i := len(entries) - hops
+	if i < 0 {
+		i = 0
+	}
+	return entries[i]
+}
+
+// clientIP is the caller's address. X-Forwarded-For is only believed when
+// TRUST_PROXY is set, since clients can send anything in it.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if fwd := forwardedFor(r.Header.Values("X-Forwarded-For"), proxyHops); fwd != "" {
+			return fwd
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitCaller identifies who is spending the bucket: the signed-in user
+// when the request carries a valid token, otherwise the client's IP.
+func rateLimitCaller(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		if username, err := parseAccessToken(token); err == nil {
+			return "user:" + username
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// limitRequests enforces the matched route's rate limit and reports the
+// caller's budget in X-RateLimit-* headers. Requests made with an API key
+// spend that key's own bucket instead. When Redis cannot be reached
+// requests are let through rather than locking everyone out.
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		name := routeName(r)
+		if unlimitedRoutes[name] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit, ok := routeLimits[name]
+		if !ok {
+			limit = defaultLimit
+		}
+		caller := rateLimitCaller(r)
+		if key := currentAPIKey(r); key != nil {
+			limit, caller = apiKeyLimit, "key:"+key.ID
+		}
+
+		allowed, left, err := limit.take(ctx, caller)
+		if err != nil {
+			logFor(r).Error("checking rate limit", "bucket", limit.Name, "err", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		untilFull := math.Ceil((float64(limit.Burst) - left) / limit.Rate)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(left)))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(untilFull)))
+		if !allowed {
+			retry := math.Ceil((1 - left) / limit.Rate)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry)))
+			logFor(r).Warn("rate limited", "bucket", limit.Name, "path", r.URL.Path)
+			writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		trust bool
+		hops  int
+		xff   []string
+		want  string
+	}{
+		{name: "proxy not trusted", hops: 1, xff: []string{"10.0.0.1"}, want: "192.0.2.1"},
+		{name: "no header", trust: true, hops: 1, want: "192.0.2.1"},
+		{name: "one proxy", trust: true, hops: 1, xff: []string{"10.0.0.1"}, want: "10.0.0.1"},
+		{name: "forged entry ignored", trust: true, hops: 1, xff: []string{"6.6.6.6, 10.0.0.1"}, want: "10.0.0.1"},
+		{name: "two proxies", trust: true, hops: 2, xff: []string{"6.6.6.6, 10.0.0.1, 10.0.0.2"}, want: "10.0.0.1"},
+		{name: "split across headers", trust: true, hops: 2, xff: []string{"6.6.6.6", "10.0.0.1, 10.0.0.2"}, want: "10.0.0.1"},
+		{name: "fewer entries than hops", trust: true, hops: 3, xff: []string{"10.0.0.1"}, want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldTrust, oldHops := trustProxy, proxyHops
+			t.Cleanup(func() { trustProxy, proxyHops = oldTrust, oldHops })
+			trustProxy, proxyHops = tt.trust, tt.hops
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	testRedis(t)
+	r := mux.NewRouter()
+	r.Use(limitRequests)
+	r.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+
+	get := func(path, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < authLimit.Burst; i++ {
+		if w := get("/api/login", "192.0.2.1:1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+	w := get("/api/login", "192.0.2.1:1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("missing budget headers: %v", w.Header())
+	}
+	if w := get("/api/login", "192.0.2.2:1"); w.Code != http.StatusOK {
+		t.Errorf("another caller: status %d, want %d", w.Code, http.StatusOK)
+	}
+	for i := 0; i < 2*defaultLimit.Burst; i++ {
+		if w := get("/healthz", "192.0.2.1:1"); w.Code != http.StatusOK {
+			t.Fatalf("health check %d: status %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	ratingsKey    = "ratings"
+	defaultRating = 1200.0
+	ratingK       = 32.0
+	// ratedTTL is how long a rated game is remembered, so finishing it
+	// again can't rate it twice.
+	ratedTTL = 7 * 24 * time.Hour
+	// ratingAttempts bounds how often rating a game is retried after
+	// another game's ratings changed underneath it.
+	ratingAttempts = 5
+)
+
+var errRatingBusy = errors.New("ratings kept changing while rating the game")
+
+func ratedKey(gameID string) string {
+	return fmt.Sprintf("game:%s:rated", gameID)
+}
+
+func getRating(ctx context.Context, username string) (float64, error) {
+	return ratingFrom(ctx, rdb, username)
+}
+
+func ratingFrom(ctx context.Context, c redis.Cmdable, username string) (float64, error) {
+	rating, err := c.ZScore(ctx, ratingsKey, username).Result()
+	if err == redis.Nil {
+		return defaultRating, nil
+	}
+	return rating, err
+}
+
+// placements orders a finished game's players from first to last: the
+// winner, then everyone else in reverse order of elimination, then anyone
+// who abandoned the game.
+func (g *GameState) placements() []string {
+	order := []string{}
+	if g.Winner != "" {
+		order = append(order, g.Winner)
+	}
+	for i := len(g.Eliminated) - 1; i >= 0; i-- {
+		if g.Eliminated[i] != g.Winner {
+			order = append(order, g.Eliminated[i])
+		}
+	}
+	for i := len(g.Abandoned) - 1; i >= 0; i-- {
+		order = append(order, g.Abandoned[i])
+	}
+	return order
+}
+
+// eloDeltas scores a multiplayer finish as a set of pairwise results where
+// each player beat everyone placed below them. K is split across opponents
+// so larger tables don't swing ratings harder.
+func eloDeltas(order []string, ratings map[string]float64) map[string]float64 {
+	deltas := make(map[string]float64, len(order))
+	if len(order) < 2 {
+		return deltas
+	}
+	k := ratingK / float64(len(order)-1)
+	for i, a := range order {
+		for _, b := range order[i+1:] {
+			expected := 1 / (1 + math.Pow(10, (ratings[b]-ratings[a])/400))
+			deltas[a] += k * (1 - expected)
+			deltas[b] -= k * (1 - expected)
+		}
+	}
+	return deltas
+}
+
+// updateRatings applies the ELO change for a finished multiplayer game.
+// Each game is only ever rated once: the rated marker is set in the same
+// transaction as the new ratings, which is retried if another game is
+// rated meanwhile. Only human players are rated.
+func updateRatings(ctx context.Context, g *GameState) error {
+	order := []string{}
+	for _, p := range g.placements() {
+		if !g.isBot(p) {
+			order = append(order, p)
+		}
+	}
+	if g.Status != GameFinished || len(g.Players) < 2 || len(order) < 2 {
+		return nil
+	}
+
+	key := ratedKey(g.ID)
+	for attempt := 0; attempt < ratingAttempts; attempt++ {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			rated, err := tx.Exists(ctx, key).Result()
+			if err != nil || rated > 0 {
+				return err
+			}
+			ratings := make(map[string]float64, len(order))
+			for _, p := range order {
+				if ratings[p], err = ratingFrom(ctx, tx, p); err != nil {
+					return err
+				}
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for p, delta := range eloDeltas(order, ratings) {
+					pipe.ZAdd(ctx, ratingsKey, &redis.Z{Score: math.Round(ratings[p] + delta), Member: p})
+				}
+				pipe.Set(ctx, key, 1, ratedTTL)
+				return nil
+			})
+			return err
+		}, key, ratingsKey)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errRatingBusy
+}
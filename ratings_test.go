@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestEloDeltas(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   []string
+		ratings map[string]float64
+		want    map[string]float64
+	}{
+		{
+			name:    "even pair",
+			order:   []string{"alice", "bob"},
+			ratings: map[string]float64{"alice": 1200, "bob": 1200},
+			want:    map[string]float64{"alice": 16, "bob": -16},
+		},
+		{
+			name:    "favourite wins",
+			order:   []string{"alice", "bob"},
+			ratings: map[string]float64{"alice": 1600, "bob": 1200},
+			want:    map[string]float64{"alice": 2.9, "bob": -2.9},
+		},
+		{
+			name:    "even table of three",
+			order:   []string{"alice", "bob", "carol"},
+			ratings: map[string]float64{"alice": 1200, "bob": 1200, "carol": 1200},
+			want:    map[string]float64{"alice": 16, "bob": 0, "carol": -16},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := eloDeltas(tt.order, tt.ratings)
+			for p, want := range tt.want {
+				if math.Abs(got[p]-want) > 0.05 {
+					t.Errorf("%s moves %.2f, want %.1f", p, got[p], want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateRatingsOnce(t *testing.T) {
+	ctx := context.Background()
+	mr := testRedis(t)
+	g := &GameState{
+		ID:         "g1",
+		Players:    []string{"alice", "bob"},
+		Eliminated: []string{"bob"},
+		Status:     GameFinished,
+		Winner:     "alice",
+	}
+	for i := 0; i < 2; i++ {
+		if err := updateRatings(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p, want := range map[string]float64{"alice": 1216, "bob": 1184} {
+		if got, err := getRating(ctx, p); err != nil || got != want {
+			t.Errorf("%s is rated %v (%v), want %v", p, got, err, want)
+		}
+	}
+	if ttl := mr.TTL(ratedKey(g.ID)); ttl != ratedTTL {
+		t.Errorf("rated marker expires in %v, want %v", ttl, ratedTTL)
+	}
+}
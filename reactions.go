@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+var (
+	errReactionNoRoom   = errors.New("reactions are only available inside a room")
+	errReactionReadOnly = errors.New("spectators cannot react")
+	errUnknownEmote     = errors.New("no such emote")
+	errReactionFlood    = errors.New("sending reactions too quickly")
+)
+
+// emotes are the reactions players can send. Clients draw them from the
+// ID, so new ones need a matching asset before they are added here.
+var emotes = []string{
+	"laugh", "cry", "angry", "shocked", "cool", "thinking",
+	"thumbs_up", "thumbs_down", "clap", "wave", "gg", "explode",
+}
+
+func knownEmote(id string) bool {
+	for _, e := range emotes {
+		if e == id {
+			return true
+		}
+	}
+	return false
+}
+
+// react shows an emote to everyone in the client's room. Like chat, it is
+// for seated players only, but nothing is kept once it has been sent.
+func (c *Client) react(ctx context.Context, emote string) error {
+	if c.room == lobbyRoom {
+		return errReactionNoRoom
+	}
+	if c.spectator {
+		return errReactionReadOnly
+	}
+	if !knownEmote(emote) {
+		return errUnknownEmote
+	}
+
+	allowed, _, err := reactionLimit.take(ctx, "user:"+c.username)
+	if err != nil {
+		slog.Error("checking rate limit", "bucket", reactionLimit.Name, "err", err)
+	} else if !allowed {
+		return errReactionFlood
+	}
+
+	hub.broadcast(ctx, c.room, EventReaction, map[string]interface{}{
+		"username": c.username,
+		"emote":    emote,
+	})
+	return nil
+}
+
+func listEmotes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(emotes)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	ConnectionConnected    = "connected"
+	ConnectionDisconnected = "disconnected"
+)
+
+const (
+	defaultReconnectGrace = 60 * time.Second
+	reconnectTokenTTL     = 24 * time.Hour
+	// backlogSize is how many recent events per room are kept for clients
+	// resuming after a dropped connection.
+	backlogSize = 200
+	backlogTTL  = 24 * time.Hour
+)
+
+// reconnectGrace is how long a dropped player's seat is held for them
+// before a room with backfill hands it to a bot. Set with RECONNECT_GRACE.
+var reconnectGrace = defaultReconnectGrace
+
+// ConnectionState is a seated player's last known connection status.
+type ConnectionState struct {
+	Status string    `json:"status"`
+	Since  time.Time `json:"since"`
+}
+
+// backlogEntry is a buffered event. Private events carry their recipient.
+type backlogEntry struct {
+	To    string          `json:"to,omitempty"`
+	Event json.RawMessage `json:"event"`
+}
+
+func reconnectKey(token string) string {
+	return fmt.Sprintf("reconnect:%s", token)
+}
+
+// reconnectTokensKey lists a player's outstanding reconnect tokens, so they
+// can all be revoked at once.
+func reconnectTokensKey(username string) string {
+	return fmt.Sprintf("player:%s:reconnect_tokens", username)
+}
+
+func connectionsKey(room string) string {
+	return fmt.Sprintf("room:%s:connections", room)
+}
+
+func backlogKey(room string) string {
+	return fmt.Sprintf("room:%s:backlog", room)
+}
+
+func backlogSeqKey(room string) string {
+	return fmt.Sprintf("room:%s:seq", room)
+}
+
+// encodeEvent numbers an event within its room and keeps a copy in the
+// room's backlog so it can be replayed to a client that missed it.
+func encodeEvent(ctx context.Context, ev *Event, to string) ([]byte, error) {
+	if ev.Room == "" || ev.Room == lobbyRoom {
+		return json.Marshal(ev)
+	}
+
+	seq, err := rdb.Incr(ctx, backlogSeqKey(ev.Room)).Result()
+	if err != nil {
+		slog.Error("sequencing event", "room", ev.Room, "err", err)
+		return json.Marshal(ev)
+	}
+	ev.Seq = seq
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, _ := json.Marshal(backlogEntry{To: to, Event: data})
+	pipe := rdb.TxPipeline()
+	pipe.RPush(ctx, backlogKey(ev.Room), entry)
+	pipe.LTrim(ctx, backlogKey(ev.Room), -backlogSize, -1)
+	pipe.Expire(ctx, backlogKey(ev.Room), backlogTTL)
+	pipe.Expire(ctx, backlogSeqKey(ev.Room), backlogTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("buffering event", "room", ev.Room, "err", err)
+	}
+	return data, nil
+}
+
+// missedEvents returns the buffered events after seq that username is
+// allowed to see.
+func missedEvents(ctx context.Context, room, username string, since int64) ([][]byte, error) {
+	raw, err := rdb.LRange(ctx, backlogKey(room), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	missed := [][]byte{}
+	for _, item := range raw {
+		var entry backlogEntry
+		var ev Event
+		if json.Unmarshal([]byte(item), &entry) != nil || json.Unmarshal(entry.Event, &ev) != nil {
+			continue
+		}
+		if ev.Seq <= since || (entry.To != "" && entry.To != username) {
+			continue
+		}
+		missed = append(missed, entry.Event)
+	}
+	return missed, nil
+}
+
+// issueReconnectToken hands a seated client a single-use token it can
+// resume its session with after the connection drops.
+func issueReconnectToken(ctx context.Context, room, username string) (string, error) {
+	token := randomToken()
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, reconnectKey(token), "room", room, "username", username)
+	pipe.Expire(ctx, reconnectKey(token), reconnectTokenTTL)
+	pipe.SAdd(ctx, reconnectTokensKey(username), token)
+	pipe.Expire(ctx, reconnectTokensKey(username), reconnectTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeReconnectTokens deletes every reconnect token issued to a player,
+// so a kicked session can't resume.
+func revokeReconnectTokens(ctx context.Context, username string) error {
+	tokens, err := rdb.SMembers(ctx, reconnectTokensKey(username)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{reconnectTokensKey(username)}
+	for _, token := range tokens {
+		keys = append(keys, reconnectKey(token))
+	}
+	return rdb.Del(ctx, keys...).Err()
+}
+
+// seatedIn reports whether username still holds a seat in room, which is
+// a room ID or, for games played without a room, the game ID.
+func seatedIn(ctx context.Context, room, username string) (bool, error) {
+	rm, err := loadRoom(ctx, room)
+	if err == nil {
+		return rm.hasPlayer(username), nil
+	}
+	if err != errRoomNotFound {
+		return false, err
+	}
+	g, err := loadGame(ctx, room)
+	if err == errGameNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return g.hasPlayer(username), nil
+}
+
+func setConnectionState(ctx context.Context, room, username, status string) {
+	data, _ := json.Marshal(ConnectionState{Status: status, Since: time.Now().UTC()})
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, connectionsKey(room), username, data)
+	pipe.Expire(ctx, connectionsKey(room), backlogTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("saving connection state", "username", username, "room", room, "err", err)
+		return
+	}
+	hub.broadcast(ctx, room, EventConnectionChanged, map[string]interface{}{
+		"username": username,
+		"status":   status,
+	})
+}
+
+func connectionState(ctx context.Context, room, username string) string {
+	data, err := rdb.HGet(ctx, connectionsKey(room), username).Bytes()
+	if err != nil {
+		return ""
+	}
+	var st ConnectionState
+	json.Unmarshal(data, &st)
+	return st.Status
+}
+
+// playerDisconnected records a dropped seat and starts its grace period,
+// unless the player still has another connection open here or on another
+// instance.
+func playerDisconnected(ctx context.Context, room, username string) {
+	if hub.connected(room, username) {
+		return
+	}
+	if connected, err := seatConnected(ctx, room, username); err != nil {
+		slog.Error("checking connections", "username", username, "room", room, "err", err)
+	} else if connected {
+		return
+	}
+	setConnectionState(ctx, room, username, ConnectionDisconnected)
+	watchAbandon(ctx, room, username)
+}
+
+// connectClient upgrades the request and subscribes it to room. Resuming
+// clients first receive every event they missed after since; events can
+// arrive twice around the resume point, so clients should skip any seq
+// they have already seen.
+func connectClient(w http.ResponseWriter, r *http.Request, room, username string, spectator, resume bool, since int64) {
+	ctx := r.Context()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logFor(r).Warn("websocket upgrade failed", "err", err)
+		return
+	}
+
+	c := &Client{
+		id:        newID(),
+		hub:       hub,
+		conn:      conn,
+		room:      room,
+		username:  username,
+		send:      make(chan []byte, sendBufferSize),
+		spectator: spectator,
+	}
+	hub.register(ctx, c)
+	touchPresence(ctx, c)
+
+	if resume {
+		missed, err := missedEvents(ctx, room, username, since)
+		if err != nil {
+			slog.Error("loading backlog", "room", room, "err", err)
+		}
+		for _, data := range missed {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				break
+			}
+		}
+	}
+
+	go c.writePump()
+	// The connection outlives the upgrade request, so its reads must not be
+	// cancelled along with it.
+	go c.readPump(context.WithoutCancel(ctx))
+
+	if spectator || room == lobbyRoom {
+		return
+	}
+	token, err := issueReconnectToken(ctx, room, username)
+	if err != nil {
+		slog.Error("issuing reconnect token", "username", username, "err", err)
+	} else {
+		hub.notify(ctx, room, username, EventSession, map[string]interface{}{
+			"reconnect_token": token,
+			"grace_seconds":   int(reconnectGrace.Seconds()),
+		})
+	}
+	setConnectionState(ctx, room, username, ConnectionConnected)
+}
+
+// joinGameStream subscribes a stream without a websocket, for gRPC or
+// server-sent events, to a game's room in the hub as connectClient does,
+// and returns the buffered events it missed after since. cancel ends the
+// stream when the hub disconnects it.
+func joinGameStream(ctx context.Context, username, gameID string, since int64, cancel context.CancelCauseFunc) (*Client, *GameState, [][]byte, error) {
+	g, err := loadGame(ctx, gameID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !g.hasPlayer(username) {
+		return nil, nil, nil, errNotInGame
+	}
+	room := g.channel()
+	var missed [][]byte
+	if since > 0 {
+		if missed, err = missedEvents(ctx, room, username, since); err != nil {
+			slog.Error("loading backlog", "room", room, "err", err)
+		}
+	}
+
+	client := &Client{
+		id:       newID(),
+		hub:      hub,
+		room:     room,
+		username: username,
+		send:     make(chan []byte, sendBufferSize),
+		cancel:   cancel,
+	}
+	hub.register(ctx, client)
+	touchPresence(ctx, client)
+	setConnectionState(ctx, room, username, ConnectionConnected)
+	return client, g, missed, nil
+}
+
+// leaveGameStream is readPump's cleanup for a stream.
+func leaveGameStream(ctx context.Context, client *Client) {
+	hub.unregister(ctx, client)
+	if hub.closing.Load() {
+		return
+	}
+	dropPresence(ctx, client)
+	playerDisconnected(ctx, client.room, client.username)
+}
+
+// resumeWs reattaches a dropped client using the reconnect token from its
+// last session instead of an access token, which may have expired while
+// the device was offline. The token only stands in for the access token,
+// so the account must still exist, be unbanned and hold its seat.
+func resumeWs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := r.URL.Query().Get("reconnect_token")
+	if token == "" {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "reconnect_token is required")
+		return
+	}
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+
+	pipe := rdb.TxPipeline()
+	fields := pipe.HGetAll(ctx, reconnectKey(token))
+	pipe.Del(ctx, reconnectKey(token))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		respondInternal(w, r, err, "Error resuming session")
+		return
+	}
+	room, username := fields.Val()["room"], fields.Val()["username"]
+	if room == "" || username == "" {
+		respondError(w, r, http.StatusUnauthorized, errInvalidToken)
+		return
+	}
+	rdb.SRem(ctx, reconnectTokensKey(username), token)
+
+	if ban, err := loadBan(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error checking account")
+		return
+	} else if ban != nil {
+		respondBanned(w, r, ban)
+		return
+	}
+	if exists, err := users.UserExists(ctx, username); err != nil {
+		respondInternal(w, r, err, "Error checking account")
+		return
+	} else if !exists {
+		respondError(w, r, http.StatusUnauthorized, errInvalidToken)
+		return
+	}
+	if seated, err := seatedIn(ctx, room, username); err != nil {
+		respondInternal(w, r, err, "Error resuming session")
+		return
+	} else if !seated {
+		respondError(w, r, http.StatusForbidden, errNotInGame)
+		return
+	}
+
+	setRequestUser(r, username)
+	connectClient(w, r, room, username, false, true, since)
+}
+
+func getRoomConnections(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	raw, err := rdb.HGetAll(ctx, connectionsKey(mux.Vars(r)["id"])).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading connections")
+		return
+	}
+
+	states := make(map[string]ConnectionState, len(raw))
+	for username, data := range raw {
+		var st ConnectionState
+		if json.Unmarshal([]byte(data), &st) == nil {
+			states[username] = st
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
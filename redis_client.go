@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis deployments REDIS_MODE can name.
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// newRedisClient connects to Redis as REDIS_MODE says:
+//
+//   - standalone (the default) talks to the server at ADDRESS.
+//   - sentinel asks the sentinels in REDIS_ADDRS, a comma-separated list,
+//     for the master of REDIS_MASTER_NAME, and follows it on failover.
+//     SENTINEL_PASSWORD authenticates with the sentinels themselves.
+//
+// Cluster mode is refused: scripts and transactions touch keys, such as a
+// player's coins and inventory or a game's markers and the leaderboards,
+// that a cluster would spread over different slots.
+//
+// PASSWORD authenticates with Redis in every mode, as the ACL user
+// REDIS_USERNAME when set. REDIS_DB picks the database, and REDIS_TLS=true
+// connects over TLS (see redisTLSConfig). loadConfig has already checked
+// the settings fit together.
+func newRedisClient(rc RedisConfig) redis.UniversalClient {
+	tlsConfig, err := redisTLSConfig(rc)
+	if err != nil {
+		fatal("configuring Redis TLS", "err", err)
+	}
+	retries := rc.MaxRetries
+	if retries == 0 {
+		retries = -1 // go-redis reads 0 as its default of 3
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:            rc.Addrs,
+		DB:               rc.DB,
+		Username:         rc.Username,
+		Password:         rc.Password,
+		MasterName:       rc.MasterName,
+		SentinelPassword: rc.SentinelPassword,
+		TLSConfig:        tlsConfig,
+		MaxRetries:       retries,
+		MinRetryBackoff:  rc.RetryBackoff,
+		MaxRetryBackoff:  rc.MaxRetryBackoff,
+	}
+
+	switch rc.Mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(opts.Failover())
+	default:
+		return redis.NewClient(opts.Simple())
+	}
+}
+
+// redisTLSConfig is nil unless REDIS_TLS=true. REDIS_CA_CERT names a PEM
+// file of CAs to trust in place of the system's, for providers with a
+// private CA, and REDIS_CLIENT_CERT and REDIS_CLIENT_KEY a certificate to
+// present to servers that require one.
+func redisTLSConfig(rc RedisConfig) (*tls.Config, error) {
+	if !rc.TLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if rc.CACert != "" {
+		pem, err := os.ReadFile(rc.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", rc.CACert)
+		}
+	}
+
+	if rc.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(rc.ClientCert, rc.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
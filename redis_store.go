@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// recordAttempts bounds how often recording a game is retried after a
+// participant's stats changed underneath it.
+const recordAttempts = 5
+
+var errHistoryBusy = errors.New("stats kept changing while recording the game")
+
+// RedisStore implements the storage interfaces on top of a Redis client.
+// Accounts are hashes at account:<name>, games are JSON blobs at
+// game:<id> and each leaderboard is a sorted set named after the board.
+type RedisStore struct {
+	client redis.UniversalClient
+}
+
+func newRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) CreateUser(ctx context.Context, username, passwordHash string) error {
+	created, err := s.client.HSetNX(ctx, accountKey(username), "password_hash", passwordHash).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return errUsernameTaken
+	}
+	return s.client.HSet(ctx, accountKey(username), "created_at", time.Now().UTC().Format(time.RFC3339)).Err()
+}
+
+func (s *RedisStore) CreateGuest(ctx context.Context, username string, ttl time.Duration) error {
+	created, err := s.client.HSetNX(ctx, accountKey(username), "guest", "1").Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return errUsernameTaken
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, accountKey(username), "created_at", time.Now().UTC().Format(time.RFC3339))
+	pipe.Expire(ctx, accountKey(username), ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) PasswordHash(ctx context.Context, username string) (string, error) {
+	hash, err := s.client.HGet(ctx, accountKey(username), "password_hash").Result()
+	if err == redis.Nil {
+		return "", errUserNotFound
+	}
+	return hash, err
+}
+
+func (s *RedisStore) SetPasswordHash(ctx context.Context, username, passwordHash string) error {
+	if _, err := s.PasswordHash(ctx, username); err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, accountKey(username), "password_hash", passwordHash).Err()
+}
+
+func (s *RedisStore) UserExists(ctx context.Context, username string) (bool, error) {
+	n, err := s.client.Exists(ctx, accountKey(username)).Result()
+	return n > 0, err
+}
+
+func (s *RedisStore) IsGuest(ctx context.Context, username string) (bool, error) {
+	flag, err := s.client.HGet(ctx, accountKey(username), "guest").Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return flag == "1", nil
+}
+
+func (s *RedisStore) DeleteUser(ctx context.Context, username string) error {
+	return s.client.Del(ctx, accountKey(username)).Err()
+}
+
+func (s *RedisStore) RenameUser(ctx context.Context, from, to string) error {
+	exists, err := s.client.Exists(ctx, accountKey(from)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errUserNotFound
+	}
+	renamed, err := s.client.RenameNX(ctx, accountKey(from), accountKey(to)).Result()
+	if err != nil {
+		return err
+	}
+	if !renamed {
+		return errUsernameTaken
+	}
+	return nil
+}
+
+func (s *RedisStore) Role(ctx context.Context, username string) (string, error) {
+	role, err := s.client.HGet(ctx, accountKey(username), "role").Result()
+	if err == nil {
+		return role, nil
+	}
+	if err != redis.Nil {
+		return "", err
+	}
+	exists, err := s.UserExists(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errUserNotFound
+	}
+	return RolePlayer, nil
+}
+
+func (s *RedisStore) SetRole(ctx context.Context, username, role string) error {
+	n, err := s.client.Exists(ctx, accountKey(username)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUserNotFound
+	}
+	return s.client.HSet(ctx, accountKey(username), "role", role).Err()
+}
+
+func (s *RedisStore) Profile(ctx context.Context, username string) (*Profile, error) {
+	fields, err := s.client.HGetAll(ctx, accountKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errUserNotFound
+	}
+	return &Profile{Avatar: fields["avatar"], Bio: fields["bio"], FavoriteCard: fields["favorite_card"]}, nil
+}
+
+func (s *RedisStore) SetProfile(ctx context.Context, username string, p *Profile) error {
+	n, err := s.client.Exists(ctx, accountKey(username)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUserNotFound
+	}
+	return s.client.HSet(ctx, accountKey(username),
+		"avatar", p.Avatar,
+		"bio", p.Bio,
+		"favorite_card", p.FavoriteCard,
+	).Err()
+}
+
+// SearchUsers scans the account keys, so it is meant for the occasional
+// admin lookup rather than anything players can call.
+func (s *RedisStore) SearchUsers(ctx context.Context, prefix string, limit, offset int) ([]Account, int64, error) {
+	prefix = strings.ToLower(prefix)
+	names := []string{}
+	err := scanBatches(ctx, s.client, accountKey("*"), func(keys []string) error {
+		for _, key := range keys {
+			name := strings.TrimPrefix(key, accountKey(""))
+			if strings.HasPrefix(strings.ToLower(name), prefix) {
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(names)
+
+	total := int64(len(names))
+	if offset >= len(names) {
+		return []Account{}, total, nil
+	}
+	names = names[offset:]
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.HGetAll(ctx, accountKey(name))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+	accounts := make([]Account, 0, len(names))
+	for i, name := range names {
+		accounts = append(accounts, *accountFromHash(name, cmds[i].Val()))
+	}
+	return accounts, total, nil
+}
+
+func (s *RedisStore) LoadAccount(ctx context.Context, username string) (*Account, error) {
+	fields, err := s.client.HGetAll(ctx, accountKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errUserNotFound
+	}
+	return accountFromHash(username, fields), nil
+}
+
+func accountFromHash(username string, fields map[string]string) *Account {
+	a := &Account{Username: username, Role: fields["role"], Guest: fields["guest"] == "1"}
+	if a.Role == "" {
+		a.Role = RolePlayer
+	}
+	a.CreatedAt, _ = time.Parse(time.RFC3339, fields["created_at"])
+	return a
+}
+
+func (s *RedisStore) LoadGame(ctx context.Context, id string) (*GameState, error) {
+	data, err := s.client.Get(ctx, gameKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, errGameNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var g GameState
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *RedisStore) SaveGame(ctx context.Context, g *GameState) error {
+	key := gameKey(g.ID)
+	next := *g
+	next.Version++
+	next.UpdatedAt = time.Now().UTC()
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err := checkStoredVersion(data, g.Version); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(&next); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, next.ttl())
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return errStaleVersion
+	}
+	if err == nil {
+		g.Version, g.UpdatedAt = next.Version, next.UpdatedAt
+	}
+	return err
+}
+
+// maxUpdateAttempts bounds how often UpdateGame retries after another
+// writer changed the game underneath it.
+const maxUpdateAttempts = 5
+
+func (s *RedisStore) UpdateGame(ctx context.Context, id string, change func(g *GameState) error) (*GameState, error) {
+	key := gameKey(id)
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var g GameState
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if err == redis.Nil {
+				return errGameNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &g); err != nil {
+				return err
+			}
+			if err := change(&g); err != nil {
+				return err
+			}
+			g.Version++
+			g.UpdatedAt = time.Now().UTC()
+			if data, err = json.Marshal(&g); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, g.ttl())
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &g, nil
+	}
+	return nil, errGameBusy
+}
+
+func (s *RedisStore) DeleteGame(ctx context.Context, id string) error {
+	return s.client.Del(ctx, gameKey(id)).Err()
+}
+
+func (s *RedisStore) AddPlayer(ctx context.Context, board, username string) error {
+	return s.client.ZAddNX(ctx, board, &redis.Z{Score: 0, Member: username}).Err()
+}
+
+func (s *RedisStore) IncrementScore(ctx context.Context, username string, by int, boards ...string) error {
+	pipe := s.client.TxPipeline()
+	for _, board := range boards {
+		pipe.ZIncrBy(ctx, board, float64(by), username)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// incrementScoreOnce sets the marker at KEYS[1] and adds ARGV[3] to
+// ARGV[1]'s score on every board in KEYS[2:], unless the marker is already
+// set. ARGV[2] is how long the marker lasts, in milliseconds.
+var incrementScoreOnce = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 0
+end
+for i = 2, #KEYS do
+	redis.call('ZINCRBY', KEYS[i], ARGV[3], ARGV[1])
+end
+return 1
+`)
+
+func (s *RedisStore) IncrementScoreOnce(ctx context.Context, marker string, keep time.Duration, username string, by int, boards ...string) (bool, error) {
+	keys := append([]string{marker}, boards...)
+	added, err := incrementScoreOnce.Run(ctx, s.client, keys, username, keep.Milliseconds(), by).Int()
+	return added == 1, err
+}
+
+func (s *RedisStore) SetScore(ctx context.Context, board, username string, score int) error {
+	return s.client.ZAdd(ctx, board, &redis.Z{Score: float64(score), Member: username}).Err()
+}
+
+func (s *RedisStore) Score(ctx context.Context, board, username string) (int, error) {
+	score, err := s.client.ZScore(ctx, board, username).Result()
+	if err == redis.Nil {
+		return 0, errNotRanked
+	}
+	return int(score), err
+}
+
+func (s *RedisStore) RemovePlayer(ctx context.Context, board, username string) error {
+	return s.client.ZRem(ctx, board, username).Err()
+}
+
+func (s *RedisStore) Count(ctx context.Context, board string) (int64, error) {
+	return s.client.ZCard(ctx, board).Result()
+}
+
+func (s *RedisStore) Range(ctx context.Context, board string, start, stop int64) ([]Player, error) {
+	entries, err := s.client.ZRevRangeWithScores(ctx, board, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	players := []Player{}
+	for i, z := range entries {
+		players = append(players, Player{
+			Username: z.Member.(string),
+			Score:    int(z.Score),
+			Rank:     int(start) + i + 1,
+		})
+	}
+	return players, nil
+}
+
+func (s *RedisStore) Rank(ctx context.Context, board, username string) (int64, error) {
+	rank, err := s.client.ZRevRank(ctx, board, username).Result()
+	if err == redis.Nil {
+		return 0, errNotRanked
+	}
+	return rank, err
+}
+
+// RecordGame writes the record in the same transaction as the stats, and
+// retries if a participant's stats change meanwhile, so a game is counted
+// exactly once even if recording it fails part way and is tried again.
+func (s *RedisStore) RecordGame(ctx context.Context, record *GameRecord, participants []string) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{historyKey(record.ID)}
+	for _, p := range participants {
+		keys = append(keys, statsKey(p))
+	}
+	for attempt := 0; attempt < recordAttempts; attempt++ {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			recorded, err := tx.Exists(ctx, historyKey(record.ID)).Result()
+			if err != nil || recorded > 0 {
+				return err
+			}
+			streaks := make(map[string]streak, len(participants))
+			for _, p := range participants {
+				if streaks[p], err = streakFrom(ctx, tx, p); err != nil {
+					return err
+				}
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, historyKey(record.ID), data, 0)
+				for _, p := range participants {
+					st := record.Stats[p]
+					pipe.ZAdd(ctx, playerHistoryKey(p), &redis.Z{Score: float64(record.FinishedAt.Unix()), Member: record.ID})
+					pipe.HIncrBy(ctx, statsKey(p), "games_played", 1)
+					pipe.HIncrBy(ctx, statsKey(p), "cards_drawn", int64(st.CardsDrawn))
+					pipe.HIncrBy(ctx, statsKey(p), "defused", int64(st.Defused))
+					if st.Forfeited {
+						pipe.HIncrBy(ctx, statsKey(p), "forfeits", 1)
+					}
+					if p != record.Winner {
+						pipe.HIncrBy(ctx, statsKey(p), "losses", 1)
+						pipe.HSet(ctx, statsKey(p), "current_streak", 0)
+						continue
+					}
+					pipe.HIncrBy(ctx, statsKey(p), "wins", 1)
+					current, longest := streaks[p].current+1, streaks[p].longest
+					if current > longest {
+						longest = current
+					}
+					pipe.HSet(ctx, statsKey(p), "current_streak", current, "longest_streak", longest)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errHistoryBusy
+}
+
+// streak is a player's current and longest run of wins.
+type streak struct {
+	current, longest int64
+}
+
+func streakFrom(ctx context.Context, c redis.Cmdable, username string) (streak, error) {
+	var st streak
+	vals, err := c.HMGet(ctx, statsKey(username), "current_streak", "longest_streak").Result()
+	if err != nil {
+		return st, err
+	}
+	parse := func(v interface{}) int64 {
+		s, _ := v.(string)
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	st.current, st.longest = parse(vals[0]), parse(vals[1])
+	return st, nil
+}
+
+func (s *RedisStore) PlayerStats(ctx context.Context, username string) (*PlayerStats, error) {
+	fields, err := s.client.HGetAll(ctx, statsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	atoi := func(key string) int {
+		n, _ := strconv.Atoi(fields[key])
+		return n
+	}
+	st := &PlayerStats{
+		Username:      username,
+		GamesPlayed:   atoi("games_played"),
+		Wins:          atoi("wins"),
+		Losses:        atoi("losses"),
+		CardsDrawn:    atoi("cards_drawn"),
+		Defused:       atoi("defused"),
+		Forfeits:      atoi("forfeits"),
+		CurrentStreak: atoi("current_streak"),
+		LongestStreak: atoi("longest_streak"),
+	}
+	st.fillWinRate()
+	return st, nil
+}
+
+func (s *RedisStore) CurrentStreaks(ctx context.Context, usernames []string) (map[string]int, error) {
+	streaks := make(map[string]int, len(usernames))
+	if len(usernames) == 0 {
+		return streaks, nil
+	}
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(usernames))
+	for i, username := range usernames {
+		cmds[i] = pipe.HGet(ctx, statsKey(username), "current_streak")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, username := range usernames {
+		streaks[username], _ = cmds[i].Int()
+	}
+	return streaks, nil
+}
+
+func (s *RedisStore) PlayerGames(ctx context.Context, username string, limit, offset int) ([]GameRecord, int64, error) {
+	total, err := s.client.ZCard(ctx, playerHistoryKey(username)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := []GameRecord{}
+	if limit <= 0 {
+		return records, total, nil
+	}
+	ids, err := s.client.ZRevRange(ctx, playerHistoryKey(username), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ids) == 0 {
+		return records, total, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = historyKey(id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var record GameRecord
+		if json.Unmarshal([]byte(data), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, total, nil
+}
+
+func (s *RedisStore) MoveHistory(ctx context.Context, from, to string) error {
+	for _, keys := range [][2]string{
+		{playerHistoryKey(from), playerHistoryKey(to)},
+		{statsKey(from), statsKey(to)},
+	} {
+		exists, err := s.client.Exists(ctx, keys[0]).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			continue
+		}
+		if err := s.client.Rename(ctx, keys[0], keys[1]).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) DeleteHistory(ctx context.Context, username string) error {
+	return s.client.Del(ctx, playerHistoryKey(username), statsKey(username)).Err()
+}
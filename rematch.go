@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	RematchNone     = "none"
+	RematchPending  = "pending"
+	RematchDeclined = "declined"
+	RematchStarted  = "started"
+)
+
+const (
+	// rematchTTL is how long an offer of a rematch stays open.
+	rematchTTL        = 10 * time.Minute
+	rematchVotePrefix = "vote:"
+)
+
+var (
+	errGameNotFinished = errors.New("game has not finished yet")
+	errRematchDeclined = errors.New("rematch was declined")
+)
+
+// RematchRequest is a participant's vote. Leaving Accept out accepts.
+type RematchRequest struct {
+	Accept *bool `json:"accept"`
+}
+
+// Rematch is where an offer to play a finished game again stands. Bots
+// always accept, so only human players vote.
+type Rematch struct {
+	GameID    string          `json:"game_id"`
+	Status    string          `json:"status"`
+	Votes     map[string]bool `json:"votes"`
+	Waiting   []string        `json:"waiting"`
+	RoomID    string          `json:"room_id,omitempty"`
+	NewGameID string          `json:"new_game_id,omitempty"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+func rematchKey(gameID string) string {
+	return fmt.Sprintf("game:%s:rematch", gameID)
+}
+
+// humanPlayers lists the players who get a say in a rematch.
+func (g *GameState) humanPlayers() []string {
+	humans := []string{}
+	for _, p := range g.Players {
+		if !g.isBot(p) {
+			humans = append(humans, p)
+		}
+	}
+	return humans
+}
+
+func loadRematch(ctx context.Context, g *GameState) (*Rematch, error) {
+	key := rematchKey(g.ID)
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Rematch{
+		GameID:    g.ID,
+		Status:    RematchNone,
+		Votes:     map[string]bool{},
+		Waiting:   []string{},
+		RoomID:    fields["room"],
+		NewGameID: fields["game"],
+	}
+	for field, vote := range fields {
+		if username, ok := strings.CutPrefix(field, rematchVotePrefix); ok {
+			m.Votes[username] = vote == "1"
+		}
+	}
+	for _, p := range g.humanPlayers() {
+		if _, ok := m.Votes[p]; !ok {
+			m.Waiting = append(m.Waiting, p)
+		}
+	}
+
+	switch {
+	case m.NewGameID != "":
+		m.Status = RematchStarted
+	case len(m.Votes) == 0:
+		return m, nil
+	default:
+		m.Status = RematchPending
+		for _, accepted := range m.Votes {
+			if !accepted {
+				m.Status = RematchDeclined
+			}
+		}
+	}
+	if ttl, err := rdb.TTL(ctx, key).Result(); err == nil && ttl > 0 {
+		at := time.Now().Add(ttl).UTC()
+		m.ExpiresAt = &at
+	}
+	return m, nil
+}
+
+// startRematch seats the same players at a fresh table with the settings
+// of the room they just played in. Bots come back as new bots of the same
+// difficulty.
+func startRematch(ctx context.Context, g *GameState) (*Room, *GameState, error) {
+	if g.RoomID == "" {
+		next := newGame("", g.Players, g.Rules)
+		if err := saveGame(ctx, next); err != nil {
+			return nil, nil, err
+		}
+		recordGameStart(ctx, next)
+		trackActiveGame(ctx, next)
+		return nil, next, nil
+	}
+
+	old, err := loadRoom(ctx, g.RoomID)
+	if err == errRoomNotFound {
+		old = &Room{Capacity: len(g.Players)}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	room := &Room{
+		ID:        newID(),
+		Players:   []string{},
+		Capacity:  old.Capacity,
+		Backfill:  old.Backfill,
+		Private:   old.Private,
+		Rules:     old.Rules,
+		Status:    RoomWaiting,
+		CreatedAt: time.Now().UTC(),
+	}
+	if room.Private {
+		if err := assignJoinCode(ctx, room); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, p := range g.Players {
+		if !g.isBot(p) {
+			room.Players = append(room.Players, p)
+			continue
+		}
+		for bot, difficulty := range newBots(1, g.Bots[p]) {
+			if room.Bots == nil {
+				room.Bots = map[string]string{}
+			}
+			room.Bots[bot] = difficulty
+			room.Players = append(room.Players, bot)
+		}
+	}
+	room.Owner = g.humanPlayers()[0]
+	if old.Owner != "" && room.hasPlayer(old.Owner) {
+		room.Owner = old.Owner
+	}
+	if room.Capacity < len(room.Players) {
+		room.Capacity = len(room.Players)
+	}
+
+	next, err := room.start(room.Owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := saveGame(ctx, next); err != nil {
+		return nil, nil, err
+	}
+	if err := saveRoom(ctx, room); err != nil {
+		return nil, nil, err
+	}
+	recordGameStart(ctx, next)
+	trackActiveGame(ctx, next)
+	return room, next, nil
+}
+
+func getRematch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := loadGame(ctx, mux.Vars(r)["id"])
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading game")
+		return
+	}
+
+	m, err := loadRematch(ctx, g)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading rematch")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// voteRematch proposes a rematch of a finished game or answers one already
+// proposed. Once every player has accepted, the new game starts straight
+// away; a single decline calls it off.
+func voteRematch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req RematchRequest
+	if err := decodeJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		respondPayload(w, r, err)
+		return
+	}
+	accept := req.Accept == nil || *req.Accept
+
+	g, err := loadGame(ctx, mux.Vars(r)["id"])
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading game")
+		return
+	}
+	if !g.hasPlayer(username) || g.isBot(username) {
+		respondError(w, r, http.StatusForbidden, errNotInGame)
+		return
+	}
+	if g.Status != GameFinished {
+		respondError(w, r, http.StatusConflict, errGameNotFinished)
+		return
+	}
+
+	m, err := loadRematch(ctx, g)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading rematch")
+		return
+	}
+	switch m.Status {
+	case RematchDeclined:
+		respondError(w, r, http.StatusConflict, errRematchDeclined)
+		return
+	case RematchStarted:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+		return
+	}
+
+	vote := "0"
+	if accept {
+		vote = "1"
+	}
+	key := rematchKey(g.ID)
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, key, rematchVotePrefix+username, vote)
+	if m.Status == RematchNone {
+		pipe.Expire(ctx, key, rematchTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error recording vote")
+		return
+	}
+
+	switch {
+	case !accept:
+		hub.broadcast(ctx, g.channel(), EventRematchDeclined, map[string]interface{}{"username": username})
+	case m.Status == RematchNone:
+		hub.broadcast(ctx, g.channel(), EventRematchProposed, map[string]interface{}{
+			"username":   username,
+			"expires_in": int(rematchTTL.Seconds()),
+		})
+	default:
+		hub.broadcast(ctx, g.channel(), EventRematchAccepted, map[string]interface{}{"username": username})
+	}
+
+	if m, err = loadRematch(ctx, g); err != nil {
+		respondInternal(w, r, err, "Error loading rematch")
+		return
+	}
+	if m.Status == RematchPending && len(m.Waiting) == 0 {
+		m, err = launchRematch(ctx, g)
+		if err != nil {
+			logFor(r).Error("starting rematch", "game", g.ID, "err", err)
+			respondInternal(w, r, err, "Error starting rematch")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// launchRematch starts the new game once. When the last two votes land
+// together only one of them gets to start it.
+func launchRematch(ctx context.Context, g *GameState) (*Rematch, error) {
+	key := rematchKey(g.ID)
+	claimed, err := rdb.HSetNX(ctx, key, "launching", "1").Result()
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return loadRematch(ctx, g)
+	}
+
+	room, next, err := startRematch(ctx, g)
+	if err != nil {
+		rdb.HDel(ctx, key, "launching")
+		return nil, err
+	}
+	roomID := ""
+	if room != nil {
+		roomID = room.ID
+	}
+	if err := rdb.HSet(ctx, key, "room", roomID, "game", next.ID).Err(); err != nil {
+		slog.Error("recording rematch", "game", g.ID, "err", err)
+	}
+
+	hub.broadcast(ctx, g.channel(), EventRematchStarted, map[string]interface{}{
+		"room_id": roomID,
+		"game_id": next.ID,
+		"players": next.Players,
+	})
+	publishTurn(ctx, next)
+	return loadRematch(ctx, g)
+}
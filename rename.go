@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// usernameChangeCooldown is how long a player must wait between name
+// changes, so names can't be cycled to shake off reports.
+const usernameChangeCooldown = 30 * 24 * time.Hour
+
+var (
+	errSameUsername   = errors.New("that is already your username")
+	errGuestRename    = errors.New("guests choose a name by upgrading their account")
+	errRenameBusy     = errors.New("leave matchmaking and finish your games before changing your name")
+	errRenameCooldown = errors.New("username was changed too recently")
+)
+
+type UsernameChangeRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// UsernameChange is one entry in an account's rename history.
+type UsernameChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// renamesKey lists an account's name changes, oldest first. It moves with
+// the account so moderators can trace a player back through old names.
+func renamesKey(username string) string {
+	return fmt.Sprintf("player:%s:renames", username)
+}
+
+func usernameChanges(ctx context.Context, username string) ([]UsernameChange, error) {
+	raw, err := rdb.LRange(ctx, renamesKey(username), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	changes := []UsernameChange{}
+	for _, item := range raw {
+		var change UsernameChange
+		if json.Unmarshal([]byte(item), &change) == nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// nextUsernameChange returns when the player may next change their name,
+// or the zero time if they may now.
+func nextUsernameChange(ctx context.Context, username string) (time.Time, error) {
+	raw, err := rdb.LIndex(ctx, renamesKey(username), -1).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last UsernameChange
+	if err := json.Unmarshal([]byte(raw), &last); err != nil {
+		return time.Time{}, nil
+	}
+	next := last.ChangedAt.Add(usernameChangeCooldown)
+	if time.Now().After(next) {
+		return time.Time{}, nil
+	}
+	return next, nil
+}
+
+// playing reports whether a player is queued for a match or seated in a
+// game that has not finished. Games hold their players' names, so those
+// must be settled before a rename.
+func playing(ctx context.Context, username string) (bool, error) {
+	_, err := rdb.ZScore(ctx, matchQueueKey, username).Result()
+	if err == nil {
+		return true, nil
+	}
+	if err != redis.Nil {
+		return false, err
+	}
+	ids, err := rdb.ZRange(ctx, activeGamesKey(username), 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		g, err := loadGame(ctx, id)
+		if err == errGameNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if g.Status != GameFinished && g.hasPlayer(username) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// moveScores carries a player's standing on every leaderboard, their
+// rating and their XP over to a new name.
+func moveScores(ctx context.Context, from, to string) error {
+	seasons, err := seasonIDs(ctx)
+	if err != nil {
+		return err
+	}
+	boards := []string{leaderboardKey}
+	for _, id := range seasons {
+		boards = append(boards, seasonLeaderboardKey(id))
+	}
+	for _, board := range boards {
+		score, err := leaderboards.Score(ctx, board, from)
+		if err == errNotRanked {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := leaderboards.SetScore(ctx, board, to, score); err != nil {
+			return err
+		}
+		if err := leaderboards.RemovePlayer(ctx, board, from); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{ratingsKey, xpKey} {
+		score, err := rdb.ZScore(ctx, key, from).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pipe := rdb.TxPipeline()
+		pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: to})
+		pipe.ZRem(ctx, key, from)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFriendships points the player's friends and pending requests at the
+// new name, keeping when each request was sent.
+func moveFriendships(ctx context.Context, from, to string) error {
+	friends, err := rdb.SMembers(ctx, friendsKey(from)).Result()
+	if err != nil {
+		return err
+	}
+	incoming, err := rdb.ZRangeWithScores(ctx, friendRequestsKey(from), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	outgoing, err := rdb.ZRangeWithScores(ctx, sentRequestsKey(from), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, friend := range friends {
+		pipe.SRem(ctx, friendsKey(friend), from)
+		pipe.SAdd(ctx, friendsKey(friend), to)
+	}
+	for _, z := range incoming {
+		other := z.Member.(string)
+		pipe.ZRem(ctx, sentRequestsKey(other), from)
+		pipe.ZAdd(ctx, sentRequestsKey(other), &redis.Z{Score: z.Score, Member: to})
+	}
+	for _, z := range outgoing {
+		other := z.Member.(string)
+		pipe.ZRem(ctx, friendRequestsKey(other), from)
+		pipe.ZAdd(ctx, friendRequestsKey(other), &redis.Z{Score: z.Score, Member: to})
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// movePlayerKeys renames the keys named after the player. Missing keys are
+// skipped.
+func movePlayerKeys(ctx context.Context, from, to string) error {
+	for _, keys := range [][2]string{
+		{friendsKey(from), friendsKey(to)},
+		{friendRequestsKey(from), friendRequestsKey(to)},
+		{sentRequestsKey(from), sentRequestsKey(to)},
+		{playerCardsKey(ctx, from), playerCardsKey(ctx, to)},
+		{banHistoryKey(from), banHistoryKey(to)},
+		{lastSeenKey(from), lastSeenKey(to)},
+		{renamesKey(from), renamesKey(to)},
+		{achievementsKey(from), achievementsKey(to)},
+		{coinsKey(from), coinsKey(to)},
+		{inventoryKey(from), inventoryKey(to)},
+		{dailyRewardKey(from), dailyRewardKey(to)},
+		{devicesKey(from), devicesKey(to)},
+		{pushPrefsKey(from), pushPrefsKey(to)},
+		{notificationsKey(from), notificationsKey(to)},
+		{notificationIndexKey(from), notificationIndexKey(to)},
+		{unreadNotificationsKey(from), unreadNotificationsKey(to)},
+		{notificationPrefsKey(from), notificationPrefsKey(to)},
+		{challengeProgressKey(challengeDay(time.Now()), from), challengeProgressKey(challengeDay(time.Now()), to)},
+	} {
+		exists, err := rdb.Exists(ctx, keys[0]).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			continue
+		}
+		if err := rdb.Rename(ctx, keys[0], keys[1]).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameAccount moves a player and everything keyed by their name to a new
+// one. The new name is claimed and the account moved first, so neither
+// name can be taken by someone else part way through. Finished games and
+// chat keep the name the player had at the time.
+func renameAccount(ctx context.Context, from, to string) error {
+	sameName := strings.EqualFold(from, to)
+	if !sameName {
+		if err := claimUsername(ctx, to); err != nil {
+			return err
+		}
+	}
+	if err := users.RenameUser(ctx, from, to); err != nil {
+		if !sameName {
+			releaseUsername(ctx, to)
+		}
+		return err
+	}
+	if sameName {
+		rdb.Set(ctx, usernameIndexKey(to), to, 0)
+	} else {
+		releaseUsername(ctx, from)
+	}
+
+	if err := histories.MoveHistory(ctx, from, to); err != nil {
+		return err
+	}
+	if err := moveScores(ctx, from, to); err != nil {
+		return err
+	}
+	if err := moveFriendships(ctx, from, to); err != nil {
+		return err
+	}
+	if err := movePlayerKeys(ctx, from, to); err != nil {
+		return err
+	}
+	if err := moveOAuthLinks(ctx, from, to); err != nil {
+		return err
+	}
+	if err := moveEmail(ctx, from, to); err != nil {
+		return err
+	}
+	if err := moveAPIKeys(ctx, from, to); err != nil {
+		return err
+	}
+
+	change, err := json.Marshal(UsernameChange{From: from, To: to, ChangedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return rdb.RPush(ctx, renamesKey(to), change).Err()
+}
+
+// changeUsername renames the caller's account and signs them in under the
+// new name. Sessions under the old name are ended.
+func changeUsername(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req UsernameChangeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if problem := validateUsername(req.Username); problem != nil {
+		respondInvalid(w, r, []*FieldError{problem})
+		return
+	}
+	if req.Username == username {
+		respondError(w, r, http.StatusBadRequest, errSameUsername)
+		return
+	}
+
+	guest, err := users.IsGuest(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error changing username")
+		return
+	}
+	if guest {
+		respondError(w, r, http.StatusForbidden, errGuestRename)
+		return
+	}
+	noPassword, err := passwordless(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error changing username")
+		return
+	}
+	if !noPassword {
+		if req.Password == "" {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "Send the new username and your password")
+			return
+		}
+		err = checkPassword(ctx, username, req.Password)
+		if err == errInvalidCredentials {
+			respondError(w, r, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error changing username")
+			return
+		}
+	}
+
+	next, err := nextUsernameChange(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error changing username")
+		return
+	}
+	if !next.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next).Seconds())+1))
+		writeError(w, r, http.StatusTooManyRequests, errorCodes[errRenameCooldown],
+			fmt.Sprintf("Username can be changed again after %s", next.Format(time.RFC3339)))
+		return
+	}
+	busy, err := playing(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error changing username")
+		return
+	}
+	if busy {
+		respondError(w, r, http.StatusConflict, errRenameBusy)
+		return
+	}
+
+	err = renameAccount(ctx, username, req.Username)
+	if err == errUsernameTaken {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		logFor(r).Error("changing username", "from", username, "to", req.Username, "err", err)
+		respondInternal(w, r, err, "Error changing username")
+		return
+	}
+	logFor(r).Info("username changed", "from", username, "to", req.Username)
+	audit(ctx, username, AuditAccountRenamed, username,
+		map[string]string{"username": username}, map[string]string{"username": req.Username})
+
+	hub.disconnectUser(ctx, username, websocket.CloseNormalClosure, "username changed")
+	if err := revokeRefreshTokens(ctx, username); err != nil {
+		logFor(r).Error("revoking refresh tokens", "username", username, "err", err)
+	}
+	if err := revokeAccessTokens(ctx, username); err != nil {
+		logFor(r).Error("revoking access tokens", "username", username, "err", err)
+	}
+	if err := revokeReconnectTokens(ctx, username); err != nil {
+		logFor(r).Error("revoking reconnect tokens", "username", username, "err", err)
+	}
+	tokens, err := issueTokens(ctx, req.Username)
+	if err != nil {
+		respondInternal(w, r, err, "Error issuing tokens")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// listRenames shows an account's name changes, newest first.
+func listRenames(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	changes, err := usernameChanges(ctx, mux.Vars(r)["username"])
+	if err != nil {
+		respondInternal(w, r, err, "Error loading username changes")
+		return
+	}
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
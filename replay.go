@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// ReplayEvent is one entry of a game's recorded timeline. Unlike the live
+// websocket feed it carries full information, so it is only served once the
+// game is over.
+type ReplayEvent struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+func gameEventsKey(gameID string) string {
+	return fmt.Sprintf("game:%s:events", gameID)
+}
+
+// recordEvent appends an action to the game's replay stream. Failures are
+// logged rather than failing the action that produced them.
+func recordEvent(ctx context.Context, gameID, eventType string, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("encoding replay event", "type", eventType, "err", err)
+		return
+	}
+
+	err = rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: gameEventsKey(gameID),
+		Values: map[string]interface{}{
+			"type": eventType,
+			"data": encoded,
+			"time": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}).Err()
+	if err != nil {
+		slog.Error("recording replay event", "type", eventType, "game", gameID, "err", err)
+	}
+}
+
+func recordGameStart(ctx context.Context, g *GameState) {
+	recordEvent(ctx, g.ID, EventGameStarted, map[string]interface{}{
+		"players":    g.Players,
+		"hands":      g.Hands,
+		"deck":       g.Deck,
+		"commitment": g.Commitment,
+	})
+}
+
+func getReplay(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	g, err := loadGame(ctx, id)
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading game")
+		return
+	}
+	if g.Status != GameFinished {
+		writeError(w, r, http.StatusConflict, "GAME_NOT_FINISHED", "Replay is available once the game has finished")
+		return
+	}
+
+	entries, err := rdb.XRange(ctx, gameEventsKey(id), "-", "+").Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading replay")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"game":   g.turnView(),
+		"events": replayEvents(entries),
+	})
+}
+
+func replayEvents(entries []redis.XMessage) []ReplayEvent {
+	events := []ReplayEvent{}
+	for _, entry := range entries {
+		eventType, _ := entry.Values["type"].(string)
+		data, _ := entry.Values["data"].(string)
+		stamp, _ := entry.Values["time"].(string)
+		at, _ := time.Parse(time.RFC3339Nano, stamp)
+		events = append(events, ReplayEvent{
+			ID:   entry.ID,
+			Type: eventType,
+			Time: at,
+			Data: json.RawMessage(data),
+		})
+	}
+	return events
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	ReportOpen      = "open"
+	ReportReviewing = "reviewing"
+	ReportResolved  = "resolved"
+)
+
+const (
+	// reportEventLimit is how many of a game's latest events are kept with
+	// a report.
+	reportEventLimit = 50
+	maxReportDetails = 1000
+	// reportCooldown stops the same player being reported over and over for
+	// the same game.
+	reportCooldown = 24 * time.Hour
+)
+
+// reportReasons are the categories a player can report under.
+var reportReasons = map[string]bool{
+	"cheating":       true,
+	"abusive_chat":   true,
+	"offensive_name": true,
+	"griefing":       true,
+	"other":          true,
+}
+
+// reportResolutions are the outcomes a moderator can close a report with.
+var reportResolutions = map[string]bool{
+	"dismissed": true,
+	"actioned":  true,
+}
+
+var (
+	errReportSelf        = errors.New("you cannot report yourself")
+	errBadReportReason   = errors.New("unknown report reason")
+	errReportedNotInGame = errors.New("that player was not in the game")
+	errAlreadyReported   = errors.New("you have already reported that player")
+	errReportNotFound    = errors.New("report not found")
+	errReportResolved    = errors.New("report has already been resolved")
+	errBadResolution     = errors.New("resolution must be dismissed or actioned")
+	errBadReportStatus   = errors.New("status must be open, reviewing or resolved")
+)
+
+type ReportRequest struct {
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
+	GameID   string `json:"game_id,omitempty"`
+	Details  string `json:"details,omitempty"`
+}
+
+type ResolveReportRequest struct {
+	Resolution string `json:"resolution"`
+	Note       string `json:"note,omitempty"`
+}
+
+// ReportSnapshot is what the reported game looked like when the report was
+// made, so moderators see it even after the room's chat and events expire.
+type ReportSnapshot struct {
+	Chat   []ChatMessage `json:"chat"`
+	Events []ReplayEvent `json:"events"`
+}
+
+type Report struct {
+	ID         string          `json:"id"`
+	Reporter   string          `json:"reporter"`
+	Reported   string          `json:"reported"`
+	Reason     string          `json:"reason"`
+	Details    string          `json:"details,omitempty"`
+	GameID     string          `json:"game_id,omitempty"`
+	Status     string          `json:"status"`
+	Resolution string          `json:"resolution,omitempty"`
+	Note       string          `json:"note,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ReviewedBy string          `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time      `json:"reviewed_at,omitempty"`
+	ResolvedBy string          `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time      `json:"resolved_at,omitempty"`
+	Snapshot   *ReportSnapshot `json:"snapshot,omitempty"`
+}
+
+func reportKey(id string) string {
+	return fmt.Sprintf("report:%s", id)
+}
+
+// reportsKey indexes reports in a status by when they were made.
+func reportsKey(status string) string {
+	return fmt.Sprintf("reports:%s", status)
+}
+
+func reportCooldownKey(reporter, reported, gameID string) string {
+	return fmt.Sprintf("report:sent:%s:%s:%s", reporter, reported, gameID)
+}
+
+func loadReport(ctx context.Context, id string) (*Report, error) {
+	data, err := rdb.Get(ctx, reportKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, errReportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// saveReport stores a report and files it under its status, moving it out
+// of the status it had before.
+func saveReport(ctx context.Context, report *Report, previous string) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, reportKey(report.ID), data, 0)
+	if previous != "" && previous != report.Status {
+		pipe.ZRem(ctx, reportsKey(previous), report.ID)
+	}
+	pipe.ZAdd(ctx, reportsKey(report.Status), &redis.Z{Score: float64(report.CreatedAt.Unix()), Member: report.ID})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// snapshotGame copies a game's recent chat and latest events.
+func snapshotGame(ctx context.Context, g *GameState) (*ReportSnapshot, error) {
+	snap := &ReportSnapshot{Chat: []ChatMessage{}}
+
+	raw, err := rdb.LRange(ctx, chatKey(g.channel()), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range raw {
+		var msg ChatMessage
+		if json.Unmarshal([]byte(item), &msg) == nil {
+			snap.Chat = append(snap.Chat, msg)
+		}
+	}
+
+	entries, err := rdb.XRevRangeN(ctx, gameEventsKey(g.ID), "+", "-", reportEventLimit).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	snap.Events = replayEvents(entries)
+	return snap, nil
+}
+
+func createReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req ReportRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Username == "" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidPayload, "username is required")
+		return
+	}
+	if req.Username == username {
+		respondError(w, r, http.StatusBadRequest, errReportSelf)
+		return
+	}
+	if !reportReasons[req.Reason] {
+		respondError(w, r, http.StatusBadRequest, errBadReportReason)
+		return
+	}
+	if len(req.Details) > maxReportDetails {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Details must be at most %d characters", maxReportDetails))
+		return
+	}
+	exists, err := users.UserExists(ctx, req.Username)
+	if err != nil {
+		respondInternal(w, r, err, "Error creating report")
+		return
+	}
+	if !exists {
+		respondError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+
+	report := &Report{
+		ID:        newID(),
+		Reporter:  username,
+		Reported:  req.Username,
+		Reason:    req.Reason,
+		Details:   req.Details,
+		GameID:    req.GameID,
+		Status:    ReportOpen,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.GameID != "" {
+		g, err := loadGame(ctx, req.GameID)
+		if err == errGameNotFound {
+			respondError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error loading game")
+			return
+		}
+		if !g.hasPlayer(req.Username) {
+			respondError(w, r, http.StatusBadRequest, errReportedNotInGame)
+			return
+		}
+		if report.Snapshot, err = snapshotGame(ctx, g); err != nil {
+			respondInternal(w, r, err, "Error creating report")
+			return
+		}
+	}
+
+	fresh, err := rdb.SetNX(ctx, reportCooldownKey(username, req.Username, req.GameID), report.ID, reportCooldown).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error creating report")
+		return
+	}
+	if !fresh {
+		respondError(w, r, http.StatusConflict, errAlreadyReported)
+		return
+	}
+	if err := saveReport(ctx, report, ""); err != nil {
+		rdb.Del(ctx, reportCooldownKey(username, req.Username, req.GameID))
+		respondInternal(w, r, err, "Error creating report")
+		return
+	}
+	logFor(r).Info("player reported", "report", report.ID, "reported", report.Reported, "reason", report.Reason)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": report.ID, "status": report.Status})
+}
+
+// listReports pages through reports in one status, oldest first so the
+// queue is worked in order. ?status= defaults to open.
+func listReports(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReportOpen
+	}
+	if status != ReportOpen && status != ReportReviewing && status != ReportResolved {
+		respondError(w, r, http.StatusBadRequest, errBadReportStatus)
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	total, err := rdb.ZCard(ctx, reportsKey(status)).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading reports")
+		return
+	}
+	reports := []*Report{}
+	if limit > 0 {
+		ids, err := rdb.ZRange(ctx, reportsKey(status), int64(offset), int64(offset+limit-1)).Result()
+		if err != nil {
+			respondInternal(w, r, err, "Error loading reports")
+			return
+		}
+		for _, id := range ids {
+			report, err := loadReport(ctx, id)
+			if err == errReportNotFound {
+				continue
+			}
+			if err != nil {
+				respondInternal(w, r, err, "Error loading reports")
+				return
+			}
+			report.Snapshot = nil
+			reports = append(reports, report)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	json.NewEncoder(w).Encode(reports)
+}
+
+func getReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	report, err := loadReport(ctx, mux.Vars(r)["id"])
+	if err == errReportNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// reviewReport takes an open report off the queue while a moderator looks
+// into it.
+func reviewReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	report, err := loadReport(ctx, mux.Vars(r)["id"])
+	if err == errReportNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading report")
+		return
+	}
+	if report.Status == ReportResolved {
+		respondError(w, r, http.StatusConflict, errReportResolved)
+		return
+	}
+
+	if report.Status == ReportOpen {
+		now := time.Now().UTC()
+		report.Status = ReportReviewing
+		report.ReviewedBy = actorName(r)
+		report.ReviewedAt = &now
+		if err := saveReport(ctx, report, ReportOpen); err != nil {
+			respondInternal(w, r, err, "Error updating report")
+			return
+		}
+		audit(ctx, report.ReviewedBy, AuditReportReviewed, report.ID,
+			map[string]string{"status": ReportOpen}, map[string]string{"status": report.Status})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func resolveReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ResolveReportRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if !reportResolutions[req.Resolution] {
+		respondError(w, r, http.StatusBadRequest, errBadResolution)
+		return
+	}
+
+	report, err := loadReport(ctx, mux.Vars(r)["id"])
+	if err == errReportNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading report")
+		return
+	}
+	if report.Status == ReportResolved {
+		respondError(w, r, http.StatusConflict, errReportResolved)
+		return
+	}
+
+	previous := report.Status
+	now := time.Now().UTC()
+	if report.ReviewedAt == nil {
+		report.ReviewedBy = actorName(r)
+		report.ReviewedAt = &now
+	}
+	report.Status = ReportResolved
+	report.Resolution = req.Resolution
+	report.Note = req.Note
+	report.ResolvedBy = actorName(r)
+	report.ResolvedAt = &now
+	if err := saveReport(ctx, report, previous); err != nil {
+		respondInternal(w, r, err, "Error updating report")
+		return
+	}
+	logFor(r).Info("report resolved", "report", report.ID, "resolution", report.Resolution)
+	audit(ctx, report.ResolvedBy, AuditReportResolved, report.ID,
+		map[string]string{"status": previous},
+		map[string]string{"status": report.Status, "resolution": report.Resolution, "note": report.Note})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
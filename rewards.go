@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Daily login rewards grow by dailyRewardStep coins for each day in a row
+// a player claims them, up to dailyRewardMaxDays days.
+const (
+	dailyRewardStep    = 10
+	dailyRewardMaxDays = 7
+)
+
+// DailyReward is the outcome of a visit to the daily reward endpoint.
+// Claimed is false when today's reward had already been collected.
+type DailyReward struct {
+	Date        string    `json:"date"`
+	Claimed     bool      `json:"claimed"`
+	Streak      int       `json:"streak"`
+	Reward      int       `json:"reward"`
+	Coins       int       `json:"coins"`
+	NextClaimAt time.Time `json:"next_claim_at"`
+}
+
+// dailyRewardKey holds the day a player last claimed their reward and how
+// many days in a row they have.
+func dailyRewardKey(username string) string {
+	return fmt.Sprintf("player:%s:daily_reward", username)
+}
+
+func dailyRewardFor(streak int) int {
+	if streak > dailyRewardMaxDays {
+		streak = dailyRewardMaxDays
+	}
+	return streak * dailyRewardStep
+}
+
+// claimDailyReward pays today's reward if it hasn't been paid yet. The
+// WATCH makes a burst of requests pay out once.
+func claimDailyReward(ctx context.Context, username string, now time.Time) (*DailyReward, error) {
+	today := challengeDay(now)
+	yesterday := challengeDay(now.AddDate(0, 0, -1))
+	key := dailyRewardKey(username)
+
+	claim := &DailyReward{Date: today}
+	err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		streak, _ := strconv.Atoi(fields["streak"])
+		if fields["last"] == today {
+			claim.Streak = streak
+			claim.Reward = dailyRewardFor(streak)
+			return nil
+		}
+		if fields["last"] == yesterday {
+			streak++
+		} else {
+			streak = 1
+		}
+
+		claim.Claimed = true
+		claim.Streak = streak
+		claim.Reward = dailyRewardFor(streak)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "last", today, "streak", streak)
+			pipe.IncrBy(ctx, coinsKey(username), int64(claim.Reward))
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if claim.Coins, err = coinBalance(ctx, username); err != nil {
+		return nil, err
+	}
+	t := now.UTC()
+	claim.NextClaimAt = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	return claim, nil
+}
+
+// getDailyReward collects the caller's daily reward. Calling it again the
+// same day pays nothing and reports the reward already collected.
+func getDailyReward(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	claim, err := claimDailyReward(ctx, username, time.Now())
+	if err == redis.TxFailedErr {
+		// Lost the race to a concurrent claim, which has now paid out.
+		claim, err = claimDailyReward(ctx, username, time.Now())
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error claiming daily reward")
+		return
+	}
+	if claim.Claimed {
+		logFor(r).Info("daily reward claimed", "username", username, "streak", claim.Streak, "reward", claim.Reward)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claim)
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	RoomWaiting    = "waiting"
+	RoomInProgress = "in-progress"
+	RoomFinished   = "finished"
+)
+
+const (
+	minRoomCapacity = 2
+	maxRoomCapacity = 5
+	maxSpectators   = 20
+	openRoomsKey    = "rooms:open"
+	liveRoomsKey    = "rooms:live"
+)
+
+var (
+	errRoomNotFound   = errors.New("room not found")
+	errRoomFull       = errors.New("room is full")
+	errRoomClosed     = errors.New("room is not accepting players")
+	errAlreadyInRoom  = errors.New("player is already in this room")
+	errNotRoomOwner   = errors.New("only the room owner can do that")
+	errNotEnough      = errors.New("not enough players to start")
+	errSpectatorsFull = errors.New("room has no spectator seats left")
+	errRoomBusy       = errors.New("room is busy, try again")
+)
+
+type Room struct {
+	ID             string            `json:"id"`
+	Owner          string            `json:"owner"`
+	Players        []string          `json:"players"`
+	Spectators     []string          `json:"spectators"`
+	Bots           map[string]string `json:"bots,omitempty"`
+	Backfill       bool              `json:"backfill"`
+	Private        bool              `json:"private"`
+	JoinCode       string            `json:"join_code,omitempty"`
+	SpectatorCount int               `json:"spectator_count"`
+	Capacity       int               `json:"capacity"`
+	Status         string            `json:"status"`
+	GameID         string            `json:"game_id,omitempty"`
+	Tournament     string            `json:"tournament,omitempty"`
+	Rules          *HouseRules       `json:"rules,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// CreateRoomRequest opens a lobby. Backfill opts in to bots taking over
+// the seats of players who disconnect mid-game. Private rooms stay out of
+// the public listings and are joined with their join code. Setting Bots
+// instead starts a game against that many server-side opponents straight
+// away. Rules sets house rules for every game played in the room.
+type CreateRoomRequest struct {
+	Capacity   int         `json:"capacity"`
+	Backfill   bool        `json:"backfill"`
+	Private    bool        `json:"private"`
+	Bots       int         `json:"bots"`
+	Difficulty string      `json:"difficulty"`
+	Rules      *HouseRules `json:"rules"`
+}
+
+func roomKey(id string) string {
+	return fmt.Sprintf("room:%s", id)
+}
+
+func loadRoom(ctx context.Context, id string) (*Room, error) {
+	data, err := rdb.Get(ctx, roomKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, errRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var room Room
+	if err := json.Unmarshal(data, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// loadRooms reads the rooms an index lists with one MGET, dropping ids
+// whose room has expired from the index.
+func loadRooms(ctx context.Context, index string, ids []string) ([]*Room, error) {
+	rooms := []*Room{}
+	if len(ids) == 0 {
+		return rooms, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = roomKey(id)
+	}
+	values, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	gone := []interface{}{}
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			gone = append(gone, ids[i])
+			continue
+		}
+		var room Room
+		if json.Unmarshal([]byte(data), &room) == nil {
+			rooms = append(rooms, &room)
+		}
+	}
+	if len(gone) > 0 {
+		rdb.SRem(ctx, index, gone...)
+	}
+	return rooms, nil
+}
+
+// saveRoom persists the room and keeps the open-lobby and live-game
+// indexes in sync with its status.
+func saveRoom(ctx context.Context, room *Room) error {
+	room.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, roomKey(room.ID), data, 0)
+	pipe.SRem(ctx, openRoomsKey, room.ID)
+	pipe.SRem(ctx, liveRoomsKey, room.ID)
+	switch room.Status {
+	case RoomWaiting:
+		pipe.SAdd(ctx, openRoomsKey, room.ID)
+	case RoomInProgress:
+		pipe.SAdd(ctx, liveRoomsKey, room.ID)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// updateRoom changes a stored room holding its lock, so instances can't
+// hand out the same seat twice. Nothing is saved if change fails.
+func updateRoom(ctx context.Context, id string, change func(room *Room) error) (*Room, error) {
+	var room *Room
+	err := withLock(ctx, roomLockKey(id), errRoomBusy, func() (err error) {
+		if room, err = loadRoom(ctx, id); err != nil {
+			return err
+		}
+		if err := change(room); err != nil {
+			return err
+		}
+		return saveRoom(ctx, room)
+	})
+	return room, err
+}
+
+func (room *Room) hasPlayer(username string) bool {
+	for _, p := range room.Players {
+		if p == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (room *Room) join(username string) error {
+	if room.Status != RoomWaiting {
+		return errRoomClosed
+	}
+	if room.hasPlayer(username) {
+		return errAlreadyInRoom
+	}
+	if len(room.Players) >= room.Capacity {
+		return errRoomFull
+	}
+	room.Players = append(room.Players, username)
+	return nil
+}
+
+func (room *Room) hasSpectator(username string) bool {
+	for _, s := range room.Spectators {
+		if s == username {
+			return true
+		}
+	}
+	return false
+}
+
+// spectate seats a non-participant in the audience. Spectators may join at
+// any point before the room finishes.
+func (room *Room) spectate(username string) error {
+	if room.Status == RoomFinished {
+		return errRoomClosed
+	}
+	if room.hasPlayer(username) || room.hasSpectator(username) {
+		return errAlreadyInRoom
+	}
+	if len(room.Spectators) >= maxSpectators {
+		return errSpectatorsFull
+	}
+	room.Spectators = append(room.Spectators, username)
+	room.SpectatorCount = len(room.Spectators)
+	return nil
+}
+
+// start moves a full enough lobby into play and deals its game.
+func (room *Room) start(username string) (*GameState, error) {
+	if room.Owner != username {
+		return nil, errNotRoomOwner
+	}
+	if room.Status != RoomWaiting {
+		return nil, errRoomClosed
+	}
+	if len(room.Players) < minRoomCapacity {
+		return nil, errNotEnough
+	}
+
+	g := newGame(room.ID, room.Players, room.Rules)
+	g.Bots = room.Bots
+	room.Status = RoomInProgress
+	room.GameID = g.ID
+	return g, nil
+}
+
+// finishRoom closes the room a finished game was played in.
+func finishRoom(ctx context.Context, g *GameState) {
+	if g.RoomID == "" {
+		return
+	}
+	room, err := updateRoom(ctx, g.RoomID, func(room *Room) error {
+		room.Status = RoomFinished
+		return nil
+	})
+	if err != nil {
+		slog.Error("finishing room", "room", g.RoomID, "err", err)
+		return
+	}
+	releaseJoinCode(ctx, room)
+}
+
+func createRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req CreateRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	if req.Bots != 0 {
+		createBotRoom(w, r, req)
+		return
+	}
+	if req.Capacity == 0 {
+		req.Capacity = maxRoomCapacity
+	}
+	if req.Capacity < minRoomCapacity || req.Capacity > maxRoomCapacity {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Capacity must be between %d and %d", minRoomCapacity, maxRoomCapacity))
+		return
+	}
+	if problems := validateHouseRules(req.Rules, req.Capacity); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+	if !req.Rules.allowedFor(currentUser(r)) {
+		respondError(w, r, http.StatusForbidden, errFeatureDisabled)
+		return
+	}
+
+	room := &Room{
+		ID:        newID(),
+		Owner:     currentUser(r),
+		Players:   []string{currentUser(r)},
+		Capacity:  req.Capacity,
+		Backfill:  req.Backfill,
+		Private:   req.Private,
+		Rules:     req.Rules,
+		Status:    RoomWaiting,
+		CreatedAt: time.Now().UTC(),
+	}
+	if room.Private {
+		if err := assignJoinCode(ctx, room); err != nil {
+			respondInternal(w, r, err, "Error creating room")
+			return
+		}
+	}
+	if err := saveRoom(ctx, room); err != nil {
+		respondInternal(w, r, err, "Error creating room")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// createBotRoom seats the caller against bots and starts the game at once.
+func createBotRoom(w http.ResponseWriter, r *http.Request, req CreateRoomRequest) {
+	ctx := r.Context()
+	if req.Bots < minBots || req.Bots > maxBots {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Bots must be between %d and %d", minBots, maxBots))
+		return
+	}
+	if req.Difficulty == "" {
+		req.Difficulty = BotMedium
+	}
+	if !validDifficulty(req.Difficulty) {
+		respondError(w, r, http.StatusBadRequest, errBadDifficulty)
+		return
+	}
+	if problems := validateHouseRules(req.Rules, req.Bots+1); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+	if !req.Rules.allowedFor(currentUser(r)) {
+		respondError(w, r, http.StatusForbidden, errFeatureDisabled)
+		return
+	}
+
+	username := currentUser(r)
+	bots := newBots(req.Bots, req.Difficulty)
+	players := []string{username}
+	for bot := range bots {
+		players = append(players, bot)
+	}
+	room := &Room{
+		ID:        newID(),
+		Owner:     username,
+		Players:   players,
+		Bots:      bots,
+		Rules:     req.Rules,
+		Capacity:  len(players),
+		Status:    RoomWaiting,
+		CreatedAt: time.Now().UTC(),
+	}
+	g, err := room.start(username)
+	if err != nil {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err := saveGame(ctx, g); err != nil {
+		respondInternal(w, r, err, "Error creating game")
+		return
+	}
+	if err := saveRoom(ctx, room); err != nil {
+		respondInternal(w, r, err, "Error creating room")
+		return
+	}
+	recordGameStart(ctx, g)
+	trackActiveGame(ctx, g)
+	publishTurn(ctx, g)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+func joinRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	room, err := loadRoom(ctx, mux.Vars(r)["id"])
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading room")
+		return
+	}
+	if room.Private {
+		respondError(w, r, http.StatusForbidden, errRoomPrivate)
+		return
+	}
+
+	enterRoom(w, r, room)
+}
+
+// enterRoom seats the caller in a room, or in its audience with
+// ?spectate=true.
+func enterRoom(w http.ResponseWriter, r *http.Request, room *Room) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	spectating := r.URL.Query().Get("spectate") == "true"
+	room, err := updateRoom(ctx, room.ID, func(room *Room) error {
+		if spectating {
+			return room.spectate(username)
+		}
+		return room.join(username)
+	})
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if knownError(err) {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error joining room")
+		return
+	}
+	if spectating {
+		hub.broadcast(ctx, room.ID, EventSpectatorJoined, map[string]interface{}{
+			"username":        username,
+			"spectator_count": room.SpectatorCount,
+		})
+	} else {
+		hub.broadcast(ctx, room.ID, EventPlayerJoined, map[string]interface{}{
+			"username": username,
+			"players":  room.Players,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(room)
+}
+
+// listRooms lists public open lobbies by default, or public games in
+// progress for spectators with ?status=in-progress.
+func listRooms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = RoomWaiting
+	}
+	index := openRoomsKey
+	switch status {
+	case RoomWaiting:
+	case RoomInProgress:
+		index = liveRoomsKey
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Status must be waiting or in-progress")
+		return
+	}
+
+	ids, err := rdb.SMembers(ctx, index).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error listing rooms")
+		return
+	}
+
+	rooms, err := loadRooms(ctx, index, ids)
+	if err != nil {
+		respondInternal(w, r, err, "Error listing rooms")
+		return
+	}
+	listed := []*Room{}
+	for _, room := range rooms {
+		if room.Status == status && !room.Private {
+			listed = append(listed, room)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listed)
+}
+
+func startRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var g *GameState
+	_, err := updateRoom(ctx, mux.Vars(r)["id"], func(room *Room) (err error) {
+		if g, err = room.start(username); err != nil {
+			return err
+		}
+		return saveGame(ctx, g)
+	})
+	if err == errRoomNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err == errNotRoomOwner {
+		respondError(w, r, http.StatusForbidden, err)
+		return
+	}
+	if knownError(err) {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error starting room")
+		return
+	}
+	recordGameStart(ctx, g)
+	trackActiveGame(ctx, g)
+	publishTurn(ctx, g)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
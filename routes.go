@@ -0,0 +1,216 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	apiV1Prefix  = "/api/v1"
+	legacyPrefix = "/api"
+)
+
+// legacySunset is when the unversioned /api aliases are due to be removed.
+var legacySunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// mountAPI serves each API version under its own prefix. A breaking v2
+// gets its own register function and prefix next to v1, so both run side
+// by side until v1 is retired.
+func mountAPI(r *mux.Router) {
+	r.HandleFunc(legacyPrefix+"/openapi.json", serveOpenAPI).Methods("GET")
+	r.HandleFunc(legacyPrefix+"/docs", serveAPIDocs).Methods("GET")
+	registerV1(r.PathPrefix(apiV1Prefix).Subrouter())
+
+	legacy := r.PathPrefix(legacyPrefix).Subrouter()
+	legacy.Use(deprecated(apiV1Prefix))
+	registerV1(legacy)
+}
+
+func registerV1(r *mux.Router) {
+	r.HandleFunc("/register", handleRegister).Methods("POST")
+	r.HandleFunc("/login", handleLogin).Methods("POST")
+	r.HandleFunc("/token/refresh", handleRefresh).Methods("POST")
+	r.HandleFunc("/logout", handleLogout).Methods("POST")
+	r.HandleFunc("/guest", handleGuest).Methods("POST")
+	r.HandleFunc("/auth/{provider}/start", startOAuth).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", oauthCallback).Methods("GET")
+	r.HandleFunc("/email/verify", verifyEmail).Methods("POST")
+	r.HandleFunc("/password/forgot", forgotPassword).Methods("POST")
+	r.HandleFunc("/password/reset", resetPassword).Methods("POST")
+	r.HandleFunc("/leaderboard", getLeaderboard).Methods("GET")
+	r.HandleFunc("/seasons", listSeasons).Methods("GET")
+	r.HandleFunc("/players/{username}/profile", getPlayerProfile).Methods("GET")
+	r.HandleFunc("/players/{username}/stats", getPlayerStats).Methods("GET")
+	r.HandleFunc("/players/{username}/games", getPlayerGames).Methods("GET")
+	r.HandleFunc("/players/{username}/games/active", getActiveGames).Methods("GET")
+	r.HandleFunc("/players/{username}/achievements", getPlayerAchievements).Methods("GET")
+	r.HandleFunc("/rooms", listRooms).Methods("GET")
+	r.HandleFunc("/cards", listCards).Methods("GET")
+	r.HandleFunc("/emotes", listEmotes).Methods("GET")
+	r.HandleFunc("/avatars", listAvatars).Methods("GET")
+	r.HandleFunc("/shop", listCosmetics).Methods("GET")
+	r.HandleFunc("/tournaments", listTournaments).Methods("GET")
+	r.HandleFunc("/tournaments/{id}", getTournament).Methods("GET")
+	r.HandleFunc("/events/active", getActiveEvents).Methods("GET")
+	r.HandleFunc("/challenges/today", getTodaysChallenges).Methods("GET")
+	r.HandleFunc("/games/{id}/replay", getReplay).Methods("GET")
+	r.HandleFunc("/games/{id}/fairness", getFairness).Methods("GET")
+	r.HandleFunc("/rooms/{id}/connections", getRoomConnections).Methods("GET")
+	r.HandleFunc("/motd", getMOTD).Methods("GET")
+	r.HandleFunc("/version", getVersion).Methods("GET")
+	r.HandleFunc("/telemetry", ingestTelemetry).Methods("POST")
+
+	mod := r.PathPrefix("/admin").Subrouter()
+	mod.Use(requireRole(RoleModerator))
+	mod.HandleFunc("/reports", listReports).Methods("GET")
+	mod.HandleFunc("/reports/{id}", getReport).Methods("GET")
+	mod.HandleFunc("/reports/{id}/review", reviewReport).Methods("POST")
+	mod.HandleFunc("/reports/{id}/resolve", resolveReport).Methods("POST")
+	mod.HandleFunc("/users", searchUsers).Methods("GET")
+	mod.HandleFunc("/users/{username}", getUser).Methods("GET")
+	mod.HandleFunc("/users/{username}/ban", banUser).Methods("POST")
+	mod.HandleFunc("/users/{username}/ban", unbanUser).Methods("DELETE")
+	mod.HandleFunc("/users/{username}/bans", listBans).Methods("GET")
+	mod.HandleFunc("/users/{username}/renames", listRenames).Methods("GET")
+	mod.HandleFunc("/games/{id}", getAnyGame).Methods("GET")
+	mod.HandleFunc("/games/{id}/changes", getGameChanges).Methods("GET")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(requireRole(RoleAdmin))
+	admin.HandleFunc("/log-level", setLogLevel).Methods("PUT")
+	admin.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	admin.HandleFunc("/audit", getAuditLog).Methods("GET")
+	admin.HandleFunc("/jobs", getJobStats).Methods("GET")
+	admin.HandleFunc("/stats", getAdminStats).Methods("GET")
+	admin.HandleFunc("/webhooks", createWebhook).Methods("POST")
+	admin.HandleFunc("/webhooks", listWebhooks).Methods("GET")
+	admin.HandleFunc("/webhooks/{id}", deleteWebhook).Methods("DELETE")
+	admin.HandleFunc("/jobs/retry", retryFailedJobs).Methods("POST")
+	admin.HandleFunc("/maintenance", getMaintenance).Methods("GET")
+	admin.HandleFunc("/maintenance", startMaintenance).Methods("PUT")
+	admin.HandleFunc("/maintenance", endMaintenance).Methods("DELETE")
+	admin.HandleFunc("/motd", setMOTD).Methods("PUT")
+	admin.HandleFunc("/motd", clearMOTD).Methods("DELETE")
+	admin.HandleFunc("/flags", listFlags).Methods("GET")
+	admin.HandleFunc("/flags/{name}", setFlag).Methods("PUT")
+	admin.HandleFunc("/flags/{name}", resetFlag).Methods("DELETE")
+	admin.HandleFunc("/tournaments", createTournament).Methods("POST")
+	admin.HandleFunc("/events", createLiveEvent).Methods("POST")
+	admin.HandleFunc("/events", listLiveEvents).Methods("GET")
+	admin.HandleFunc("/events/{id}", deleteLiveEvent).Methods("DELETE")
+	admin.HandleFunc("/users/{username}/role", setUserRole).Methods("PUT")
+	admin.HandleFunc("/users/{username}/score", setUserScore).Methods("PUT")
+	admin.HandleFunc("/users/{username}/score", resetUserScore).Methods("DELETE")
+
+	api := r.NewRoute().Subrouter()
+	api.Use(requireAuth)
+	api.HandleFunc("/reports", createReport).Methods("POST")
+	api.HandleFunc("/features", getFeatures).Methods("GET")
+	api.HandleFunc("/leaderboard/me", getLeaderboardAroundMe).Methods("GET")
+	api.HandleFunc("/leaderboard/friends", getFriendsLeaderboard).Methods("GET")
+	api.HandleFunc("/friends", listFriends).Methods("GET")
+	api.HandleFunc("/friends/requests", sendFriendRequest).Methods("POST")
+	api.HandleFunc("/friends/requests/{username}/accept", acceptFriendRequest).Methods("POST")
+	api.HandleFunc("/friends/requests/{username}/decline", declineFriendRequest).Methods("POST")
+	api.HandleFunc("/friends/requests/{username}", cancelFriendRequest).Methods("DELETE")
+	api.HandleFunc("/friends/{username}", removeFriend).Methods("DELETE")
+	api.HandleFunc("/guest/upgrade", handleGuestUpgrade).Methods("POST")
+	api.HandleFunc("/account", deleteAccount).Methods("DELETE")
+	api.HandleFunc("/account/export", exportAccount).Methods("GET")
+	api.HandleFunc("/account/username", changeUsername).Methods("PUT")
+	api.HandleFunc("/account/email", getEmail).Methods("GET")
+	api.HandleFunc("/account/email", changeEmail).Methods("PUT")
+	api.HandleFunc("/account/email/verify", resendVerification).Methods("POST")
+	api.HandleFunc("/account/oauth", listOAuthLinks).Methods("GET")
+	api.HandleFunc("/account/api-keys", listAPIKeys).Methods("GET")
+	api.HandleFunc("/account/api-keys", createAPIKey).Methods("POST")
+	api.HandleFunc("/account/api-keys/{id}/rotate", rotateAPIKey).Methods("POST")
+	api.HandleFunc("/account/api-keys/{id}", revokeAPIKey).Methods("DELETE")
+	api.HandleFunc("/account/oauth/{provider}", unlinkOAuth).Methods("DELETE")
+	api.HandleFunc("/account/devices", listDevices).Methods("GET")
+	api.HandleFunc("/account/devices", registerDevice).Methods("POST")
+	api.HandleFunc("/account/devices/{token}", removeDevice).Methods("DELETE")
+	api.HandleFunc("/account/notifications", getPushPrefs).Methods("GET")
+	api.HandleFunc("/account/notifications", setPushPrefs).Methods("PUT")
+	api.HandleFunc("/notifications", getNotifications).Methods("GET")
+	api.HandleFunc("/notifications/read", markAllNotificationsRead).Methods("POST")
+	api.HandleFunc("/notifications/settings", getNotificationPrefs).Methods("GET")
+	api.HandleFunc("/notifications/settings", setNotificationPrefs).Methods("PUT")
+	api.HandleFunc("/notifications/{id}/read", markNotificationRead).Methods("POST")
+	api.HandleFunc("/players/{username}/profile", updatePlayerProfile).Methods("PUT")
+	api.HandleFunc("/challenges/progress", getChallengeProgress).Methods("GET")
+	api.HandleFunc("/shop/{id}/purchase", purchaseCosmetic).Methods("POST")
+	api.HandleFunc("/inventory", getInventory).Methods("GET")
+	api.HandleFunc("/rewards/daily", getDailyReward).Methods("GET")
+	api.HandleFunc("/tournaments/{id}/register", registerForTournament).Methods("POST")
+	api.HandleFunc("/tournaments/{id}/register", withdrawFromTournament).Methods("DELETE")
+	api.HandleFunc("/score", updateScore).Methods("POST")
+	api.HandleFunc("/saveCardDraw", saveCardDraw).Methods("POST")
+	api.HandleFunc("/deleteSavedCards", deleteSavedCards).Methods("DELETE")
+	api.HandleFunc("/fetchSavedCards", fetchSavedCards).Methods("GET")
+	api.HandleFunc("/game", createGame).Methods("POST")
+	api.HandleFunc("/games", createGame).Methods("POST")
+	api.HandleFunc("/games", listGames).Methods("GET")
+	api.HandleFunc("/games/{id}/suspend", suspendGame).Methods("POST")
+	api.HandleFunc("/games/{id}/resume", resumeGame).Methods("POST")
+	api.HandleFunc("/game/{id}/draw", drawCard).Methods("POST")
+	api.HandleFunc("/game/{id}/play", playCard).Methods("POST")
+	api.HandleFunc("/game/{id}/combo", playCombo).Methods("POST")
+	api.HandleFunc("/game/{id}/give", giveFavor).Methods("POST")
+	api.HandleFunc("/game/{id}/nope", playNope).Methods("POST")
+	api.HandleFunc("/game/{id}/reinsert", reinsertKitten).Methods("POST")
+	api.HandleFunc("/game/{id}/alter", alterFuture).Methods("POST")
+	api.HandleFunc("/game/{id}/forfeit", forfeitGame).Methods("POST")
+	api.HandleFunc("/game/{id}/rematch", voteRematch).Methods("POST")
+	api.HandleFunc("/game/{id}/rematch", getRematch).Methods("GET")
+	api.HandleFunc("/game/{id}/state", getGameState).Methods("GET")
+	api.HandleFunc("/game/{id}/events", streamGameEvents).Methods("GET")
+	api.HandleFunc("/rooms", createRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/join", joinRoom).Methods("POST")
+	api.HandleFunc("/rooms/join-by-code/{code}", joinRoomByCode).Methods("POST")
+	api.HandleFunc("/rooms/{id}/invite", inviteToRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/chat", getChatHistory).Methods("GET")
+	api.HandleFunc("/rooms/{id}/start", startRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/backfill", backfillRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/leave", leaveRoom).Methods("POST")
+	api.HandleFunc("/matchmaking/join", joinMatchmaking).Methods("POST")
+	api.HandleFunc("/matchmaking/leave", leaveMatchmaking).Methods("POST")
+}
+
+// deprecated marks responses from a legacy alias and points clients at the
+// same route under successor.
+func deprecated(successor string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+			link := successor + strings.TrimPrefix(r.URL.Path, legacyPrefix)
+			w.Header().Set("Link", "<"+link+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeName is a route's template without its version prefix, so limits
+// and metrics treat /api/login and /api/v1/login as one endpoint.
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	if rest := strings.TrimPrefix(tmpl, apiV1Prefix); rest != tmpl {
+		return rest
+	}
+	if rest := strings.TrimPrefix(tmpl, legacyPrefix); rest != tmpl {
+		return rest
+	}
+	return tmpl
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const futureSize = 3
+
+var (
+	errCardNotInHand   = errors.New("card is not in your hand")
+	errCardNotPlayable = errors.New("card cannot be played on its own")
+	errInvalidTarget   = errors.New("invalid target player")
+	errNothingToNope   = errors.New("there is no action to nope")
+)
+
+type PlayRequest struct {
+	Card   string `json:"card"`
+	Target string `json:"target"`
+}
+
+type PlayResult struct {
+	Card   string    `json:"card"`
+	Cards  []string  `json:"cards,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Named  string    `json:"named,omitempty"`
+	Hand   []string  `json:"hand"`
+	State  *TurnView `json:"state"`
+}
+
+// play removes an action card from the current player's hand and opens a
+// Nope window for it. The effect itself is applied by applyAction once the
+// window closes without being noped.
+func (g *GameState) play(username, card, target string, now time.Time) (*PlayResult, error) {
+	if err := g.requireTurn(username); err != nil {
+		return nil, err
+	}
+	if err := g.requireIdle(); err != nil {
+		return nil, err
+	}
+
+	switch card {
+	case CardSkip, CardAttack, CardShuffle, CardSeeTheFuture, CardAlterTheFuture:
+	case CardFavor, CardTargetedAttack:
+		if target == username || !g.hasPlayer(target) || g.isEliminated(target) {
+			return nil, errInvalidTarget
+		}
+	case CardNope:
+		return nil, errNothingToNope
+	default:
+		return nil, errCardNotPlayable
+	}
+	if !g.removeCard(username, card) {
+		return nil, errCardNotInHand
+	}
+	g.countPlay(username, card)
+	g.discard(card)
+	g.logAction(LogEntry{Type: EventCardPlayed, Player: username, Card: card, Target: target})
+
+	g.Pending = &PendingAction{
+		ID:       newID(),
+		Player:   username,
+		Card:     card,
+		Target:   target,
+		Nopes:    []string{},
+		Deadline: now.Add(g.nopeWindow()),
+	}
+
+	return &PlayResult{
+		Card:   card,
+		Target: target,
+		Hand:   g.Hands[username],
+	}, nil
+}
+
+// applyAction carries out the effect of an action card that survived its
+// Nope window.
+func (g *GameState) applyAction(p *PendingAction, res *Resolution) {
+	switch p.Card {
+	case CardSkip:
+		g.endTurn()
+	case CardAttack:
+		g.attack()
+	case CardShuffle:
+		shuffleCards(g.Deck, g.rng())
+		g.botsForget()
+	case CardTargetedAttack:
+		g.targetedAttack(p.Target)
+	case CardSeeTheFuture, CardAlterTheFuture:
+		n := futureSize
+		if n > len(g.Deck) {
+			n = len(g.Deck)
+		}
+		res.Future = append([]string{}, g.Deck[:n]...)
+		g.botRemember(p.Player, res.Future)
+		if p.Card == CardAlterTheFuture && n > 0 {
+			g.Altering = p.Player
+		}
+	case CardFavor:
+		g.askFavor(p.Target, p.Player)
+	case ComboPair, ComboTriple, ComboFive:
+		g.applyCombo(p, res)
+	}
+}
+
+// attack ends the current player's turn without drawing. The next player
+// owes two turns, plus every turn the attacker still owed if they were
+// attacked themselves.
+func (g *GameState) attack() {
+	owed := g.attackOwed()
+	g.advanceTurn()
+	g.TurnsOwed = owed
+	g.Attacked = true
+}
+
+func (g *GameState) attackOwed() int {
+	owed := 2
+	if g.Attacked {
+		owed += g.TurnsOwed
+	}
+	return owed
+}
+
+// takeRandomCard moves a random card from one hand to another and returns
+// it, or "" if the giver has nothing to give.
+func (g *GameState) takeRandomCard(from, to string) string {
+	hand := g.Hands[from]
+	if len(hand) == 0 {
+		return ""
+	}
+	card := hand[g.rng().IntN(len(hand))]
+	g.removeCard(from, card)
+	g.Hands[to] = append(g.Hands[to], card)
+	return card
+}
+
+// publishPlay announces a freshly played action card and arms the timer
+// that closes its Nope window.
+func publishPlay(ctx context.Context, g *GameState, username string, result *PlayResult) {
+	recordEvent(ctx, g.ID, EventCardPlayed, map[string]interface{}{
+		"username": username,
+		"card":     result.Card,
+		"cards":    result.Cards,
+		"target":   result.Target,
+		"named":    result.Named,
+	})
+	hub.broadcast(ctx, g.channel(), EventCardPlayed, map[string]interface{}{
+		"username": username,
+		"card":     result.Card,
+		"cards":    result.Cards,
+		"target":   result.Target,
+		"named":    result.Named,
+		"deadline": g.Pending.Deadline,
+	})
+	scheduleResolution(ctx, g.ID, g.Pending.ID, g.Pending.Deadline)
+}
+
+func playCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	var req PlayRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+
+	expected, err := expectedVersion(r)
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	g, result, err := playFor(ctx, mux.Vars(r)["id"], username, expected, req)
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", g.etag())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// playFor plays a card for username and tells the table, for the REST and
+// gRPC APIs alike.
+func playFor(ctx context.Context, id, username string, expected int64, req PlayRequest) (*GameState, *PlayResult, error) {
+	var (
+		settled *Resolution
+		result  *PlayResult
+	)
+	g, err := applyMove(ctx, id, "play", username, expected, func(g *GameState) (err error) {
+		now := time.Now()
+		settled = g.settle(now)
+		result, err = g.play(username, req.Card, req.Target, now)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// The view comes from the saved game so it carries the new version.
+	result.State = g.turnView()
+	publishResolution(ctx, g, settled)
+	publishPlay(ctx, g, username, result)
+	return g, result, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testGame deals players a hand of the given cards over a deck of skips,
+// with the first player to move.
+func testGame(hand []string, players ...string) *GameState {
+	g := &GameState{
+		ID:        "g1",
+		Players:   players,
+		Hands:     map[string][]string{},
+		Status:    GameActive,
+		TurnsOwed: 1,
+	}
+	for _, p := range players {
+		g.Hands[p] = append([]string{}, hand...)
+	}
+	for i := 0; i < 10; i++ {
+		g.Deck = append(g.Deck, CardSkip)
+	}
+	return g
+}
+
+// mustPlay plays a card and lets its Nope window close unanswered.
+func mustPlay(t *testing.T, g *GameState, username, card, target string) *Resolution {
+	t.Helper()
+	now := time.Now()
+	if _, err := g.play(username, card, target, now); err != nil {
+		t.Fatalf("%s playing %s: %v", username, card, err)
+	}
+	res := g.settle(now.Add(nopeWindow))
+	if res == nil {
+		t.Fatalf("%s's %s did not resolve", username, card)
+	}
+	return res
+}
+
+func mustDraw(t *testing.T, g *GameState, username string) *DrawResult {
+	t.Helper()
+	res, err := g.draw(username)
+	if err != nil {
+		t.Fatalf("%s drawing: %v", username, err)
+	}
+	return res
+}
+
+func TestPlay(t *testing.T) {
+	tests := []struct {
+		name   string
+		card   string
+		target string
+		check  func(t *testing.T, g *GameState, res *Resolution)
+	}{
+		{
+			name: "skip ends the turn",
+			card: CardSkip,
+			check: func(t *testing.T, g *GameState, res *Resolution) {
+				if got := g.currentPlayer(); got != "bob" {
+					t.Errorf("current player is %s, want bob", got)
+				}
+			},
+		},
+		{
+			name: "see the future shows the top three",
+			card: CardSeeTheFuture,
+			check: func(t *testing.T, g *GameState, res *Resolution) {
+				if want := g.Deck[:futureSize]; !reflect.DeepEqual(res.Future, want) {
+					t.Errorf("saw %v, want %v", res.Future, want)
+				}
+				if got := g.currentPlayer(); got != "alice" {
+					t.Errorf("current player is %s, want alice", got)
+				}
+			},
+		},
+		{
+			name:   "favor leaves the target owing a card",
+			card:   CardFavor,
+			target: "bob",
+			check: func(t *testing.T, g *GameState, res *Resolution) {
+				if f := g.Favor; f == nil || f.From != "bob" || f.To != "alice" {
+					t.Fatalf("favor owed is %+v, want bob owing alice", f)
+				}
+				if len(g.Hands["bob"]) != 4 {
+					t.Errorf("bob holds %d cards, want 4", len(g.Hands["bob"]))
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{tt.card, CardShuffle, CardNope, CardDefuse}, "alice", "bob")
+			res := mustPlay(t, g, "alice", tt.card, tt.target)
+			want := 3
+			if res.Received != "" {
+				want++
+			}
+			if got := len(g.Hands["alice"]); got != want {
+				t.Errorf("alice holds %d cards, want %d", got, want)
+			}
+			tt.check(t, g, res)
+		})
+	}
+}
+
+func TestPlayRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		card   string
+		target string
+		want   error
+	}{
+		{"out of turn", "bob", CardSkip, "", errNotYourTurn},
+		{"card not held", "alice", CardAttack, "", errCardNotInHand},
+		{"nope with nothing to nope", "alice", CardNope, "", errNothingToNope},
+		{"defuse on its own", "alice", CardDefuse, "", errCardNotPlayable},
+		{"favor from yourself", "alice", CardFavor, "alice", errInvalidTarget},
+		{"favor from a stranger", "alice", CardFavor, "carol", errInvalidTarget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardSkip, CardFavor, CardNope, CardDefuse}, "alice", "bob")
+			if _, err := g.play(tt.player, tt.card, tt.target, time.Now()); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttackStacksOwedTurns(t *testing.T) {
+	tests := []struct {
+		name   string
+		moves  func(t *testing.T, g *GameState)
+		player string
+		owed   int
+	}{
+		{
+			name: "attack",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardAttack, "")
+			},
+			player: "bob",
+			owed:   2,
+		},
+		{
+			name: "attack back at once",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardAttack, "")
+				mustPlay(t, g, "bob", CardAttack, "")
+			},
+			player: "carol",
+			owed:   4,
+		},
+		{
+			name: "attack back after one turn",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardAttack, "")
+				mustDraw(t, g, "bob")
+				mustPlay(t, g, "bob", CardAttack, "")
+			},
+			player: "carol",
+			owed:   3,
+		},
+		{
+			name: "attack after serving an attack",
+			moves: func(t *testing.T, g *GameState) {
+				mustPlay(t, g, "alice", CardAttack, "")
+				mustDraw(t, g, "bob")
+				mustDraw(t, g, "bob")
+				mustPlay(t, g, "carol", CardAttack, "")
+			},
+			player: "alice",
+			owed:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame([]string{CardAttack, CardAttack}, "alice", "bob", "carol")
+			tt.moves(t, g)
+			if got := g.currentPlayer(); got != tt.player {
+				t.Fatalf("current player is %s, want %s", got, tt.player)
+			}
+			if g.TurnsOwed != tt.owed {
+				t.Errorf("%s owes %d turns, want %d", tt.player, g.TurnsOwed, tt.owed)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultSavedGameTTL = 30 * 24 * time.Hour
+
+// savedGameTTL is how long a single-player game is kept after its last
+// move, suspended or not. Set with SAVED_GAME_TTL.
+var savedGameTTL = defaultSavedGameTTL
+
+var (
+	errGameSuspended = errors.New("game is suspended, resume it first")
+	errNotSuspended  = errors.New("game is not suspended")
+	errNotSolo       = errors.New("only single-player games can be suspended")
+)
+
+// SavedGame is a player's view of one of their games, with their hand.
+type SavedGame struct {
+	State *TurnView `json:"state"`
+	Hand  []string  `json:"hand"`
+}
+
+// solo reports whether this is a single-player game outside any room.
+func (g *GameState) solo() bool {
+	return g.RoomID == "" && len(g.Players) == 1
+}
+
+// ttl is how long the game is kept after a write. Multiplayer games are
+// kept until they are cleaned up.
+func (g *GameState) ttl() time.Duration {
+	if g.solo() {
+		return savedGameTTL
+	}
+	return 0
+}
+
+// expiresAt is when an untouched game will be deleted, if ever.
+func (g *GameState) expiresAt() *time.Time {
+	if g.ttl() == 0 || g.UpdatedAt.IsZero() {
+		return nil
+	}
+	at := g.UpdatedAt.Add(g.ttl())
+	return &at
+}
+
+func (g *GameState) suspend(username string) error {
+	if !g.hasPlayer(username) {
+		return errNotInGame
+	}
+	if !g.solo() {
+		return errNotSolo
+	}
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	g.Status = GameSuspended
+	return nil
+}
+
+func (g *GameState) resume(username string) error {
+	if !g.hasPlayer(username) {
+		return errNotInGame
+	}
+	if g.Status != GameSuspended {
+		return errNotSuspended
+	}
+	g.Status = GameActive
+	return nil
+}
+
+// listGames returns the caller's ongoing games, optionally only those with
+// the given status.
+func listGames(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	status := r.URL.Query().Get("status")
+	if status != "" && status != GameActive && status != GameSuspended {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Status must be active or suspended")
+		return
+	}
+
+	ids, err := rdb.ZRevRange(ctx, activeGamesKey(username), 0, -1).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading games")
+		return
+	}
+
+	saved := []SavedGame{}
+	for _, id := range ids {
+		g, err := loadGame(ctx, id)
+		if err == errGameNotFound {
+			untrackActiveGame(ctx, id, username)
+			continue
+		}
+		if err != nil {
+			respondInternal(w, r, err, "Error loading games")
+			return
+		}
+		if status != "" && g.Status != status {
+			continue
+		}
+		saved = append(saved, SavedGame{State: g.turnView(), Hand: g.Hands[username]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
+
+func suspendGame(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	g, err := updateGameAs(ctx, mux.Vars(r)["id"], "suspend", username, func(g *GameState) error {
+		return g.suspend(username)
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", g.etag())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g.turnView())
+}
+
+func resumeGame(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	g, err := updateGameAs(ctx, mux.Vars(r)["id"], "resume", username, func(g *GameState) error {
+		return g.resume(username)
+	})
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", g.etag())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(SavedGame{State: g.turnView(), Hand: g.Hands[username]})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// scanBatch is the COUNT hint for each SCAN call, and so roughly how many
+// keys each batch holds.
+const scanBatch = 500
+
+// scanBatches walks the keyspace with SCAN, calling fn with each batch of
+// keys matching pattern. Unlike KEYS it never blocks Redis for the whole
+// walk, but a key may turn up twice, or not at all if it is created or
+// deleted meanwhile.
+func scanBatches(ctx context.Context, client redis.UniversalClient, pattern string, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, scanBatch).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// scanKeys calls fn with every key matching pattern.
+func scanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	return scanBatches(ctx, rdb, pattern, func(keys []string) error {
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanValues calls fn with every string key matching pattern and its
+// value, fetching each batch with one MGET. Keys that expired since the
+// SCAN, or that hold something other than a string, are skipped.
+func scanValues(ctx context.Context, client redis.UniversalClient, pattern string, fn func(key, value string) error) error {
+	return scanBatches(ctx, client, pattern, func(keys []string) error {
+		values, err := client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			value, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if err := fn(keys[i], value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
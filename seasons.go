@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	currentSeasonKey = "season:current"
+	seasonArchiveKey = "seasons:archive"
+
+	// Seasons roll over at midnight UTC at the start of every quarter
+	// unless SEASON_SCHEDULE says otherwise.
+	defaultSeasonSchedule = "0 0 1 1,4,7,10 *"
+)
+
+var errSeasonNotFound = errors.New("season not found")
+
+type Season struct {
+	ID        string `json:"id"`
+	StartedAt string `json:"started_at"`
+	ClosedAt  string `json:"closed_at,omitempty"`
+}
+
+func seasonKey(id string) string {
+	return fmt.Sprintf("season:%s", id)
+}
+
+func seasonLeaderboardKey(id string) string {
+	return fmt.Sprintf("leaderboard:season:%s", id)
+}
+
+// nextSeasonID numbers seasons within a year: 2024-S1, 2024-S2, ... and
+// restarts at S1 when the year changes.
+func nextSeasonID(current string, now time.Time) string {
+	year := now.UTC().Year()
+	parts := strings.SplitN(current, "-S", 2)
+	if len(parts) == 2 && parts[0] == strconv.Itoa(year) {
+		if n, err := strconv.Atoi(parts[1]); err == nil {
+			return fmt.Sprintf("%d-S%d", year, n+1)
+		}
+	}
+	return fmt.Sprintf("%d-S1", year)
+}
+
+func currentSeason(ctx context.Context) (string, error) {
+	id, err := rdb.Get(ctx, currentSeasonKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return id, err
+}
+
+func openSeason(ctx context.Context, pipe redis.Pipeliner, id string, now time.Time) {
+	pipe.Set(ctx, currentSeasonKey, id, 0)
+	pipe.HSet(ctx, seasonKey(id), "started_at", now.UTC().Format(time.RFC3339))
+}
+
+// ensureSeason opens the first season if none has been started yet.
+func ensureSeason(ctx context.Context) error {
+	id := nextSeasonID("", time.Now())
+	ok, err := rdb.SetNX(ctx, currentSeasonKey, id, 0).Result()
+	if err != nil || !ok {
+		return err
+	}
+	return rdb.HSet(ctx, seasonKey(id), "started_at", time.Now().UTC().Format(time.RFC3339)).Err()
+}
+
+// rolloverSeason closes the current season, freezing its standings, and
+// opens the next one. The WATCH makes concurrent rollovers from several
+// instances collapse into one.
+func rolloverSeason(ctx context.Context, now time.Time) error {
+	return rdb.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, currentSeasonKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		next := nextSeasonID(current, now)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if current != "" {
+				pipe.HSet(ctx, seasonKey(current), "closed_at", now.UTC().Format(time.RFC3339))
+				pipe.LPush(ctx, seasonArchiveKey, current)
+			}
+			openSeason(ctx, pipe, next, now)
+			return nil
+		})
+		if err == nil {
+			slog.Info("rolled over season", "closed", current, "opened", next)
+		}
+		return err
+	}, currentSeasonKey)
+}
+
+// startSeasonScheduler queues a season rollover on schedule
+// (SEASON_SCHEDULE). Every instance's scheduler fires; the rollover is
+// queued once.
+func startSeasonScheduler(ctx context.Context, schedule string) *cron.Cron {
+	c := cron.New(cron.WithLocation(time.UTC))
+	_, err := c.AddFunc(schedule, func() {
+		now := time.Now().UTC().Truncate(time.Minute)
+		err := enqueueJobOnce(ctx, "season:"+now.Format(time.RFC3339), time.Hour, JobSeasonRollover, SeasonRolloverJob{At: now})
+		if err != nil {
+			slog.Error("queueing season rollover", "err", err)
+		}
+	})
+	if err != nil {
+		fatal("invalid SEASON_SCHEDULE", "value", schedule, "err", err)
+	}
+	c.Start()
+	return c
+}
+
+func loadSeason(ctx context.Context, id string) (*Season, error) {
+	fields, err := rdb.HGetAll(ctx, seasonKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errSeasonNotFound
+	}
+	return &Season{
+		ID:        id,
+		StartedAt: fields["started_at"],
+		ClosedAt:  fields["closed_at"],
+	}, nil
+}
+
+// leaderboardFor resolves the ?season= parameter to the sorted set holding
+// that season's standings. Without it the lifetime leaderboard is used.
+func leaderboardFor(r *http.Request) (string, error) {
+	ctx := r.Context()
+	return seasonLeaderboard(ctx, r.URL.Query().Get("season"))
+}
+
+// seasonLeaderboard is the board for a season's ID, or the lifetime board
+// for "".
+func seasonLeaderboard(ctx context.Context, id string) (string, error) {
+	if id == "" {
+		return leaderboardKey, nil
+	}
+	if _, err := loadSeason(ctx, id); err != nil {
+		return "", err
+	}
+	return seasonLeaderboardKey(id), nil
+}
+
+// seasonIDs lists every season, the current one first and then the
+// archive newest first.
+func seasonIDs(ctx context.Context) ([]string, error) {
+	current, err := currentSeason(ctx)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := rdb.LRange(ctx, seasonArchiveKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if current == "" {
+		return archived, nil
+	}
+	return append([]string{current}, archived...), nil
+}
+
+func listSeasons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current, err := currentSeason(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading seasons")
+		return
+	}
+	ids, err := seasonIDs(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading seasons")
+		return
+	}
+
+	seasons := []*Season{}
+	for _, id := range ids {
+		season, err := loadSeason(ctx, id)
+		if err != nil {
+			continue
+		}
+		seasons = append(seasons, season)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current": current,
+		"seasons": seasons,
+	})
+}
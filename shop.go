@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Coins paid out for winning a game and for each point a challenge
+// rewards.
+const (
+	coinsPerWin            = 10
+	coinsPerChallengePoint = 10
+)
+
+// Kinds of cosmetic.
+const (
+	CosmeticCardBack = "card_back"
+	CosmeticAvatar   = "avatar"
+)
+
+var (
+	errItemNotFound      = errors.New("no such item")
+	errItemOwned         = errors.New("you already own this item")
+	errInsufficientCoins = errors.New("not enough coins")
+	errAvatarNotOwned    = errors.New("buy this avatar in the shop first")
+)
+
+// Cosmetic is an item players can buy with coins. Like avatars and emotes,
+// clients draw it from the ID.
+type Cosmetic struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Price int    `json:"price"`
+}
+
+var cosmetics = []Cosmetic{
+	{ID: "back_classic_red", Kind: CosmeticCardBack, Name: "Classic Red", Price: 50},
+	{ID: "back_midnight", Kind: CosmeticCardBack, Name: "Midnight", Price: 100},
+	{ID: "back_hairy_potato", Kind: CosmeticCardBack, Name: "Hairy Potato", Price: 150},
+	{ID: "back_rainbow", Kind: CosmeticCardBack, Name: "Rainbow-Ralphing", Price: 250},
+	{ID: "back_gold", Kind: CosmeticCardBack, Name: "Solid Gold", Price: 500},
+	{ID: "beard_cat", Kind: CosmeticAvatar, Name: "Beard Cat", Price: 100},
+	{ID: "cattermelon", Kind: CosmeticAvatar, Name: "Cattermelon", Price: 150},
+	{ID: "tacocat_deluxe", Kind: CosmeticAvatar, Name: "Tacocat Deluxe", Price: 200},
+	{ID: "exploding_kitten", Kind: CosmeticAvatar, Name: "Exploding Kitten", Price: 400},
+}
+
+func findCosmetic(id string) (Cosmetic, bool) {
+	for _, c := range cosmetics {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return Cosmetic{}, false
+}
+
+// shopAvatar reports whether an avatar has to be bought.
+func shopAvatar(id string) bool {
+	c, ok := findCosmetic(id)
+	return ok && c.Kind == CosmeticAvatar
+}
+
+func coinsKey(username string) string {
+	return fmt.Sprintf("player:%s:coins", username)
+}
+
+// inventoryKey holds the IDs of the cosmetics a player owns.
+func inventoryKey(username string) string {
+	return fmt.Sprintf("player:%s:inventory", username)
+}
+
+func coinBalance(ctx context.Context, username string) (int, error) {
+	n, err := rdb.Get(ctx, coinsKey(username)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func awardCoins(ctx context.Context, username string, n int) error {
+	return rdb.IncrBy(ctx, coinsKey(username), int64(n)).Err()
+}
+
+func ownsCosmetic(ctx context.Context, username, id string) (bool, error) {
+	return rdb.SIsMember(ctx, inventoryKey(username), id).Result()
+}
+
+// purchase takes the price from the balance and adds the item to the
+// inventory in one step, so concurrent purchases can't overspend. It
+// returns -1 if the item is owned, -2 if the balance is short, and the new
+// balance otherwise.
+var purchase = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[2], ARGV[1]) == 1 then
+	return -1
+end
+local price = tonumber(ARGV[2])
+local balance = tonumber(redis.call('GET', KEYS[1])) or 0
+if balance < price then
+	return -2
+end
+balance = redis.call('DECRBY', KEYS[1], price)
+redis.call('SADD', KEYS[2], ARGV[1])
+return balance
+`)
+
+func buyCosmetic(ctx context.Context, username string, item Cosmetic) (int, error) {
+	res, err := purchase.Run(ctx, rdb, []string{coinsKey(username), inventoryKey(username)}, item.ID, item.Price).Int()
+	if err != nil {
+		return 0, err
+	}
+	switch res {
+	case -1:
+		return 0, errItemOwned
+	case -2:
+		return 0, errInsufficientCoins
+	}
+	return res, nil
+}
+
+func listCosmetics(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	items := []Cosmetic{}
+	for _, c := range cosmetics {
+		if kind == "" || c.Kind == kind {
+			items = append(items, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func purchaseCosmetic(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	item, ok := findCosmetic(mux.Vars(r)["id"])
+	if !ok {
+		respondError(w, r, http.StatusNotFound, errItemNotFound)
+		return
+	}
+
+	balance, err := buyCosmetic(ctx, username, item)
+	if err == errItemOwned {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err == errInsufficientCoins {
+		respondError(w, r, http.StatusPaymentRequired, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error buying item")
+		return
+	}
+	logFor(r).Info("cosmetic purchased", "username", username, "item", item.ID, "price", item.Price)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"item":  item,
+		"coins": balance,
+	})
+}
+
+// getInventory lists the caller's coins and the cosmetics they own.
+func getInventory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+
+	balance, err := coinBalance(ctx, username)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading inventory")
+		return
+	}
+	owned, err := rdb.SMembers(ctx, inventoryKey(username)).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error loading inventory")
+		return
+	}
+	ownedSet := map[string]bool{}
+	for _, id := range owned {
+		ownedSet[id] = true
+	}
+	// Catalog order, so inventories read the same as the shop.
+	items := []Cosmetic{}
+	for _, c := range cosmetics {
+		if ownedSet[c.ID] {
+			items = append(items, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"coins": balance,
+		"items": items,
+	})
+}
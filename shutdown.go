@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownTimeout bounds how long in-flight requests get to finish once a
+// shutdown signal arrives.
+const shutdownTimeout = 30 * time.Second
+
+// serve runs the HTTP server, over TLS when hc says so, until SIGINT or
+// SIGTERM, then stops taking connections, lets in-flight requests finish
+// and runs the cleanup hooks.
+func serve(addr string, handler http.Handler, hc HTTPSConfig, cleanup ...func()) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	run, redirect := listener(srv, hc)
+
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- run()
+	}()
+	if redirect != nil {
+		go func() {
+			errs <- redirect.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server stopped", "err", err)
+		}
+		return
+	case <-stop.Done():
+	}
+
+	slog.Info("shutting down")
+	timeout, done := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer done()
+
+	// Websockets are hijacked connections that Shutdown does not track, so
+	// they are told to reconnect elsewhere explicitly.
+	hub.closeAll(websocket.CloseServiceRestart, "server restarting")
+	if err := srv.Shutdown(timeout); err != nil {
+		slog.Error("draining requests", "err", err)
+	}
+	if redirect != nil {
+		redirect.Shutdown(timeout)
+	}
+	for _, fn := range cleanup {
+		fn()
+	}
+	slog.Info("shutdown complete")
+}
+
+// resumeGames re-arms the timers that drive live games: Nope windows that
+// were still open, bots whose turn it is and turn clocks. All of them only
+// exist in memory, so they are lost when an instance stops.
+func resumeGames(ctx context.Context) {
+	ids, err := rdb.SMembers(ctx, liveRoomsKey).Result()
+	if err != nil {
+		slog.Error("listing live rooms", "err", err)
+		return
+	}
+	for _, id := range ids {
+		room, err := loadRoom(ctx, id)
+		if err != nil || room.GameID == "" {
+			continue
+		}
+		g, err := loadGame(ctx, room.GameID)
+		if err != nil || g.Status != GameActive {
+			continue
+		}
+		if g.Pending != nil {
+			scheduleResolution(ctx, g.ID, g.Pending.ID, g.Pending.Deadline)
+			continue
+		}
+		rdb.Del(ctx, botLockKey(g.ID))
+		scheduleBotTurn(ctx, g)
+		watchTurn(ctx, g)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EventStreamClosed is the last event on a stream the server ends, such as
+// when restarting, carrying the reason.
+const EventStreamClosed = "stream_closed"
+
+// sseRetry is how long browsers wait before reconnecting a dropped stream.
+const sseRetry = 3 * time.Second
+
+// streamGameEvents serves a game's events as server-sent events, for
+// clients behind proxies that break websockets. Each event is the same
+// JSON the websocket sends, with its seq as the event ID, so a reconnecting
+// EventSource resumes from Last-Event-ID. Clients that reconnect by hand
+// can pass ?since= instead. EventSource cannot set headers, so the access
+// token may be passed as ?token= as for websockets.
+func streamGameEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, err := lastEventID(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Last-Event-ID must be an event seq")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Streaming is not supported")
+		return
+	}
+
+	c, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	client, _, missed, err := joinGameStream(ctx, currentUser(r), mux.Vars(r)["id"], since, cancel)
+	if err != nil {
+		respondGameError(w, r, err)
+		return
+	}
+	// The request context is gone once the client hangs up.
+	defer leaveGameStream(context.WithoutCancel(ctx), client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Buffering proxies would hold events back until the stream ends.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	for _, data := range missed {
+		writeSSE(w, data)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(pingPeriod)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Done():
+			// The hub ends streams with the reason it gives websockets a
+			// close frame; a client that hung up is owed nothing.
+			if cause := context.Cause(c); r.Context().Err() == nil && !errors.Is(cause, context.Canceled) {
+				data, _ := json.Marshal(Event{
+					Type:    EventStreamClosed,
+					Payload: map[string]string{"reason": cause.Error()},
+					Time:    time.Now().UTC(),
+				})
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		case data, ok := <-client.send:
+			if !ok {
+				// Dropped by the hub for falling behind; the client
+				// reconnects and resumes.
+				return
+			}
+			writeSSE(w, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			// Comments keep idle proxies from timing the stream out.
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			touchPresence(ctx, client)
+		}
+	}
+}
+
+// writeSSE writes one hub event as a server-sent event.
+func writeSSE(w http.ResponseWriter, data []byte) {
+	var ev struct {
+		Seq int64 `json:"seq"`
+	}
+	json.Unmarshal(data, &ev)
+	if ev.Seq > 0 {
+		fmt.Fprintf(w, "id: %d\n", ev.Seq)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// lastEventID is the seq a client last saw, from the Last-Event-ID header
+// an EventSource sends when reconnecting, or ?since=.
+func lastEventID(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("since")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, errors.New("bad event ID")
+	}
+	return seq, nil
+}
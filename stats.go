@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// onlinePlayersKey holds everyone with a live connection on any
+	// instance, scored by when their presence lapses without a heartbeat.
+	onlinePlayersKey = "stats:online"
+	// liveGamesKey holds every game in progress, scored by start time.
+	liveGamesKey = "stats:games:active"
+	// dailyStatsKeep is how long each day's counters are kept.
+	dailyStatsKeep = 8 * 24 * time.Hour
+)
+
+// dailyStatsKey counts finished games and matches over one UTC day.
+func dailyStatsKey(day time.Time) string {
+	return fmt.Sprintf("stats:daily:%s", day.UTC().Format("2006-01-02"))
+}
+
+// OpsStats is how the game is doing right now, for the ops dashboard.
+// Today is the current UTC day.
+type OpsStats struct {
+	OnlinePlayers int64            `json:"online_players"`
+	Games         GameOpsStats     `json:"games"`
+	Matchmaking   MatchmakingStats `json:"matchmaking"`
+	GeneratedAt   time.Time        `json:"generated_at"`
+}
+
+// GameOpsStats covers the games in play and those finished today.
+type GameOpsStats struct {
+	Active        int64 `json:"active"`
+	FinishedToday int64 `json:"finished_today"`
+	// AverageDuration is over games finished today, in seconds.
+	AverageDuration float64 `json:"average_duration_seconds"`
+}
+
+// MatchmakingStats covers the queue now and the players matched today.
+type MatchmakingStats struct {
+	Queued       int64   `json:"queued"`
+	LongestWait  int64   `json:"longest_wait_seconds"`
+	MatchedToday int64   `json:"matched_today"`
+	AverageWait  float64 `json:"average_wait_seconds"`
+}
+
+// markOnline counts username as online until their presence lapses.
+func markOnline(ctx context.Context, pipe redis.Pipeliner, username string, now time.Time) {
+	pipe.ZAdd(ctx, onlinePlayersKey, &redis.Z{Score: float64(now.Add(presenceTTL).Unix()), Member: username})
+}
+
+// markOffline stops counting username once their last connection closes.
+func markOffline(ctx context.Context, username string) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	live, err := rdb.ZCount(ctx, presenceConnectionsKey(username), now, "+inf").Result()
+	if err != nil || live > 0 {
+		return
+	}
+	rdb.ZRem(ctx, onlinePlayersKey, username)
+}
+
+// countGameEnded stops counting a game that ended without finishing.
+func countGameEnded(ctx context.Context, gameID string) {
+	if err := rdb.ZRem(ctx, liveGamesKey, gameID).Err(); err != nil {
+		slog.Error("counting game", "game", gameID, "err", err)
+	}
+}
+
+// countGameFinished adds a finished game and how long it took to today's
+// counters.
+func countGameFinished(ctx context.Context, g *GameState, now time.Time) {
+	key := dailyStatsKey(now)
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, liveGamesKey, g.ID)
+	pipe.HIncrBy(ctx, key, "games_finished", 1)
+	pipe.HIncrBy(ctx, key, "game_seconds", int64(now.Sub(g.StartedAt).Seconds()))
+	pipe.Expire(ctx, key, dailyStatsKeep)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("counting finished game", "game", g.ID, "err", err)
+	}
+}
+
+// countMatched adds how long each player in a new match waited to today's
+// counters.
+func countMatched(ctx context.Context, group []queuedPlayer, now time.Time) {
+	var waited int64
+	for _, p := range group {
+		waited += int64(now.Sub(p.JoinedAt).Seconds())
+	}
+	key := dailyStatsKey(now)
+	pipe := rdb.TxPipeline()
+	pipe.HIncrBy(ctx, key, "players_matched", int64(len(group)))
+	pipe.HIncrBy(ctx, key, "match_wait_seconds", waited)
+	pipe.Expire(ctx, key, dailyStatsKeep)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("counting match", "err", err)
+	}
+}
+
+// pruneLiveGames drops games that went quietly, such as saved games left to
+// expire, from liveGamesKey. Only games older than idleGameTTL are checked,
+// since anything newer can't have been expired yet.
+func pruneLiveGames(ctx context.Context, now time.Time) error {
+	cutoff := strconv.FormatInt(now.Add(-idleGameTTL).Unix(), 10)
+	ids, err := rdb.ZRangeByScore(ctx, liveGamesKey, &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		g, err := loadGame(ctx, id)
+		if err != nil && err != errGameNotFound {
+			return err
+		}
+		if err == errGameNotFound || g.Status != GameActive {
+			countGameEnded(ctx, id)
+		}
+	}
+	return nil
+}
+
+func perItem(total, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
+
+// getAdminStats reports live counts for ops: who is online, the games in
+// play and finished today, and how long matchmaking is taking.
+func getAdminStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := time.Now().UTC()
+	if err := pruneLiveGames(ctx, now); err != nil {
+		respondInternal(w, r, err, "Error loading stats")
+		return
+	}
+
+	unix := strconv.FormatInt(now.Unix(), 10)
+	pipe := rdb.Pipeline()
+	pipe.ZRemRangeByScore(ctx, onlinePlayersKey, "-inf", "("+unix)
+	online := pipe.ZCard(ctx, onlinePlayersKey)
+	active := pipe.ZCard(ctx, liveGamesKey)
+	queued := pipe.ZCard(ctx, matchQueueKey)
+	oldest := pipe.ZRangeWithScores(ctx, matchQueueKey, 0, 0)
+	daily := pipe.HGetAll(ctx, dailyStatsKey(now))
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondInternal(w, r, err, "Error loading stats")
+		return
+	}
+
+	counter := func(field string) int64 {
+		n, _ := strconv.ParseInt(daily.Val()[field], 10, 64)
+		return n
+	}
+	stats := OpsStats{
+		OnlinePlayers: online.Val(),
+		Games: GameOpsStats{
+			Active:          active.Val(),
+			FinishedToday:   counter("games_finished"),
+			AverageDuration: perItem(counter("game_seconds"), counter("games_finished")),
+		},
+		Matchmaking: MatchmakingStats{
+			Queued:       queued.Val(),
+			MatchedToday: counter("players_matched"),
+			AverageWait:  perItem(counter("match_wait_seconds"), counter("players_matched")),
+		},
+		GeneratedAt: now,
+	}
+	if first := oldest.Val(); len(first) > 0 {
+		stats.Matchmaking.LongestWait = now.Unix() - int64(first[0].Score)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
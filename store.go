@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errNotRanked    = errors.New("player is not on the leaderboard")
+	errGameBusy     = errors.New("game is busy, try again")
+	errStaleVersion = errors.New("game has changed since that version")
+)
+
+// UserStore persists player accounts.
+type UserStore interface {
+	// CreateUser adds a registered account, failing with errUsernameTaken
+	// if the name is in use.
+	CreateUser(ctx context.Context, username, passwordHash string) error
+	// CreateGuest adds a guest account that expires after ttl unless it is
+	// upgraded.
+	CreateGuest(ctx context.Context, username string, ttl time.Duration) error
+	// PasswordHash returns errUserNotFound for unknown or guest accounts.
+	PasswordHash(ctx context.Context, username string) (string, error)
+	// SetPasswordHash returns errUserNotFound for unknown or guest
+	// accounts.
+	SetPasswordHash(ctx context.Context, username, passwordHash string) error
+	UserExists(ctx context.Context, username string) (bool, error)
+	IsGuest(ctx context.Context, username string) (bool, error)
+	DeleteUser(ctx context.Context, username string) error
+	// RenameUser moves an account to a new name, failing with
+	// errUsernameTaken if it is in use or errUserNotFound if there is no
+	// account to move.
+	RenameUser(ctx context.Context, from, to string) error
+	// Role returns an account's role, RolePlayer unless one was assigned,
+	// or errUserNotFound.
+	Role(ctx context.Context, username string) (string, error)
+	// SetRole returns errUserNotFound for unknown accounts.
+	SetRole(ctx context.Context, username, role string) error
+	// LoadAccount returns errUserNotFound for unknown accounts.
+	LoadAccount(ctx context.Context, username string) (*Account, error)
+	// SearchUsers pages through accounts whose name starts with prefix,
+	// ignoring case, in name order, and returns how many match in all.
+	SearchUsers(ctx context.Context, prefix string, limit, offset int) ([]Account, int64, error)
+	// Profile returns errUserNotFound for unknown accounts. Fields a player
+	// has never set are empty.
+	Profile(ctx context.Context, username string) (*Profile, error)
+	// SetProfile returns errUserNotFound for unknown accounts.
+	SetProfile(ctx context.Context, username string, p *Profile) error
+}
+
+// Profile is what a player chooses to show about themselves.
+type Profile struct {
+	Avatar       string `json:"avatar"`
+	Bio          string `json:"bio"`
+	FavoriteCard string `json:"favorite_card"`
+}
+
+// Account is what the admin API shows of a player's account.
+type Account struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Guest     bool      `json:"guest"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HistoryStore archives finished games and keeps lifetime player stats.
+type HistoryStore interface {
+	// RecordGame archives a game and folds it into each participant's
+	// stats. Recording the same game twice is a no-op.
+	RecordGame(ctx context.Context, record *GameRecord, participants []string) error
+	PlayerStats(ctx context.Context, username string) (*PlayerStats, error)
+	// CurrentStreaks reads many players' current win streaks at once.
+	// Players who have never finished a game are on a streak of zero.
+	CurrentStreaks(ctx context.Context, usernames []string) (map[string]int, error)
+	// PlayerGames pages through a player's games, newest first, and
+	// returns the total number of games they have played.
+	PlayerGames(ctx context.Context, username string, limit, offset int) ([]GameRecord, int64, error)
+	// MoveHistory hands one player's games and stats to another name.
+	MoveHistory(ctx context.Context, from, to string) error
+	// DeleteHistory forgets a player's game list and stats. The games
+	// themselves stay on record for the other players in them.
+	DeleteHistory(ctx context.Context, username string) error
+}
+
+// GameStore persists game state.
+type GameStore interface {
+	// LoadGame returns errGameNotFound for unknown ids.
+	LoadGame(ctx context.Context, id string) (*GameState, error)
+	// SaveGame writes g only if the stored game is still at g.Version,
+	// failing with errStaleVersion otherwise. Every write bumps Version,
+	// stamps UpdatedAt and restarts the game's TTL.
+	SaveGame(ctx context.Context, g *GameState) error
+	// UpdateGame loads a game, applies change and saves the result as one
+	// atomic step, so concurrent moves cannot overwrite each other. change
+	// may run more than once and must only touch the game it is given; if
+	// it returns an error nothing is saved and that error is returned.
+	UpdateGame(ctx context.Context, id string, change func(g *GameState) error) (*GameState, error)
+	// DeleteGame removes a game. Deleting a missing game is a no-op.
+	DeleteGame(ctx context.Context, id string) error
+}
+
+// LeaderboardStore keeps ranked scores on named boards: the lifetime
+// leaderboard and one board per season.
+type LeaderboardStore interface {
+	// AddPlayer lists a player with a zero score, leaving any existing
+	// score alone.
+	AddPlayer(ctx context.Context, board, username string) error
+	// IncrementScore adds to a player's score on every given board at once.
+	IncrementScore(ctx context.Context, username string, by int, boards ...string) error
+	// IncrementScoreOnce is IncrementScore guarded by marker: it sets the
+	// marker for keep and adds the score in one step, or does neither if
+	// the marker is already set. It reports whether the score was added.
+	IncrementScoreOnce(ctx context.Context, marker string, keep time.Duration, username string, by int, boards ...string) (bool, error)
+	SetScore(ctx context.Context, board, username string, score int) error
+	// Score returns errNotRanked for players missing from the board.
+	Score(ctx context.Context, board, username string) (int, error)
+	RemovePlayer(ctx context.Context, board, username string) error
+	Count(ctx context.Context, board string) (int64, error)
+	// Range returns players ranked start..stop (0-based, inclusive) with
+	// their 1-based rank filled in.
+	Range(ctx context.Context, board string, start, stop int64) ([]Player, error)
+	// Rank returns a player's 0-based position, or errNotRanked.
+	Rank(ctx context.Context, board, username string) (int64, error)
+}
+
+// checkStoredVersion compares an encoded stored game, or nil if there is
+// none yet, with the version a writer loaded.
+func checkStoredVersion(stored []byte, version int64) error {
+	if stored == nil {
+		if version != 0 {
+			return errGameNotFound
+		}
+		return nil
+	}
+	var current struct {
+		Version int64 `json:"version"`
+	}
+	if err := json.Unmarshal(stored, &current); err != nil {
+		return err
+	}
+	if current.Version != version {
+		return errStaleVersion
+	}
+	return nil
+}
+
+var (
+	users        UserStore
+	games        GameStore
+	histories    HistoryStore
+	leaderboards LeaderboardStore
+)
+
+// configureStores picks the storage backends. STORAGE=postgres moves
+// accounts and game history to the database at DATABASE_URL; everything
+// else always lives in Redis. STORAGE=memory needs no services at all: the
+// stores live in process and the Redis-only features run against an
+// embedded Redis.
+func configureStores(ctx context.Context, cfg *Config) {
+	if cfg.Storage == "memory" {
+		mr, err := miniredis.Run()
+		if err != nil {
+			fatal("starting embedded Redis", "err", err)
+		}
+		rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		mem := newMemoryStore()
+		users, games, histories, leaderboards = mem, mem, mem, mem
+		slog.Warn("using in-memory storage; nothing will survive a restart")
+		return
+	}
+
+	store := newRedisStore(rdb)
+	users, games, histories, leaderboards = store, store, store, store
+
+	if cfg.Storage == "postgres" {
+		pg, err := openPostgres(ctx, cfg.DatabaseURL)
+		if err != nil {
+			fatal("opening Postgres", "err", err)
+		}
+		users, histories = pg, pg
+	}
+}
+
+// closeStores releases the storage connections on shutdown.
+func closeStores() {
+	if pg, ok := users.(*PostgresStore); ok {
+		pg.db.Close()
+	}
+	rdb.Close()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// testStore is everything a storage backend implements.
+type testStore interface {
+	UserStore
+	GameStore
+	HistoryStore
+	LeaderboardStore
+}
+
+// testStores returns a fresh instance of each backend that can run
+// in-process, so the same checks cover all of them.
+func testStores(t *testing.T) map[string]testStore {
+	t.Helper()
+	mr := testRedis(t)
+	return map[string]testStore{
+		"redis":  newRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": newMemoryStore(),
+	}
+}
+
+func TestStoreUsers(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.CreateUser(ctx, "alice", "hash"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CreateUser(ctx, "alice", "other"); err != errUsernameTaken {
+				t.Errorf("creating alice twice: got %v, want %v", err, errUsernameTaken)
+			}
+			if err := s.CreateGuest(ctx, "guest-1", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CreateGuest(ctx, "guest-1", time.Hour); err != errUsernameTaken {
+				t.Errorf("creating guest-1 twice: got %v, want %v", err, errUsernameTaken)
+			}
+
+			if hash, err := s.PasswordHash(ctx, "alice"); err != nil || hash != "hash" {
+				t.Errorf("alice's hash is %q (%v), want %q", hash, err, "hash")
+			}
+			for _, u := range []string{"guest-1", "nobody"} {
+				if _, err := s.PasswordHash(ctx, u); err != errUserNotFound {
+					t.Errorf("%s's hash: got %v, want %v", u, err, errUserNotFound)
+				}
+			}
+			for u, want := range map[string]bool{"alice": false, "guest-1": true, "nobody": false} {
+				if guest, err := s.IsGuest(ctx, u); err != nil || guest != want {
+					t.Errorf("%s is guest = %v (%v), want %v", u, guest, err, want)
+				}
+			}
+
+			if err := s.DeleteUser(ctx, "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if exists, err := s.UserExists(ctx, "alice"); err != nil || exists {
+				t.Errorf("alice exists = %v (%v) after deletion", exists, err)
+			}
+		})
+	}
+}
+
+func TestStoreGames(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.LoadGame(ctx, "g1"); err != errGameNotFound {
+				t.Errorf("loading a missing game: got %v, want %v", err, errGameNotFound)
+			}
+			g := testGame([]string{CardDefuse}, "alice", "bob")
+			if err := s.SaveGame(ctx, g); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.LoadGame(ctx, g.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Hands, g.Hands) || !reflect.DeepEqual(got.Deck, g.Deck) {
+				t.Errorf("loaded %+v, want %+v", got, g)
+			}
+		})
+	}
+}
+
+func TestStoreLeaderboards(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, p := range []string{"alice", "bob", "carol"} {
+				if err := s.AddPlayer(ctx, "lifetime", p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.IncrementScore(ctx, "bob", 3, "lifetime", "season"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetScore(ctx, "lifetime", "carol", 5); err != nil {
+				t.Fatal(err)
+			}
+			// Adding a ranked player again keeps their score.
+			if err := s.AddPlayer(ctx, "lifetime", "carol"); err != nil {
+				t.Fatal(err)
+			}
+
+			if score, err := s.Score(ctx, "season", "bob"); err != nil || score != 3 {
+				t.Errorf("bob's season score is %d (%v), want 3", score, err)
+			}
+			if _, err := s.Score(ctx, "season", "alice"); err != errNotRanked {
+				t.Errorf("alice's season score: got %v, want %v", err, errNotRanked)
+			}
+			if n, err := s.Count(ctx, "lifetime"); err != nil || n != 3 {
+				t.Errorf("lifetime board holds %d (%v), want 3", n, err)
+			}
+			players, err := s.Range(ctx, "lifetime", 0, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []Player{{Username: "carol", Score: 5, Rank: 1}, {Username: "bob", Score: 3, Rank: 2}}
+			if !reflect.DeepEqual(players, want) {
+				t.Errorf("top two are %+v, want %+v", players, want)
+			}
+			if rank, err := s.Rank(ctx, "lifetime", "bob"); err != nil || rank != 1 {
+				t.Errorf("bob ranks %d (%v), want 1", rank, err)
+			}
+
+			if err := s.RemovePlayer(ctx, "lifetime", "carol"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Rank(ctx, "lifetime", "carol"); err != errNotRanked {
+				t.Errorf("ranking a removed player: got %v, want %v", err, errNotRanked)
+			}
+		})
+	}
+}
+
+func gameRecord(id, winner string, players ...string) *GameRecord {
+	record := &GameRecord{
+		ID:         id,
+		Players:    players,
+		Winner:     winner,
+		FinishedAt: time.Now(),
+		Stats:      map[string]*GameStats{},
+	}
+	for _, p := range players {
+		record.Stats[p] = &GameStats{CardsDrawn: 2}
+	}
+	return record
+}
+
+func TestStoreRecordGame(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		winners []string
+		alice   PlayerStats
+	}{
+		{
+			name:    "one win",
+			winners: []string{"alice"},
+			alice:   PlayerStats{GamesPlayed: 1, Wins: 1, CardsDrawn: 2, CurrentStreak: 1, LongestStreak: 1},
+		},
+		{
+			name:    "streak broken",
+			winners: []string{"alice", "alice", "bob", "alice"},
+			alice:   PlayerStats{GamesPlayed: 4, Wins: 3, Losses: 1, CardsDrawn: 8, CurrentStreak: 1, LongestStreak: 2},
+		},
+	}
+	for _, tt := range tests {
+		for name, s := range testStores(t) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				for i, winner := range tt.winners {
+					record := gameRecord(fmt.Sprintf("g%d", i), winner, "alice", "bob")
+					// Finishing a game again must not count it twice.
+					for j := 0; j < 2; j++ {
+						if err := s.RecordGame(ctx, record, record.Players); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				got, err := s.PlayerStats(ctx, "alice")
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tt.alice
+				want.Username = "alice"
+				want.WinRate = float64(want.Wins) / float64(want.GamesPlayed)
+				if *got != want {
+					t.Errorf("got %+v, want %+v", *got, want)
+				}
+				games, total, err := s.PlayerGames(ctx, "alice", 10, 0)
+				if err != nil || len(games) != len(tt.winners) || total != int64(len(tt.winners)) {
+					t.Errorf("alice has %d of %d games (%v), want %d", len(games), total, err, len(tt.winners))
+				}
+			})
+		}
+	}
+}
+
+func TestRedisStoreRecordGameRetry(t *testing.T) {
+	ctx := context.Background()
+	mr := testRedis(t)
+	s := newRedisStore(rdb)
+	record := gameRecord("g1", "alice", "alice", "bob")
+
+	mr.SetError("LOADING")
+	if err := s.RecordGame(ctx, record, record.Players); err == nil {
+		t.Fatal("recorded the game while Redis was failing")
+	}
+	mr.SetError("")
+	if err := s.RecordGame(ctx, record, record.Players); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.PlayerStats(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.GamesPlayed != 1 || st.Wins != 1 {
+		t.Errorf("retry recorded %d games and %d wins, want 1 and 1", st.GamesPlayed, st.Wins)
+	}
+}
+
+func TestStoreIncrementScoreOnce(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, want := range []bool{true, false} {
+				added, err := s.IncrementScoreOnce(ctx, "game:g1:scored", time.Hour, "alice", 2, "lifetime", "season")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if added != want {
+					t.Errorf("attempt %d added = %v, want %v", i+1, added, want)
+				}
+			}
+			for _, board := range []string{"lifetime", "season"} {
+				if score, err := s.Score(ctx, board, "alice"); err != nil || score != 2 {
+					t.Errorf("alice's %s score is %d (%v), want 2", board, score, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreCountsForfeits(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			record := gameRecord("g1", "bob", "alice", "bob")
+			record.Stats["alice"].Forfeited = true
+			if err := s.RecordGame(ctx, record, record.Players); err != nil {
+				t.Fatal(err)
+			}
+			for p, want := range map[string]int{"alice": 1, "bob": 0} {
+				if st, err := s.PlayerStats(ctx, p); err != nil || st.Forfeits != want {
+					t.Errorf("%s has %+v (%v), want %d forfeits", p, st, err, want)
+				}
+			}
+		})
+	}
+}
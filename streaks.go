@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StreakBonus multiplies the points for a win once the winner has won
+// Streak games in a row, that one included.
+type StreakBonus struct {
+	Streak     int `json:"streak"`
+	Multiplier int `json:"multiplier"`
+}
+
+var defaultStreakBonuses = []StreakBonus{
+	{Streak: 3, Multiplier: 2},
+	{Streak: 5, Multiplier: 3},
+}
+
+// streakBonuses is sorted by streak, shortest first.
+var streakBonuses = defaultStreakBonuses
+
+// parseStreakBonuses reads STREAK_BONUSES, a comma separated list of
+// streak:multiplier pairs such as "3:2,5:3". Empty means the defaults, and
+// "off" turns bonuses off.
+func parseStreakBonuses(v string) ([]StreakBonus, error) {
+	switch v {
+	case "":
+		return defaultStreakBonuses, nil
+	case "off":
+		return nil, nil
+	}
+
+	bonuses := []StreakBonus{}
+	for _, pair := range strings.Split(v, ",") {
+		streak, multiplier, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		s, err1 := strconv.Atoi(streak)
+		m, err2 := strconv.Atoi(multiplier)
+		if !ok || err1 != nil || err2 != nil || s < 1 || m < 1 {
+			return nil, fmt.Errorf("%q is not a streak:multiplier pair of positive numbers", pair)
+		}
+		bonuses = append(bonuses, StreakBonus{Streak: s, Multiplier: m})
+	}
+	sort.Slice(bonuses, func(i, j int) bool { return bonuses[i].Streak < bonuses[j].Streak })
+	return bonuses, nil
+}
+
+// streakMultiplier is what a win that brings a player's streak to streak
+// is multiplied by.
+func streakMultiplier(streak int) int {
+	multiplier := 1
+	for _, b := range streakBonuses {
+		if streak >= b.Streak {
+			multiplier = b.Multiplier
+		}
+	}
+	return multiplier
+}
+
+// fillStreaks adds each player's current win streak to a leaderboard page.
+func fillStreaks(ctx context.Context, players []Player) error {
+	usernames := make([]string, len(players))
+	for i, p := range players {
+		usernames[i] = p.Username
+	}
+	streaks, err := histories.CurrentStreaks(ctx, usernames)
+	if err != nil {
+		return err
+	}
+	for i := range players {
+		players[i].Streak = streaks[players[i].Username]
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Where client analytics are sent.
+const (
+	TelemetryRedis  = "redis"
+	TelemetryStdout = "stdout"
+	TelemetryHTTP   = "http"
+	TelemetryOff    = "off"
+)
+
+const (
+	// telemetryStreamKey is the redis sink, trimmed to about
+	// telemetryStreamLen events for a collector to read.
+	telemetryStreamKey = "telemetry:events"
+	telemetryStreamLen = 1000000
+
+	maxTelemetryBatch      = 100
+	maxTelemetryProperties = 20
+	maxTelemetryValue      = 200
+	maxTelemetryID         = 64
+	// telemetryMaxAge is how old an event a batch may carry, for clients
+	// that were offline; telemetrySkew is how far ahead their clock may be.
+	telemetryMaxAge = 7 * 24 * time.Hour
+	telemetrySkew   = 5 * time.Minute
+)
+
+// telemetryEvents are the events clients may send, with the properties
+// each must have.
+var telemetryEvents = map[string][]string{
+	"session_start": {},
+	"session_end":   {},
+	"screen_view":   {"screen"},
+	"funnel_step":   {"funnel", "step"},
+}
+
+var telemetryPropertyName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// TelemetryConfig is where client analytics go. TELEMETRY_SINK is redis,
+// a stream, stdout, as JSON lines, http, POSTed to TELEMETRY_URL, or off.
+// TELEMETRY_SAMPLE_RATE is the share of sessions kept.
+type TelemetryConfig struct {
+	Sink       string
+	URL        string
+	SampleRate float64
+}
+
+// TelemetryEvent is one thing that happened in the client. Time is when,
+// by the client's clock, and defaults to when it arrives.
+type TelemetryEvent struct {
+	Name       string                 `json:"name"`
+	Time       time.Time              `json:"time"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// TelemetryBatch is the body of POST /telemetry. SessionID groups the
+// events of one run of the client.
+type TelemetryBatch struct {
+	SessionID string           `json:"session_id"`
+	Platform  string           `json:"platform"`
+	Events    []TelemetryEvent `json:"events"`
+}
+
+// TelemetryRecord is an event as the sink gets it, with who sent it.
+type TelemetryRecord struct {
+	Event      string                 `json:"event"`
+	Time       time.Time              `json:"time"`
+	ReceivedAt time.Time              `json:"received_at"`
+	SessionID  string                 `json:"session_id"`
+	Username   string                 `json:"username,omitempty"`
+	Platform   string                 `json:"platform,omitempty"`
+	AppVersion string                 `json:"app_version,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// TelemetrySink forwards accepted events.
+type TelemetrySink interface {
+	Send(ctx context.Context, records []TelemetryRecord) error
+}
+
+var (
+	telemetry           TelemetrySink = streamSink{}
+	telemetrySampleRate               = 1.0
+	telemetryURL        string
+	telemetryClient     = &http.Client{Timeout: webhookTimeout}
+)
+
+// configureTelemetry picks the sink, which loadConfig has checked.
+func configureTelemetry(c TelemetryConfig) {
+	telemetrySampleRate = c.SampleRate
+	telemetryURL = c.URL
+	switch c.Sink {
+	case TelemetryStdout:
+		telemetry = &stdoutSink{enc: json.NewEncoder(os.Stdout)}
+	case TelemetryHTTP:
+		telemetry = httpSink{}
+	case TelemetryOff:
+		telemetry = nil
+	default:
+		telemetry = streamSink{}
+	}
+}
+
+// streamSink appends events to telemetryStreamKey.
+type streamSink struct{}
+
+func (streamSink) Send(ctx context.Context, records []TelemetryRecord) error {
+	pipe := rdb.Pipeline()
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: telemetryStreamKey,
+			MaxLen: telemetryStreamLen,
+			Approx: true,
+			Values: map[string]interface{}{"event": rec.Event, "data": data},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// stdoutSink prints events as JSON lines for a log shipper to pick up.
+type stdoutSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (s *stdoutSink) Send(ctx context.Context, records []TelemetryRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range records {
+		if err := s.enc.Encode(map[string]interface{}{"telemetry": rec}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// httpSink POSTs each batch to TELEMETRY_URL from the job queue, which
+// retries when the collector is down.
+type httpSink struct{}
+
+func (httpSink) Send(ctx context.Context, records []TelemetryRecord) error {
+	return enqueueJob(ctx, JobTelemetry, records)
+}
+
+func runTelemetry(ctx context.Context, payload json.RawMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telemetryURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "exploding-kittens-telemetry")
+	resp, err := telemetryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("telemetry collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// sampledSession reports whether a session's events are kept. Whole
+// sessions are kept or dropped, so funnels within one stay complete.
+func sampledSession(sessionID string) bool {
+	if telemetrySampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return float64(h.Sum32()%10000) < telemetrySampleRate*10000
+}
+
+func validateTelemetryValue(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return len(v) <= maxTelemetryValue
+	case float64, bool:
+		return true
+	}
+	return false
+}
+
+func validateTelemetry(batch *TelemetryBatch, now time.Time) []*FieldError {
+	problems := []*FieldError{}
+	if batch.SessionID == "" || len(batch.SessionID) > maxTelemetryID {
+		problems = append(problems, &FieldError{Field: "session_id", Code: "SESSION_ID_INVALID",
+			Message: fmt.Sprintf("Session ID is required and at most %d characters", maxTelemetryID)})
+	}
+	if len(batch.Platform) > maxTelemetryID {
+		problems = append(problems, &FieldError{Field: "platform", Code: "PLATFORM_INVALID",
+			Message: fmt.Sprintf("Platform is at most %d characters", maxTelemetryID)})
+	}
+	if len(batch.Events) == 0 || len(batch.Events) > maxTelemetryBatch {
+		problems = append(problems, &FieldError{Field: "events", Code: "BATCH_SIZE",
+			Message: fmt.Sprintf("Send between 1 and %d events", maxTelemetryBatch)})
+		return problems
+	}
+	known := make([]string, 0, len(telemetryEvents))
+	for name := range telemetryEvents {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+
+	for i, e := range batch.Events {
+		field := fmt.Sprintf("events[%d]", i)
+		required, ok := telemetryEvents[e.Name]
+		if !ok {
+			problems = append(problems, &FieldError{Field: field + ".name", Code: "EVENT_UNKNOWN",
+				Message: fmt.Sprintf("Events must be one of %s", strings.Join(known, ", "))})
+			continue
+		}
+		if !e.Time.IsZero() && (e.Time.Before(now.Add(-telemetryMaxAge)) || e.Time.After(now.Add(telemetrySkew))) {
+			problems = append(problems, &FieldError{Field: field + ".time", Code: "TIME_OUT_OF_RANGE",
+				Message: "Time must be within the last week"})
+		}
+		if len(e.Properties) > maxTelemetryProperties {
+			problems = append(problems, &FieldError{Field: field + ".properties", Code: "TOO_MANY_PROPERTIES",
+				Message: fmt.Sprintf("Events have at most %d properties", maxTelemetryProperties)})
+		}
+		for name, v := range e.Properties {
+			if !telemetryPropertyName.MatchString(name) {
+				problems = append(problems, &FieldError{Field: field + ".properties." + name, Code: "PROPERTY_NAME_INVALID",
+					Message: "Property names are lowercase letters, digits and underscores"})
+			} else if !validateTelemetryValue(v) {
+				problems = append(problems, &FieldError{Field: field + ".properties." + name, Code: "PROPERTY_VALUE_INVALID",
+					Message: fmt.Sprintf("Properties are numbers, booleans or strings of at most %d characters", maxTelemetryValue)})
+			}
+		}
+		for _, name := range required {
+			if _, ok := e.Properties[name]; !ok {
+				problems = append(problems, &FieldError{Field: field + ".properties." + name, Code: "PROPERTY_REQUIRED",
+					Message: fmt.Sprintf("%s events need %s", e.Name, name)})
+			}
+		}
+	}
+	return problems
+}
+
+// ingestTelemetry takes a batch of client events. Signing in is optional,
+// so screens before the login are counted too.
+func ingestTelemetry(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var batch TelemetryBatch
+	if err := decodeJSON(r, &batch); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	if problems := validateTelemetry(&batch, now); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	if telemetry == nil || !sampledSession(batch.SessionID) {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"accepted": 0, "sampled": false})
+		return
+	}
+	var username string
+	if token := bearerToken(r); token != "" {
+		username, _ = parseAccessToken(token)
+	}
+	appVersion := ""
+	if v, ok := parseClientVersion(r.Header.Get(clientVersionHeader)); ok {
+		appVersion = v.String()
+	}
+	records := make([]TelemetryRecord, len(batch.Events))
+	for i, e := range batch.Events {
+		at := e.Time.UTC()
+		if e.Time.IsZero() {
+			at = now
+		}
+		records[i] = TelemetryRecord{
+			Event:      e.Name,
+			Time:       at,
+			ReceivedAt: now,
+			SessionID:  batch.SessionID,
+			Username:   username,
+			Platform:   batch.Platform,
+			AppVersion: appVersion,
+			Properties: e.Properties,
+		}
+	}
+	if err := telemetry.Send(ctx, records); err != nil {
+		respondInternal(w, r, err, "Error recording events")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"accepted": len(records), "sampled": true})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const defaultRedisTimeout = 2 * time.Second
+
+// redisTimeout bounds every Redis command and pipeline, so a stuck Redis
+// fails requests rather than hanging them. Set with REDIS_TIMEOUT.
+var redisTimeout = defaultRedisTimeout
+
+// blockingReadTime is how long a blocking read such as XREADGROUP waits
+// for something to arrive. It stays under REDIS_TIMEOUT, which would
+// otherwise cut the read off.
+func blockingReadTime() time.Duration {
+	return redisTimeout / 2
+}
+
+// redisRetryAfter is how long clients are told to wait before retrying a
+// request that timed out on Redis.
+const redisRetryAfter = time.Second
+
+type cancelKey struct{}
+
+// redisDeadlines gives each Redis command or pipeline its own deadline,
+// within whatever deadline its context already has.
+type redisDeadlines struct{}
+
+func (redisDeadlines) BeforeProcess(c context.Context, cmd redis.Cmder) (context.Context, error) {
+	return withRedisDeadline(c), nil
+}
+
+func (redisDeadlines) AfterProcess(c context.Context, cmd redis.Cmder) error {
+	releaseRedisDeadline(c)
+	return nil
+}
+
+func (redisDeadlines) BeforeProcessPipeline(c context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return withRedisDeadline(c), nil
+}
+
+func (redisDeadlines) AfterProcessPipeline(c context.Context, cmds []redis.Cmder) error {
+	releaseRedisDeadline(c)
+	return nil
+}
+
+func withRedisDeadline(c context.Context) context.Context {
+	c, cancel := context.WithTimeout(c, redisTimeout)
+	return context.WithValue(c, cancelKey{}, cancel)
+}
+
+func releaseRedisDeadline(c context.Context) {
+	if cancel, ok := c.Value(cancelKey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+}
+
+// redisTimedOut reports whether err is Redis running out of time, whether
+// the context's deadline passed or the connection's read or write did.
+func redisTimedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// respondUnavailable tells the client Redis timed out or is down and the
+// request is worth retrying shortly.
+func respondUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	logFor(r).Warn("redis unavailable", "path", r.URL.Path, "err", err)
+	w.Header().Set("Retry-After", strconv.Itoa(int(redisRetryAfter.Seconds())))
+	code := CodeStorageDown
+	if redisTimedOut(err) {
+		code = CodeStorageTimeout
+	}
+	writeError(w, r, http.StatusServiceUnavailable, code, "The server is busy, try again shortly")
+}
+
+// respondInternal reports a server-side failure with a message saying what
+// failed, or a retryable 503 when Redis timed out or is down.
+func respondInternal(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if storageDown(err) {
+		respondUnavailable(w, r, err)
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, message)
+}
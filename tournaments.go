@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	TournamentRegistering = "registering"
+	TournamentRunning     = "running"
+	TournamentFinished    = "finished"
+	TournamentCancelled   = "cancelled"
+)
+
+const (
+	// tournamentsKey lists every tournament by start time.
+	tournamentsKey = "tournaments"
+	// pendingTournamentsKey lists tournaments still taking registrations by
+	// start time, for the janitor to start when they are due.
+	pendingTournamentsKey = "tournaments:pending"
+
+	minTournamentCapacity = 2
+	maxTournamentCapacity = 64
+	maxTournamentName     = 64
+)
+
+var (
+	errTournamentNotFound = errors.New("tournament not found")
+	errTournamentClosed   = errors.New("tournament is no longer taking registrations")
+	errTournamentFull     = errors.New("tournament is full")
+	errAlreadyRegistered  = errors.New("already registered for this tournament")
+	errNotRegistered      = errors.New("not registered for this tournament")
+	errTournamentBusy     = errors.New("tournament is busy, try again")
+)
+
+// Tournament is a single-elimination bracket. Rounds is empty until the
+// tournament starts.
+type Tournament struct {
+	ID         string               `json:"id"`
+	Name       string               `json:"name"`
+	StartsAt   time.Time            `json:"starts_at"`
+	Capacity   int                  `json:"capacity"`
+	Status     string               `json:"status"`
+	Players    []string             `json:"players"`
+	Rounds     [][]*TournamentMatch `json:"rounds,omitempty"`
+	Winner     string               `json:"winner,omitempty"`
+	CreatedBy  string               `json:"created_by"`
+	CreatedAt  time.Time            `json:"created_at"`
+	FinishedAt *time.Time           `json:"finished_at,omitempty"`
+}
+
+// TournamentMatch is one game in the bracket. A seat is empty while the
+// match feeding it is undecided, or for good when it is a first-round bye.
+type TournamentMatch struct {
+	Round   int      `json:"round"`
+	Players []string `json:"players"`
+	RoomID  string   `json:"room_id,omitempty"`
+	GameID  string   `json:"game_id,omitempty"`
+	Winner  string   `json:"winner,omitempty"`
+}
+
+type CreateTournamentRequest struct {
+	Name     string    `json:"name"`
+	StartsAt time.Time `json:"starts_at"`
+	Capacity int       `json:"capacity"`
+}
+
+func tournamentKey(id string) string {
+	return fmt.Sprintf("tournament:%s", id)
+}
+
+func loadTournament(ctx context.Context, id string) (*Tournament, error) {
+	data, err := rdb.Get(ctx, tournamentKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, errTournamentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t Tournament
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func saveTournament(ctx context.Context, t *Tournament) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, tournamentKey(t.ID), data, 0)
+	pipe.ZAdd(ctx, tournamentsKey, &redis.Z{Score: float64(t.StartsAt.Unix()), Member: t.ID})
+	pipe.ZAdd(ctx, pendingTournamentsKey, &redis.Z{Score: float64(t.StartsAt.Unix()), Member: t.ID})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// updateTournament changes a stored tournament atomically, retrying if
+// another writer got there first. Returning errNoChange from change skips
+// the save.
+func updateTournament(ctx context.Context, id string, change func(t *Tournament) error) (*Tournament, error) {
+	key := tournamentKey(id)
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var t Tournament
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if err == redis.Nil {
+				return errTournamentNotFound
+			}
+			if err != nil {
+				return err
+			}
+			t = Tournament{}
+			if err := json.Unmarshal(data, &t); err != nil {
+				return err
+			}
+			if err := change(&t); err != nil {
+				return err
+			}
+			if data, err = json.Marshal(&t); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, 0)
+				if t.Status != TournamentRegistering {
+					pipe.ZRem(ctx, pendingTournamentsKey, t.ID)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+	return nil, errTournamentBusy
+}
+
+func (t *Tournament) registered(username string) bool {
+	for _, p := range t.Players {
+		if p == username {
+			return true
+		}
+	}
+	return false
+}
+
+// bracketOrder lists seeds in bracket order for a bracket of size players,
+// so that pairing neighbours has the top seeds meet as late as possible:
+// 1v8, 4v5, 2v7, 3v6 for eight.
+func bracketOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		n := len(order) * 2
+		next := make([]int, 0, n)
+		for _, seed := range order {
+			next = append(next, seed, n+1-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// buildBracket seeds the registered players by rating and lays out every
+// round. Brackets are padded to a power of two, with the missing seeds
+// handing the top seeds a first-round bye.
+func (t *Tournament) buildBracket(ctx context.Context) error {
+	ratings := map[string]float64{}
+	for _, p := range t.Players {
+		rating, err := getRating(ctx, p)
+		if err != nil {
+			return err
+		}
+		ratings[p] = rating
+	}
+	seeds := append([]string{}, t.Players...)
+	sort.SliceStable(seeds, func(i, j int) bool { return ratings[seeds[i]] > ratings[seeds[j]] })
+
+	size := 2
+	for size < len(seeds) {
+		size *= 2
+	}
+	order := bracketOrder(size)
+	t.Rounds = nil
+	for round, matches := 0, size/2; matches >= 1; round, matches = round+1, matches/2 {
+		list := make([]*TournamentMatch, matches)
+		for i := range list {
+			list[i] = &TournamentMatch{Round: round, Players: []string{"", ""}}
+			if round == 0 {
+				for seat := 0; seat < 2; seat++ {
+					if seed := order[2*i+seat]; seed <= len(seeds) {
+						list[i].Players[seat] = seeds[seed-1]
+					}
+				}
+			}
+		}
+		t.Rounds = append(t.Rounds, list)
+	}
+	return nil
+}
+
+// advance settles byes, moves winners into their next match and finishes
+// the tournament once the final is decided. It returns the matches that
+// now have both players and need a room, having picked their room IDs.
+func (t *Tournament) advance(now time.Time) []*TournamentMatch {
+	ready := []*TournamentMatch{}
+	for round, matches := range t.Rounds {
+		for i, m := range matches {
+			if m.Winner == "" && round == 0 && (m.Players[0] == "" || m.Players[1] == "") {
+				m.Winner = m.Players[0] + m.Players[1]
+			}
+			if m.Winner == "" {
+				if m.Players[0] != "" && m.Players[1] != "" && m.RoomID == "" {
+					m.RoomID = newID()
+					ready = append(ready, m)
+				}
+				continue
+			}
+			if round+1 < len(t.Rounds) {
+				t.Rounds[round+1][i/2].Players[i%2] = m.Winner
+				continue
+			}
+			if t.Status != TournamentFinished {
+				t.Status = TournamentFinished
+				t.Winner = m.Winner
+				finished := now.UTC()
+				t.FinishedAt = &finished
+			}
+		}
+	}
+	return ready
+}
+
+// matchInRoom finds the match being played in a room.
+func (t *Tournament) matchInRoom(roomID string) *TournamentMatch {
+	for _, matches := range t.Rounds {
+		for _, m := range matches {
+			if m.RoomID == roomID {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// startTournamentMatches opens a room for each match that is ready and
+// tells its players where to go.
+func startTournamentMatches(ctx context.Context, t *Tournament, ready []*TournamentMatch) {
+	for _, m := range ready {
+		room, g, err := openMatchRoom(ctx, &Room{ID: m.RoomID, Players: append([]string{}, m.Players...), Tournament: t.ID})
+		if err != nil {
+			slog.Error("starting tournament match", "tournament", t.ID, "room", m.RoomID, "err", err)
+			continue
+		}
+		_, err = updateTournament(ctx, t.ID, func(t *Tournament) error {
+			if stored := t.matchInRoom(room.ID); stored != nil {
+				stored.GameID = g.ID
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("recording tournament game", "tournament", t.ID, "game", g.ID, "err", err)
+		}
+		for _, p := range m.Players {
+			hub.notifyUser(ctx, p, EventTournamentMatch, map[string]interface{}{
+				"tournament_id": t.ID,
+				"round":         m.Round,
+				"room_id":       room.ID,
+				"game_id":       g.ID,
+				"players":       m.Players,
+			})
+			notifyDevices(ctx, p, PushTournament, map[string]string{"round": strconv.Itoa(m.Round)},
+				map[string]string{"tournament_id": t.ID, "room_id": room.ID, "game_id": g.ID})
+		}
+		publishTurn(ctx, g)
+	}
+}
+
+// announceTournamentEnd tells every entrant how a tournament ended.
+func announceTournamentEnd(ctx context.Context, t *Tournament) {
+	for _, p := range t.Players {
+		hub.notifyUser(ctx, p, EventTournamentOver, map[string]interface{}{
+			"tournament_id": t.ID,
+			"status":        t.Status,
+			"winner":        t.Winner,
+		})
+	}
+}
+
+// beginTournament closes registration and draws the bracket. Tournaments
+// without enough entrants are cancelled.
+func beginTournament(ctx context.Context, id string, now time.Time) error {
+	var ready []*TournamentMatch
+	t, err := updateTournament(ctx, id, func(t *Tournament) error {
+		if t.Status != TournamentRegistering {
+			return errNoChange
+		}
+		if len(t.Players) < minTournamentCapacity {
+			t.Status = TournamentCancelled
+			return nil
+		}
+		if err := t.buildBracket(ctx); err != nil {
+			return err
+		}
+		t.Status = TournamentRunning
+		ready = t.advance(now)
+		return nil
+	})
+	if err == errNoChange {
+		rdb.ZRem(ctx, pendingTournamentsKey, id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("tournament started", "tournament", t.ID, "status", t.Status, "players", len(t.Players))
+	if t.Status == TournamentCancelled {
+		announceTournamentEnd(ctx, t)
+		return nil
+	}
+	startTournamentMatches(ctx, t, ready)
+	return nil
+}
+
+// startDueTournaments begins every tournament whose start time has passed.
+func startDueTournaments(ctx context.Context, now time.Time) {
+	ids, err := rdb.ZRangeByScore(ctx, pendingTournamentsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		slog.Error("listing due tournaments", "err", err)
+		return
+	}
+	for _, id := range ids {
+		err := beginTournament(ctx, id, now)
+		if err == errTournamentNotFound {
+			rdb.ZRem(ctx, pendingTournamentsKey, id)
+			continue
+		}
+		if err != nil {
+			slog.Error("starting tournament", "tournament", id, "err", err)
+		}
+	}
+}
+
+// advanceTournament records the result of a finished tournament game and
+// starts whatever matches that unblocks.
+func advanceTournament(ctx context.Context, g *GameState) {
+	if g.RoomID == "" {
+		return
+	}
+	room, err := loadRoom(ctx, g.RoomID)
+	if err != nil || room.Tournament == "" {
+		return
+	}
+
+	var ready []*TournamentMatch
+	t, err := updateTournament(ctx, room.Tournament, func(t *Tournament) error {
+		m := t.matchInRoom(room.ID)
+		if m == nil || m.Winner != "" {
+			return errNoChange
+		}
+		// A game nobody won, because everyone left, goes to the higher seed.
+		m.Winner = m.Players[0]
+		if g.Winner == m.Players[1] {
+			m.Winner = g.Winner
+		}
+		ready = t.advance(time.Now())
+		return nil
+	})
+	if err == errNoChange {
+		return
+	}
+	if err != nil {
+		slog.Error("advancing tournament", "tournament", room.Tournament, "game", g.ID, "err", err)
+		return
+	}
+	startTournamentMatches(ctx, t, ready)
+	if t.Status == TournamentFinished {
+		slog.Info("tournament finished", "tournament", t.ID, "winner", t.Winner)
+		announceTournamentEnd(ctx, t)
+	}
+}
+
+func validateTournament(req *CreateTournamentRequest) []*FieldError {
+	problems := []*FieldError{}
+	if req.Name == "" || len(req.Name) > maxTournamentName {
+		problems = append(problems, &FieldError{Field: "name", Code: "NAME_INVALID",
+			Message: fmt.Sprintf("Name must be 1 to %d characters", maxTournamentName)})
+	}
+	if !req.StartsAt.After(time.Now()) {
+		problems = append(problems, &FieldError{Field: "starts_at", Code: "START_IN_PAST", Message: "Start time must be in the future"})
+	}
+	if req.Capacity < minTournamentCapacity || req.Capacity > maxTournamentCapacity {
+		problems = append(problems, &FieldError{Field: "capacity", Code: "CAPACITY_OUT_OF_RANGE",
+			Message: fmt.Sprintf("Capacity must be between %d and %d", minTournamentCapacity, maxTournamentCapacity)})
+	}
+	return problems
+}
+
+func createTournament(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req CreateTournamentRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if problems := validateTournament(&req); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	t := &Tournament{
+		ID:        newID(),
+		Name:      req.Name,
+		StartsAt:  req.StartsAt.UTC(),
+		Capacity:  req.Capacity,
+		Status:    TournamentRegistering,
+		Players:   []string{},
+		CreatedBy: actorName(r),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := saveTournament(ctx, t); err != nil {
+		respondInternal(w, r, err, "Error creating tournament")
+		return
+	}
+	logFor(r).Info("tournament created", "tournament", t.ID, "starts_at", t.StartsAt, "capacity", t.Capacity)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func listTournaments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	total, err := rdb.ZCard(ctx, tournamentsKey).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error listing tournaments")
+		return
+	}
+
+	list := []*Tournament{}
+	if limit > 0 {
+		ids, err := rdb.ZRevRange(ctx, tournamentsKey, int64(offset), int64(offset+limit-1)).Result()
+		if err != nil {
+			respondInternal(w, r, err, "Error listing tournaments")
+			return
+		}
+		for _, id := range ids {
+			t, err := loadTournament(ctx, id)
+			if err == errTournamentNotFound {
+				continue
+			}
+			if err != nil {
+				respondInternal(w, r, err, "Error listing tournaments")
+				return
+			}
+			list = append(list, t)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	json.NewEncoder(w).Encode(list)
+}
+
+func getTournament(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	t, err := loadTournament(ctx, mux.Vars(r)["id"])
+	if err == errTournamentNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading tournament")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func registerForTournament(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	t, err := updateTournament(ctx, mux.Vars(r)["id"], func(t *Tournament) error {
+		if t.Status != TournamentRegistering {
+			return errTournamentClosed
+		}
+		if t.registered(username) {
+			return errAlreadyRegistered
+		}
+		if len(t.Players) >= t.Capacity {
+			return errTournamentFull
+		}
+		t.Players = append(t.Players, username)
+		return nil
+	})
+	if err == errTournamentNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err == errTournamentClosed || err == errAlreadyRegistered || err == errTournamentFull || err == errTournamentBusy {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error registering for tournament")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t)
+}
+
+func withdrawFromTournament(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := currentUser(r)
+	t, err := updateTournament(ctx, mux.Vars(r)["id"], func(t *Tournament) error {
+		if t.Status != TournamentRegistering {
+			return errTournamentClosed
+		}
+		for i, p := range t.Players {
+			if p == username {
+				t.Players = append(t.Players[:i:i], t.Players[i+1:]...)
+				return nil
+			}
+		}
+		return errNotRegistered
+	})
+	if err == errTournamentNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err == errTournamentClosed || err == errNotRegistered || err == errTournamentBusy {
+		respondError(w, r, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error withdrawing from tournament")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t)
+}
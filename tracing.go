@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "exploding-kitten-backend"
+
+// tracer starts the spans for game logic. It is a no-op until initTracing
+// installs an exporter.
+var tracer = otel.Tracer(serviceName)
+
+// initTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// is set; the exporter reads the rest of the standard OTEL_* variables
+// itself. W3C traceparent headers are honoured either way. The returned
+// func flushes buffered spans.
+func initTracing(ctx context.Context) func() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func() {}
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		slog.Error("creating trace exporter, tracing disabled", "err", err)
+		return func() {}
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		slog.Warn("building trace resource", "err", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	rdb.AddHook(redisTracing{})
+	slog.Info("tracing enabled", "endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+
+	return func() {
+		timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(timeout); err != nil {
+			slog.Error("flushing spans", "err", err)
+		}
+	}
+}
+
+// traceRequests starts a server span per request, continuing the caller's
+// trace when it sends a traceparent header.
+func traceRequests(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server")
+}
+
+// nameSpans renames the request span after the matched route, so spans
+// group by endpoint rather than by raw path.
+func nameSpans(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + tmpl)
+				span.SetAttributes(attribute.String("http.route", tmpl))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redisTracing records a client span for every Redis command and pipeline.
+type redisTracing struct{}
+
+func (redisTracing) BeforeProcess(c context.Context, cmd redis.Cmder) (context.Context, error) {
+	c, _ = tracer.Start(c, "redis "+cmd.FullName(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.operation", cmd.Name()),
+		),
+	)
+	return c, nil
+}
+
+func (redisTracing) AfterProcess(c context.Context, cmd redis.Cmder) error {
+	endRedisSpan(c, cmd.Err())
+	return nil
+}
+
+func (redisTracing) BeforeProcessPipeline(c context.Context, cmds []redis.Cmder) (context.Context, error) {
+	c, _ = tracer.Start(c, "redis pipeline",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.Int("db.redis.num_cmd", len(cmds)),
+		),
+	)
+	return c, nil
+}
+
+func (redisTracing) AfterProcessPipeline(c context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	endRedisSpan(c, err)
+	return nil
+}
+
+// endRedisSpan closes the span a hook started. A missing key is an answer,
+// not a failure.
+func endRedisSpan(c context.Context, err error) {
+	span := trace.SpanFromContext(c)
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceStep runs one stage of a request in its own child span, so a slow
+// request shows where its time went. fn gets the span's context, so the
+// Redis calls it makes nest under the stage.
+func traceStep(c context.Context, name string, fn func(ctx context.Context) error) error {
+	c, span := tracer.Start(c, name)
+	defer span.End()
+	err := fn(c)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
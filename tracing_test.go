@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRedisSpansNestUnderRequest(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	defer provider.Shutdown(context.Background())
+	otel.SetTracerProvider(provider)
+
+	testRedis(t)
+	rdb.AddHook(redisTracing{})
+
+	r := mux.NewRouter()
+	r.Use(nameSpans)
+	r.HandleFunc("/games/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rdb.Get(r.Context(), "game:"+mux.Vars(r)["id"])
+		traceStep(r.Context(), "draw", func(ctx context.Context) error {
+			return rdb.Set(ctx, "game:"+mux.Vars(r)["id"], "{}", 0).Err()
+		})
+	})
+	traceRequests(r).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/games/g1", nil))
+
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans.Ended() {
+		byName[span.Name()] = span
+	}
+	request, ok := byName["GET /games/{id}"]
+	if !ok {
+		t.Fatalf("no request span among %v", byName)
+	}
+	for name, parent := range map[string]string{
+		"redis get": "GET /games/{id}",
+		"draw":      "GET /games/{id}",
+		"redis set": "draw",
+	} {
+		span, ok := byName[name]
+		if !ok {
+			t.Fatalf("no %q span among %v", name, byName)
+		}
+		if span.SpanContext().TraceID() != request.SpanContext().TraceID() {
+			t.Errorf("%q is in trace %s, want the request's %s", name, span.SpanContext().TraceID(), request.SpanContext().TraceID())
+		}
+		if got, want := span.Parent().SpanID(), byName[parent].SpanContext().SpanID(); got != want {
+			t.Errorf("%q has parent %s, want %q (%s)", name, got, parent, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTurnTimeout = 30 * time.Second
+	defaultMaxTimeouts = 3
+	// turnTickInterval is how often a running turn clock is broadcast.
+	turnTickInterval = 5 * time.Second
+)
+
+// Actions the server takes for a player who let their turn clock run out.
+const (
+	TimeoutDraw     = "draw"
+	TimeoutReinsert = "reinsert"
+	TimeoutForfeit  = "forfeit"
+)
+
+var (
+	// turnTimeout is how long a player in a multiplayer game has to act
+	// before the server acts for them. Set with TURN_TIMEOUT.
+	turnTimeout = defaultTurnTimeout
+	// maxTimeouts is how many turns in a row a player may time out before
+	// they forfeit. Set with TURN_TIMEOUT_LIMIT.
+	maxTimeouts = defaultMaxTimeouts
+)
+
+// turnClocks remembers which turn deadline this instance is already
+// watching for each game, so re-publishing a turn does not start a second
+// clock.
+var turnClocks = struct {
+	sync.Mutex
+	deadlines map[string]time.Time
+}{deadlines: map[string]time.Time{}}
+
+// startTurnClock gives the current player a fresh deadline. Single-player
+// games are untimed.
+func (g *GameState) startTurnClock() {
+	if g.solo() {
+		g.TurnDeadline = time.Time{}
+		return
+	}
+	g.TurnDeadline = time.Now().UTC().Add(g.Rules.turnTimeout())
+}
+
+// turnDeadline is when the current turn times out, if it is timed.
+func (g *GameState) turnDeadline() *time.Time {
+	if g.Status != GameActive || g.TurnDeadline.IsZero() {
+		return nil
+	}
+	at := g.TurnDeadline
+	return &at
+}
+
+// resetTimeouts clears a player's run of timed-out turns once they act.
+func (g *GameState) resetTimeouts(username string) {
+	delete(g.Timeouts, username)
+}
+
+// timeOut acts for the current player whose clock ran out: a pending
+// kitten goes back at random, otherwise they draw, and after maxTimeouts
+// turns in a row they forfeit.
+func (g *GameState) timeOut() (action string, result interface{}, err error) {
+	player := g.currentPlayer()
+	if g.Reinserting == player {
+		position := g.rng().IntN(len(g.Deck) + 1)
+		return TimeoutReinsert, position, g.reinsert(player, position)
+	}
+	// A future left unaltered stays in the order it was seen.
+	g.Altering = ""
+
+	if g.Timeouts == nil {
+		g.Timeouts = map[string]int{}
+	}
+	g.Timeouts[player]++
+	if g.Timeouts[player] >= maxTimeouts {
+		return TimeoutForfeit, nil, g.forfeit(player)
+	}
+	draw, err := g.draw(player)
+	return TimeoutDraw, draw, err
+}
+
+// watchTurn runs the clock for the game's current turn on this instance,
+// broadcasting the time left and acting once it runs out.
+func watchTurn(ctx context.Context, g *GameState) {
+	deadline := g.turnDeadline()
+	if deadline == nil {
+		return
+	}
+	gameID := g.ID
+
+	turnClocks.Lock()
+	if turnClocks.deadlines[gameID].Equal(*deadline) {
+		turnClocks.Unlock()
+		return
+	}
+	turnClocks.deadlines[gameID] = *deadline
+	turnClocks.Unlock()
+
+	go runTurnClock(context.WithoutCancel(ctx), gameID, *deadline)
+}
+
+func runTurnClock(ctx context.Context, gameID string, deadline time.Time) {
+	defer func() {
+		turnClocks.Lock()
+		if turnClocks.deadlines[gameID].Equal(deadline) {
+			delete(turnClocks.deadlines, gameID)
+		}
+		turnClocks.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	ticker := time.NewTicker(turnTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Another instance may have moved the game on since.
+			g, err := loadGame(ctx, gameID)
+			if err != nil || g.Status != GameActive || !g.TurnDeadline.Equal(deadline) {
+				return
+			}
+			hub.broadcast(ctx, g.channel(), EventTurnTimer, map[string]interface{}{
+				"player":       g.currentPlayer(),
+				"deadline":     deadline,
+				"seconds_left": int(time.Until(deadline).Round(time.Second) / time.Second),
+			})
+		case <-timer.C:
+			timeoutTurn(ctx, gameID, deadline)
+			return
+		}
+	}
+}
+
+// timeoutTurn acts for the player whose turn ended at deadline, unless they
+// acted in time. A Nope window still open, or a favor still owed, holds the
+// clock; the turn is re-published, and the clock re-armed, once it closes.
+// During maintenance nobody can act, so the clock starts over instead.
+func timeoutTurn(ctx context.Context, gameID string, deadline time.Time) {
+	var (
+		player string
+		action string
+		result interface{}
+		paused bool
+	)
+	g, err := updateGame(ctx, gameID, "timeout", func(g *GameState) (err error) {
+		if g.Status != GameActive || !g.TurnDeadline.Equal(deadline) || g.Pending != nil || g.Favor != nil {
+			return errNoChange
+		}
+		if currentMaintenance() != nil {
+			paused = true
+			g.startTurnClock()
+			return nil
+		}
+		player = g.currentPlayer()
+		action, result, err = g.timeOut()
+		return err
+	})
+	if err == errNoChange || err == errGameNotFound {
+		return
+	}
+	if err != nil {
+		slog.Error("timing out turn", "game", gameID, "player", player, "err", err)
+		return
+	}
+	if paused {
+		publishTurn(ctx, g)
+		return
+	}
+
+	hub.broadcast(ctx, g.channel(), EventTurnTimeout, map[string]interface{}{
+		"player":   player,
+		"action":   action,
+		"timeouts": g.Timeouts[player],
+	})
+	switch action {
+	case TimeoutReinsert:
+		publishReinsert(ctx, g, player, result.(int))
+	case TimeoutDraw:
+		if g.Status == GameFinished {
+			completeGame(ctx, g)
+		}
+		publishDraw(ctx, g, player, result.(*DrawResult))
+	default:
+		publishForfeit(ctx, g, player)
+	}
+}
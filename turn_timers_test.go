@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestTimeOut(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts int
+		action   string
+		current  string
+	}{
+		{name: "first timeout draws", timeouts: 0, action: TimeoutDraw, current: "bob"},
+		{name: "one short of the limit draws", timeouts: maxTimeouts - 2, action: TimeoutDraw, current: "bob"},
+		{name: "limit reached forfeits", timeouts: maxTimeouts - 1, action: TimeoutForfeit, current: "bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGame(nil, "alice", "bob", "carol")
+			g.Timeouts = map[string]int{"alice": tt.timeouts}
+			action, _, err := g.timeOut()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action != tt.action {
+				t.Errorf("action %s, want %s", action, tt.action)
+			}
+			if forfeited := g.isEliminated("alice"); forfeited != (tt.action == TimeoutForfeit) {
+				t.Errorf("alice eliminated = %v", forfeited)
+			}
+			if got := g.currentPlayer(); got != tt.current {
+				t.Errorf("current player is %s, want %s", got, tt.current)
+			}
+		})
+	}
+}
+
+func TestTimeOutReinsertsFromSeed(t *testing.T) {
+	positions := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		g := testGame([]string{CardDefuse}, "alice", "bob")
+		g.Seed = "seed"
+		g.Deck = append([]string{CardExploding}, g.Deck...)
+		mustDraw(t, g, "alice")
+
+		action, position, err := g.timeOut()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != TimeoutReinsert {
+			t.Fatalf("action %s, want %s", action, TimeoutReinsert)
+		}
+		if p := position.(int); g.Deck[p] != CardExploding {
+			t.Errorf("kitten not at %d in %v", p, g.Deck)
+		}
+		positions[position.(int)] = true
+	}
+	if len(positions) != 1 {
+		t.Errorf("the same seed put the kitten at %v", positions)
+	}
+}
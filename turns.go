@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errNotYourTurn = errors.New("it is not your turn")
+	errPlayerOut   = errors.New("player has been eliminated")
+)
+
+// TurnView is the public, render-ready snapshot of a game's turn state.
+type TurnView struct {
+	ID            string         `json:"id"`
+	Version       int64          `json:"version"`
+	RoomID        string         `json:"room_id,omitempty"`
+	Status        string         `json:"status"`
+	Players       []string       `json:"players"`
+	Eliminated    []string       `json:"eliminated"`
+	CurrentPlayer string         `json:"current_player,omitempty"`
+	TurnsOwed     int            `json:"turns_owed"`
+	TurnOrder     []string       `json:"turn_order"`
+	CardsLeft     int            `json:"cards_left"`
+	Pending       *PendingAction `json:"pending,omitempty"`
+	Reinserting   string         `json:"reinserting,omitempty"`
+	Altering      string         `json:"altering,omitempty"`
+	Favor         *FavorRequest  `json:"favor,omitempty"`
+	ImplodingAt   *int           `json:"imploding_at,omitempty"`
+	Winner        string         `json:"winner,omitempty"`
+	Commitment    string         `json:"seed_commitment,omitempty"`
+	ExpiresAt     *time.Time     `json:"expires_at,omitempty"`
+	TurnDeadline  *time.Time     `json:"turn_deadline,omitempty"`
+	Rules         *HouseRules    `json:"rules,omitempty"`
+	Modifiers     []string       `json:"modifiers,omitempty"`
+	Composition   map[string]int `json:"composition,omitempty"`
+}
+
+// channel is the hub room that receives this game's events.
+func (g *GameState) channel() string {
+	if g.RoomID != "" {
+		return g.RoomID
+	}
+	return g.ID
+}
+
+func (g *GameState) isEliminated(username string) bool {
+	for _, p := range g.Eliminated {
+		if p == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GameState) alivePlayers() []string {
+	alive := []string{}
+	for _, p := range g.Players {
+		if !g.isEliminated(p) {
+			alive = append(alive, p)
+		}
+	}
+	return alive
+}
+
+func (g *GameState) currentPlayer() string {
+	if g.Status != GameActive || len(g.Players) == 0 {
+		return ""
+	}
+	return g.Players[g.Turn]
+}
+
+// turnOrder lists the surviving players starting with whoever is up now.
+func (g *GameState) turnOrder() []string {
+	order := []string{}
+	if len(g.Players) == 0 {
+		return order
+	}
+	for i := 0; i < len(g.Players); i++ {
+		p := g.Players[(g.Turn+i)%len(g.Players)]
+		if !g.isEliminated(p) {
+			order = append(order, p)
+		}
+	}
+	return order
+}
+
+// requireTurn rejects actions from anyone but the player whose turn it is.
+func (g *GameState) requireTurn(username string) error {
+	if g.Status != GameActive {
+		return errGameOver
+	}
+	if !g.hasPlayer(username) {
+		return errNotInGame
+	}
+	if g.isEliminated(username) {
+		return errPlayerOut
+	}
+	if g.currentPlayer() != username {
+		return errNotYourTurn
+	}
+	return nil
+}
+
+// requireIdle rejects new actions while an earlier one is still being
+// resolved.
+func (g *GameState) requireIdle() error {
+	if g.Pending != nil {
+		return errActionPending
+	}
+	if g.Reinserting != "" {
+		return errReinsertPending
+	}
+	if g.Altering != "" {
+		return errAlterPending
+	}
+	if g.Favor != nil {
+		return errFavorPending
+	}
+	return nil
+}
+
+// advanceTurn passes play to the next surviving player, who owes one turn.
+func (g *GameState) advanceTurn() {
+	for i := 1; i <= len(g.Players); i++ {
+		next := (g.Turn + i) % len(g.Players)
+		if !g.isEliminated(g.Players[next]) {
+			g.Turn = next
+			g.TurnsOwed = 1
+			g.Attacked = false
+			g.startTurnClock()
+			return
+		}
+	}
+}
+
+// endTurn settles one owed turn for the current player and only moves on
+// once they have no turns left to take. Each owed turn gets its own clock.
+func (g *GameState) endTurn() {
+	g.TurnsOwed--
+	if g.TurnsOwed <= 0 {
+		g.advanceTurn()
+		return
+	}
+	g.startTurnClock()
+}
+
+// eliminate knocks a player out and finishes the game once a single
+// survivor (or nobody, in solo play) remains.
+func (g *GameState) eliminate(username string) {
+	if g.isEliminated(username) {
+		return
+	}
+	g.Eliminated = append(g.Eliminated, username)
+	g.Hands[username] = []string{}
+
+	alive := g.alivePlayers()
+	if len(alive) <= 1 {
+		g.Status = GameFinished
+		if len(alive) == 1 && len(g.Players) > 1 {
+			g.Winner = alive[0]
+		}
+		return
+	}
+	if g.Players[g.Turn] == username {
+		g.advanceTurn()
+	}
+}
+
+func (g *GameState) turnView() *TurnView {
+	eliminated := g.Eliminated
+	if eliminated == nil {
+		eliminated = []string{}
+	}
+	return &TurnView{
+		ID:            g.ID,
+		Version:       g.Version,
+		RoomID:        g.RoomID,
+		Status:        g.Status,
+		Players:       g.Players,
+		Eliminated:    eliminated,
+		CurrentPlayer: g.currentPlayer(),
+		TurnsOwed:     g.TurnsOwed,
+		TurnOrder:     g.turnOrder(),
+		CardsLeft:     len(g.Deck),
+		Pending:       g.Pending,
+		Reinserting:   g.Reinserting,
+		Altering:      g.Altering,
+		Favor:         g.Favor,
+		ImplodingAt:   g.implodingAt(),
+		Winner:        g.Winner,
+		Commitment:    g.Commitment,
+		ExpiresAt:     g.expiresAt(),
+		TurnDeadline:  g.turnDeadline(),
+		Rules:         g.Rules,
+		Modifiers:     g.Modifiers,
+		Composition:   g.Composition,
+	}
+}
+
+func publishTurn(ctx context.Context, g *GameState) {
+	if g.Status != GameActive {
+		return
+	}
+	hub.broadcast(ctx, g.channel(), EventTurnChanged, map[string]interface{}{
+		"player":     g.currentPlayer(),
+		"turns_owed": g.TurnsOwed,
+		"version":    g.Version,
+		"deadline":   g.turnDeadline(),
+	})
+	scheduleBotTurn(ctx, g)
+	watchTurn(ctx, g)
+	remindTurn(ctx, g)
+}
+
+func getGameState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := loadGame(ctx, mux.Vars(r)["id"])
+	if err == errGameNotFound {
+		respondError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondInternal(w, r, err, "Error loading game")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", g.etag())
+	json.NewEncoder(w).Encode(g.stateView(currentUser(r)))
+}
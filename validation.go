@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 20
+)
+
+var usernameChars = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedNames could be mistaken for the server or its staff. They are
+// matched case-insensitively.
+var reservedNames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"anonymous":     true,
+	"lobby":         true,
+	"me":            true,
+	"mod":           true,
+	"moderator":     true,
+	"null":          true,
+	"root":          true,
+	"server":        true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// FieldError is one problem with one field of a request, so clients can
+// show it next to the right input.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+// fieldCodes is the top-level error code reported for a problem with each
+// field, kept from before problems were itemised.
+var fieldCodes = map[string]string{
+	"username": CodeInvalidUsername,
+	"password": CodeInvalidPassword,
+	"email":    CodeInvalidEmail,
+}
+
+func validateUsername(username string) *FieldError {
+	invalid := func(code, msg string) *FieldError {
+		return &FieldError{Field: "username", Code: code, Message: msg}
+	}
+	n := utf8.RuneCountInString(username)
+	switch {
+	case username == "":
+		return invalid("USERNAME_REQUIRED", "Username is required")
+	case n < minUsernameLength || n > maxUsernameLength:
+		return invalid("USERNAME_LENGTH", fmt.Sprintf("Username must be %d to %d characters", minUsernameLength, maxUsernameLength))
+	case !usernameChars.MatchString(username):
+		return invalid("USERNAME_CHARACTERS", "Username may only contain letters, digits, '_' and '-'")
+	case reservedUsername(username) || reservedNames[strings.ToLower(username)]:
+		return invalid("USERNAME_RESERVED", "That username is reserved")
+	case profane(username):
+		return invalid("USERNAME_INAPPROPRIATE", "That username is not allowed")
+	}
+	return nil
+}
+
+func validatePassword(password string) *FieldError {
+	if len(password) < minPasswordLength {
+		return &FieldError{
+			Field:   "password",
+			Code:    "PASSWORD_TOO_SHORT",
+			Message: fmt.Sprintf("Password must be at least %d characters", minPasswordLength),
+		}
+	}
+	return nil
+}
+
+// validateCredentials checks a new account's name and password, returning
+// every problem found rather than stopping at the first.
+func validateCredentials(username, password string) []*FieldError {
+	problems := []*FieldError{}
+	if p := validateUsername(username); p != nil {
+		problems = append(problems, p)
+	}
+	if p := validatePassword(password); p != nil {
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+// respondInvalid reports validation problems. The envelope's code and
+// message describe the first; details lists them all.
+func respondInvalid(w http.ResponseWriter, r *http.Request, problems []*FieldError) {
+	first := problems[0]
+	code := fieldCodes[first.Field]
+	if code == "" {
+		code = CodeBadRequest
+	}
+	writeErrorBody(w, r, http.StatusBadRequest, ErrorBody{Code: code, Message: first.Message, Details: problems})
+}
+
+// usernameIndexKey maps a lowercased name to the account holding it, so
+// names differing only in case cannot both be registered.
+func usernameIndexKey(username string) string {
+	return fmt.Sprintf("username:%s", strings.ToLower(username))
+}
+
+// claimUsername reserves a name case-insensitively for a new account.
+func claimUsername(ctx context.Context, username string) error {
+	ok, err := rdb.SetNX(ctx, usernameIndexKey(username), username, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errUsernameTaken
+	}
+	return nil
+}
+
+func releaseUsername(ctx context.Context, username string) {
+	rdb.Del(ctx, usernameIndexKey(username))
+}
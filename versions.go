@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// clientVersionHeader is how clients say which version they are. Callers
+// that don't, such as browsers and integrations, are never refused.
+const clientVersionHeader = "X-Client-Version"
+
+// ClientConfig is which client versions are supported. Clients older than
+// MIN_CLIENT_VERSION are refused, those older than
+// RECOMMENDED_CLIENT_VERSION are asked to update, and CLIENT_UPDATE_URL is
+// where to get the latest. Unset versions allow any.
+type ClientConfig struct {
+	MinVersion         string
+	RecommendedVersion string
+	UpdateURL          string
+}
+
+// ClientVersion is a major.minor.patch client version.
+type ClientVersion [3]int
+
+// parseClientVersion reads "1", "1.4" or "1.4.2", with an optional
+// leading v. Anything after a - or + is ignored, so 1.4.2-beta is 1.4.2.
+func parseClientVersion(s string) (ClientVersion, bool) {
+	var v ClientVersion
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if s == "" || len(parts) > len(v) {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+func (v ClientVersion) less(other ClientVersion) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+func (v ClientVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+var (
+	clientUpdateURL string
+	// minClientVersion and recommendedVersion are nil when any version
+	// will do.
+	minClientVersion   *ClientVersion
+	recommendedVersion *ClientVersion
+)
+
+// configureClients applies ClientConfig, which loadConfig has checked.
+func configureClients(c ClientConfig) {
+	clientUpdateURL = c.UpdateURL
+	minClientVersion, recommendedVersion = nil, nil
+	if v, ok := parseClientVersion(c.MinVersion); ok {
+		minClientVersion = &v
+	}
+	if v, ok := parseClientVersion(c.RecommendedVersion); ok {
+		recommendedVersion = &v
+	}
+}
+
+// VersionInfo is what clients check at launch. UpdateRequired means the
+// caller must update before going on; UpdateRecommended that a newer
+// version is out.
+type VersionInfo struct {
+	MinVersion         string `json:"min_version,omitempty"`
+	RecommendedVersion string `json:"recommended_version,omitempty"`
+	UpdateURL          string `json:"update_url,omitempty"`
+	ClientVersion      string `json:"client_version,omitempty"`
+	UpdateRequired     bool   `json:"update_required"`
+	UpdateRecommended  bool   `json:"update_recommended"`
+}
+
+// versionInfo is VersionInfo for a client reporting version, which may be
+// empty.
+func versionInfo(version string) VersionInfo {
+	info := VersionInfo{UpdateURL: clientUpdateURL}
+	if minClientVersion != nil {
+		info.MinVersion = minClientVersion.String()
+	}
+	if recommendedVersion != nil {
+		info.RecommendedVersion = recommendedVersion.String()
+	}
+	v, ok := parseClientVersion(version)
+	if !ok {
+		return info
+	}
+	info.ClientVersion = v.String()
+	info.UpdateRequired = minClientVersion != nil && v.less(*minClientVersion)
+	info.UpdateRecommended = info.UpdateRequired || recommendedVersion != nil && v.less(*recommendedVersion)
+	return info
+}
+
+// tooOld reports whether a client reporting version must update first.
+func tooOld(version string) bool {
+	v, ok := parseClientVersion(version)
+	return ok && minClientVersion != nil && v.less(*minClientVersion)
+}
+
+// getVersion tells a client which versions are supported, and whether it
+// should update. It reads X-Client-Version, or ?version=.
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	version := r.Header.Get(clientVersionHeader)
+	if q := r.URL.Query().Get("version"); q != "" {
+		version = q
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionInfo(version))
+}
+
+// checkClientVersion refuses clients older than MIN_CLIENT_VERSION, except
+// on GET /version so they can find out what to do.
+func checkClientVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get(clientVersionHeader)
+		if !tooOld(version) || routeName(r) == "/version" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		respondUpgradeRequired(w, r)
+	})
+}
+
+func respondUpgradeRequired(w http.ResponseWriter, r *http.Request) {
+	message := localize(r, "errors."+CodeUpgradeRequired, "This version of the game is no longer supported. Please update.")
+	writeErrorBody(w, r, http.StatusUpgradeRequired, ErrorBody{
+		Code:    CodeUpgradeRequired,
+		Message: message,
+		Details: []*FieldError{{
+			Field:   clientVersionHeader,
+			Code:    "VERSION_TOO_OLD",
+			Message: fmt.Sprintf("The oldest supported version is %s", minClientVersion),
+		}},
+	})
+}
+
+// grpcClientVersion refuses gRPC clients older than MIN_CLIENT_VERSION, who
+// report their version in x-client-version metadata.
+func grpcClientVersion(c context.Context) error {
+	md, _ := metadata.FromIncomingContext(c)
+	values := md.Get(strings.ToLower(clientVersionHeader))
+	if len(values) == 0 || !tooOld(values[0]) {
+		return nil
+	}
+	return grpcStatus(codes.FailedPrecondition, CodeUpgradeRequired,
+		fmt.Sprintf("This version of the game is no longer supported. Please update to %s or later.", minClientVersion))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Events webhooks can subscribe to.
+const (
+	WebhookGameCreated  = "game.created"
+	WebhookGameFinished = "game.finished"
+	WebhookTopTen       = "leaderboard.top10.changed"
+)
+
+var webhookEvents = []string{WebhookGameCreated, WebhookGameFinished, WebhookTopTen}
+
+const (
+	webhooksKey = "webhooks"
+	// topTenKey is the lifetime board's top ten as last announced.
+	topTenKey = "webhooks:top10"
+	// webhookTimeout bounds each delivery; slower receivers are retried.
+	webhookTimeout = 10 * time.Second
+)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Webhook is an integrator's URL and the events it receives. Deliveries
+// are signed with Secret, which is only shown when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (h *Webhook) wants(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateWebhookRequest registers a webhook.
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// WebhookDelivery is the body POSTed to a webhook.
+type WebhookDelivery struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// WebhookJob is one delivery to one webhook. Body is sent exactly as
+// stored, so retries carry the same signature input.
+type WebhookJob struct {
+	Webhook string          `json:"webhook"`
+	Event   string          `json:"event"`
+	Body    json.RawMessage `json:"body"`
+}
+
+func loadWebhooks(ctx context.Context) ([]*Webhook, error) {
+	raw, err := rdb.HGetAll(ctx, webhooksKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []*Webhook{}
+	for _, data := range raw {
+		var h Webhook
+		if json.Unmarshal([]byte(data), &h) == nil {
+			list = append(list, &h)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func loadWebhook(ctx context.Context, id string) (*Webhook, error) {
+	data, err := rdb.HGet(ctx, webhooksKey, id).Bytes()
+	if err == redis.Nil {
+		return nil, errWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var h Webhook
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// dispatchWebhook queues a delivery of event to every webhook that wants
+// it. The job queue retries failed deliveries.
+func dispatchWebhook(ctx context.Context, event string, data interface{}) {
+	hooks, err := loadWebhooks(ctx)
+	if err != nil {
+		slog.Error("loading webhooks", "event", event, "err", err)
+		return
+	}
+	var body []byte
+	for _, h := range hooks {
+		if !h.wants(event) {
+			continue
+		}
+		if body == nil {
+			body, err = json.Marshal(WebhookDelivery{ID: newID(), Event: event, Time: time.Now().UTC(), Data: data})
+			if err != nil {
+				slog.Error("encoding webhook", "event", event, "err", err)
+				return
+			}
+		}
+		if err := enqueueJob(ctx, JobWebhook, WebhookJob{Webhook: h.ID, Event: event, Body: body}); err != nil {
+			slog.Error("queueing webhook", "webhook", h.ID, "event", event, "err", err)
+		}
+	}
+}
+
+// signWebhook is the X-Webhook-Signature for a body sent at timestamp:
+// an HMAC-SHA256 of "<timestamp>.<body>" with the webhook's secret.
+// Receivers should recompute it and reject old timestamps.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func runWebhook(ctx context.Context, payload json.RawMessage) error {
+	var job WebhookJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	h, err := loadWebhook(ctx, job.Webhook)
+	if err == errWebhookNotFound {
+		// Deleted since; nobody is listening.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(job.Body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "exploding-kittens-webhooks")
+	req.Header.Set("X-Webhook-Event", job.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(h.Secret, timestamp, job.Body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// processWebhooks announces games starting and finishing from the change
+// feed.
+func processWebhooks(ctx context.Context, entry redis.XMessage) error {
+	action, _ := entry.Values["action"].(string)
+	finished, _ := entry.Values["finished"].(string)
+	var event string
+	switch {
+	case action == ActionStart:
+		event = WebhookGameCreated
+	case finished == "true":
+		event = WebhookGameFinished
+	default:
+		return nil
+	}
+	id, _ := entry.Values["game"].(string)
+	g, err := loadGame(ctx, id)
+	if err == errGameNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"game_id": g.ID,
+		"room_id": g.RoomID,
+		"players": append(append([]string{}, g.Players...), g.Abandoned...),
+	}
+	if event == WebhookGameFinished {
+		data["winner"] = g.Winner
+	}
+	dispatchWebhook(ctx, event, data)
+	return nil
+}
+
+// checkTopTen announces the lifetime board's top ten whenever who is in it,
+// or their order, changes. GETSET makes one caller announce each change.
+func checkTopTen(ctx context.Context) {
+	top, err := leaderboards.Range(ctx, leaderboardKey, 0, 9)
+	if err != nil {
+		slog.Error("loading top ten", "err", err)
+		return
+	}
+	names := make([]string, len(top))
+	for i, p := range top {
+		names[i] = p.Username
+	}
+	current := strings.Join(names, "\n")
+	previous, err := rdb.GetSet(ctx, topTenKey, current).Result()
+	if err != nil && err != redis.Nil {
+		slog.Error("saving top ten", "err", err)
+		return
+	}
+	if err == redis.Nil || previous == current {
+		// The first look only sets the baseline.
+		return
+	}
+	dispatchWebhook(ctx, WebhookTopTen, map[string]interface{}{"top": top})
+}
+
+func knownWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhook(req *CreateWebhookRequest) []*FieldError {
+	problems := []*FieldError{}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problems = append(problems, &FieldError{Field: "url", Code: "URL_INVALID", Message: "URL must be an absolute http or https URL"})
+	}
+	if len(req.Events) == 0 {
+		problems = append(problems, &FieldError{Field: "events", Code: "EVENTS_REQUIRED", Message: "Subscribe to at least one event"})
+	}
+	for _, e := range req.Events {
+		if !knownWebhookEvent(e) {
+			problems = append(problems, &FieldError{Field: "events", Code: "EVENT_UNKNOWN",
+				Message: fmt.Sprintf("Events must be among %s", strings.Join(webhookEvents, ", "))})
+			break
+		}
+	}
+	return problems
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req CreateWebhookRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondPayload(w, r, err)
+		return
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if problems := validateWebhook(&req); len(problems) > 0 {
+		respondInvalid(w, r, problems)
+		return
+	}
+
+	h := &Webhook{
+		ID:        newID(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    randomToken(),
+		CreatedBy: actorName(r),
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		respondInternal(w, r, err, "Error creating webhook")
+		return
+	}
+	if err := rdb.HSet(ctx, webhooksKey, h.ID, data).Err(); err != nil {
+		respondInternal(w, r, err, "Error creating webhook")
+		return
+	}
+	logFor(r).Info("webhook registered", "webhook", h.ID, "events", h.Events)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h)
+}
+
+// listWebhooks shows every webhook, without their secrets.
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	list, err := loadWebhooks(ctx)
+	if err != nil {
+		respondInternal(w, r, err, "Error loading webhooks")
+		return
+	}
+	for _, h := range list {
+		h.Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	removed, err := rdb.HDel(ctx, webhooksKey, id).Result()
+	if err != nil {
+		respondInternal(w, r, err, "Error deleting webhook")
+		return
+	}
+	if removed == 0 {
+		respondError(w, r, http.StatusNotFound, errWebhookNotFound)
+		return
+	}
+	logFor(r).Info("webhook deleted", "webhook", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// xpKey ranks players by lifetime experience.
+const xpKey = "xp"
+
+// XP paid out for each finished game.
+const (
+	xpPerGame   = 10
+	xpPerWin    = 25
+	xpPerDefuse = 5
+)
+
+// xpPerLevel scales the level curve: reaching level n takes
+// xpPerLevel * n(n-1)/2 XP, so each level needs xpPerLevel more than the
+// last.
+const xpPerLevel = 100
+
+// defaultMinRankedLevel lets everyone into matchmaking.
+const defaultMinRankedLevel = 1
+
+// minRankedLevel is the level players need to join matchmaking. Set with
+// MIN_RANKED_LEVEL.
+var minRankedLevel = defaultMinRankedLevel
+
+var errLevelTooLow = errors.New("your level is too low for ranked play")
+
+// Level is a player's progress through the level curve.
+type Level struct {
+	Level int `json:"level"`
+	XP    int `json:"xp"`
+	// LevelXP and NextLevelXP are the totals at which the current level
+	// started and the next one begins.
+	LevelXP     int `json:"level_xp"`
+	NextLevelXP int `json:"next_level_xp"`
+}
+
+func levelThreshold(level int) int {
+	return xpPerLevel * level * (level - 1) / 2
+}
+
+func levelFor(xp int) *Level {
+	level := 1
+	for xp >= levelThreshold(level+1) {
+		level++
+	}
+	return &Level{
+		Level:       level,
+		XP:          xp,
+		LevelXP:     levelThreshold(level),
+		NextLevelXP: levelThreshold(level + 1),
+	}
+}
+
+func xpAwardedKey(gameID string) string {
+	return fmt.Sprintf("game:%s:xp", gameID)
+}
+
+func playerXP(ctx context.Context, username string) (int, error) {
+	xp, err := rdb.ZScore(ctx, xpKey, username).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int(xp), err
+}
+
+func playerLevel(ctx context.Context, username string) (*Level, error) {
+	xp, err := playerXP(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return levelFor(xp), nil
+}
+
+// fillLevels adds each player's level to a leaderboard page.
+func fillLevels(ctx context.Context, players []Player) error {
+	if len(players) == 0 {
+		return nil
+	}
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.FloatCmd, len(players))
+	for i, p := range players {
+		cmds[i] = pipe.ZScore(ctx, xpKey, p.Username)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	for i := range players {
+		players[i].Level = levelFor(int(cmds[i].Val())).Level
+	}
+	return nil
+}
+
+// gameXP is what a finished game earns a player.
+func gameXP(g *GameState, username string) int {
+	xp := xpPerGame + xpPerDefuse*g.statsFor(username).Defused
+	if g.Winner == username {
+		xp += xpPerWin
+	}
+	return doubledBy(g.Modifiers, ModifierDoubleXP, xp)
+}
+
+// awardXP pays out a finished game's XP to its human players, once per
+// game, and tells anyone who levelled up.
+func awardXP(ctx context.Context, g *GameState) {
+	first, err := rdb.SetNX(ctx, xpAwardedKey(g.ID), 1, 0).Result()
+	if err != nil || !first {
+		if err != nil {
+			slog.Error("awarding xp", "game", g.ID, "err", err)
+		}
+		return
+	}
+	for _, p := range append(append([]string{}, g.Players...), g.Abandoned...) {
+		if g.isBot(p) {
+			continue
+		}
+		earned := gameXP(g, p)
+		total, err := rdb.ZIncrBy(ctx, xpKey, float64(earned), p).Result()
+		if err != nil {
+			slog.Error("awarding xp", "game", g.ID, "username", p, "err", err)
+			continue
+		}
+		after := levelFor(int(total))
+		if before := levelFor(int(total) - earned); after.Level > before.Level {
+			hub.notifyUser(ctx, p, EventLevelUp, after)
+		}
+	}
+}